@@ -10,6 +10,7 @@ import (
 func main() {
 	r := mux.NewRouter()
 	r.HandleFunc("/books/{title}/page/{page}", GetPage)
+	registerScenarios(r)
 	http.ListenAndServe(":80", r)
 }
 
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Scenarios produce known runtime behavior on demand, so that the findings
+// of xgotop can be checked against what was asked for. Every scenario is
+// parameterized with query parameters and responds with what it did.
+
+var (
+	// leakedMu guards leaked, the channels blocking the leaked goroutines.
+	// They are never closed, and kept reachable for the lifetime of the
+	// server.
+	leakedMu sync.Mutex
+	leaked   []chan struct{}
+
+	// allocSink keeps the allocations of alloc-burst on the heap
+	allocSink [][]byte
+)
+
+func registerScenarios(r *mux.Router) {
+	r.HandleFunc("/scenario/goroutine-leak", GoroutineLeak)
+	r.HandleFunc("/scenario/alloc-burst", AllocBurst)
+	r.HandleFunc("/scenario/lock-contention", LockContention)
+}
+
+// GoroutineLeak starts n (default 100) goroutines that block forever.
+func GoroutineLeak(w http.ResponseWriter, r *http.Request) {
+	n, err := intParam(r, "n", 100)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ch := make(chan struct{})
+	leakedMu.Lock()
+	leaked = append(leaked, ch)
+	total := len(leaked)
+	leakedMu.Unlock()
+
+	for range n {
+		go leakedGoroutine(ch)
+	}
+
+	fmt.Fprintf(w, "leaked %d goroutines (%d leak requests so far)\n", n, total)
+}
+
+func leakedGoroutine(ch chan struct{}) {
+	<-ch
+}
+
+// AllocBurst allocates n (default 10000) byte slices of size bytes (default
+// 1024) and keeps them alive until the next burst.
+func AllocBurst(w http.ResponseWriter, r *http.Request) {
+	n, err := intParam(r, "n", 10000)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	size, err := intParam(r, "size", 1024)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	start := time.Now()
+	burst := make([][]byte, n)
+	for i := range burst {
+		burst[i] = make([]byte, size)
+	}
+	allocSink = burst
+
+	fmt.Fprintf(w, "allocated %d slices of %d bytes in %s\n", n, size, time.Since(start))
+}
+
+// LockContention runs workers (default 8) goroutines that take the same
+// mutex and hold it for hold (default 100us) until duration (default 1s)
+// has passed.
+func LockContention(w http.ResponseWriter, r *http.Request) {
+	workers, err := intParam(r, "workers", 8)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hold, err := durationParam(r, "hold", 100*time.Microsecond)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	duration, err := durationParam(r, "duration", time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var acquisitions int
+	deadline := time.Now().Add(duration)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				mu.Lock()
+				acquisitions++
+				time.Sleep(hold)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	fmt.Fprintf(w, "%d workers acquired the lock %d times in %s\n", workers, acquisitions, duration)
+}
+
+func intParam(r *http.Request, name string, def int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid %s: %s", name, s)
+	}
+	return v, nil
+}
+
+func durationParam(r *http.Request, name string, def time.Duration) (time.Duration, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", name, s)
+	}
+	return v, nil
+}
@@ -0,0 +1,122 @@
+// Command workload exercises a single Go runtime operation in a tight loop.
+// It is driven by `xgotop overhead` to measure the cost of every uprobe.
+//
+// After start, workload waits for a line on stdin so that the probes can be
+// attached first, runs the operation -n times and prints the elapsed
+// nanoseconds to stdout.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sinks keep the compiler from optimizing the operations away or keeping
+// their results on the stack.
+var (
+	sinkSlice  []byte
+	sinkMap    map[int]int
+	sinkObject *[64]byte
+	sinkString string
+	sinkAny    any
+)
+
+var ops = map[string]func(n int){
+	"makeslice": func(n int) {
+		size := 64
+		for range n {
+			sinkSlice = make([]byte, size)
+		}
+	},
+	"makemap": func(n int) {
+		hint := 16
+		for range n {
+			sinkMap = make(map[int]int, hint)
+		}
+	},
+	"newobject": func(n int) {
+		for range n {
+			sinkObject = new([64]byte)
+		}
+	},
+	"goroutine": func(n int) {
+		var wg sync.WaitGroup
+		for range n {
+			wg.Add(1)
+			go wg.Done()
+			wg.Wait()
+		}
+	},
+	"mutex": func(n int) {
+		// Two goroutines fighting over a mutex park on its semaphore
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		wg.Add(2)
+		for range 2 {
+			go func() {
+				defer wg.Done()
+				for range n / 2 {
+					mu.Lock()
+					time.Sleep(0)
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+	},
+	"timer": func(n int) {
+		for range n {
+			t := time.NewTimer(time.Hour)
+			t.Stop()
+		}
+	},
+	"concat": func(n int) {
+		a, b := strconv.Itoa(n), "workload"
+		for range n {
+			sinkString = a + b
+		}
+	},
+	"bytestostring": func(n int) {
+		b := []byte("workload bytes")
+		for range n {
+			sinkString = string(b)
+		}
+	},
+	"iface": func(n int) {
+		v := uint64(n) + 1000
+		for range n {
+			sinkAny = v
+		}
+	},
+}
+
+func main() {
+	op := flag.String("op", "", "Operation to run")
+	n := flag.Int("n", 1_000_000, "Number of iterations")
+	flag.Parse()
+
+	run, ok := ops[*op]
+	if !ok {
+		names := make([]string, 0, len(ops))
+		for name := range ops {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		log.Fatalf("-op must be one of %v", names)
+	}
+
+	if _, err := bufio.NewReader(os.Stdin).ReadString('\n'); err != nil {
+		log.Fatalf("waiting for start: %v", err)
+	}
+
+	start := time.Now()
+	run(*n)
+	fmt.Println(time.Since(start).Nanoseconds())
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// allocTotals are the allocations of a goroutine, extrapolated from the
+// sampled allocation events.
+type allocTotals struct {
+	// bytes and allocs are the extrapolated allocations since the last
+	// summary, and sampled counts the allocation events actually observed
+	bytes, allocs           float64
+	sampled                 uint64
+	totalBytes, totalAllocs uint64
+	exited                  bool
+}
+
+// allocSummarizer maintains running allocation byte totals of every
+// goroutine from the newobject and makeslice events of the processing
+// workers, and summarizes them periodically as allocsummary events. The
+// totals extrapolate the sampled events with the sampling rates in effect,
+// so the summaries chart the allocation trend of long captures cheaply,
+// even if the raw allocation events are heavily sampled.
+type allocSummarizer struct {
+	// rate returns the sampling rate of an event type in percent
+	rate func(storage.EventType) uint32
+	// flagged reports whether the events of a goroutine bypass sampling
+	flagged func(uint32) bool
+	// now returns the current time on the clock of the event timestamps
+	now func() uint64
+
+	mu         sync.Mutex
+	percents   map[storage.EventType]uint32
+	goroutines map[uint32]*allocTotals
+}
+
+func newAllocSummarizer(rate func(storage.EventType) uint32, flagged func(uint32) bool, now func() uint64) *allocSummarizer {
+	s := &allocSummarizer{
+		rate:       rate,
+		flagged:    flagged,
+		now:        now,
+		percents:   make(map[storage.EventType]uint32),
+		goroutines: make(map[uint32]*allocTotals),
+	}
+	s.refreshRates()
+	return s
+}
+
+// refreshRates reads the sampling rates of the allocation events, which
+// are looked up for every event otherwise. The caller must hold s.mu or be
+// the only user of s.
+func (s *allocSummarizer) refreshRates() {
+	for _, eventType := range []storage.EventType{storage.EventTypeNewObject, storage.EventTypeMakeSlice} {
+		s.percents[eventType] = s.rate(eventType)
+	}
+}
+
+// observe adds the allocation of event to the totals of its goroutine.
+func (s *allocSummarizer) observe(event *runtimeEvent) {
+	if s == nil {
+		return
+	}
+
+	var size uint64
+	switch storage.EventType(event.EventType) {
+	case storage.EventTypeNewObject:
+		size = event.Attributes[0]
+	case storage.EventTypeMakeSlice:
+		// The element size times the capacity
+		size = event.Attributes[0] * event.Attributes[3]
+	case storage.EventTypeGoExit:
+		s.mu.Lock()
+		if totals, ok := s.goroutines[uint32(event.Attributes[0])]; ok {
+			totals.exited = true
+		}
+		s.mu.Unlock()
+		return
+	default:
+		return
+	}
+	if event.Goroutine == 0 {
+		return
+	}
+
+	flagged := s.flagged != nil && s.flagged(event.Goroutine)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Every sampled event stands for 100/percent allocations, except for
+	// the events of flagged goroutines
+	weight := storage.SamplingWeight(s.percents[storage.EventType(event.EventType)], flagged)
+	totals, ok := s.goroutines[event.Goroutine]
+	if !ok {
+		totals = &allocTotals{}
+		s.goroutines[event.Goroutine] = totals
+	}
+	totals.bytes += float64(size) * weight
+	totals.allocs += weight
+	totals.sampled++
+}
+
+// summarize returns an allocsummary event for every goroutine that
+// allocated since the last call, and forgets the exited goroutines.
+func (s *allocSummarizer) summarize() []*storage.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ts := s.now()
+	var events []*storage.Event
+	for gid, totals := range s.goroutines {
+		if totals.sampled > 0 {
+			bytes, allocs := uint64(math.Round(totals.bytes)), uint64(math.Round(totals.allocs))
+			totals.totalBytes += bytes
+			totals.totalAllocs += allocs
+			events = append(events, &storage.Event{
+				Timestamp: ts,
+				EventType: storage.EventTypeAllocSummary,
+				Goroutine: gid,
+				Attributes: [5]uint64{
+					bytes, allocs,
+					totals.totalBytes, totals.totalAllocs,
+					totals.sampled,
+				},
+			})
+			totals.bytes, totals.allocs, totals.sampled = 0, 0, 0
+		}
+		if totals.exited {
+			delete(s.goroutines, gid)
+		}
+	}
+
+	s.refreshRates()
+	return events
+}
+
+// run passes the summaries to emit every interval until ctx is done. The
+// allocations since the last summary are left for the caller to summarize
+// once the processing workers are done.
+func (s *allocSummarizer) run(ctx context.Context, interval time.Duration, emit func([]*storage.Event)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if events := s.summarize(); len(events) > 0 {
+				emit(events)
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package analysis
+
+import (
+	"sort"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// UnknownState is the state of goroutines without casgstatus events before
+// the time of an AliveSet.
+const UnknownState = "unknown"
+
+// AliveGoroutine is a goroutine alive at the time of an AliveSet.
+type AliveGoroutine struct {
+	Goroutine uint32 `json:"goroutine"`
+	GoroutineIdentity
+	// CreatedAt is the timestamp the goroutine was created at, zero if it
+	// was created before the capture started
+	CreatedAt uint64 `json:"created_at,omitempty"`
+	// State is the status of the goroutine at the time, see
+	// storage.GoroutineStatus, or UnknownState
+	State string `json:"state"`
+	// StateSince is the timestamp of the casgstatus event that put the
+	// goroutine into State
+	StateSince uint64 `json:"state_since,omitempty"`
+}
+
+// goroutineState is the latest status of a goroutine up to the time of an
+// AliveSet.
+type goroutineState struct {
+	status    uint64
+	timestamp uint64
+}
+
+// AliveSet reduces the events of a session to the goroutines alive at a
+// timestamp, i.e. created before it and not exited until it, and their
+// states at that moment. Goroutines whose creation was not recorded were
+// created before the capture started. Events may be observed in any order,
+// and lifecycle events more than once, so the events of a session can be
+// observed together with its lifecycle log, which holds the lifecycle
+// events that were sampled out of the session.
+type AliveSet struct {
+	at         uint64
+	identities *IdentityResolver
+
+	created map[uint32]uint64
+	exited  map[uint32]uint64
+	seen    map[uint32]struct{}
+	states  map[uint32]goroutineState
+}
+
+func NewAliveSet(session *storage.Session, at uint64) *AliveSet {
+	return &AliveSet{
+		at:         at,
+		identities: NewIdentityResolver(session),
+		created:    make(map[uint32]uint64),
+		exited:     make(map[uint32]uint64),
+		seen:       make(map[uint32]struct{}),
+		states:     make(map[uint32]goroutineState),
+	}
+}
+
+func (a *AliveSet) Observe(event *storage.Event) {
+	if event.Goroutine != 0 {
+		a.seen[event.Goroutine] = struct{}{}
+	}
+
+	switch event.EventType {
+	case storage.EventTypeNewGoroutine:
+		a.identities.Observe(event)
+		gid := uint32(event.Attributes[1])
+		a.seen[gid] = struct{}{}
+		a.created[gid] = event.Timestamp
+	case storage.EventTypeGoExit:
+		gid := uint32(event.Attributes[0])
+		if exitedAt, ok := a.exited[gid]; !ok || event.Timestamp < exitedAt {
+			a.exited[gid] = event.Timestamp
+		}
+	case storage.EventTypeCasGStatus:
+		gid := uint32(event.Attributes[2])
+		a.seen[gid] = struct{}{}
+		if event.Timestamp > a.at {
+			return
+		}
+		if state, ok := a.states[gid]; !ok || event.Timestamp >= state.timestamp {
+			a.states[gid] = goroutineState{status: event.Attributes[1] &^ statusScan, timestamp: event.Timestamp}
+		}
+	}
+}
+
+// Goroutines returns the goroutines alive at the time, ordered by ID.
+func (a *AliveSet) Goroutines() []AliveGoroutine {
+	goroutines := make([]AliveGoroutine, 0)
+	for gid := range a.seen {
+		createdAt, created := a.created[gid]
+		if created && createdAt > a.at {
+			continue
+		}
+		if exitedAt, ok := a.exited[gid]; ok && exitedAt <= a.at {
+			continue
+		}
+
+		state, ok := a.states[gid]
+		if ok && state.status == statusDead {
+			// The exit of the goroutine was sampled out
+			continue
+		}
+
+		goroutine := AliveGoroutine{
+			Goroutine:         gid,
+			GoroutineIdentity: a.identities.Identity(gid),
+			CreatedAt:         createdAt,
+			State:             UnknownState,
+		}
+		if ok {
+			goroutine.State = storage.GoroutineStatus(state.status)
+			goroutine.StateSince = state.timestamp
+		}
+		goroutines = append(goroutines, goroutine)
+	}
+
+	sort.Slice(goroutines, func(i, j int) bool {
+		return goroutines[i].Goroutine < goroutines[j].Goroutine
+	})
+	return goroutines
+}
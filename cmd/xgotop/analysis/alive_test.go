@@ -0,0 +1,50 @@
+package analysis
+
+import (
+	"testing"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+func TestAliveSet(t *testing.T) {
+	session := &storage.Session{Functions: map[uint64]string{0x10: "main.worker", 0x20: "main.main"}}
+	worker := func(ts uint64, gid uint32) *storage.Event {
+		return newGoroutine(ts, 1, gid, 0x10, 0x20)
+	}
+	goExit := func(ts uint64, gid uint32) *storage.Event {
+		return newEvent(storage.EventTypeGoExit, ts, gid, uint64(gid))
+	}
+
+	// Not in timestamp order, with the lifecycle events twice like from the
+	// events and the lifecycle log of a session
+	events := []*storage.Event{
+		casgstatus(40, 2, statusRunning, statusWaiting),
+		worker(10, 2),
+		worker(20, 3),
+		casgstatus(25, 3, statusRunnable, statusRunning),
+		casgstatus(30, 2, statusRunnable, statusRunning|statusScan),
+		// goroutine 3 exits before the time, goroutine 4 is created after it
+		goExit(45, 3),
+		worker(60, 4),
+		casgstatus(70, 4, statusRunnable, statusRunning),
+		// goroutine 5 was created before the capture, goroutine 6 lost its
+		// exit
+		casgstatus(80, 5, statusRunning, statusWaiting),
+		casgstatus(35, 6, statusRunning, statusDead),
+		worker(10, 2),
+		goExit(45, 3),
+	}
+
+	alive := NewAliveSet(session, 50)
+	observe(events, alive)
+
+	identity := alive.identities.Identity(2)
+	if identity.StartFunc != "main.worker" {
+		t.Fatalf("identity = %+v, want main.worker", identity)
+	}
+	checkEqual(t, "goroutines", alive.Goroutines(), []AliveGoroutine{
+		{Goroutine: 1, GoroutineIdentity: GoroutineIdentity{Key: UnknownIdentity}, State: UnknownState},
+		{Goroutine: 2, GoroutineIdentity: identity, CreatedAt: 10, State: "waiting", StateSince: 40},
+		{Goroutine: 5, GoroutineIdentity: GoroutineIdentity{Key: UnknownIdentity}, State: UnknownState},
+	})
+}
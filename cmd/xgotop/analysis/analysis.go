@@ -0,0 +1,61 @@
+// Package analysis derives higher level findings from the events recorded in
+// a session.
+package analysis
+
+import (
+	"context"
+	"fmt"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// Report is the result of analyzing a whole session.
+type Report struct {
+	SessionID  string `json:"session_id"`
+	EventCount int64  `json:"event_count"`
+	// Totals are the events and allocated bytes by event type, extrapolated
+	// from the sampled events of sampled sessions
+	Totals       map[string]EventTotals `json:"totals"`
+	Extrapolated bool                   `json:"extrapolated"`
+	TimerLeaks   []TimerLeak            `json:"timer_leaks"`
+	// TimerLeaksSkipped tells why timer leaks were not detected, see
+	// NewTimerLeakDetector
+	TimerLeaksSkipped string          `json:"timer_leaks_skipped,omitempty"`
+	Markers           []MarkerLatency `json:"markers"`
+	// Migrations lists the most migrated goroutines
+	Migrations []GoroutineMigrations `json:"migrations"`
+}
+
+// reportMigrations is the number of goroutines listed in Report.Migrations
+const reportMigrations = 10
+
+// Analyze scans all events of store once and returns the combined report.
+func Analyze(ctx context.Context, store storage.EventStore) (*Report, error) {
+	session := store.GetSession()
+	report := &Report{SessionID: session.ID}
+	totals := NewTotalsCounter(session.Sampling)
+	timers := NewTimerLeakDetector(session.Sampling)
+	markers := NewMarkerLatencyTracker()
+	migrations := NewMigrationCounter()
+
+	err := store.ScanEvents(ctx, 0, func(_ int64, event *storage.Event) error {
+		report.EventCount++
+		totals.Observe(event)
+		timers.Observe(event)
+		markers.Observe(event)
+		migrations.Observe(event)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan events: %w", err)
+	}
+
+	report.Totals = totals.Totals()
+	report.Extrapolated = totals.Extrapolated()
+	if report.TimerLeaks, err = timers.Leaks(); err != nil {
+		report.TimerLeaksSkipped = err.Error()
+	}
+	report.Markers = markers.Latencies()
+	report.Migrations = migrations.Migrations(reportMigrations)
+	return report, nil
+}
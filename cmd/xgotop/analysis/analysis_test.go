@@ -0,0 +1,54 @@
+package analysis
+
+import (
+	"reflect"
+	"testing"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// observer is an analyzer fed one event at a time.
+type observer interface {
+	Observe(event *storage.Event)
+}
+
+// observe feeds events to every observer, in order.
+func observe(events []*storage.Event, observers ...observer) {
+	for _, event := range events {
+		for _, o := range observers {
+			o.Observe(event)
+		}
+	}
+}
+
+// newEvent returns an event of eventType at ts on goroutine gid, with the
+// given attributes.
+func newEvent(eventType storage.EventType, ts uint64, gid uint32, attrs ...uint64) *storage.Event {
+	event := &storage.Event{Timestamp: ts, EventType: eventType, Goroutine: gid}
+	copy(event.Attributes[:], attrs)
+	return event
+}
+
+// casgstatus returns a status change of goroutine gid.
+func casgstatus(ts uint64, gid uint32, oldStatus, newStatus uint64) *storage.Event {
+	return newEvent(storage.EventTypeCasGStatus, ts, gid, oldStatus, newStatus, uint64(gid))
+}
+
+// newGoroutine returns the creation of goroutine gid by creator, running the
+// function at startPC from the go statement at goPC.
+func newGoroutine(ts uint64, creator, gid uint32, startPC, goPC uint64) *storage.Event {
+	return newEvent(storage.EventTypeNewGoroutine, ts, creator, uint64(creator), uint64(gid), startPC, goPC)
+}
+
+// newObject returns an allocation of size bytes by goroutine gid.
+func newObject(ts uint64, gid uint32, size uint64) *storage.Event {
+	return newEvent(storage.EventTypeNewObject, ts, gid, size)
+}
+
+// checkEqual reports what got is if it differs from want.
+func checkEqual[T any](t *testing.T, what string, got, want T) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s = %+v, want %+v", what, got, want)
+	}
+}
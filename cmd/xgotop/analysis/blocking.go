@@ -0,0 +1,158 @@
+package analysis
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// Goroutine statuses of casgstatus events, the runtime's _G* constants
+const (
+	statusRunnable = 1
+	statusRunning  = 2
+	statusWaiting  = 4
+	statusDead     = 6
+	// statusScan is set in the status of goroutines whose stack is being
+	// scanned
+	statusScan = 0x1000
+)
+
+// BlockingStack is the time the goroutines of a creation stack spent parked.
+type BlockingStack struct {
+	// Frames are the functions of the creation chain of the goroutines,
+	// innermost first, see IdentityResolver.CreationStack
+	Frames      []string `json:"frames"`
+	Contentions int64    `json:"contentions"`
+	DelayNanos  int64    `json:"delay_ns"`
+}
+
+// BlockProfiler pairs the casgstatus events that park a goroutine, i.e. put
+// it into the waiting state, with the events that make it runnable again,
+// and aggregates the time spent parked by the creation stack of the
+// goroutines. xgotop does not capture the stacks goroutines park at, so the
+// creation stack stands in for them, like the "created by" frames of
+// goroutine dumps.
+//
+// Parks are only paired if both of their casgstatus events were captured,
+// so sessions with sampled casgstatus events underestimate the contentions.
+type BlockProfiler struct {
+	session    *storage.Session
+	identities *IdentityResolver
+	// parked maps the parked goroutines to the timestamp they parked at
+	parked map[uint32]uint64
+	stacks map[uint32]*BlockingStack
+
+	first, last uint64
+}
+
+func NewBlockProfiler(session *storage.Session) *BlockProfiler {
+	return &BlockProfiler{
+		session:    session,
+		identities: NewIdentityResolver(session),
+		parked:     make(map[uint32]uint64),
+		stacks:     make(map[uint32]*BlockingStack),
+	}
+}
+
+func (p *BlockProfiler) Observe(event *storage.Event) {
+	p.identities.Observe(event)
+	if p.first == 0 || event.Timestamp < p.first {
+		p.first = event.Timestamp
+	}
+	p.last = max(p.last, event.Timestamp)
+
+	if event.EventType != storage.EventTypeCasGStatus {
+		return
+	}
+
+	oldStatus := event.Attributes[0] &^ statusScan
+	newStatus := event.Attributes[1] &^ statusScan
+	gid := uint32(event.Attributes[2])
+	switch {
+	case newStatus == statusWaiting:
+		// Parked goroutines briefly leave the waiting state to get their
+		// stack shrunk, which does not end the park
+		if _, ok := p.parked[gid]; !ok {
+			p.parked[gid] = event.Timestamp
+		}
+	case oldStatus == statusWaiting && newStatus == statusRunnable:
+		parkedAt, ok := p.parked[gid]
+		if !ok {
+			return
+		}
+		delete(p.parked, gid)
+		if event.Timestamp < parkedAt {
+			return
+		}
+
+		stack, ok := p.stacks[gid]
+		if !ok {
+			stack = &BlockingStack{}
+			p.stacks[gid] = stack
+		}
+		stack.Contentions++
+		stack.DelayNanos += int64(event.Timestamp - parkedAt)
+	case newStatus == statusRunning:
+		// The wakeup of the goroutine was lost
+		delete(p.parked, gid)
+	}
+}
+
+// Stacks returns the blocking of every creation stack, most delayed first.
+// Goroutines still parked at the end of the session are not included.
+func (p *BlockProfiler) Stacks() []BlockingStack {
+	byStack := make(map[string]*BlockingStack)
+	for gid, blocking := range p.stacks {
+		frames := p.identities.CreationStack(gid)
+		if len(frames) == 0 {
+			frames = []string{UnknownIdentity}
+		}
+
+		key := strings.Join(frames, "\x00")
+		stack, ok := byStack[key]
+		if !ok {
+			stack = &BlockingStack{Frames: frames}
+			byStack[key] = stack
+		}
+		stack.Contentions += blocking.Contentions
+		stack.DelayNanos += blocking.DelayNanos
+	}
+
+	stacks := make([]BlockingStack, 0, len(byStack))
+	for _, stack := range byStack {
+		stacks = append(stacks, *stack)
+	}
+	sort.Slice(stacks, func(i, j int) bool {
+		if stacks[i].DelayNanos != stacks[j].DelayNanos {
+			return stacks[i].DelayNanos > stacks[j].DelayNanos
+		}
+		return strings.Join(stacks[i].Frames, "\x00") < strings.Join(stacks[j].Frames, "\x00")
+	})
+	return stacks
+}
+
+// WriteProfile writes the blocking of every creation stack as a gzipped
+// pprof block profile, readable with go tool pprof.
+func (p *BlockProfiler) WriteProfile(w io.Writer) error {
+	profile := &pprofProfile{
+		sampleTypes: [][2]string{{"contentions", "count"}, {"delay", "nanoseconds"}},
+		periodType:  [2]string{"contentions", "count"},
+		period:      1,
+	}
+	if p.session != nil && !p.session.StartTime.IsZero() {
+		profile.timeNanos = p.session.StartTime.UnixNano()
+	}
+	if p.last > p.first {
+		profile.duration = time.Duration(p.last - p.first)
+	}
+	for _, stack := range p.Stacks() {
+		profile.samples = append(profile.samples, pprofSample{
+			frames: stack.Frames,
+			values: []int64{stack.Contentions, stack.DelayNanos},
+		})
+	}
+	return profile.write(w)
+}
@@ -0,0 +1,71 @@
+package analysis
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+func TestBlockProfiler(t *testing.T) {
+	session := &storage.Session{Functions: map[uint64]string{
+		0x10: "main.worker",
+		0x20: "main.main",
+		0x30: "main.serve",
+	}}
+	events := []*storage.Event{
+		// goroutine 1 creates the workers 2 and 3, and goroutine 4 from
+		// main.serve
+		newGoroutine(1, 1, 2, 0x10, 0x20),
+		newGoroutine(2, 1, 3, 0x10, 0x20),
+		newGoroutine(3, 1, 4, 0x30, 0x20),
+		// both workers park, 2 twice with its stack shrunk while parked
+		casgstatus(10, 2, statusRunning, statusWaiting),
+		casgstatus(15, 2, statusWaiting, 8),
+		casgstatus(16, 2, 8, statusWaiting),
+		casgstatus(30, 2, statusWaiting, statusRunnable),
+		casgstatus(40, 2, statusRunning, statusWaiting),
+		casgstatus(50, 2, statusWaiting|statusScan, statusRunnable),
+		casgstatus(20, 3, statusRunning, statusWaiting),
+		casgstatus(25, 3, statusWaiting, statusRunnable),
+		// goroutine 4 runs again without its wakeup, and parks once more
+		casgstatus(60, 4, statusRunning, statusWaiting),
+		casgstatus(70, 4, statusRunnable, statusRunning),
+		casgstatus(80, 4, statusRunning, statusWaiting),
+		casgstatus(85, 4, statusWaiting, statusRunnable),
+		// goroutine 5 was not created during the session, and is still
+		// parked at its end
+		casgstatus(90, 5, statusRunning, statusWaiting),
+		casgstatus(91, 5, statusWaiting, statusRunnable),
+		casgstatus(95, 6, statusRunning, statusWaiting),
+	}
+
+	profiler := NewBlockProfiler(session)
+	observe(events, profiler)
+
+	checkEqual(t, "Stacks()", profiler.Stacks(), []BlockingStack{
+		{Frames: []string{"main.worker", "main.main"}, Contentions: 3, DelayNanos: 20 + 10 + 5},
+		{Frames: []string{"main.serve", "main.main"}, Contentions: 1, DelayNanos: 5},
+		{Frames: []string{UnknownIdentity}, Contentions: 1, DelayNanos: 1},
+	})
+
+	var buf bytes.Buffer
+	if err := profiler.WriteProfile(&buf); err != nil {
+		t.Fatalf("WriteProfile: %v", err)
+	}
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	for _, s := range []string{"contentions", "delay", "nanoseconds", "main.worker", "main.serve"} {
+		if !bytes.Contains(data, []byte(s)) {
+			t.Errorf("profile lacks %q", s)
+		}
+	}
+}
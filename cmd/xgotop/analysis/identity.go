@@ -0,0 +1,288 @@
+package analysis
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// UnknownIdentity is the identity of goroutines whose creation was not
+// recorded, e.g. the goroutines already running when the session started.
+const UnknownIdentity = "unknown"
+
+// maxCreationDepth bounds the creation chains hashed into an identity, in case
+// of cycles caused by lost events.
+const maxCreationDepth = 64
+
+// GoroutineIdentity identifies the same logical goroutine across sessions,
+// where numeric goroutine IDs differ. Two goroutines have the same identity
+// if they run the same function, were created at the same go statement, and
+// their creators have the same identity.
+type GoroutineIdentity struct {
+	// Key is a hash of the creation chain of the goroutine
+	Key       string `json:"key"`
+	StartFunc string `json:"start_func,omitempty"`
+	CreatedBy string `json:"created_by,omitempty"`
+}
+
+// IdentityStats counts the goroutines and events of an identity in a session.
+type IdentityStats struct {
+	GoroutineIdentity
+	Goroutines int    `json:"goroutines"`
+	Events     uint64 `json:"events"`
+}
+
+type goroutineCreation struct {
+	creator uint32
+	startPC uint64
+	goPC    uint64
+}
+
+// IdentityResolver assigns identities to the goroutines of a session from
+// its newgoroutine events. The start and go statement PCs are resolved to
+// function names with Session.Functions; PCs without a name are used as is,
+// so identities are then only stable across runs of the same binary.
+type IdentityResolver struct {
+	functions map[uint64]string
+	creations map[uint32]goroutineCreation
+	events    map[uint32]uint64
+	resolved  map[uint32]GoroutineIdentity
+}
+
+func NewIdentityResolver(session *storage.Session) *IdentityResolver {
+	r := &IdentityResolver{
+		creations: make(map[uint32]goroutineCreation),
+		events:    make(map[uint32]uint64),
+		resolved:  make(map[uint32]GoroutineIdentity),
+	}
+	if session != nil {
+		r.functions = session.Functions
+	}
+	return r
+}
+
+func (r *IdentityResolver) Observe(event *storage.Event) {
+	r.events[event.Goroutine]++
+	if event.EventType == storage.EventTypeNewGoroutine {
+		r.creations[uint32(event.Attributes[1])] = goroutineCreation{
+			creator: uint32(event.Attributes[0]),
+			startPC: event.Attributes[2],
+			goPC:    event.Attributes[3],
+		}
+	}
+}
+
+// Identity returns the identity of goroutine gid.
+func (r *IdentityResolver) Identity(gid uint32) GoroutineIdentity {
+	return r.identity(gid, 0)
+}
+
+func (r *IdentityResolver) identity(gid uint32, depth int) GoroutineIdentity {
+	if identity, ok := r.resolved[gid]; ok {
+		return identity
+	}
+
+	creation, ok := r.creations[gid]
+	if !ok || depth >= maxCreationDepth {
+		return GoroutineIdentity{Key: UnknownIdentity}
+	}
+
+	identity := GoroutineIdentity{
+		StartFunc: r.function(creation.startPC),
+		CreatedBy: r.function(creation.goPC),
+	}
+	parent := r.identity(creation.creator, depth+1)
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%s\x00%s", identity.StartFunc, identity.CreatedBy, parent.Key)
+	identity.Key = fmt.Sprintf("%016x", h.Sum64())
+
+	r.resolved[gid] = identity
+	return identity
+}
+
+// CreationStack returns the functions of the creation chain of goroutine
+// gid, innermost first: the function the goroutine runs, the function of the
+// go statement that created it, then the same for its creator. Consecutive
+// repeats of a function are listed once. It is empty if the creation of the
+// goroutine was not recorded.
+func (r *IdentityResolver) CreationStack(gid uint32) []string {
+	var stack []string
+	push := func(name string) {
+		if len(stack) == 0 || stack[len(stack)-1] != name {
+			stack = append(stack, name)
+		}
+	}
+	for depth := 0; depth < maxCreationDepth; depth++ {
+		creation, ok := r.creations[gid]
+		if !ok {
+			break
+		}
+		push(r.function(creation.startPC))
+		push(r.function(creation.goPC))
+		gid = creation.creator
+	}
+	return stack
+}
+
+func (r *IdentityResolver) function(pc uint64) string {
+	if name, ok := r.functions[pc]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%x", pc)
+}
+
+// Stats returns the goroutine and event counts of every identity, ordered by
+// goroutine count, then key.
+func (r *IdentityResolver) Stats() []IdentityStats {
+	byKey := make(map[string]*IdentityStats)
+	add := func(gid uint32, goroutines int, events uint64) {
+		identity := r.Identity(gid)
+		stats, ok := byKey[identity.Key]
+		if !ok {
+			stats = &IdentityStats{GoroutineIdentity: identity}
+			byKey[identity.Key] = stats
+		}
+		stats.Goroutines += goroutines
+		stats.Events += events
+	}
+
+	for gid := range r.creations {
+		add(gid, 1, r.events[gid])
+	}
+	for gid, events := range r.events {
+		if _, ok := r.creations[gid]; !ok {
+			add(gid, 1, events)
+		}
+	}
+
+	stats := make([]IdentityStats, 0, len(byKey))
+	for _, s := range byKey {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Goroutines != stats[j].Goroutines {
+			return stats[i].Goroutines > stats[j].Goroutines
+		}
+		return stats[i].Key < stats[j].Key
+	})
+	return stats
+}
+
+// Identities scans all events of store and returns the stats of every
+// goroutine identity.
+func Identities(ctx context.Context, store storage.EventStore) ([]IdentityStats, error) {
+	resolver := NewIdentityResolver(store.GetSession())
+	err := store.ScanEvents(ctx, 0, func(_ int64, event *storage.Event) error {
+		resolver.Observe(event)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan events: %w", err)
+	}
+	return resolver.Stats(), nil
+}
+
+// IdentityDelta compares an identity between two sessions.
+type IdentityDelta struct {
+	GoroutineIdentity
+	BaseGoroutines    int    `json:"base_goroutines"`
+	CompareGoroutines int    `json:"compare_goroutines"`
+	DeltaGoroutines   int    `json:"delta_goroutines"`
+	BaseEvents        uint64 `json:"base_events"`
+	CompareEvents     uint64 `json:"compare_events"`
+}
+
+// Diff compares the identities of two sessions, ordered by the absolute
+// change in goroutine count, then key. Identities present in only one of the
+// sessions are included with zero counts for the other.
+func Diff(base, compare []IdentityStats) []IdentityDelta {
+	byKey := make(map[string]*IdentityDelta)
+	get := func(identity GoroutineIdentity) *IdentityDelta {
+		delta, ok := byKey[identity.Key]
+		if !ok {
+			delta = &IdentityDelta{GoroutineIdentity: identity}
+			byKey[identity.Key] = delta
+		}
+		return delta
+	}
+
+	for _, s := range base {
+		delta := get(s.GoroutineIdentity)
+		delta.BaseGoroutines = s.Goroutines
+		delta.BaseEvents = s.Events
+	}
+	for _, s := range compare {
+		delta := get(s.GoroutineIdentity)
+		delta.CompareGoroutines = s.Goroutines
+		delta.CompareEvents = s.Events
+	}
+
+	deltas := make([]IdentityDelta, 0, len(byKey))
+	for _, delta := range byKey {
+		delta.DeltaGoroutines = delta.CompareGoroutines - delta.BaseGoroutines
+		deltas = append(deltas, *delta)
+	}
+	sort.Slice(deltas, func(i, j int) bool {
+		di, dj := abs(deltas[i].DeltaGoroutines), abs(deltas[j].DeltaGoroutines)
+		if di != dj {
+			return di > dj
+		}
+		return deltas[i].Key < deltas[j].Key
+	})
+	return deltas
+}
+
+// IdentityTrend is the goroutine count of an identity in each session of a
+// series.
+type IdentityTrend struct {
+	GoroutineIdentity
+	// Goroutines has one count per session, in the order of the series
+	Goroutines []int `json:"goroutines"`
+}
+
+// Trend follows every identity through a series of sessions, ordered by the
+// change in goroutine count from the first to the last session, then key.
+func Trend(series [][]IdentityStats) []IdentityTrend {
+	byKey := make(map[string]*IdentityTrend)
+	for i, stats := range series {
+		for _, s := range stats {
+			trend, ok := byKey[s.Key]
+			if !ok {
+				trend = &IdentityTrend{GoroutineIdentity: s.GoroutineIdentity, Goroutines: make([]int, len(series))}
+				byKey[s.Key] = trend
+			}
+			trend.Goroutines[i] = s.Goroutines
+		}
+	}
+
+	change := func(t IdentityTrend) int {
+		if len(t.Goroutines) == 0 {
+			return 0
+		}
+		return abs(t.Goroutines[len(t.Goroutines)-1] - t.Goroutines[0])
+	}
+
+	trends := make([]IdentityTrend, 0, len(byKey))
+	for _, trend := range byKey {
+		trends = append(trends, *trend)
+	}
+	sort.Slice(trends, func(i, j int) bool {
+		ci, cj := change(trends[i]), change(trends[j])
+		if ci != cj {
+			return ci > cj
+		}
+		return trends[i].Key < trends[j].Key
+	})
+	return trends
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
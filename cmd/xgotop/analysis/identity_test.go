@@ -0,0 +1,68 @@
+package analysis
+
+import (
+	"testing"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+func TestIdentityDiff(t *testing.T) {
+	functions := map[uint64]string{
+		0x10: "main.worker",
+		0x20: "main.main",
+		0x30: "main.handle",
+		0x40: "main.serve",
+	}
+	stats := func(events []*storage.Event) []IdentityStats {
+		resolver := NewIdentityResolver(&storage.Session{Functions: functions})
+		observe(events, resolver)
+		return resolver.Stats()
+	}
+
+	// main (gid 1, created before the session) starts a server which handles
+	// one request, then two workers
+	base := stats([]*storage.Event{
+		newGoroutine(0, 1, 5, 0x40, 0x20),
+		newGoroutine(0, 5, 6, 0x30, 0x40),
+		newGoroutine(0, 1, 7, 0x10, 0x20),
+		newGoroutine(0, 1, 8, 0x10, 0x20),
+	})
+	// Different goroutine IDs, one more request and one worker less
+	compare := stats([]*storage.Event{
+		newGoroutine(0, 1, 15, 0x40, 0x20),
+		newGoroutine(0, 15, 16, 0x30, 0x40),
+		newGoroutine(0, 15, 17, 0x30, 0x40),
+		newGoroutine(0, 1, 20, 0x10, 0x20),
+		// a handler started by a worker is a different logical goroutine
+		newGoroutine(0, 20, 21, 0x30, 0x10),
+	})
+
+	deltas := Diff(base, compare)
+
+	type delta struct {
+		startFunc, createdBy string
+		base, compare        int
+	}
+	expected := map[delta]bool{
+		{"main.handle", "main.worker", 0, 1}: true,
+		{"main.handle", "main.serve", 1, 2}:  true,
+		{"main.worker", "main.main", 2, 1}:   true,
+		{"main.serve", "main.main", 1, 1}:    true,
+		{"", "", 1, 1}:                       true,
+	}
+	if len(deltas) != len(expected) {
+		t.Fatalf("expected %d deltas, got %d: %+v", len(expected), len(deltas), deltas)
+	}
+	for i, got := range deltas {
+		d := delta{got.StartFunc, got.CreatedBy, got.BaseGoroutines, got.CompareGoroutines}
+		if !expected[d] {
+			t.Errorf("unexpected delta %d: %+v", i, got)
+		}
+		if i > 0 && abs(got.DeltaGoroutines) > abs(deltas[i-1].DeltaGoroutines) {
+			t.Errorf("delta %d is not ordered by absolute change: %+v", i, got)
+		}
+		if got.StartFunc == "" && got.Key != UnknownIdentity {
+			t.Errorf("expected goroutine 1 to have the unknown identity, got %s", got.Key)
+		}
+	}
+}
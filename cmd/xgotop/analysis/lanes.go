@@ -0,0 +1,166 @@
+package analysis
+
+import (
+	"sort"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// Lane is the activity of a goroutine on the timeline.
+type Lane struct {
+	Goroutine      uint32 `json:"goroutine"`
+	Events         int    `json:"events"`
+	FirstTimestamp uint64 `json:"first_timestamp"`
+	LastTimestamp  uint64 `json:"last_timestamp"`
+	// Activity counts the events of the goroutine in every bucket of the
+	// timeline
+	Activity []int `json:"activity"`
+}
+
+// OtherLane aggregates the goroutines that did not make it into the lanes.
+type OtherLane struct {
+	Goroutines     int    `json:"goroutines"`
+	Events         int    `json:"events"`
+	FirstTimestamp uint64 `json:"first_timestamp"`
+	LastTimestamp  uint64 `json:"last_timestamp"`
+	Activity       []int  `json:"activity"`
+}
+
+// Lanes is a timeline bounded in size regardless of the number of
+// goroutines: the most active goroutines get their own lane, and all others
+// share a single one.
+type Lanes struct {
+	StartTimestamp uint64 `json:"start_timestamp"`
+	EndTimestamp   uint64 `json:"end_timestamp"`
+	// BucketNanos is the duration covered by every activity bucket
+	BucketNanos uint64 `json:"bucket_ns"`
+	// Lanes are ordered by activity, most active first
+	Lanes []Lane `json:"lanes"`
+	// Other is nil if every goroutine has its own lane
+	Other *OtherLane `json:"other,omitempty"`
+}
+
+// LaneCounter counts the events of every goroutine, to find the goroutines
+// that get their own lane before a LaneBuilder builds the lanes. Events
+// outside of goroutines, e.g. USDT probes, are ignored.
+type LaneCounter struct {
+	counts map[uint32]int
+	start  uint64
+	end    uint64
+}
+
+func NewLaneCounter() *LaneCounter {
+	return &LaneCounter{counts: make(map[uint32]int)}
+}
+
+func (c *LaneCounter) Observe(event *storage.Event) {
+	if event.Goroutine == 0 {
+		return
+	}
+	if len(c.counts) == 0 {
+		c.start, c.end = event.Timestamp, event.Timestamp
+	}
+	c.counts[event.Goroutine]++
+	c.start = min(c.start, event.Timestamp)
+	c.end = max(c.end, event.Timestamp)
+}
+
+// Range returns the timestamps of the first and last observed events.
+func (c *LaneCounter) Range() (start, end uint64) {
+	return c.start, c.end
+}
+
+// Top returns the k goroutines with the most events, most active first.
+func (c *LaneCounter) Top(k int) []uint32 {
+	gids := make([]uint32, 0, len(c.counts))
+	for gid := range c.counts {
+		gids = append(gids, gid)
+	}
+	sort.Slice(gids, func(i, j int) bool {
+		if c.counts[gids[i]] != c.counts[gids[j]] {
+			return c.counts[gids[i]] > c.counts[gids[j]]
+		}
+		return gids[i] < gids[j]
+	})
+	return gids[:min(k, len(gids))]
+}
+
+// LaneBuilder builds the lanes of the goroutines found by a LaneCounter, and
+// aggregates the events of all other goroutines into the other lane.
+type LaneBuilder struct {
+	start uint64
+	end   uint64
+	width uint64
+
+	lanes map[uint32]*Lane
+	order []uint32
+	other OtherLane
+	// others are the goroutines aggregated into the other lane
+	others map[uint32]struct{}
+}
+
+// NewLaneBuilder creates a builder with a lane for each of top, whose
+// activity is counted in buckets between start and end. Events outside of
+// the range are ignored.
+func NewLaneBuilder(top []uint32, start, end uint64, buckets int) *LaneBuilder {
+	b := &LaneBuilder{
+		start:  start,
+		end:    end,
+		width:  (end-start)/uint64(buckets) + 1,
+		lanes:  make(map[uint32]*Lane, len(top)),
+		order:  top,
+		other:  OtherLane{Activity: make([]int, buckets)},
+		others: make(map[uint32]struct{}),
+	}
+	for _, gid := range top {
+		b.lanes[gid] = &Lane{Goroutine: gid, Activity: make([]int, buckets)}
+	}
+	return b
+}
+
+func (b *LaneBuilder) Observe(event *storage.Event) {
+	if event.Goroutine == 0 || event.Timestamp < b.start || event.Timestamp > b.end {
+		return
+	}
+	bucket := int((event.Timestamp - b.start) / b.width)
+
+	if lane, ok := b.lanes[event.Goroutine]; ok {
+		if lane.Events == 0 {
+			lane.FirstTimestamp, lane.LastTimestamp = event.Timestamp, event.Timestamp
+		}
+		lane.Events++
+		lane.FirstTimestamp = min(lane.FirstTimestamp, event.Timestamp)
+		lane.LastTimestamp = max(lane.LastTimestamp, event.Timestamp)
+		lane.Activity[bucket]++
+		return
+	}
+
+	if b.other.Events == 0 {
+		b.other.FirstTimestamp, b.other.LastTimestamp = event.Timestamp, event.Timestamp
+	}
+	b.others[event.Goroutine] = struct{}{}
+	b.other.Events++
+	b.other.FirstTimestamp = min(b.other.FirstTimestamp, event.Timestamp)
+	b.other.LastTimestamp = max(b.other.LastTimestamp, event.Timestamp)
+	b.other.Activity[bucket]++
+}
+
+// Lanes returns the lanes in the order of the goroutines given to
+// NewLaneBuilder.
+func (b *LaneBuilder) Lanes() *Lanes {
+	lanes := &Lanes{
+		StartTimestamp: b.start,
+		EndTimestamp:   b.end,
+		BucketNanos:    b.width,
+		Lanes:          make([]Lane, 0, len(b.order)),
+	}
+	for _, gid := range b.order {
+		lanes.Lanes = append(lanes.Lanes, *b.lanes[gid])
+	}
+	if len(b.others) > 0 {
+		other := b.other
+		other.Goroutines = len(b.others)
+		lanes.Other = &other
+	}
+	return lanes
+}
@@ -0,0 +1,53 @@
+package analysis
+
+import (
+	"testing"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+func TestLanes(t *testing.T) {
+	events := []*storage.Event{
+		// goroutine 1 is the most active
+		newObject(100, 1, 0),
+		newObject(150, 1, 0),
+		newObject(199, 1, 0),
+		// goroutines 2 and 3 are tied, the lower ID wins
+		newObject(120, 3, 0),
+		newObject(130, 3, 0),
+		newObject(110, 2, 0),
+		newObject(190, 2, 0),
+		// goroutine 4 only makes it into the other lane
+		newObject(140, 4, 0),
+		// events outside of goroutines are ignored
+		newObject(50, 0, 0),
+	}
+
+	counter := NewLaneCounter()
+	observe(events, counter)
+	start, end := counter.Range()
+	if start != 100 || end != 199 {
+		t.Fatalf("expected range 100-199, got %d-%d", start, end)
+	}
+
+	top := counter.Top(2)
+	checkEqual(t, "top goroutines", top, []uint32{1, 2})
+
+	builder := NewLaneBuilder(top, start, end, 2)
+	observe(events, builder)
+
+	checkEqual(t, "lanes", builder.Lanes(), &Lanes{
+		StartTimestamp: 100,
+		EndTimestamp:   199,
+		BucketNanos:    50,
+		Lanes: []Lane{
+			{Goroutine: 1, Events: 3, FirstTimestamp: 100, LastTimestamp: 199, Activity: []int{1, 2}},
+			{Goroutine: 2, Events: 2, FirstTimestamp: 110, LastTimestamp: 190, Activity: []int{1, 1}},
+		},
+		Other: &OtherLane{Goroutines: 2, Events: 3, FirstTimestamp: 120, LastTimestamp: 140, Activity: []int{3, 0}},
+	})
+
+	if all := NewLaneBuilder(counter.Top(10), start, end, 2).Lanes(); all.Other != nil {
+		t.Errorf("expected no other lane when every goroutine has a lane, got %+v", all.Other)
+	}
+}
@@ -0,0 +1,119 @@
+package analysis
+
+import (
+	"sort"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// Marker phases, as defined by enum marker_phase in xgotop.h
+const (
+	MarkerBegin = 0
+	MarkerEnd   = 1
+)
+
+// MarkerLatency summarizes the latencies between the Begin and End markers
+// with the same ID.
+type MarkerLatency struct {
+	ID    uint64 `json:"id"`
+	Count int    `json:"count"`
+	// Unmatched counts the markers without a counterpart on their goroutine,
+	// e.g. operations still running when the session ended.
+	Unmatched int    `json:"unmatched"`
+	MinNs     uint64 `json:"min_ns"`
+	MaxNs     uint64 `json:"max_ns"`
+	MeanNs    uint64 `json:"mean_ns"`
+	P50Ns     uint64 `json:"p50_ns"`
+	P99Ns     uint64 `json:"p99_ns"`
+}
+
+type markerKey struct {
+	goroutine uint32
+	id        uint64
+}
+
+// MarkerLatencyTracker pairs marker events and computes the latency of every
+// marked operation. A Begin marker is paired with the next End marker with
+// the same ID on the same goroutine, so nested operations with the same ID
+// are paired innermost first.
+type MarkerLatencyTracker struct {
+	markers []*storage.Event
+}
+
+func NewMarkerLatencyTracker() *MarkerLatencyTracker {
+	return &MarkerLatencyTracker{}
+}
+
+func (t *MarkerLatencyTracker) Observe(event *storage.Event) {
+	if event.EventType == storage.EventTypeMarker {
+		t.markers = append(t.markers, event)
+	}
+}
+
+// Latencies returns the latency statistics of every marker ID, ordered by ID.
+func (t *MarkerLatencyTracker) Latencies() []MarkerLatency {
+	// Events are not necessarily stored in timestamp order
+	sort.SliceStable(t.markers, func(i, j int) bool {
+		return t.markers[i].Timestamp < t.markers[j].Timestamp
+	})
+
+	open := make(map[markerKey][]uint64)
+	durations := make(map[uint64][]uint64)
+	unmatched := make(map[uint64]int)
+
+	for _, event := range t.markers {
+		key := markerKey{goroutine: event.Goroutine, id: event.Attributes[0]}
+		switch event.Attributes[1] {
+		case MarkerBegin:
+			open[key] = append(open[key], event.Timestamp)
+		case MarkerEnd:
+			begins := open[key]
+			if len(begins) == 0 {
+				unmatched[key.id]++
+				continue
+			}
+			begin := begins[len(begins)-1]
+			open[key] = begins[:len(begins)-1]
+			durations[key.id] = append(durations[key.id], event.Timestamp-begin)
+		}
+	}
+	for key, begins := range open {
+		unmatched[key.id] += len(begins)
+	}
+
+	ids := make(map[uint64]struct{})
+	for id := range durations {
+		ids[id] = struct{}{}
+	}
+	for id := range unmatched {
+		ids[id] = struct{}{}
+	}
+
+	latencies := make([]MarkerLatency, 0, len(ids))
+	for id := range ids {
+		latency := MarkerLatency{ID: id, Unmatched: unmatched[id]}
+
+		d := durations[id]
+		if len(d) > 0 {
+			sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+			var sum uint64
+			for _, v := range d {
+				sum += v
+			}
+			latency.Count = len(d)
+			latency.MinNs = d[0]
+			latency.MaxNs = d[len(d)-1]
+			latency.MeanNs = sum / uint64(len(d))
+			latency.P50Ns = d[(len(d)-1)*50/100]
+			latency.P99Ns = d[(len(d)-1)*99/100]
+		}
+
+		latencies = append(latencies, latency)
+	}
+
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i].ID < latencies[j].ID
+	})
+
+	return latencies
+}
@@ -0,0 +1,35 @@
+package analysis
+
+import (
+	"testing"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+func TestMarkerLatencyTracker(t *testing.T) {
+	marker := func(ts uint64, gid uint32, id, phase uint64) *storage.Event {
+		return newEvent(storage.EventTypeMarker, ts, gid, id, phase)
+	}
+
+	events := []*storage.Event{
+		// two requests with ID 1 on different goroutines, interleaved
+		marker(10, 1, 1, MarkerBegin),
+		marker(20, 2, 1, MarkerBegin),
+		marker(40, 1, 1, MarkerEnd),
+		// stored out of order
+		marker(120, 2, 1, MarkerEnd),
+		marker(100, 3, 2, MarkerEnd),
+		marker(50, 3, 2, MarkerBegin),
+		// an End on another goroutine does not close the Begin
+		marker(70, 4, 2, MarkerEnd),
+		newObject(60, 3, 0),
+	}
+
+	tracker := NewMarkerLatencyTracker()
+	observe(events, tracker)
+
+	checkEqual(t, "latencies", tracker.Latencies(), []MarkerLatency{
+		{ID: 1, Count: 2, MinNs: 30, MaxNs: 100, MeanNs: 65, P50Ns: 30, P99Ns: 30},
+		{ID: 2, Count: 1, Unmatched: 1, MinNs: 50, MaxNs: 50, MeanNs: 50, P50Ns: 50, P99Ns: 50},
+	})
+}
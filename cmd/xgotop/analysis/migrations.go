@@ -0,0 +1,98 @@
+package analysis
+
+import (
+	"sort"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// GoroutineMigrations is the number of times a goroutine was seen on a
+// different P than in its previous event. Frequent migration hurts cache
+// locality.
+type GoroutineMigrations struct {
+	Goroutine  uint32 `json:"goroutine"`
+	Migrations int    `json:"migrations"`
+	// Events is the number of events of the goroutine with a known P
+	Events int `json:"events"`
+	// Ps is the number of distinct Ps the goroutine ran on
+	Ps int `json:"ps"`
+}
+
+type pSample struct {
+	timestamp uint64
+	goroutine uint32
+	p         uint32
+}
+
+// MigrationCounter counts the P changes between consecutive events of every
+// goroutine. Only events recorded with the full event detail level carry a
+// P, all other events are ignored.
+type MigrationCounter struct {
+	samples []pSample
+}
+
+func NewMigrationCounter() *MigrationCounter {
+	return &MigrationCounter{}
+}
+
+func (c *MigrationCounter) Observe(event *storage.Event) {
+	// Events outside of goroutines, e.g. USDT probes and scheduler samples,
+	// do not tell where a goroutine ran
+	if event.P == nil || event.Goroutine == 0 {
+		return
+	}
+	c.samples = append(c.samples, pSample{
+		timestamp: event.Timestamp,
+		goroutine: event.Goroutine,
+		p:         *event.P,
+	})
+}
+
+// Migrations returns the goroutines that migrated at least once, most
+// migrated first. If limit is positive, at most limit goroutines are
+// returned.
+func (c *MigrationCounter) Migrations(limit int) []GoroutineMigrations {
+	// Events are not necessarily stored in timestamp order
+	sort.SliceStable(c.samples, func(i, j int) bool {
+		return c.samples[i].timestamp < c.samples[j].timestamp
+	})
+
+	last := make(map[uint32]uint32)
+	seen := make(map[uint32]map[uint32]struct{})
+	counts := make(map[uint32]*GoroutineMigrations)
+
+	for _, sample := range c.samples {
+		count, ok := counts[sample.goroutine]
+		if !ok {
+			count = &GoroutineMigrations{Goroutine: sample.goroutine}
+			counts[sample.goroutine] = count
+			seen[sample.goroutine] = make(map[uint32]struct{})
+		} else if last[sample.goroutine] != sample.p {
+			count.Migrations++
+		}
+		count.Events++
+		last[sample.goroutine] = sample.p
+		seen[sample.goroutine][sample.p] = struct{}{}
+	}
+
+	migrations := make([]GoroutineMigrations, 0)
+	for gid, count := range counts {
+		if count.Migrations == 0 {
+			continue
+		}
+		count.Ps = len(seen[gid])
+		migrations = append(migrations, *count)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		if migrations[i].Migrations != migrations[j].Migrations {
+			return migrations[i].Migrations > migrations[j].Migrations
+		}
+		return migrations[i].Goroutine < migrations[j].Goroutine
+	})
+
+	if limit > 0 && len(migrations) > limit {
+		migrations = migrations[:limit]
+	}
+	return migrations
+}
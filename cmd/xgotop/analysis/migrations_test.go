@@ -0,0 +1,42 @@
+package analysis
+
+import (
+	"testing"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+func TestMigrationCounter(t *testing.T) {
+	pEvent := func(ts uint64, gid uint32, p uint32) *storage.Event {
+		event := newEvent(storage.EventTypeCasGStatus, ts, gid)
+		event.P = &p
+		return event
+	}
+
+	events := []*storage.Event{
+		// goroutine 1 moves from P 0 to P 1 and back
+		pEvent(10, 1, 0),
+		pEvent(20, 1, 1),
+		pEvent(40, 1, 0),
+		// goroutine 2 never migrates
+		pEvent(15, 2, 3),
+		pEvent(25, 2, 3),
+		// goroutine 3 migrates once, its events are out of order
+		pEvent(60, 3, 2),
+		pEvent(50, 3, 1),
+		pEvent(55, 3, 1),
+		// events without a P or outside of goroutines are ignored
+		newObject(30, 1, 0),
+		pEvent(35, 0, 5),
+	}
+
+	counter := NewMigrationCounter()
+	observe(events, counter)
+
+	expected := []GoroutineMigrations{
+		{Goroutine: 1, Migrations: 2, Events: 3, Ps: 2},
+		{Goroutine: 3, Migrations: 1, Events: 3, Ps: 2},
+	}
+	checkEqual(t, "migrations", counter.Migrations(0), expected)
+	checkEqual(t, "migrations with limit 1", counter.Migrations(1), expected[:1])
+}
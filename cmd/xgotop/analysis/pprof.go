@@ -0,0 +1,162 @@
+package analysis
+
+import (
+	"compress/gzip"
+	"io"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the messages of profile.proto, the pprof profile format
+const (
+	profileSampleType    = 1
+	profileSample        = 2
+	profileLocation      = 4
+	profileFunction      = 5
+	profileStringTable   = 6
+	profileTimeNanos     = 9
+	profileDurationNanos = 10
+	profilePeriodType    = 11
+	profilePeriod        = 12
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+
+	locationID   = 1
+	locationLine = 4
+
+	lineFunctionID = 1
+
+	functionID         = 1
+	functionName       = 2
+	functionSystemName = 3
+)
+
+// pprofSample is a sample of a pprofProfile. The frames are function names,
+// innermost first.
+type pprofSample struct {
+	frames []string
+	values []int64
+}
+
+// pprofProfile is a pprof profile whose locations are functions without
+// addresses or lines, as xgotop only knows the names of the functions of
+// the traced program.
+type pprofProfile struct {
+	// sampleTypes are the type and unit of every sample value
+	sampleTypes [][2]string
+	samples     []pprofSample
+	periodType  [2]string
+	period      int64
+	timeNanos   int64
+	duration    time.Duration
+}
+
+// write encodes the profile in the gzipped protobuf format read by go tool
+// pprof.
+func (p *pprofProfile) write(w io.Writer) error {
+	var buf []byte
+	strs := []string{""}
+	stringIDs := map[string]uint64{"": 0}
+	str := func(s string) uint64 {
+		id, ok := stringIDs[s]
+		if !ok {
+			id = uint64(len(strs))
+			strs = append(strs, s)
+			stringIDs[s] = id
+		}
+		return id
+	}
+	valueType := func(field protowire.Number, t [2]string) {
+		var msg []byte
+		msg = protowire.AppendTag(msg, valueTypeType, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, str(t[0]))
+		msg = protowire.AppendTag(msg, valueTypeUnit, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, str(t[1]))
+		buf = protowire.AppendTag(buf, field, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, msg)
+	}
+
+	for _, t := range p.sampleTypes {
+		valueType(profileSampleType, t)
+	}
+
+	// Every function has a single location with the same ID
+	var functions []string
+	functionIDs := make(map[string]uint64)
+	for _, sample := range p.samples {
+		var locations, values []byte
+		for _, frame := range sample.frames {
+			id, ok := functionIDs[frame]
+			if !ok {
+				functions = append(functions, frame)
+				id = uint64(len(functions))
+				functionIDs[frame] = id
+			}
+			locations = protowire.AppendVarint(locations, id)
+		}
+		for _, v := range sample.values {
+			values = protowire.AppendVarint(values, uint64(v))
+		}
+
+		var msg []byte
+		msg = protowire.AppendTag(msg, sampleLocationID, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, locations)
+		msg = protowire.AppendTag(msg, sampleValue, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, values)
+		buf = protowire.AppendTag(buf, profileSample, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, msg)
+	}
+
+	for i, name := range functions {
+		id := uint64(i + 1)
+
+		var line []byte
+		line = protowire.AppendTag(line, lineFunctionID, protowire.VarintType)
+		line = protowire.AppendVarint(line, id)
+
+		var location []byte
+		location = protowire.AppendTag(location, locationID, protowire.VarintType)
+		location = protowire.AppendVarint(location, id)
+		location = protowire.AppendTag(location, locationLine, protowire.BytesType)
+		location = protowire.AppendBytes(location, line)
+		buf = protowire.AppendTag(buf, profileLocation, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, location)
+
+		var function []byte
+		function = protowire.AppendTag(function, functionID, protowire.VarintType)
+		function = protowire.AppendVarint(function, id)
+		function = protowire.AppendTag(function, functionName, protowire.VarintType)
+		function = protowire.AppendVarint(function, str(name))
+		function = protowire.AppendTag(function, functionSystemName, protowire.VarintType)
+		function = protowire.AppendVarint(function, str(name))
+		buf = protowire.AppendTag(buf, profileFunction, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, function)
+	}
+
+	if p.timeNanos != 0 {
+		buf = protowire.AppendTag(buf, profileTimeNanos, protowire.VarintType)
+		buf = protowire.AppendVarint(buf, uint64(p.timeNanos))
+	}
+	buf = protowire.AppendTag(buf, profileDurationNanos, protowire.VarintType)
+	buf = protowire.AppendVarint(buf, uint64(p.duration.Nanoseconds()))
+	valueType(profilePeriodType, p.periodType)
+	buf = protowire.AppendTag(buf, profilePeriod, protowire.VarintType)
+	buf = protowire.AppendVarint(buf, uint64(p.period))
+
+	// The string table is complete once everything else is encoded
+	for _, s := range strs {
+		buf = protowire.AppendTag(buf, profileStringTable, protowire.BytesType)
+		buf = protowire.AppendString(buf, s)
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(buf); err != nil {
+		return err
+	}
+	return gz.Close()
+}
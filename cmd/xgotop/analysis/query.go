@@ -0,0 +1,493 @@
+package analysis
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// defaultQueryTop is the number of groups or pattern matches listed by a
+// query without top.
+const defaultQueryTop = 20
+
+// Names is a list of names, which can be given as a single string too.
+type Names []string
+
+func (n *Names) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*n = Names{name}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(n))
+}
+
+// EventMatch selects events by type, goroutine, time and the fields of the
+// decoded events, see storage.DecodeEvent. Where maps field names to the
+// value they must equal, or to a comparison with a number such as ">=1024".
+// All conditions must hold.
+type EventMatch struct {
+	Events    Names          `json:"event,omitempty"`
+	Goroutine *uint32        `json:"goroutine,omitempty"`
+	From      uint64         `json:"from,omitempty"`
+	To        uint64         `json:"to,omitempty"`
+	Where     map[string]any `json:"where,omitempty"`
+}
+
+// QuerySpec is a query evaluated over the events of a session. A query
+// either counts the events matching Filter, optionally summing a field and
+// grouping them by fields, searches the goroutines whose events follow
+// Pattern, or runs one of the built-in analyses. Min and Max turn the query
+// into a check of its value, which is the number of matching events, the
+// sum, the number of goroutines matching the pattern or the number of
+// findings of the analysis.
+type QuerySpec struct {
+	Name   string     `json:"name"`
+	Filter EventMatch `json:"filter"`
+	// GroupBy are the fields the matching events are grouped by, and Sum
+	// the numeric field summed instead of counting events
+	GroupBy Names  `json:"group_by,omitempty"`
+	Sum     string `json:"sum,omitempty"`
+	// Pattern are the events a goroutine must emit in this order, with any
+	// events in between, and Within the longest time from the first to the
+	// last of them, e.g. "500ms". Key is the field identifying the
+	// goroutine, goroutine by default.
+	Pattern []EventMatch `json:"pattern,omitempty"`
+	Within  string       `json:"within,omitempty"`
+	Key     string       `json:"key,omitempty"`
+	// Analysis is totals, timer-leaks, markers or migrations
+	Analysis string `json:"analysis,omitempty"`
+	// Top is the number of groups or pattern matches listed
+	Top int      `json:"top,omitempty"`
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+}
+
+// QueryGroup is a group of the events matching a query.
+type QueryGroup struct {
+	Key   map[string]any `json:"key"`
+	Count int64          `json:"count"`
+	Sum   float64        `json:"sum,omitempty"`
+}
+
+// PatternMatch is a goroutine whose events followed the pattern of a query,
+// with the timestamps of the events that matched its steps.
+type PatternMatch struct {
+	Key        any      `json:"key"`
+	Timestamps []uint64 `json:"timestamps"`
+}
+
+// QueryResult is the outcome of a query.
+type QueryResult struct {
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+	// Count is the number of matching events or goroutines
+	Count    int64          `json:"count"`
+	Groups   []QueryGroup   `json:"groups,omitempty"`
+	Matches  []PatternMatch `json:"matches,omitempty"`
+	Analysis any            `json:"analysis,omitempty"`
+	// Passed is set for checks, Failure tells which bound the value broke
+	Passed  *bool  `json:"passed,omitempty"`
+	Failure string `json:"failure,omitempty"`
+}
+
+// condition is a compiled condition of EventMatch.Where.
+type condition struct {
+	field string
+	// op is empty for equality with value, or a comparison with number
+	op     string
+	value  string
+	number float64
+}
+
+// compiledMatch is a compiled EventMatch.
+type compiledMatch struct {
+	types      map[storage.EventType]bool
+	goroutine  *uint32
+	from, to   uint64
+	conditions []condition
+}
+
+func compileMatch(m EventMatch) (*compiledMatch, error) {
+	c := &compiledMatch{goroutine: m.Goroutine, from: m.From, to: m.To}
+	if len(m.Events) > 0 {
+		c.types = make(map[storage.EventType]bool)
+		for _, name := range m.Events {
+			eventType, ok := storage.ParseEventType(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown event name: %s", name)
+			}
+			c.types[eventType] = true
+		}
+	}
+
+	for field, value := range m.Where {
+		cond := condition{field: field, value: fmt.Sprint(value)}
+		if s, ok := value.(string); ok {
+			for _, op := range []string{">=", "<=", "!=", ">", "<"} {
+				if rest, ok := strings.CutPrefix(s, op); ok {
+					n, err := strconv.ParseFloat(strings.TrimSpace(rest), 64)
+					if err != nil {
+						return nil, fmt.Errorf("invalid comparison %q of %s: %v", s, field, err)
+					}
+					cond.op, cond.number = op, n
+					break
+				}
+			}
+		}
+		c.conditions = append(c.conditions, cond)
+	}
+	sort.Slice(c.conditions, func(i, j int) bool { return c.conditions[i].field < c.conditions[j].field })
+	return c, nil
+}
+
+// matches reports whether event matches, decoding it with decode if a
+// condition needs its fields.
+func (c *compiledMatch) matches(event *storage.Event, decode func() *storage.DecodedEvent) bool {
+	if c.types != nil && !c.types[event.EventType] {
+		return false
+	}
+	if c.goroutine != nil && event.Goroutine != *c.goroutine {
+		return false
+	}
+	if event.Timestamp < c.from || (c.to != 0 && event.Timestamp > c.to) {
+		return false
+	}
+	for _, cond := range c.conditions {
+		value, ok := field(decode(), cond.field)
+		if !ok {
+			return false
+		}
+		if cond.op == "" {
+			if fmt.Sprint(value) != cond.value {
+				return false
+			}
+			continue
+		}
+		n, ok := number(value)
+		if !ok {
+			return false
+		}
+		switch cond.op {
+		case ">=":
+			ok = n >= cond.number
+		case "<=":
+			ok = n <= cond.number
+		case "!=":
+			ok = n != cond.number
+		case ">":
+			ok = n > cond.number
+		case "<":
+			ok = n < cond.number
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// field returns the value of the named field of a decoded event.
+func field(d *storage.DecodedEvent, name string) (any, bool) {
+	for _, f := range d.Fields {
+		if f.Name == name {
+			return f.Value, true
+		}
+	}
+	return nil, false
+}
+
+// number returns the value of a numeric field.
+func number(value any) (float64, bool) {
+	switch v := value.(type) {
+	case uint64:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// patternState is the progress of a goroutine through the pattern.
+type patternState struct {
+	step       int
+	timestamps []uint64
+}
+
+// Query evaluates a QuerySpec over the observed events.
+type Query struct {
+	spec    QuerySpec
+	session *storage.Session
+
+	filter  *compiledMatch
+	pattern []*compiledMatch
+	within  uint64
+	key     string
+
+	count  int64
+	sum    float64
+	groups map[string]*QueryGroup
+
+	progress map[string]*patternState
+	matches  map[string]*PatternMatch
+	order    []string
+
+	// analyze observes the events of a built-in analysis, and findings
+	// returns its result and the number of its findings
+	analyze  func(*storage.Event)
+	findings func() (any, int)
+}
+
+// NewQuery compiles spec for the events of session.
+func NewQuery(spec QuerySpec, session *storage.Session) (*Query, error) {
+	if spec.Name == "" {
+		return nil, errors.New("query without name")
+	}
+	q := &Query{spec: spec, session: session, key: spec.Key}
+	if q.key == "" {
+		q.key = "goroutine"
+	}
+	if spec.Top <= 0 {
+		q.spec.Top = defaultQueryTop
+	}
+
+	switch {
+	case spec.Analysis != "":
+		if len(spec.Pattern) > 0 || len(spec.GroupBy) > 0 || spec.Sum != "" {
+			return nil, fmt.Errorf("query %s: analysis cannot be combined with pattern, group_by or sum", spec.Name)
+		}
+		if err := q.setAnalysis(spec.Analysis); err != nil {
+			return nil, fmt.Errorf("query %s: %w", spec.Name, err)
+		}
+	case len(spec.Pattern) > 0:
+		if len(spec.GroupBy) > 0 || spec.Sum != "" {
+			return nil, fmt.Errorf("query %s: pattern cannot be combined with group_by or sum", spec.Name)
+		}
+		for i, step := range spec.Pattern {
+			m, err := compileMatch(step)
+			if err != nil {
+				return nil, fmt.Errorf("query %s: pattern step %d: %w", spec.Name, i+1, err)
+			}
+			q.pattern = append(q.pattern, m)
+		}
+		if spec.Within != "" {
+			within, err := time.ParseDuration(spec.Within)
+			if err != nil || within <= 0 {
+				return nil, fmt.Errorf("query %s: invalid within %q", spec.Name, spec.Within)
+			}
+			q.within = uint64(within.Nanoseconds())
+		}
+		q.progress = make(map[string]*patternState)
+		q.matches = make(map[string]*PatternMatch)
+	default:
+		q.groups = make(map[string]*QueryGroup)
+	}
+
+	filter, err := compileMatch(spec.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("query %s: filter: %w", spec.Name, err)
+	}
+	q.filter = filter
+	return q, nil
+}
+
+// setAnalysis sets up the named built-in analysis.
+func (q *Query) setAnalysis(name string) error {
+	switch name {
+	case "totals":
+		totals := NewTotalsCounter(q.session.Sampling)
+		q.analyze = totals.Observe
+		q.findings = func() (any, int) {
+			var events int
+			for _, t := range totals.Totals() {
+				events += int(t.Events)
+			}
+			return totals.Totals(), events
+		}
+	case "timer-leaks":
+		timers := NewTimerLeakDetector(q.session.Sampling)
+		if _, err := timers.Leaks(); err != nil {
+			return err
+		}
+		q.analyze = timers.Observe
+		q.findings = func() (any, int) {
+			leaks, _ := timers.Leaks()
+			return leaks, len(leaks)
+		}
+	case "markers":
+		markers := NewMarkerLatencyTracker()
+		q.analyze = markers.Observe
+		q.findings = func() (any, int) {
+			latencies := markers.Latencies()
+			return latencies, len(latencies)
+		}
+	case "migrations":
+		migrations := NewMigrationCounter()
+		q.analyze = migrations.Observe
+		q.findings = func() (any, int) {
+			top := migrations.Migrations(q.spec.Top)
+			return top, len(top)
+		}
+	default:
+		return fmt.Errorf("unknown analysis %q (supported: totals, timer-leaks, markers, migrations)", name)
+	}
+	return nil
+}
+
+// Observe evaluates the query on event. decode returns the decoded event,
+// which is shared by the queries evaluated together.
+func (q *Query) Observe(event *storage.Event, decode func() *storage.DecodedEvent) {
+	if !q.filter.matches(event, decode) {
+		return
+	}
+
+	switch {
+	case q.analyze != nil:
+		q.analyze(event)
+	case q.pattern != nil:
+		q.observePattern(event, decode)
+	default:
+		q.observeEvent(decode)
+	}
+}
+
+func (q *Query) observeEvent(decode func() *storage.DecodedEvent) {
+	var value float64
+	if q.spec.Sum != "" {
+		v, ok := field(decode(), q.spec.Sum)
+		if !ok {
+			return
+		}
+		if value, ok = number(v); !ok {
+			return
+		}
+	}
+	q.count++
+	q.sum += value
+
+	if len(q.spec.GroupBy) == 0 {
+		return
+	}
+	d := decode()
+	values := make([]string, len(q.spec.GroupBy))
+	for i, name := range q.spec.GroupBy {
+		v, _ := field(d, name)
+		values[i] = fmt.Sprint(v)
+	}
+	id := strings.Join(values, "\x00")
+	group, ok := q.groups[id]
+	if !ok {
+		group = &QueryGroup{Key: make(map[string]any, len(q.spec.GroupBy))}
+		for _, name := range q.spec.GroupBy {
+			group.Key[name], _ = field(d, name)
+		}
+		q.groups[id] = group
+	}
+	group.Count++
+	group.Sum += value
+}
+
+func (q *Query) observePattern(event *storage.Event, decode func() *storage.DecodedEvent) {
+	keyValue, ok := field(decode(), q.key)
+	if !ok {
+		return
+	}
+	key := fmt.Sprint(keyValue)
+	if _, ok := q.matches[key]; ok {
+		return
+	}
+
+	state, ok := q.progress[key]
+	if ok && q.within > 0 && event.Timestamp-state.timestamps[0] > q.within {
+		delete(q.progress, key)
+		state, ok = nil, false
+	}
+	if !ok {
+		if !q.pattern[0].matches(event, decode) {
+			return
+		}
+		state = &patternState{step: 1, timestamps: []uint64{event.Timestamp}}
+		q.progress[key] = state
+	} else if q.pattern[state.step].matches(event, decode) {
+		state.step++
+		state.timestamps = append(state.timestamps, event.Timestamp)
+	} else {
+		return
+	}
+
+	if state.step == len(q.pattern) {
+		delete(q.progress, key)
+		q.matches[key] = &PatternMatch{Key: keyValue, Timestamps: state.timestamps}
+		q.order = append(q.order, key)
+	}
+}
+
+// Result returns the outcome of the query over the events observed so far.
+func (q *Query) Result() *QueryResult {
+	result := &QueryResult{Name: q.spec.Name}
+
+	switch {
+	case q.analyze != nil:
+		analysis, findings := q.findings()
+		result.Analysis = analysis
+		result.Count = int64(findings)
+		result.Value = float64(findings)
+	case q.pattern != nil:
+		result.Count = int64(len(q.matches))
+		result.Value = float64(result.Count)
+		for _, key := range q.order[:min(len(q.order), q.spec.Top)] {
+			result.Matches = append(result.Matches, *q.matches[key])
+		}
+	default:
+		result.Count = q.count
+		result.Value = float64(q.count)
+		if q.spec.Sum != "" {
+			result.Value = q.sum
+		}
+		groups := make([]QueryGroup, 0, len(q.groups))
+		for _, group := range q.groups {
+			groups = append(groups, *group)
+		}
+		sort.Slice(groups, func(i, j int) bool {
+			if groups[i].Sum != groups[j].Sum {
+				return groups[i].Sum > groups[j].Sum
+			}
+			if groups[i].Count != groups[j].Count {
+				return groups[i].Count > groups[j].Count
+			}
+			return fmt.Sprint(groups[i].Key) < fmt.Sprint(groups[j].Key)
+		})
+		if len(groups) > 0 {
+			result.Groups = groups[:min(len(groups), q.spec.Top)]
+		}
+	}
+
+	if q.spec.Min != nil || q.spec.Max != nil {
+		passed := true
+		if q.spec.Min != nil && result.Value < *q.spec.Min {
+			passed = false
+			result.Failure = fmt.Sprintf("value %g is below min %g", result.Value, *q.spec.Min)
+		}
+		if q.spec.Max != nil && result.Value > *q.spec.Max {
+			passed = false
+			result.Failure = fmt.Sprintf("value %g is above max %g", result.Value, *q.spec.Max)
+		}
+		result.Passed = &passed
+	}
+	return result
+}
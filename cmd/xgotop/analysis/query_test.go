@@ -0,0 +1,98 @@
+package analysis
+
+import (
+	"testing"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+func TestQuery(t *testing.T) {
+	events := []*storage.Event{
+		newObject(10, 1, 16),
+		newObject(20, 2, 2048),
+		newEvent(storage.EventTypeTimerCreate, 30, 1, 0xa),
+		newObject(40, 1, 4096),
+		newEvent(storage.EventTypeTimerCreate, 50, 2, 0xb),
+		newEvent(storage.EventTypeTimerStop, 60, 1, 0xa),
+		newObject(2000, 2, 32),
+	}
+	ptr := func(v float64) *float64 { return &v }
+	passed, failed := true, false
+	two := uint32(2)
+
+	tests := []struct {
+		name     string
+		spec     QuerySpec
+		expected QueryResult
+	}{
+		{
+			name:     "count",
+			spec:     QuerySpec{Filter: EventMatch{Events: Names{"newobject"}}},
+			expected: QueryResult{Value: 4, Count: 4},
+		},
+		{
+			name: "sum by goroutine",
+			spec: QuerySpec{
+				Filter:  EventMatch{Events: Names{"newobject"}, Where: map[string]any{"size": ">=1024"}},
+				GroupBy: Names{"goroutine"},
+				Sum:     "size",
+			},
+			expected: QueryResult{Value: 6144, Count: 2, Groups: []QueryGroup{
+				{Key: map[string]any{"goroutine": uint32(1)}, Count: 1, Sum: 4096},
+				{Key: map[string]any{"goroutine": uint32(2)}, Count: 1, Sum: 2048},
+			}},
+		},
+		{
+			name: "pattern within",
+			spec: QuerySpec{
+				Pattern: []EventMatch{{Events: Names{"newobject"}}, {Events: Names{"timercreate"}}, {Events: Names{"newobject"}}},
+				Within:  "1us",
+			},
+			// goroutine 2 allocates again too late
+			expected: QueryResult{Value: 1, Count: 1, Matches: []PatternMatch{{Key: uint32(1), Timestamps: []uint64{10, 30, 40}}}},
+		},
+		{
+			name:     "analysis check",
+			spec:     QuerySpec{Analysis: "timer-leaks", Max: ptr(0)},
+			expected: QueryResult{Value: 1, Count: 1, Analysis: []TimerLeak{{Goroutine: 2, Timers: 1, OldestTimestamp: 50}}, Passed: &failed, Failure: "value 1 is above max 0"},
+		},
+		{
+			name:     "min check",
+			spec:     QuerySpec{Filter: EventMatch{Goroutine: &two, From: 15}, Min: ptr(2)},
+			expected: QueryResult{Value: 3, Count: 3, Passed: &passed},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.spec.Name = tt.name
+			q, err := NewQuery(tt.spec, &storage.Session{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, event := range events {
+				var decoded *storage.DecodedEvent
+				q.Observe(event, func() *storage.DecodedEvent {
+					if decoded == nil {
+						decoded = storage.DecodeEvent(event, nil)
+					}
+					return decoded
+				})
+			}
+
+			tt.expected.Name = tt.name
+			checkEqual(t, "result", *q.Result(), tt.expected)
+		})
+	}
+
+	for _, spec := range []QuerySpec{
+		{Name: "unknown event", Filter: EventMatch{Events: Names{"nope"}}},
+		{Name: "unknown analysis", Analysis: "nope"},
+		{Name: "bad comparison", Filter: EventMatch{Where: map[string]any{"size": ">big"}}},
+		{Name: "pattern and sum", Pattern: []EventMatch{{}}, Sum: "size"},
+	} {
+		if _, err := NewQuery(spec, &storage.Session{}); err == nil {
+			t.Errorf("NewQuery(%s) succeeded", spec.Name)
+		}
+	}
+}
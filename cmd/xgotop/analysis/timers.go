@@ -0,0 +1,117 @@
+package analysis
+
+import (
+	"fmt"
+	"sort"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// TimerLeak summarizes the timers and tickers a goroutine created but never
+// stopped during the session.
+type TimerLeak struct {
+	Goroutine uint32 `json:"goroutine"`
+	Timers    int    `json:"timers"`
+	Tickers   int    `json:"tickers"`
+	// OldestTimestamp is the creation time of the oldest unstopped timer.
+	OldestTimestamp uint64 `json:"oldest_timestamp"`
+}
+
+type liveTimer struct {
+	goroutine uint32
+	period    uint64
+	createdAt uint64
+}
+
+// TimerLeakDetector tracks timer creation and stop events and reports the
+// timers that were never stopped.
+//
+// One-shot timers that fired and became unreachable are garbage collected by
+// the runtime even if they are never stopped, so tickers are the more
+// reliable leak signal.
+type TimerLeakDetector struct {
+	// live maps the address of a runtime timeTimer to the timer created
+	// there. Addresses are reused once a timer is collected, in which case
+	// the newer timer replaces the older one.
+	live map[uint64]liveTimer
+	// err is set if the timer events were sampled
+	err error
+}
+
+// NewTimerLeakDetector returns a detector of the timer leaks of a session
+// captured with sampling. The creation and stop of a timer are sampled
+// independently, so that a sampled timer may have been stopped unseen: leaks
+// are only detected in sessions whose timer events were all captured.
+func NewTimerLeakDetector(sampling *storage.SamplingManifest) *TimerLeakDetector {
+	d := &TimerLeakDetector{
+		live: make(map[uint64]liveTimer),
+	}
+	if sampling != nil {
+		for _, eventType := range []storage.EventType{storage.EventTypeTimerCreate, storage.EventTypeTimerStop} {
+			for _, period := range sampling.Rates[eventType.String()] {
+				if period.Percent < 100 {
+					d.err = fmt.Errorf("%s events were sampled at %d%%, so stopped timers would be reported as leaks", eventType, period.Percent)
+					break
+				}
+			}
+		}
+	}
+	return d
+}
+
+func (d *TimerLeakDetector) Observe(event *storage.Event) {
+	if d.err != nil {
+		return
+	}
+	switch event.EventType {
+	case storage.EventTypeTimerCreate:
+		d.live[event.Attributes[0]] = liveTimer{
+			goroutine: event.Goroutine,
+			period:    event.Attributes[1],
+			createdAt: event.Timestamp,
+		}
+	case storage.EventTypeTimerStop:
+		delete(d.live, event.Attributes[0])
+	}
+}
+
+// Leaks returns the unstopped timers grouped by creating goroutine, most
+// leaky goroutines first. It fails if the timer events were sampled.
+func (d *TimerLeakDetector) Leaks() ([]TimerLeak, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	byGoroutine := make(map[uint32]*TimerLeak)
+	for _, t := range d.live {
+		leak, ok := byGoroutine[t.goroutine]
+		if !ok {
+			leak = &TimerLeak{Goroutine: t.goroutine, OldestTimestamp: t.createdAt}
+			byGoroutine[t.goroutine] = leak
+		}
+
+		if t.period > 0 {
+			leak.Tickers++
+		} else {
+			leak.Timers++
+		}
+		leak.OldestTimestamp = min(leak.OldestTimestamp, t.createdAt)
+	}
+
+	leaks := make([]TimerLeak, 0, len(byGoroutine))
+	for _, leak := range byGoroutine {
+		leaks = append(leaks, *leak)
+	}
+
+	sort.Slice(leaks, func(i, j int) bool {
+		if leaks[i].Tickers != leaks[j].Tickers {
+			return leaks[i].Tickers > leaks[j].Tickers
+		}
+		if leaks[i].Timers != leaks[j].Timers {
+			return leaks[i].Timers > leaks[j].Timers
+		}
+		return leaks[i].Goroutine < leaks[j].Goroutine
+	})
+
+	return leaks, nil
+}
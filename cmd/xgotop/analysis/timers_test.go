@@ -0,0 +1,77 @@
+package analysis
+
+import (
+	"testing"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+func TestTimerLeakDetector(t *testing.T) {
+	create, stop := storage.EventTypeTimerCreate, storage.EventTypeTimerStop
+	events := []*storage.Event{
+		// goroutine 1 creates a ticker and a timer, stops the timer
+		newEvent(create, 10, 1, 0x1000, 100),
+		newEvent(create, 20, 1, 0x2000),
+		newEvent(stop, 30, 1, 0x2000),
+		// goroutine 2 creates two timers and stops none of them
+		newEvent(create, 40, 2, 0x3000),
+		newEvent(create, 50, 2, 0x4000),
+		// goroutine 3 stops its ticker from another goroutine
+		newEvent(create, 60, 3, 0x5000, 100),
+		newEvent(stop, 70, 4, 0x5000),
+		// the address of a collected timer is reused by goroutine 5
+		newEvent(create, 80, 5, 0x3000),
+		newObject(90, 6, 0),
+	}
+
+	detector := NewTimerLeakDetector(nil)
+	observe(events, detector)
+
+	leaks, err := detector.Leaks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(t, "leaks", leaks, []TimerLeak{
+		{Goroutine: 1, Tickers: 1, OldestTimestamp: 10},
+		{Goroutine: 2, Timers: 1, OldestTimestamp: 50},
+		{Goroutine: 5, Timers: 1, OldestTimestamp: 80},
+	})
+}
+
+func TestTimerLeakDetectorSampled(t *testing.T) {
+	tests := []struct {
+		name    string
+		rates   map[string][]storage.SamplingPeriod
+		wantErr bool
+	}{
+		{name: "unsampled"},
+		{
+			name:  "other types sampled",
+			rates: map[string][]storage.SamplingPeriod{"newobject": {{Percent: 10}}},
+		},
+		{
+			name:    "stops sampled",
+			rates:   map[string][]storage.SamplingPeriod{"timerstop": {{Percent: 50}}},
+			wantErr: true,
+		},
+		{
+			name:    "creations sampled later",
+			rates:   map[string][]storage.SamplingPeriod{"timercreate": {{Percent: 100, ToTimestamp: 10}, {Percent: 20, FromTimestamp: 10}}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detector := NewTimerLeakDetector(&storage.SamplingManifest{Rates: tt.rates})
+			detector.Observe(newEvent(storage.EventTypeTimerCreate, 10, 1, 0x1000))
+			leaks, err := detector.Leaks()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Leaks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && len(leaks) != 1 {
+				t.Errorf("got %d leaks, want 1", len(leaks))
+			}
+		})
+	}
+}
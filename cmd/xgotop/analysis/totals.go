@@ -0,0 +1,92 @@
+package analysis
+
+import "go.sazak.io/xgotop/cmd/xgotop/storage"
+
+// EventTotals are the events of a type recorded in a session, and their
+// estimated number had the session not been sampled.
+type EventTotals struct {
+	Events uint64 `json:"events"`
+	// Bytes is the memory allocated by the events of allocation types
+	Bytes uint64 `json:"bytes,omitempty"`
+	// EstimatedEvents and EstimatedBytes scale every event by the inverse of
+	// the sampling rate it was captured with. They equal Events and Bytes if
+	// no event of the type was sampled.
+	EstimatedEvents float64 `json:"estimated_events"`
+	EstimatedBytes  float64 `json:"estimated_bytes,omitempty"`
+	// Extrapolated is set if the estimates are extrapolated from sampled
+	// events.
+	Extrapolated bool `json:"extrapolated"`
+}
+
+// AllocatedBytes returns the memory allocated on the heap by event, and
+// whether event is an allocation with a known size.
+func AllocatedBytes(event *storage.Event) (uint64, bool) {
+	attrs := event.Attributes
+	switch event.EventType {
+	case storage.EventTypeMakeSlice:
+		return attrs[0] * attrs[3], true
+	case storage.EventTypeNewObject:
+		return attrs[0], true
+	case storage.EventTypeIfaceConv:
+		return attrs[1], true
+	case storage.EventTypeStringAlloc:
+		if attrs[3] != 0 {
+			// Strings on the stack do not allocate
+			return 0, true
+		}
+		return attrs[0], true
+	}
+	return 0, false
+}
+
+// TotalsCounter counts the events and allocated bytes of every event type,
+// and extrapolates them using the sampling manifest of the session.
+type TotalsCounter struct {
+	manifest *storage.SamplingManifest
+	totals   map[storage.EventType]*EventTotals
+}
+
+func NewTotalsCounter(manifest *storage.SamplingManifest) *TotalsCounter {
+	return &TotalsCounter{
+		manifest: manifest,
+		totals:   make(map[storage.EventType]*EventTotals),
+	}
+}
+
+func (c *TotalsCounter) Observe(event *storage.Event) {
+	totals, ok := c.totals[event.EventType]
+	if !ok {
+		totals = &EventTotals{}
+		c.totals[event.EventType] = totals
+	}
+
+	weight := c.manifest.Weight(event)
+	if weight != 1 {
+		totals.Extrapolated = true
+	}
+	totals.Events++
+	totals.EstimatedEvents += weight
+	if bytes, ok := AllocatedBytes(event); ok {
+		totals.Bytes += bytes
+		totals.EstimatedBytes += weight * float64(bytes)
+	}
+}
+
+// Totals returns the totals by event name.
+func (c *TotalsCounter) Totals() map[string]EventTotals {
+	totals := make(map[string]EventTotals, len(c.totals))
+	for eventType, t := range c.totals {
+		totals[eventType.String()] = *t
+	}
+	return totals
+}
+
+// Extrapolated reports whether any of the totals is extrapolated.
+func (c *TotalsCounter) Extrapolated() bool {
+	for _, t := range c.totals {
+		if t.Extrapolated {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package analysis
+
+import (
+	"testing"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+func TestTotalsCounter(t *testing.T) {
+	manifest := &storage.SamplingManifest{
+		Rates: map[string][]storage.SamplingPeriod{
+			// newobject was sampled at 10%, then at 50% from timestamp 100 on
+			"newobject": {
+				{Percent: 10, FromTimestamp: 0, ToTimestamp: 100},
+				{Percent: 50, FromTimestamp: 100},
+			},
+			// casgstatus events at 0% were in flight when the rate was set
+			"casgstatus": {{Percent: 0}},
+		},
+		// Goroutine 7 was flagged from timestamp 200 to 300
+		Flagged: map[uint32][]storage.FlagPeriod{7: {{FromTimestamp: 200, ToTimestamp: 300}}},
+	}
+	events := []*storage.Event{
+		newObject(10, 1, 16),
+		newObject(150, 1, 32),
+		// Captured while flagged, and sampled again after
+		newObject(250, 7, 64),
+		newObject(350, 7, 8),
+		newEvent(storage.EventTypeCasGStatus, 20, 0),
+		newEvent(storage.EventTypeMakeSlice, 30, 0, 8, 0, 4, 10),
+	}
+
+	counter := NewTotalsCounter(manifest)
+	observe(events, counter)
+
+	checkEqual(t, "totals", counter.Totals(), map[string]EventTotals{
+		"newobject":  {Events: 4, Bytes: 120, EstimatedEvents: 15, EstimatedBytes: 304, Extrapolated: true},
+		"casgstatus": {Events: 1, EstimatedEvents: 1},
+		"makeslice":  {Events: 1, Bytes: 80, EstimatedEvents: 1, EstimatedBytes: 80},
+	})
+	if !counter.Extrapolated() {
+		t.Error("expected the totals to be extrapolated")
+	}
+
+	unsampled := NewTotalsCounter(nil)
+	unsampled.Observe(newObject(10, 1, 16))
+	if unsampled.Extrapolated() {
+		t.Error("totals of an unsampled session are not extrapolated")
+	}
+}
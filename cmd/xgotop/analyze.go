@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.sazak.io/xgotop/cmd/xgotop/analysis"
+	"go.sazak.io/xgotop/cmd/xgotop/api"
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// subcommands maps the first command line argument to the function
+// implementing it. Without a subcommand, xgotop captures events.
+var subcommands = map[string]func(args []string){
+	"analyze":  runAnalyze,
+	"export":   runExport,
+	"import":   runImport,
+	"mark":     runMark,
+	"overhead": runOverhead,
+	"query":    runQuery,
+}
+
+// interruptContext returns a context cancelled on SIGINT or SIGTERM, so that
+// subcommands stop the storage work in progress and clean up after it.
+func interruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// runAnalyze prints the analysis report of a recorded session as JSON.
+func runAnalyze(args []string) {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	sessionID := fs.String("session", "", "ID of the session to analyze")
+	dir := fs.String("storage-dir", "./sessions", "Directory for storing session data")
+	flagAPI := fs.String("flag-api", "", "URL of the API of the xgotop capturing the same process, to flag the leak suspects so that their events bypass sampling")
+	fs.Parse(args)
+
+	if *sessionID == "" {
+		log.Fatal("-session must be provided")
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	manager, err := storage.NewManager(*dir)
+	must(err, "creating storage manager")
+
+	store, err := manager.OpenSession(ctx, *sessionID)
+	must(err, "opening session")
+	defer store.Close()
+
+	report, err := analysis.Analyze(ctx, store)
+	must(err, "analyzing session")
+
+	if *flagAPI != "" {
+		if report.TimerLeaksSkipped != "" {
+			log.Printf("Warning: no leak suspects to flag: %s", report.TimerLeaksSkipped)
+		}
+		suspects := make([]uint32, 0, len(report.TimerLeaks))
+		for _, leak := range report.TimerLeaks {
+			suspects = append(suspects, leak.Goroutine)
+		}
+		must(flagGoroutines(*flagAPI, suspects, "timer-leak"), "flagging leak suspects")
+		log.Printf("Flagged %d leak suspects", len(suspects))
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	must(encoder.Encode(report), "writing report")
+}
+
+// flagGoroutines flags goroutines through the API of a running xgotop.
+func flagGoroutines(apiURL string, goroutines []uint32, reason string) error {
+	if len(goroutines) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(&api.FlagRequest{Goroutines: goroutines, Reason: reason})
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(strings.TrimSuffix(apiURL, "/")+"/api/flagged", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		var msg bytes.Buffer
+		msg.ReadFrom(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(msg.String()))
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+const (
+	// anomalyWarmup is the number of stats intervals observed to establish
+	// the baselines before RPS collapses and QWL spikes are detected.
+	anomalyWarmup = 5
+	// anomalyBaselineWeight is the weight of the last interval in the moving
+	// average of the baselines.
+	anomalyBaselineWeight = 0.2
+
+	// rpsCollapseRatio is the fraction of the baseline read rate under which
+	// the read rate collapsed.
+	rpsCollapseRatio = 0.2
+	// rpsCollapseMinBaseline ignores collapses of captures that barely read
+	// any events to begin with.
+	rpsCollapseMinBaseline = 100
+
+	// qwlSpikeRatio is the multiple of the baseline queue wait latency above
+	// which the latency spiked.
+	qwlSpikeRatio = 5
+	// qwlSpikeMinNs ignores spikes of latencies that are too short to matter.
+	qwlSpikeMinNs = 100_000
+)
+
+// anomalyKinds are the kinds of the annotations of the anomalyDetector.
+var anomalyKinds = []storage.AnnotationKind{storage.AnnotationRPSCollapse, storage.AnnotationQWLSpike, storage.AnnotationDropBurst}
+
+// metricSample are the pipeline metrics of one stats interval.
+type metricSample struct {
+	rps   float64
+	qwl   float64
+	drops uint64
+}
+
+// openAnomaly is an anomaly that lasted up to the last observed interval.
+type openAnomaly struct {
+	annotation storage.Annotation
+	// worst is the value of the metric furthest from the baseline
+	worst    float64
+	baseline float64
+	drops    uint64
+}
+
+// anomalyDetector detects anomalies in the pipeline metrics of every stats
+// interval and records them as automatic annotations of the session. An
+// anomaly lasting several consecutive intervals is a single annotation. The
+// baselines are moving averages of the intervals without anomaly.
+type anomalyDetector struct {
+	interval time.Duration
+
+	mu          sync.Mutex
+	samples     int
+	rpsBaseline float64
+	qwlBaseline float64
+	open        map[storage.AnnotationKind]*openAnomaly
+	annotations []storage.Annotation
+}
+
+func newAnomalyDetector(interval time.Duration) *anomalyDetector {
+	return &anomalyDetector{
+		interval: interval,
+		open:     make(map[storage.AnnotationKind]*openAnomaly),
+	}
+}
+
+// observe checks the sample of the interval ending at now, whose monotonic
+// timestamp is ts, and returns the kinds of the anomalies going on.
+func (d *anomalyDetector) observe(now time.Time, ts uint64, sample metricSample) []storage.AnnotationKind {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.samples++
+	warm := d.samples > anomalyWarmup
+
+	rpsCollapsed := warm && d.rpsBaseline >= rpsCollapseMinBaseline && sample.rps < d.rpsBaseline*rpsCollapseRatio
+	qwlSpiked := warm && d.qwlBaseline > 0 && sample.qwl >= qwlSpikeMinNs && sample.qwl > d.qwlBaseline*qwlSpikeRatio
+
+	d.update(storage.AnnotationRPSCollapse, rpsCollapsed, now, ts, func(a *openAnomaly) {
+		a.worst = min(a.worst, sample.rps)
+		a.annotation.Detail = fmt.Sprintf("read rate fell to %.0f ev/s, baseline %.0f ev/s", a.worst, a.baseline)
+	}, sample.rps, d.rpsBaseline)
+	d.update(storage.AnnotationQWLSpike, qwlSpiked, now, ts, func(a *openAnomaly) {
+		a.worst = max(a.worst, sample.qwl)
+		a.annotation.Detail = fmt.Sprintf("queue wait latency rose to %.0f ns/event, baseline %.0f ns/event", a.worst, a.baseline)
+	}, sample.qwl, d.qwlBaseline)
+	d.update(storage.AnnotationDropBurst, sample.drops > 0, now, ts, func(a *openAnomaly) {
+		a.drops += sample.drops
+		a.annotation.Detail = fmt.Sprintf("%d events lost", a.drops)
+	}, 0, 0)
+
+	// Anomalies would drag the baselines along
+	if !rpsCollapsed {
+		d.rpsBaseline = movingAverage(d.rpsBaseline, sample.rps, d.samples)
+	}
+	if !qwlSpiked {
+		d.qwlBaseline = movingAverage(d.qwlBaseline, sample.qwl, d.samples)
+	}
+
+	var active []storage.AnnotationKind
+	for _, kind := range anomalyKinds {
+		if _, ok := d.open[kind]; ok {
+			active = append(active, kind)
+		}
+	}
+	return active
+}
+
+// update opens, extends or closes the anomaly of kind depending on whether
+// the last interval is anomalous. extend records the sample in the anomaly.
+func (d *anomalyDetector) update(kind storage.AnnotationKind, anomalous bool, now time.Time, ts uint64, extend func(*openAnomaly), value, baseline float64) {
+	a, ok := d.open[kind]
+	if !anomalous {
+		if ok {
+			d.annotations = append(d.annotations, a.annotation)
+			delete(d.open, kind)
+		}
+		return
+	}
+
+	if !ok {
+		a = &openAnomaly{
+			annotation: storage.Annotation{
+				Kind:           kind,
+				StartTimestamp: ts - uint64(min(d.interval.Nanoseconds(), int64(ts))),
+				Start:          now.Add(-d.interval),
+				Automatic:      true,
+			},
+			worst:    value,
+			baseline: baseline,
+		}
+		d.open[kind] = a
+	}
+	a.annotation.EndTimestamp = ts
+	a.annotation.End = now
+	extend(a)
+	if !ok {
+		log.Printf("[Anomaly] %s: %s", kind, a.annotation.Detail)
+	}
+}
+
+// finish closes the anomalies going on and returns all annotations, ordered
+// by their end.
+func (d *anomalyDetector) finish() []storage.Annotation {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, kind := range anomalyKinds {
+		if a, ok := d.open[kind]; ok {
+			d.annotations = append(d.annotations, a.annotation)
+			delete(d.open, kind)
+		}
+	}
+	return append([]storage.Annotation(nil), d.annotations...)
+}
+
+// movingAverage adds value to the exponential moving average avg of n
+// values, which is a plain average during the warmup.
+func movingAverage(avg, value float64, n int) float64 {
+	if n <= anomalyWarmup {
+		return avg + (value-avg)/float64(n)
+	}
+	return avg + anomalyBaselineWeight*(value-avg)
+}
@@ -0,0 +1,321 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.sazak.io/xgotop/cmd/xgotop/analysis"
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// getTimers reports the timers and tickers created but never stopped during
+// the session, grouped by goroutine.
+func (s *Server) getTimers(w http.ResponseWriter, r *http.Request, sessionID string) {
+	store, err := s.manager.OpenSession(r.Context(), sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer store.Close()
+
+	detector := analysis.NewTimerLeakDetector(store.GetSession().Sampling)
+	err = store.ScanEvents(r.Context(), 0, func(_ int64, event *storage.Event) error {
+		detector.Observe(event)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	leaks, err := detector.Leaks()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(leaks)
+}
+
+// getMarkers reports the latencies between the Begin and End markers of the
+// session, grouped by marker ID.
+func (s *Server) getMarkers(w http.ResponseWriter, r *http.Request, sessionID string) {
+	store, err := s.manager.OpenSession(r.Context(), sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer store.Close()
+
+	tracker := analysis.NewMarkerLatencyTracker()
+	err = store.ScanEvents(r.Context(), 0, func(_ int64, event *storage.Event) error {
+		tracker.Observe(event)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tracker.Latencies())
+}
+
+// defaultTopLimit is the number of goroutines listed by the top endpoint
+// unless the limit parameter is given.
+const defaultTopLimit = 10
+
+// TopGoroutines ranks the goroutines of a session by their scheduling
+// behavior.
+type TopGoroutines struct {
+	// Migrations lists the goroutines that changed P most often. It is only
+	// populated for sessions recorded with -event-detail full.
+	Migrations []analysis.GoroutineMigrations `json:"migrations"`
+}
+
+// getTop reports the goroutines ranking highest in the session, e.g. the most
+// migrated ones.
+func (s *Server) getTop(w http.ResponseWriter, r *http.Request, sessionID string) {
+	limit := defaultTopLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	store, err := s.manager.OpenSession(r.Context(), sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer store.Close()
+
+	migrations := analysis.NewMigrationCounter()
+	err = store.ScanEvents(r.Context(), 0, func(_ int64, event *storage.Event) error {
+		migrations.Observe(event)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TopGoroutines{Migrations: migrations.Migrations(limit)})
+}
+
+const (
+	// defaultLaneLimit is the number of goroutine lanes unless the limit
+	// parameter is given.
+	defaultLaneLimit = 100
+	// maxLaneLimit caps the limit parameter, so lanes stay bounded in size.
+	maxLaneLimit = 1000
+	// defaultLaneBuckets is the number of activity buckets of every lane
+	// unless the buckets parameter is given.
+	defaultLaneBuckets = 200
+	// maxLaneBuckets caps the buckets parameter.
+	maxLaneBuckets = 2000
+)
+
+// getLanes reports the timeline of the session as the lanes of the limit
+// most active goroutines, and aggregates all other goroutines into one other
+// lane, so the response is bounded in size however many goroutines the
+// session has. The start_time and end_time parameters restrict the timeline
+// to a time range.
+func (s *Server) getLanes(w http.ResponseWriter, r *http.Request, sessionID string) {
+	limit, err := queryInt(r, "limit", defaultLaneLimit, maxLaneLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	buckets, err := queryInt(r, "buckets", defaultLaneBuckets, maxLaneBuckets)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter := parseEventFilter(r)
+	inRange := func(event *storage.Event) bool {
+		return (filter.StartTime == nil || event.Timestamp >= *filter.StartTime) &&
+			(filter.EndTime == nil || event.Timestamp <= *filter.EndTime)
+	}
+
+	store, err := s.manager.OpenSession(r.Context(), sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer store.Close()
+
+	// The first scan finds the most active goroutines, the second one builds
+	// their lanes, so only the lanes are held in memory
+	counter := analysis.NewLaneCounter()
+	err = store.ScanEvents(r.Context(), 0, func(_ int64, event *storage.Event) error {
+		if inRange(event) {
+			counter.Observe(event)
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	start, end := counter.Range()
+	builder := analysis.NewLaneBuilder(counter.Top(limit), start, end, buckets)
+	err = store.ScanEvents(r.Context(), 0, func(_ int64, event *storage.Event) error {
+		builder.Observe(event)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(builder.Lanes())
+}
+
+// getBlockProfile serves the time the goroutines of the session spent
+// parked as a pprof block profile, aggregated by creation stack, e.g. for
+// go tool pprof -diff_base.
+func (s *Server) getBlockProfile(w http.ResponseWriter, r *http.Request, sessionID string) {
+	store, err := s.manager.OpenSession(r.Context(), sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer store.Close()
+
+	profiler := analysis.NewBlockProfiler(store.GetSession())
+	err = store.ScanEvents(r.Context(), 0, func(_ int64, event *storage.Event) error {
+		profiler.Observe(event)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+sessionID+"-block.pb.gz\"")
+	if err := profiler.WriteProfile(w); err != nil {
+		log.Printf("Block profile of session %s failed: %v", sessionID, err)
+	}
+}
+
+// AliveGoroutines are the goroutines alive at a point in time of a session.
+type AliveGoroutines struct {
+	// At is the timestamp on the clock of the event timestamps
+	At uint64 `json:"at"`
+	// Count is the number of goroutines alive, and States counts them by
+	// state, even if Goroutines is cut off by the limit parameter
+	Count      int                       `json:"count"`
+	States     map[string]int            `json:"states"`
+	Goroutines []analysis.AliveGoroutine `json:"goroutines"`
+}
+
+// getAlive reports the goroutines alive at the time of the at parameter,
+// either an event timestamp or an RFC 3339 time for sessions with clock
+// metadata, with their states at that moment. Creations and exits are taken
+// from the lifecycle log if the session has one, so that they are complete
+// even if the lifecycle events were sampled. The state parameter only lists
+// the goroutines in a state, and limit caps the number of goroutines listed.
+func (s *Server) getAlive(w http.ResponseWriter, r *http.Request, sessionID string) {
+	limit, err := queryInt(r, "limit", math.MaxInt, math.MaxInt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	store, err := s.manager.OpenSession(r.Context(), sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer store.Close()
+
+	session := store.GetSession()
+	at, err := parseTimestamp(r.URL.Query().Get("at"), session)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	alive := analysis.NewAliveSet(session, at)
+	lifecycle, err := s.manager.ReadLifecycle(r.Context(), sessionID, nil)
+	if err != nil && !errors.Is(err, storage.ErrNoLifecycleLog) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, event := range lifecycle {
+		alive.Observe(event)
+	}
+	err = store.ScanEvents(r.Context(), 0, func(_ int64, event *storage.Event) error {
+		alive.Observe(event)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := AliveGoroutines{At: at, States: make(map[string]int), Goroutines: make([]analysis.AliveGoroutine, 0)}
+	state := r.URL.Query().Get("state")
+	for _, goroutine := range alive.Goroutines() {
+		result.Count++
+		result.States[goroutine.State]++
+		if (state == "" || goroutine.State == state) && len(result.Goroutines) < limit {
+			result.Goroutines = append(result.Goroutines, goroutine)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// parseTimestamp parses value as an event timestamp, or as an RFC 3339 time
+// converted to the clock of the event timestamps of session.
+func parseTimestamp(value string, session *storage.Session) (uint64, error) {
+	if value == "" {
+		return 0, errors.New("at must be provided")
+	}
+	if ts, err := strconv.ParseUint(value, 10, 64); err == nil {
+		return ts, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: not a timestamp or RFC 3339 time", value)
+	}
+	if session.Clock == nil {
+		return 0, errors.New("session has no clock metadata, the time must be a timestamp")
+	}
+	ts := t.UnixNano() - session.Clock.Start.OffsetNs
+	if ts < 0 {
+		return 0, fmt.Errorf("time %s is before the clock of the session started", value)
+	}
+	return uint64(ts), nil
+}
+
+// queryInt parses the positive integer query parameter name, which defaults
+// to def and is capped at maxValue.
+func queryInt(r *http.Request, name string, def, maxValue int) (int, error) {
+	str := r.URL.Query().Get(name)
+	if str == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(str)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s", name)
+	}
+	return min(n, maxValue), nil
+}
@@ -0,0 +1,237 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+const (
+	// backfillChunkSize is the number of events sent per backfill message.
+	backfillChunkSize = 1000
+
+	// maxBackfillEvents caps the number of events a single client can
+	// request as backfill.
+	maxBackfillEvents = 100_000
+)
+
+// handleWs serves the live event WebSocket. Clients can pass either
+// backfill_events=M or backfill_seconds=N to receive the last M events or the
+// last N seconds of the live session before switching to live broadcasts.
+func (s *Server) handleWs(w http.ResponseWriter, r *http.Request) {
+	req, err := parseBackfill(r)
+	if err != nil {
+		log.Printf("WebSocket backfill error: %v", err)
+		req = backfillRequest{}
+	}
+
+	ServeWs(s.hub, w, r, func(client *Client) {
+		if err := s.subscribe(r.Context(), client, req); err != nil {
+			log.Printf("WebSocket backfill error: %v", err)
+		}
+	})
+}
+
+// backfillRequest is the backfill a live feed client asked for, the last
+// lastEvents events or the events of the last window.
+type backfillRequest struct {
+	lastEvents int
+	window     time.Duration
+}
+
+func parseBackfill(r *http.Request) (backfillRequest, error) {
+	var req backfillRequest
+
+	if eventsStr := r.URL.Query().Get("backfill_events"); eventsStr != "" {
+		n, err := strconv.Atoi(eventsStr)
+		if err != nil || n < 0 {
+			return backfillRequest{}, fmt.Errorf("invalid backfill_events: %q", eventsStr)
+		}
+		req.lastEvents = min(n, maxBackfillEvents)
+	}
+
+	if secondsStr := r.URL.Query().Get("backfill_seconds"); secondsStr != "" {
+		secs, err := strconv.ParseFloat(secondsStr, 64)
+		if err != nil || secs < 0 {
+			return backfillRequest{}, fmt.Errorf("invalid backfill_seconds: %q", secondsStr)
+		}
+		req.window = time.Duration(secs * float64(time.Second))
+	}
+
+	return req, nil
+}
+
+// subscribe registers client with the hub and queues the backfill req asks
+// for ahead of the live messages. The client is registered before the
+// backfill is read and holds the live messages until the backfill is queued,
+// so that the events written in between are neither lost nor sent twice.
+func (s *Server) subscribe(ctx context.Context, client *Client, req backfillRequest) error {
+	if req.lastEvents == 0 && req.window == 0 {
+		s.hub.register <- client
+		return nil
+	}
+
+	client.holding = true
+	s.hub.register <- client
+
+	events, err := s.backfillEvents(ctx, req)
+	if err != nil {
+		client.release(nil, nil)
+		return err
+	}
+
+	messages := make([][]byte, 0, (len(events)+backfillChunkSize-1)/backfillChunkSize)
+	for start := 0; start < len(events); start += backfillChunkSize {
+		end := min(start+backfillChunkSize, len(events))
+		data, err := marshalBatch(events[start:end], true)
+		if err != nil {
+			client.release(nil, nil)
+			return fmt.Errorf("marshal backfill batch: %w", err)
+		}
+		messages = append(messages, data)
+	}
+
+	client.release(messages, events)
+	return nil
+}
+
+// backfillEvents reads the events req asks for from the live session.
+func (s *Server) backfillEvents(ctx context.Context, req backfillRequest) ([]*storage.Event, error) {
+	sessionID := s.getLiveSessionID()
+	if sessionID == "" {
+		return nil, nil
+	}
+
+	store, err := s.manager.OpenSession(ctx, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("open live session: %w", err)
+	}
+	defer store.Close()
+
+	events, err := tailEvents(ctx, store, req.lastEvents, req.window)
+	if err != nil {
+		return nil, fmt.Errorf("read live session: %w", err)
+	}
+	return events, nil
+}
+
+// marshalBatch returns the live feed message of a batch of events.
+func marshalBatch(events []*storage.Event, backfill bool) ([]byte, error) {
+	message := map[string]interface{}{
+		"type":   "batch",
+		"events": events,
+	}
+	if backfill {
+		message["backfill"] = true
+	}
+	return json.Marshal(message)
+}
+
+// eventKey identifies an event, so that the events of a backfill are not
+// sent again by the live messages.
+type eventKey struct {
+	timestamp  uint64
+	eventType  storage.EventType
+	goroutine  uint32
+	attributes [5]uint64
+}
+
+func keyOf(event *storage.Event) eventKey {
+	return eventKey{event.Timestamp, event.EventType, event.Goroutine, event.Attributes}
+}
+
+// tailEvents returns the last events of store, at most lastEvents of them if
+// set, and only those of the last window if set, but never more than
+// maxBackfillEvents. The events are scanned with a bounded buffer. If the
+// session has clock metadata, the window starts before now, and the scan
+// skips the events before it; otherwise it ends at the last event.
+//
+// The scan starts before the end of the store, at the event count of its
+// session, and reaches back further, doubling the number of events read,
+// until it has enough events, passed the start of the window or reached the
+// start of the store, so that a backfill only reads the tail of the session.
+func tailEvents(ctx context.Context, store storage.EventStore, lastEvents int, window time.Duration) ([]*storage.Event, error) {
+	limit := maxBackfillEvents
+	if lastEvents > 0 {
+		limit = min(lastEvents, maxBackfillEvents)
+	}
+
+	session := store.GetSession()
+	var cutoff uint64
+	if clock := session.Clock; window > 0 && clock != nil {
+		if start := time.Now().UnixNano() - clock.Start.OffsetNs - window.Nanoseconds(); start > 0 {
+			cutoff = uint64(start)
+		}
+	}
+
+	count := session.EventCount
+	span := int64(limit)
+	if window > 0 {
+		span = min(span, backfillChunkSize)
+	}
+	for {
+		from := max(count-span, 0)
+
+		// ring holds the last limit events scanned, next is where the next
+		// one goes once it is full. before is set once an event before the
+		// window was scanned.
+		ring := make([]*storage.Event, 0, min(limit, backfillChunkSize))
+		next := 0
+		var latest uint64
+		last, before := int64(-1), false
+		err := store.ScanEvents(ctx, from, func(cursor int64, event *storage.Event) error {
+			last = cursor
+			if event.Timestamp < cutoff {
+				before = true
+				return nil
+			}
+			latest = max(latest, event.Timestamp)
+			if len(ring) < limit {
+				ring = append(ring, event)
+				return nil
+			}
+			ring[next] = event
+			next = (next + 1) % limit
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		events := slices.Concat(ring[next:], ring[:next])
+
+		// Events are written by several workers, so the file is only roughly
+		// ordered by time.
+		sort.Slice(events, func(i, j int) bool {
+			return events[i].Timestamp < events[j].Timestamp
+		})
+
+		if window > 0 && cutoff == 0 && latest > uint64(window) {
+			start := sort.Search(len(events), func(i int) bool {
+				return events[i].Timestamp >= latest-uint64(window)
+			})
+			before = before || start > 0
+			events = events[start:]
+		}
+
+		switch {
+		case from == 0:
+			return events, nil
+		case last < count-1:
+			// The cursors end before the event count, e.g. as a memory store
+			// overwrote its oldest events, so only a full scan finds the tail.
+			span = count
+		case len(events) >= limit || before:
+			return events, nil
+		default:
+			span *= 2
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// scanRecorder records the cursor the scans of a store start from.
+type scanRecorder struct {
+	storage.EventStore
+	from []int64
+}
+
+func (s *scanRecorder) ScanEvents(ctx context.Context, fromCursor int64, fn storage.ScanFunc) error {
+	s.from = append(s.from, fromCursor)
+	return s.EventStore.ScanEvents(ctx, fromCursor, fn)
+}
+
+func TestTailEvents(t *testing.T) {
+	newStore := func(capacity int) storage.EventStore {
+		store := storage.NewMemoryStore(&storage.Session{ID: "live"}, capacity)
+		for i := range 5000 {
+			store.WriteEvent(&storage.Event{Timestamp: uint64(i+1) * uint64(time.Millisecond), EventType: storage.EventTypeNewObject})
+		}
+		return store
+	}
+
+	tests := []struct {
+		name       string
+		capacity   int
+		lastEvents int
+		window     time.Duration
+		first      uint64
+		count      int
+		from       []int64
+	}{
+		{
+			name:       "last events",
+			capacity:   5000,
+			lastEvents: 10,
+			first:      4991,
+			count:      10,
+			from:       []int64{4990},
+		},
+		{
+			name:     "window",
+			capacity: 5000,
+			window:   1500 * time.Millisecond,
+			first:    3500,
+			count:    1501,
+			from:     []int64{4000, 3000},
+		},
+		{
+			name:       "overwritten events",
+			capacity:   100,
+			lastEvents: 10,
+			first:      4991,
+			count:      10,
+			from:       []int64{4990, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &scanRecorder{EventStore: newStore(tt.capacity)}
+			events, err := tailEvents(context.Background(), store, tt.lastEvents, tt.window)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != tt.count {
+				t.Fatalf("got %d events, want %d", len(events), tt.count)
+			}
+			if first := events[0].Timestamp / uint64(time.Millisecond); first != tt.first {
+				t.Errorf("first event = %d, want %d", first, tt.first)
+			}
+			if !reflect.DeepEqual(store.from, tt.from) {
+				t.Errorf("scans from %v, want %v", store.from, tt.from)
+			}
+		})
+	}
+}
+
+func TestClientRelease(t *testing.T) {
+	event := func(ts uint64) *storage.Event {
+		return &storage.Event{Timestamp: ts, EventType: storage.EventTypeNewObject, Goroutine: 1}
+	}
+	batch := func(events ...*storage.Event) hubMessage {
+		data, _ := marshalBatch(events, false)
+		return hubMessage{data: data, events: events}
+	}
+
+	client := newClient(NewHub(), nil)
+	client.holding = true
+	// The first batch was written before the backfill was read, the second
+	// one partly, the third one after
+	for _, message := range []hubMessage{batch(event(3), event(4)), batch(event(5), event(6)), batch(event(7))} {
+		if !client.deliver(message) {
+			t.Fatal("client dropped while holding")
+		}
+	}
+	if len(client.send) != 0 {
+		t.Fatalf("%d messages sent while holding", len(client.send))
+	}
+
+	backfill := []*storage.Event{event(1), event(2), event(3), event(4), event(5)}
+	data, _ := marshalBatch(backfill, true)
+	client.release([][]byte{data}, backfill)
+
+	var got []uint64
+	for len(client.send) > 0 {
+		var message struct {
+			Events []*storage.Event `json:"events"`
+		}
+		if err := json.Unmarshal(<-client.send, &message); err != nil {
+			t.Fatal(err)
+		}
+		for _, event := range message.Events {
+			got = append(got, event.Timestamp)
+		}
+	}
+	if want := []uint64{1, 2, 3, 4, 5, 6, 7}; !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+
+	if !client.deliver(batch(event(8))) || len(client.send) != 1 {
+		t.Errorf("live message not sent after release")
+	}
+}
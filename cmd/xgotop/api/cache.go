@@ -0,0 +1,112 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// cachedSubPaths are the session endpoints whose responses only depend on
+// the events of the session. They carry an ETag and honor conditional
+// requests, so polling clients do not download unchanged data again.
+var cachedSubPaths = map[string]bool{
+	"/events":        true,
+	"/events.ndjson": true,
+	"/events.arrow":  true,
+	"/goroutines":    true,
+	"/stats":         true,
+	"/timers":        true,
+	"/markers":       true,
+	"/top":           true,
+	"/lanes":         true,
+	"/alive":         true,
+	"/pprof/block":   true,
+}
+
+// SetLiveEventCounter makes the server count the events of the live session
+// with count, since its metadata is only updated when the capture ends.
+func (s *Server) SetLiveEventCounter(count func() int64) {
+	s.liveMu.Lock()
+	s.liveEventCount = count
+	s.liveMu.Unlock()
+}
+
+// sessionVersion returns the number of events of the session, and when it
+// ended, which is nil while the session is being captured or received.
+func (s *Server) sessionVersion(ctx context.Context, sessionID string) (int64, *time.Time, error) {
+	session, err := s.manager.GetSession(ctx, sessionID)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	s.liveMu.RLock()
+	live := sessionID == s.liveSessionID
+	count := s.liveEventCount
+	s.liveMu.RUnlock()
+	if live && count != nil {
+		return count(), nil, nil
+	}
+
+	s.ingestMu.RLock()
+	is := s.ingestSessions[sessionID]
+	s.ingestMu.RUnlock()
+	if is != nil {
+		is.mu.Lock()
+		defer is.mu.Unlock()
+		return is.store.GetSession().EventCount, nil, nil
+	}
+
+	return session.EventCount, session.EndTime, nil
+}
+
+// notModified sets the validators of the events of the session on the
+// response, and replies 304 Not Modified if the client's copy is still
+// current. The ETag changes with every event written to the session and
+// when it ends. Last-Modified is only known once the session ended.
+func (s *Server) notModified(w http.ResponseWriter, r *http.Request, sessionID string) bool {
+	count, end, err := s.sessionVersion(r.Context(), sessionID)
+	if err != nil {
+		// The handler reports the missing session
+		return false
+	}
+
+	var endNanos int64
+	if end != nil {
+		endNanos = end.UnixNano()
+		w.Header().Set("Last-Modified", end.UTC().Format(http.TimeFormat))
+	}
+	etag := fmt.Sprintf(`"%d-%d"`, count, endNanos)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	// If-None-Match takes precedence over If-Modified-Since
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if !etagMatches(match, etag) {
+			return false
+		}
+	} else if since := r.Header.Get("If-Modified-Since"); since != "" && end != nil {
+		t, err := http.ParseTime(since)
+		if err != nil || end.Truncate(time.Second).After(t) {
+			return false
+		}
+	} else {
+		return false
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches reports whether the If-None-Match header value match lists
+// etag, using the weak comparison.
+func etagMatches(match, etag string) bool {
+	for _, candidate := range strings.Split(match, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
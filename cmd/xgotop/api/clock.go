@@ -0,0 +1,49 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// ClockReport is the clock metadata of a session with the values needed to
+// align its events with sessions captured on other hosts.
+type ClockReport struct {
+	*storage.ClockSync
+	// OffsetNs converts the event timestamps to Unix time in nanoseconds:
+	// unix ns = timestamp + OffsetNs.
+	OffsetNs int64 `json:"offset_ns"`
+	DriftNs  int64 `json:"drift_ns"`
+	// ErrorBoundNs bounds the error of the converted timestamps, or is -1 if
+	// the wall clock of the host was not synchronized.
+	ErrorBoundNs int64 `json:"error_bound_ns"`
+}
+
+// getClock reports how the event timestamps of a session map to wall clock
+// time.
+func (s *Server) getClock(w http.ResponseWriter, r *http.Request, sessionID string) {
+	session, err := s.manager.GetSession(r.Context(), sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if session.Clock == nil {
+		http.Error(w, "session has no clock metadata", http.StatusNotFound)
+		return
+	}
+	mode, salt, err := parseSanitize(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	session = storage.SanitizeSession(session, mode, salt)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ClockReport{
+		ClockSync:    session.Clock,
+		OffsetNs:     session.Clock.Start.OffsetNs,
+		DriftNs:      session.Clock.DriftNs(),
+		ErrorBoundNs: session.Clock.ErrorBoundNs(),
+	})
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// ndjsonFlushEvery is the number of lines written between explicit flushes
+// of the ND-JSON export stream.
+const ndjsonFlushEvery = 1000
+
+// cursorEvent is a single line of the ND-JSON export. The cursor can be passed
+// back as from_cursor to resume an interrupted export after this event.
+type cursorEvent struct {
+	Cursor int64 `json:"cursor"`
+	*storage.Event
+}
+
+// exportNDJSON streams the whole session, optionally filtered, as
+// newline-delimited JSON. Passing from_cursor=N resumes the export at the
+// event with cursor N, decoded=true decodes the attributes into named
+// fields, and fields selects the fields of the lines like for getEvents.
+func (s *Server) exportNDJSON(w http.ResponseWriter, r *http.Request, sessionID string) {
+	store, err := s.manager.OpenSession(r.Context(), sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer store.Close()
+
+	filter := parseEventFilter(r)
+
+	var fromCursor int64
+	if cursorStr := r.URL.Query().Get("from_cursor"); cursorStr != "" {
+		fromCursor, err = strconv.ParseInt(cursorStr, 10, 64)
+		if err != nil || fromCursor < 0 {
+			http.Error(w, "invalid from_cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Decoded lines carry named fields per event type instead of the raw
+	// attributes
+	decoded := r.URL.Query().Get("decoded") == "true"
+	fields, err := parseFields(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if decoded && fields != nil {
+		http.Error(w, "decoded and fields cannot be combined", http.StatusBadRequest)
+		return
+	}
+	session := store.GetSession()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+sessionID+".ndjson\"")
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	written := 0
+
+	err = store.ScanEvents(r.Context(), fromCursor, func(cursor int64, event *storage.Event) error {
+		if !filter.Matches(event) {
+			return nil
+		}
+
+		var line any = cursorEvent{Cursor: cursor, Event: event}
+		if fields != nil {
+			line = partialEvent{event: event, fields: fields, cursor: &cursor}
+		} else if decoded {
+			d := storage.DecodeEvent(event, session)
+			d.Fields = append([]storage.DecodedField{{Name: "cursor", Value: cursor}}, d.Fields...)
+			line = d
+		}
+		if err := encoder.Encode(line); err != nil {
+			return err
+		}
+
+		written++
+		if filter.Limit > 0 && written >= filter.Limit {
+			return storage.ErrStopScan
+		}
+		if flusher != nil && written%ndjsonFlushEvery == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		// Headers are already sent, so the error can only be logged. Clients
+		// detect the truncated stream and resume from the last cursor.
+		log.Printf("ND-JSON export of session %s failed: %v", sessionID, err)
+	}
+}
+
+// parseSanitize returns the mode of the sanitize query parameter, see
+// storage.SanitizeSession, and the salt of the hash_salt parameter.
+func parseSanitize(r *http.Request) (storage.SanitizeMode, string, error) {
+	mode, err := storage.ParseSanitizeMode(r.URL.Query().Get("sanitize"))
+	if err != nil {
+		return "", "", err
+	}
+	salt := r.URL.Query().Get("hash_salt")
+	if salt != "" && mode != storage.SanitizeHash {
+		return "", "", errors.New("hash_salt requires sanitize=hash")
+	}
+	return mode, salt, nil
+}
+
+// exportArrow streams the whole session, optionally filtered, as an Apache
+// Arrow IPC (Feather V2) file, with the session metadata sanitized as given
+// by the sanitize parameter. Filtering by event_type exports a single event
+// type.
+func (s *Server) exportArrow(w http.ResponseWriter, r *http.Request, sessionID string) {
+	store, err := s.manager.OpenSession(r.Context(), sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer store.Close()
+
+	filter := parseEventFilter(r)
+	mode, salt, err := parseSanitize(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apache.arrow.file")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+sessionID+".arrow\"")
+
+	arrow, err := storage.NewArrowWriter(w, storage.SanitizeSession(store.GetSession(), mode, salt))
+	if err != nil {
+		log.Printf("Arrow export of session %s failed: %v", sessionID, err)
+		return
+	}
+
+	written := 0
+	err = store.ScanEvents(r.Context(), 0, func(cursor int64, event *storage.Event) error {
+		if !filter.Matches(event) {
+			return nil
+		}
+
+		if err := arrow.Write(event); err != nil {
+			return err
+		}
+
+		written++
+		if filter.Limit > 0 && written >= filter.Limit {
+			return storage.ErrStopScan
+		}
+		return nil
+	})
+	if err == nil {
+		err = arrow.Close()
+	}
+	if err != nil {
+		// Headers are already sent, the file lacks its footer and is rejected
+		// by Arrow readers.
+		log.Printf("Arrow export of session %s failed: %v", sessionID, err)
+	}
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// eventFields append the JSON value of every event field that can be
+// selected with the fields query parameter, by its JSON name.
+var eventFields = map[string]func(buf []byte, event *storage.Event) []byte{
+	"timestamp": func(buf []byte, event *storage.Event) []byte {
+		return strconv.AppendUint(buf, event.Timestamp, 10)
+	},
+	"event_type": func(buf []byte, event *storage.Event) []byte {
+		return strconv.AppendUint(buf, uint64(event.EventType), 10)
+	},
+	"goroutine": func(buf []byte, event *storage.Event) []byte {
+		return strconv.AppendUint(buf, uint64(event.Goroutine), 10)
+	},
+	"parent_goroutine": func(buf []byte, event *storage.Event) []byte {
+		return strconv.AppendUint(buf, uint64(event.ParentGoroutine), 10)
+	},
+	"attributes": func(buf []byte, event *storage.Event) []byte {
+		buf = append(buf, '[')
+		for i, attr := range event.Attributes {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = strconv.AppendUint(buf, attr, 10)
+		}
+		return append(buf, ']')
+	},
+	"thread": func(buf []byte, event *storage.Event) []byte {
+		return strconv.AppendUint(buf, uint64(event.Thread), 10)
+	},
+	"p": func(buf []byte, event *storage.Event) []byte {
+		if event.P == nil {
+			return append(buf, "null"...)
+		}
+		return strconv.AppendUint(buf, uint64(*event.P), 10)
+	},
+}
+
+// parseFields returns the event fields selected by the comma separated
+// fields query parameter, or nil if all fields are returned.
+func parseFields(r *http.Request) ([]string, error) {
+	fieldsStr := r.URL.Query().Get("fields")
+	if fieldsStr == "" {
+		return nil, nil
+	}
+
+	var fields []string
+	seen := make(map[string]bool)
+	for _, field := range strings.Split(fieldsStr, ",") {
+		field = strings.TrimSpace(field)
+		if _, ok := eventFields[field]; !ok {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+		if !seen[field] {
+			seen[field] = true
+			fields = append(fields, field)
+		}
+	}
+	return fields, nil
+}
+
+// partialEvent encodes the selected fields of an event, in the order they
+// were selected.
+type partialEvent struct {
+	event  *storage.Event
+	fields []string
+	// cursor is prepended to the fields of ND-JSON export lines
+	cursor *int64
+}
+
+func (e partialEvent) MarshalJSON() ([]byte, error) {
+	buf := make([]byte, 0, 16+24*len(e.fields))
+	buf = append(buf, '{')
+	if e.cursor != nil {
+		buf = append(buf, `"cursor":`...)
+		buf = strconv.AppendInt(buf, *e.cursor, 10)
+	}
+	for i, field := range e.fields {
+		if i > 0 || e.cursor != nil {
+			buf = append(buf, ',')
+		}
+		buf = strconv.AppendQuote(buf, field)
+		buf = append(buf, ':')
+		buf = eventFields[field](buf, e.event)
+	}
+	return append(buf, '}'), nil
+}
+
+// selectFields returns the events reduced to fields, or the events
+// themselves if fields is nil.
+func selectFields(events []*storage.Event, fields []string) any {
+	if fields == nil {
+		return events
+	}
+	partial := make([]partialEvent, len(events))
+	for i, event := range events {
+		partial[i] = partialEvent{event: event, fields: fields}
+	}
+	return partial
+}
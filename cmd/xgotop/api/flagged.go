@@ -0,0 +1,85 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// FlaggedGoroutine is a goroutine whose events are captured without
+// sampling.
+type FlaggedGoroutine struct {
+	Goroutine uint32 `json:"goroutine"`
+	Reason    string `json:"reason"`
+}
+
+// FlagRequest is the body of POST /api/flagged.
+type FlagRequest struct {
+	Goroutines []uint32 `json:"goroutines"`
+	// Reason is recorded with the flagged goroutines, e.g. "timer-leak"
+	Reason string `json:"reason"`
+}
+
+// GoroutineFlagger flags goroutines of the live capture so that their events
+// bypass sampling.
+type GoroutineFlagger interface {
+	Flag(gid uint32, reason string) error
+	Unflag(gid uint32) error
+	Flagged() []FlaggedGoroutine
+}
+
+// SetGoroutineFlagger enables /api/flagged, which lists, flags and unflags
+// goroutines of the live capture through flagger.
+func (s *Server) SetGoroutineFlagger(flagger GoroutineFlagger) {
+	s.flaggerMu.Lock()
+	s.flagger = flagger
+	s.flaggerMu.Unlock()
+}
+
+func (s *Server) handleFlagged(w http.ResponseWriter, r *http.Request) {
+	s.flaggerMu.RLock()
+	flagger := s.flagger
+	s.flaggerMu.RUnlock()
+	if flagger == nil {
+		http.Error(w, "no live session", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(flagger.Flagged())
+
+	case http.MethodPost:
+		var req FlagRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Reason == "" {
+			req.Reason = "manual"
+		}
+		for _, gid := range req.Goroutines {
+			if err := flagger.Flag(gid, req.Reason); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		gid, err := strconv.ParseUint(r.URL.Query().Get("goroutine"), 10, 32)
+		if err != nil {
+			http.Error(w, "invalid goroutine", http.StatusBadRequest)
+			return
+		}
+		if err := flagger.Unflag(uint32(gid)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
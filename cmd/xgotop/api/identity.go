@@ -0,0 +1,98 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.sazak.io/xgotop/cmd/xgotop/analysis"
+)
+
+// sessionIdentities returns the goroutine identities of a stored session.
+func (s *Server) sessionIdentities(r *http.Request, sessionID string) ([]analysis.IdentityStats, error) {
+	store, err := s.manager.OpenSession(r.Context(), sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	return analysis.Identities(r.Context(), store)
+}
+
+// handleDiff compares the goroutines of two sessions by their identity, i.e.
+// their start function and creation chain, since goroutine IDs differ between
+// sessions.
+func (s *Server) handleDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	baseID, compareID := query.Get("base"), query.Get("compare")
+	if baseID == "" || compareID == "" {
+		http.Error(w, "base and compare must be provided", http.StatusBadRequest)
+		return
+	}
+	limit := 0
+	if limitStr := query.Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	base, err := s.sessionIdentities(r, baseID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	compare, err := s.sessionIdentities(r, compareID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	deltas := analysis.Diff(base, compare)
+	if limit > 0 && len(deltas) > limit {
+		deltas = deltas[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deltas)
+}
+
+// handleTrend follows the goroutine identities through a series of sessions,
+// given in order with the sessions parameter.
+func (s *Server) handleTrend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionsStr := r.URL.Query().Get("sessions")
+	if sessionsStr == "" {
+		http.Error(w, "sessions must be provided", http.StatusBadRequest)
+		return
+	}
+	sessionIDs := strings.Split(sessionsStr, ",")
+
+	series := make([][]analysis.IdentityStats, len(sessionIDs))
+	for i, sessionID := range sessionIDs {
+		var err error
+		series[i], err = s.sessionIdentities(r, sessionID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sessions":   sessionIDs,
+		"identities": analysis.Trend(series),
+	})
+}
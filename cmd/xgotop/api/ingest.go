@@ -0,0 +1,311 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// Headers of the batches pushed by agents to a collector
+const (
+	// IngestSeqHeader is the sequence number of the batch, counting from 0
+	// for every session. With the session metadata, it is the sequence
+	// number of the next batch the agent pushes, from which a collector that
+	// lost track of the session, e.g. by restarting, resumes it.
+	IngestSeqHeader = "X-Xgotop-Seq"
+	// IngestChecksumHeader is the CRC-32C of the body, see BatchChecksum.
+	IngestChecksumHeader = "X-Xgotop-Checksum"
+	// IngestLostFromHeader declares that the batches from this sequence
+	// number up to the pushed one were lost by the agent and will never be
+	// sent.
+	IngestLostFromHeader = "X-Xgotop-Lost-From"
+)
+
+// maxBatchBytes limits the size of pushed batches.
+const maxBatchBytes = 64 << 20
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// BatchChecksum returns the checksum of the body of a pushed batch.
+func BatchChecksum(body []byte) string {
+	return fmt.Sprintf("%08x", crc32.Checksum(body, castagnoli))
+}
+
+// IngestAck acknowledges pushed batches. It is returned for stored batches,
+// for duplicates of already stored ones, and with 409 Conflict for batches
+// pushed out of order. Batches of sessions the collector does not know, e.g.
+// after it restarted, are answered with 404 Not Found, upon which the agent
+// pushes the session metadata again.
+type IngestAck struct {
+	// NextSeq is the sequence number the collector expects next. All batches
+	// before it are stored or were declared lost.
+	NextSeq uint64 `json:"next_seq"`
+}
+
+// ingestSession is a session pushed by an agent.
+type ingestSession struct {
+	mu      sync.Mutex
+	store   storage.EventStore
+	nextSeq uint64
+	gaps    []storage.BatchGap
+	// baseCount is the number of events stored before the collector lost
+	// track of the session
+	baseCount int64
+}
+
+// EnableIngest makes the server a collector: agents push their sessions to
+// /api/ingest/<SESSION_ID>, where they are stored in format.
+func (s *Server) EnableIngest(format string) {
+	s.ingestMu.Lock()
+	s.ingestFormat = format
+	s.ingestSessions = make(map[string]*ingestSession)
+	s.ingestMu.Unlock()
+}
+
+// handleIngest serves POST /api/ingest/<SESSION_ID> with the session
+// metadata, which creates the session and updates it once the capture ends,
+// and POST /api/ingest/<SESSION_ID>/batch with the events of a batch.
+func (s *Server) handleIngest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.ingestMu.RLock()
+	enabled := s.ingestSessions != nil
+	s.ingestMu.RUnlock()
+	if !enabled {
+		http.Error(w, "server is not a collector", http.StatusNotFound)
+		return
+	}
+
+	sessionID, subPath, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/ingest/"), "/")
+	if sessionID == "" {
+		http.Error(w, "session ID must be provided", http.StatusBadRequest)
+		return
+	}
+
+	// Agents cannot push to the sessions of namespaces outside their token's
+	previous, err := s.manager.GetSession(r.Context(), sessionID)
+	if errors.Is(err, storage.ErrNoSession) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch subPath {
+	case "":
+		s.ingestSessionMetadata(w, r, sessionID, previous)
+	case "batch":
+		s.ingestBatch(w, r, sessionID)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// ingestSessionMetadata creates or updates the session. previous is the
+// stored session if the collector lost track of it, e.g. by restarting,
+// which is then resumed at the batch given by the agent.
+func (s *Server) ingestSessionMetadata(w http.ResponseWriter, r *http.Request, sessionID string, previous *storage.Session) {
+	var session storage.Session
+	if err := json.NewDecoder(r.Body).Decode(&session); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if session.ID != sessionID {
+		http.Error(w, "session ID does not match", http.StatusBadRequest)
+		return
+	}
+	if session.Namespace != "" {
+		if err := storage.ValidateNamespace(session.Namespace); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The event count of the metadata of a session the collector lost track
+	// of is the one of its last update, the stored events are counted before
+	// blocking the other pushes
+	var baseCount int64
+	if previous != nil {
+		s.ingestMu.RLock()
+		_, known := s.ingestSessions[sessionID]
+		s.ingestMu.RUnlock()
+		if !known {
+			var err error
+			if baseCount, err = s.countEvents(r.Context(), sessionID); err != nil {
+				log.Printf("Warning: counting the stored events of session %s: %v", sessionID, err)
+				baseCount = previous.EventCount
+			}
+		}
+	}
+
+	s.ingestMu.Lock()
+	defer s.ingestMu.Unlock()
+
+	is, ok := s.ingestSessions[sessionID]
+	if !ok {
+		var nextSeq uint64
+		if seqStr := r.Header.Get(IngestSeqHeader); seqStr != "" {
+			var err error
+			if nextSeq, err = strconv.ParseUint(seqStr, 10, 64); err != nil {
+				http.Error(w, "invalid "+IngestSeqHeader, http.StatusBadRequest)
+				return
+			}
+		}
+
+		store, err := s.manager.CreateSession(r.Context(), &session, s.ingestFormat)
+		if errors.Is(err, storage.ErrNamespaceDenied) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		is = &ingestSession{store: store, nextSeq: nextSeq}
+		switch {
+		case previous != nil:
+			// The stored events are appended to, the batches acknowledged
+			// before were stored
+			is.baseCount = baseCount
+			is.gaps = previous.TransferGaps
+			log.Printf("Resuming session %s at batch %d", sessionID, nextSeq)
+		case nextSeq > 0:
+			// The batches the agent pushed before were lost with the
+			// collector's storage
+			is.gaps = []storage.BatchGap{{FromSeq: 0, ToSeq: nextSeq - 1}}
+			log.Printf("Receiving session %s: batches 0 to %d were lost by the collector", sessionID, nextSeq-1)
+		default:
+			log.Printf("Receiving session %s", sessionID)
+		}
+		s.ingestSessions[sessionID] = is
+	}
+
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	// The event count, transfer gaps and namespace are the collector's
+	stored := is.store.GetSession()
+	session.EventCount = is.baseCount + stored.EventCount
+	session.Namespace = stored.Namespace
+	session.TransferGaps = is.gaps
+	if err := is.store.UpdateSession(&session); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if session.EndTime != nil {
+		delete(s.ingestSessions, sessionID)
+		if err := is.store.Close(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Received session %s: %d events, %d transfer gaps", sessionID, session.EventCount, len(is.gaps))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// countEvents returns the number of stored events of a session.
+func (s *Server) countEvents(ctx context.Context, sessionID string) (int64, error) {
+	store, err := s.manager.OpenSession(ctx, sessionID)
+	if err != nil {
+		return 0, err
+	}
+	defer store.Close()
+
+	var n int64
+	err = store.ScanEvents(ctx, 0, func(int64, *storage.Event) error {
+		n++
+		return nil
+	})
+	return n, err
+}
+
+func (s *Server) ingestBatch(w http.ResponseWriter, r *http.Request, sessionID string) {
+	s.ingestMu.RLock()
+	is, ok := s.ingestSessions[sessionID]
+	s.ingestMu.RUnlock()
+	if !ok {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+
+	seq, err := strconv.ParseUint(r.Header.Get(IngestSeqHeader), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid "+IngestSeqHeader, http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if checksum := BatchChecksum(body); checksum != r.Header.Get(IngestChecksumHeader) {
+		http.Error(w, fmt.Sprintf("checksum mismatch for batch %d", seq), http.StatusBadRequest)
+		return
+	}
+
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	if lostFromStr := r.Header.Get(IngestLostFromHeader); lostFromStr != "" {
+		lostFrom, err := strconv.ParseUint(lostFromStr, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid "+IngestLostFromHeader, http.StatusBadRequest)
+			return
+		}
+		// Only gaps starting at the expected batch can be declared, so that
+		// a late retransmission cannot hide stored batches
+		if lostFrom == is.nextSeq && seq > is.nextSeq {
+			is.gaps = append(is.gaps, storage.BatchGap{FromSeq: is.nextSeq, ToSeq: seq - 1})
+			log.Printf("Session %s: batches %d to %d were lost by the agent", sessionID, is.nextSeq, seq-1)
+			is.nextSeq = seq
+
+			// Stored right away, as a restarted collector resumes the
+			// session from its stored metadata
+			session := is.store.GetSession()
+			session.EventCount += is.baseCount
+			session.TransferGaps = is.gaps
+			if err := is.store.UpdateSession(session); err != nil {
+				log.Printf("Warning: storing the transfer gaps of session %s: %v", sessionID, err)
+			}
+		}
+	}
+
+	switch {
+	case seq < is.nextSeq:
+		// A retransmission of a stored batch whose ack was lost
+	case seq > is.nextSeq:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(IngestAck{NextSeq: is.nextSeq})
+		return
+	default:
+		var events []*storage.Event
+		if err := json.Unmarshal(body, &events); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := is.store.WriteBatch(r.Context(), events); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		is.nextSeq++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(IngestAck{NextSeq: is.nextSeq})
+}
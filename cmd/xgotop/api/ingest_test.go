@@ -0,0 +1,136 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+func TestIngestProtocol(t *testing.T) {
+	dir := t.TempDir()
+	manager, err := storage.NewManager(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCollector := func() *Server {
+		s := NewServer(manager, 0)
+		s.EnableIngest("jsonl")
+		return s
+	}
+	collector := newCollector()
+
+	pushSession := func(session storage.Session, nextSeq string) int {
+		body, _ := json.Marshal(session)
+		req := httptest.NewRequest(http.MethodPost, "/api/ingest/"+session.ID, bytes.NewReader(body))
+		if nextSeq != "" {
+			req.Header.Set(IngestSeqHeader, nextSeq)
+		}
+		rec := httptest.NewRecorder()
+		collector.httpServer.Handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	type step struct {
+		name     string
+		seq      uint64
+		lostFrom string
+		corrupt  bool
+		status   int
+		nextSeq  uint64
+	}
+	pushBatches := func(t *testing.T, steps []step) {
+		for _, st := range steps {
+			body, _ := json.Marshal([]*storage.Event{{Timestamp: 100 + st.seq, EventType: storage.EventTypeNewObject, Goroutine: 1}})
+			req := httptest.NewRequest(http.MethodPost, "/api/ingest/s1/batch", bytes.NewReader(body))
+			req.Header.Set(IngestSeqHeader, strconv.FormatUint(st.seq, 10))
+			checksum := BatchChecksum(body)
+			if st.corrupt {
+				checksum = BatchChecksum(nil)
+			}
+			req.Header.Set(IngestChecksumHeader, checksum)
+			if st.lostFrom != "" {
+				req.Header.Set(IngestLostFromHeader, st.lostFrom)
+			}
+			rec := httptest.NewRecorder()
+			collector.httpServer.Handler.ServeHTTP(rec, req)
+
+			if rec.Code != st.status {
+				t.Fatalf("%s: status = %d, want %d: %s", st.name, rec.Code, st.status, rec.Body)
+			}
+			if st.status != http.StatusOK && st.status != http.StatusConflict {
+				continue
+			}
+			var ack IngestAck
+			if err := json.NewDecoder(rec.Body).Decode(&ack); err != nil {
+				t.Fatalf("%s: decode ack: %v", st.name, err)
+			}
+			if ack.NextSeq != st.nextSeq {
+				t.Errorf("%s: next seq = %d, want %d", st.name, ack.NextSeq, st.nextSeq)
+			}
+		}
+	}
+
+	session := storage.Session{ID: "s1", StartTime: time.Unix(1, 0)}
+	if code := pushSession(session, ""); code != http.StatusNoContent {
+		t.Fatalf("create session: status = %d", code)
+	}
+	pushBatches(t, []step{
+		{name: "first", seq: 0, status: http.StatusOK, nextSeq: 1},
+		{name: "duplicate", seq: 0, status: http.StatusOK, nextSeq: 1},
+		{name: "out of order", seq: 2, status: http.StatusConflict, nextSeq: 1},
+		{name: "corrupted", seq: 1, corrupt: true, status: http.StatusBadRequest},
+		{name: "retransmitted", seq: 1, status: http.StatusOK, nextSeq: 2},
+		{name: "declared gap", seq: 4, lostFrom: "2", status: http.StatusOK, nextSeq: 5},
+		{name: "late gap", seq: 7, lostFrom: "3", status: http.StatusConflict, nextSeq: 5},
+	})
+
+	// A restarted collector does not know the session until the agent
+	// pushes it again, and resumes it at the agent's next batch
+	collector.ingestSessions["s1"].store.Close()
+	collector = newCollector()
+	pushBatches(t, []step{
+		{name: "unknown session", seq: 5, status: http.StatusNotFound},
+	})
+	if code := pushSession(session, "5"); code != http.StatusNoContent {
+		t.Fatalf("resume session: status = %d", code)
+	}
+	pushBatches(t, []step{
+		{name: "resumed", seq: 5, status: http.StatusOK, nextSeq: 6},
+		{name: "gap after resuming", seq: 7, lostFrom: "6", status: http.StatusOK, nextSeq: 8},
+	})
+
+	// The metadata stored with the gap counts the events stored before the
+	// restart
+	stored, err := manager.GetSession(context.Background(), "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.EventCount != 4 {
+		t.Errorf("event count with the gap = %d, want 4", stored.EventCount)
+	}
+
+	endTime := time.Unix(2, 0)
+	session.EndTime = &endTime
+	if code := pushSession(session, "8"); code != http.StatusNoContent {
+		t.Fatalf("end session: status = %d", code)
+	}
+
+	stored, err = manager.GetSession(context.Background(), "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.EventCount != 5 {
+		t.Errorf("event count = %d, want 5", stored.EventCount)
+	}
+	if want := []storage.BatchGap{{FromSeq: 2, ToSeq: 3}, {FromSeq: 6, ToSeq: 6}}; !reflect.DeepEqual(stored.TransferGaps, want) {
+		t.Errorf("transfer gaps = %+v, want %+v", stored.TransferGaps, want)
+	}
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// MarkerPhase is the phase of an injected marker, "begin" or "end".
+type MarkerPhase string
+
+const (
+	MarkerPhaseBegin MarkerPhase = "begin"
+	MarkerPhaseEnd   MarkerPhase = "end"
+)
+
+// MarkerRequest is the body of POST /api/markers.
+type MarkerRequest struct {
+	ID    uint64      `json:"id"`
+	Phase MarkerPhase `json:"phase"`
+	// Goroutine the marker is attributed to. Markers from different
+	// sources can only be paired if they use the same goroutine.
+	Goroutine uint32 `json:"goroutine"`
+}
+
+// MarkerInjector writes a marker event into the live event stream.
+type MarkerInjector func(marker *MarkerRequest) error
+
+// SetMarkerInjector enables POST /api/markers, which injects marker events
+// into the live session through inject.
+func (s *Server) SetMarkerInjector(inject MarkerInjector) {
+	s.markerMu.Lock()
+	s.injectMarker = inject
+	s.markerMu.Unlock()
+}
+
+func (s *Server) handleMarkers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.markerMu.RLock()
+	inject := s.injectMarker
+	s.markerMu.RUnlock()
+	if inject == nil {
+		http.Error(w, "no live session", http.StatusServiceUnavailable)
+		return
+	}
+
+	var marker MarkerRequest
+	if err := json.NewDecoder(r.Body).Decode(&marker); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if marker.Phase != MarkerPhaseBegin && marker.Phase != MarkerPhaseEnd {
+		http.Error(w, "phase must be begin or end", http.StatusBadRequest)
+		return
+	}
+
+	if err := inject(&marker); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// maxNotesRequestBytes is the largest request body accepted for notes,
+// leaving room for JSON escaping.
+const maxNotesRequestBytes = 2*storage.MaxNotesBytes + 1024
+
+// SessionPatch are the fields of a session that can be edited.
+type SessionPatch struct {
+	// Notes replaces the free-form markdown notes of the session
+	Notes *string `json:"notes"`
+}
+
+// patchSession edits the notes of a session, and returns the session.
+func (s *Server) patchSession(w http.ResponseWriter, r *http.Request, sessionID string) {
+	var patch SessionPatch
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxNotesRequestBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patch); err != nil {
+		http.Error(w, "invalid patch, only notes can be edited: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if patch.Notes == nil {
+		http.Error(w, "nothing to edit", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := s.manager.SetNotes(r.Context(), sessionID, *patch.Notes); err != nil {
+		writeNotesError(w, err)
+		return
+	}
+
+	session, err := s.manager.GetSession(r.Context(), sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.addNotes(r, session)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session)
+}
+
+// handleNotes lists the notes of a session, and adds and deletes the entries
+// of its journal.
+func (s *Server) handleNotes(w http.ResponseWriter, r *http.Request, sessionID string) {
+	switch r.Method {
+	case http.MethodGet:
+		notes, err := s.manager.GetNotes(r.Context(), sessionID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(notes)
+
+	case http.MethodPost:
+		var entry storage.NoteEntry
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxNotesRequestBytes)).Decode(&entry); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if entry.Text == "" {
+			http.Error(w, "text is required", http.StatusBadRequest)
+			return
+		}
+
+		added, err := s.manager.AddNoteEntry(r.Context(), sessionID, entry)
+		if err != nil {
+			writeNotesError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(added)
+
+	case http.MethodDelete:
+		id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		if err := s.manager.DeleteNoteEntry(r.Context(), sessionID, id); err != nil {
+			writeNotesError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// addNotes adds the notes of session to it, if it has any.
+func (s *Server) addNotes(r *http.Request, session *storage.Session) {
+	notes, err := s.manager.GetNotes(r.Context(), session.ID)
+	if err != nil {
+		return
+	}
+	session.Notes = notes.Notes
+	if len(notes.Journal) > 0 {
+		session.Journal = notes.Journal
+	}
+}
+
+func writeNotesError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotesTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, storage.ErrReadOnly):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, storage.ErrNoNoteEntry), errors.Is(err, storage.ErrNoSession), errors.Is(err, os.ErrNotExist):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
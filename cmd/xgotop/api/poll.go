@@ -0,0 +1,209 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// defaultPollWait is how long a poll waits for new batches by default.
+	defaultPollWait = 25 * time.Second
+	// maxPollWait caps the wait parameter of polls.
+	maxPollWait = time.Minute
+	// pollIdleTimeout is how long a poll client is kept between polls.
+	pollIdleTimeout = 2 * time.Minute
+)
+
+// PollResponse is returned by /api/live/poll.
+type PollResponse struct {
+	// Cursor is passed to the next poll
+	Cursor string `json:"cursor"`
+	// Messages are the live feed messages since the previous poll, as sent to
+	// WebSocket clients
+	Messages []json.RawMessage `json:"messages"`
+}
+
+// pollClient is a live feed client polling over plain HTTP. It is registered
+// with the hub like WebSocket clients, so its messages are buffered and it is
+// dropped when it falls too far behind in the same way.
+type pollClient struct {
+	*Client
+	id string
+
+	mu sync.Mutex
+	// seq counts the messages delivered to the client
+	seq uint64
+	// last are the messages of the last poll, sent again if the client
+	// polls with the previous cursor because the response was lost
+	last [][]byte
+	idle *time.Timer
+}
+
+func (c *pollClient) cursor() string {
+	return fmt.Sprintf("%s:%d", c.id, c.seq)
+}
+
+// receive waits up to wait for a message, then returns all buffered
+// messages. It returns false if the hub dropped the client.
+func (c *pollClient) receive(r *http.Request, wait time.Duration) ([][]byte, bool) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	var messages [][]byte
+	select {
+	case message, ok := <-c.send:
+		if !ok {
+			return nil, false
+		}
+		messages = append(messages, message)
+	case <-timer.C:
+		return nil, true
+	case <-r.Context().Done():
+		return nil, true
+	}
+
+	for n := len(c.send); n > 0; n-- {
+		message, ok := <-c.send
+		if !ok {
+			return nil, false
+		}
+		messages = append(messages, message)
+	}
+	return messages, true
+}
+
+// handlePoll serves the live feed to clients that can use neither
+// WebSockets nor streaming responses. The first poll, without cursor,
+// registers the client, which then polls with the cursor of the previous
+// response to receive the messages since. A poll waits up to wait (default
+// 25s) for messages. Clients that fell behind or did not poll for two minutes
+// get 410 Gone and start over without cursor. The backfill parameters of /ws
+// are supported by the first poll.
+func (s *Server) handlePoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	wait := defaultPollWait
+	if waitStr := r.URL.Query().Get("wait"); waitStr != "" {
+		d, err := time.ParseDuration(waitStr)
+		if err != nil || d < 0 {
+			http.Error(w, "invalid wait", http.StatusBadRequest)
+			return
+		}
+		wait = min(d, maxPollWait)
+	}
+
+	cursor := r.URL.Query().Get("cursor")
+	if cursor == "" {
+		req, err := parseBackfill(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		client, err := s.newPollClient(r.Context(), req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writePollResponse(w, client.cursor(), nil)
+		return
+	}
+
+	id, seqStr, _ := strings.Cut(cursor, ":")
+	seq, err := strconv.ParseUint(seqStr, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid cursor", http.StatusBadRequest)
+		return
+	}
+
+	s.pollMu.Lock()
+	client, ok := s.pollClients[id]
+	s.pollMu.Unlock()
+	if !ok {
+		http.Error(w, "cursor expired", http.StatusGone)
+		return
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	// The idle time counts from the end of the last poll
+	client.idle.Reset(pollIdleTimeout)
+	defer client.idle.Reset(pollIdleTimeout)
+
+	switch seq {
+	case client.seq:
+	case client.seq - uint64(len(client.last)):
+		writePollResponse(w, client.cursor(), client.last)
+		return
+	default:
+		http.Error(w, "cursor expired", http.StatusGone)
+		return
+	}
+
+	messages, ok := client.receive(r, wait)
+	if !ok {
+		s.removePollClient(client)
+		http.Error(w, "client fell behind, cursor expired", http.StatusGone)
+		return
+	}
+	client.seq += uint64(len(messages))
+	client.last = messages
+	writePollResponse(w, client.cursor(), messages)
+}
+
+// newPollClient registers a poll client with the hub, with the backfill req
+// asks for queued.
+func (s *Server) newPollClient(ctx context.Context, req backfillRequest) (*pollClient, error) {
+	client := &pollClient{
+		Client: newClient(s.hub, nil),
+		id:     uuid.New().String(),
+	}
+	client.idle = time.AfterFunc(pollIdleTimeout, func() {
+		s.removePollClient(client)
+	})
+
+	s.pollMu.Lock()
+	s.pollClients[client.id] = client
+	s.pollMu.Unlock()
+
+	if err := s.subscribe(ctx, client.Client, req); err != nil {
+		s.removePollClient(client)
+		return nil, err
+	}
+	return client, nil
+}
+
+func (s *Server) removePollClient(client *pollClient) {
+	s.pollMu.Lock()
+	_, ok := s.pollClients[client.id]
+	delete(s.pollClients, client.id)
+	s.pollMu.Unlock()
+
+	if ok {
+		client.idle.Stop()
+		s.hub.unregister <- client.Client
+		log.Printf("Poll client %s removed", client.id)
+	}
+}
+
+func writePollResponse(w http.ResponseWriter, cursor string, messages [][]byte) {
+	resp := PollResponse{Cursor: cursor, Messages: make([]json.RawMessage, len(messages))}
+	for i, message := range messages {
+		resp.Messages[i] = message
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// ProbesReport lists the probes attached during a session.
+type ProbesReport struct {
+	Uprobes []storage.ProbeStatus `json:"uprobes"`
+	// Failed counts the uprobes that could not be attached, not counting
+	// the pending ones
+	Failed int                 `json:"failed"`
+	USDT   []storage.USDTProbe `json:"usdt"`
+}
+
+// getProbes reports the outcome of attaching every probe of a session, to
+// diagnose probes that contributed no events.
+func (s *Server) getProbes(w http.ResponseWriter, r *http.Request, sessionID string) {
+	session, err := s.manager.GetSession(r.Context(), sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if session.Probes == nil {
+		http.Error(w, "session has no probe metadata", http.StatusNotFound)
+		return
+	}
+
+	report := ProbesReport{
+		Uprobes: session.Probes,
+		USDT:    session.USDTProbes,
+	}
+	if report.USDT == nil {
+		report.USDT = []storage.USDTProbe{}
+	}
+	for _, probe := range session.Probes {
+		if !probe.Attached && !probe.Pending {
+			report.Failed++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
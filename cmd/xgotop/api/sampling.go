@@ -0,0 +1,58 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// SamplingController adjusts the sampling rates of the live capture. The
+// adjustments are recorded in the sampling manifest of the session.
+type SamplingController interface {
+	// SamplingRates returns the rates of the sampled event types, between 0
+	// and 1
+	SamplingRates() map[string]float64
+	SetSamplingRate(eventName string, rate float64) error
+}
+
+// SetSamplingController enables /api/sampling, which lists and adjusts the
+// sampling rates of the live capture through controller.
+func (s *Server) SetSamplingController(controller SamplingController) {
+	s.samplingMu.Lock()
+	s.sampling = controller
+	s.samplingMu.Unlock()
+}
+
+// handleSampling lists the sampling rates of the live capture, or adjusts
+// them given a map of event names to rates between 0 and 1, where 1 stops
+// sampling the event type.
+func (s *Server) handleSampling(w http.ResponseWriter, r *http.Request) {
+	s.samplingMu.RLock()
+	controller := s.sampling
+	s.samplingMu.RUnlock()
+	if controller == nil {
+		http.Error(w, "no live session", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var rates map[string]float64
+		if err := json.NewDecoder(r.Body).Decode(&rates); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for name, rate := range rates {
+			if err := controller.SetSamplingRate(name, rate); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(controller.SamplingRates())
+}
@@ -2,12 +2,16 @@ package api
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 	"sync"
+	"time"
 
 	"go.sazak.io/xgotop/cmd/xgotop/storage"
 )
@@ -26,6 +30,30 @@ type Metrics struct {
 	PRC int64   `json:"prc"`
 	BFL float64 `json:"bfl"`
 	QWL float64 `json:"qwl"`
+	LOS uint64  `json:"los"`
+	THR int64   `json:"thr"`
+	WQD int64   `json:"wqd"`
+	// MEM is the RSS of xgotop in bytes, only measured with -memory-limit.
+	MEM uint64 `json:"mem,omitempty"`
+
+	// StorageError is set while the capture is paused because the disk is
+	// almost full.
+	StorageError string `json:"storage_error,omitempty"`
+
+	// Anomalies are the kinds of the anomalies of the metrics going on,
+	// which are recorded as annotations of the session.
+	Anomalies []storage.AnnotationKind `json:"anomalies,omitempty"`
+
+	// Baseline compares the rates of the capture with the -baseline
+	// session, divergences are recorded as annotations of the session.
+	Baseline []storage.BaselineMetric `json:"baseline,omitempty"`
+
+	// Sinks are the write statistics of the -storage-tee directories.
+	Sinks []storage.SinkStats `json:"sinks,omitempty"`
+
+	// Shedding are the actions taken so far to keep xgotop below its
+	// -memory-limit.
+	Shedding []storage.ShedAction `json:"shedding,omitempty"`
 }
 
 type Server struct {
@@ -36,6 +64,32 @@ type Server struct {
 	httpServer *http.Server
 	metrics    *Metrics
 	metricsMu  sync.RWMutex
+
+	liveSessionID  string
+	liveEventCount func() int64
+	liveMu         sync.RWMutex
+
+	injectMarker MarkerInjector
+	markerMu     sync.RWMutex
+
+	flagger   GoroutineFlagger
+	flaggerMu sync.RWMutex
+
+	sampling   SamplingController
+	samplingMu sync.RWMutex
+
+	storageError string
+	storageMu    sync.RWMutex
+
+	ingestFormat   string
+	ingestSessions map[string]*ingestSession
+	ingestMu       sync.RWMutex
+
+	pollClients map[string]*pollClient
+	pollMu      sync.Mutex
+
+	tokens    map[[sha256.Size]byte]tokenGrant
+	tenancyMu sync.RWMutex
 }
 
 func NewServer(manager *storage.Manager, port int) *Server {
@@ -62,7 +116,8 @@ func NewServer(manager *storage.Manager, port int) *Server {
 				"newobject": "#06b6d4",
 			},
 		},
-		hub: NewHub(),
+		hub:         NewHub(),
+		pollClients: make(map[string]*pollClient),
 	}
 
 	mux := http.NewServeMux()
@@ -71,12 +126,23 @@ func NewServer(manager *storage.Manager, port int) *Server {
 	mux.HandleFunc("/api/sessions/", server.handleSession)
 	mux.HandleFunc("/api/config", server.handleConfig)
 	mux.HandleFunc("/api/metrics", server.handleMetrics)
+	mux.HandleFunc("/api/markers", server.handleMarkers)
+	mux.HandleFunc("/api/flagged", server.handleFlagged)
+	mux.HandleFunc("/api/sampling", server.handleSampling)
+	mux.HandleFunc("/api/storage", server.handleStorage)
+	mux.HandleFunc("/api/diff", server.handleDiff)
+	mux.HandleFunc("/api/trend", server.handleTrend)
+	mux.HandleFunc("/api/snapshot", server.handleSnapshot)
+	mux.HandleFunc("/api/ingest/", server.handleIngest)
 
-	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		ServeWs(server.hub, w, r)
-	})
+	mux.HandleFunc("/ws", server.handleWs)
+	mux.HandleFunc("/api/live/poll", server.handlePoll)
 
-	handler := corsMiddleware(mux)
+	// The pipeline counters published by the capture and the memstats of
+	// the Go runtime, for expvar collectors
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	handler := corsMiddleware(server.tenancyMiddleware(readOnlyMiddleware(manager, mux)))
 
 	server.httpServer = &http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
@@ -97,6 +163,25 @@ func (s *Server) Stop(ctx context.Context) error {
 	return s.httpServer.Shutdown(ctx)
 }
 
+// SetClientStall delays every message written to WebSocket clients by d, as
+// if all clients were slow readers. It must be called before Start.
+func (s *Server) SetClientStall(d time.Duration) {
+	s.hub.stall = d
+}
+
+// SetLiveSession records the ID of the session currently being captured.
+func (s *Server) SetLiveSession(id string) {
+	s.liveMu.Lock()
+	s.liveSessionID = id
+	s.liveMu.Unlock()
+}
+
+func (s *Server) getLiveSessionID() string {
+	s.liveMu.RLock()
+	defer s.liveMu.RUnlock()
+	return s.liveSessionID
+}
+
 func (s *Server) BroadcastEvent(event *storage.Event) {
 	data, err := json.Marshal(event)
 	if err != nil {
@@ -108,16 +193,13 @@ func (s *Server) BroadcastEvent(event *storage.Event) {
 }
 
 func (s *Server) BroadcastBatch(events []*storage.Event) {
-	data, err := json.Marshal(map[string]interface{}{
-		"type":   "batch",
-		"events": events,
-	})
+	data, err := marshalBatch(events, false)
 	if err != nil {
 		log.Printf("Failed to marshal event batch: %v", err)
 		return
 	}
 
-	s.hub.Broadcast(data)
+	s.hub.broadcastBatch(data, events)
 }
 
 func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
@@ -156,23 +238,80 @@ func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
 			sessionID = sessionID[:idx]
 		}
 
+		if r.Method == http.MethodGet && cachedSubPaths[subPath] && s.notModified(w, r, sessionID) {
+			return
+		}
+
 		if subPath == "/events" {
 			s.getEvents(w, r, sessionID)
 			return
+		} else if subPath == "/events.ndjson" {
+			s.exportNDJSON(w, r, sessionID)
+			return
+		} else if subPath == "/events.arrow" {
+			s.exportArrow(w, r, sessionID)
+			return
+		} else if subPath == "/lifecycle" {
+			s.getLifecycle(w, r, sessionID)
+			return
 		} else if subPath == "/goroutines" {
 			s.getGoroutines(w, r, sessionID)
 			return
+		} else if subPath == "/stats" {
+			s.getStats(w, r, sessionID)
+			return
+		} else if subPath == "/timers" {
+			s.getTimers(w, r, sessionID)
+			return
+		} else if subPath == "/markers" {
+			s.getMarkers(w, r, sessionID)
+			return
+		} else if subPath == "/top" {
+			s.getTop(w, r, sessionID)
+			return
+		} else if subPath == "/lanes" {
+			s.getLanes(w, r, sessionID)
+			return
+		} else if subPath == "/alive" {
+			s.getAlive(w, r, sessionID)
+			return
+		} else if subPath == "/pprof/block" {
+			s.getBlockProfile(w, r, sessionID)
+			return
+		} else if subPath == "/probes" {
+			s.getProbes(w, r, sessionID)
+			return
+		} else if subPath == "/clock" {
+			s.getClock(w, r, sessionID)
+			return
+		} else if subPath == "/config" {
+			s.handleSessionConfig(w, r, sessionID)
+			return
+		} else if subPath == "/notes" {
+			s.handleNotes(w, r, sessionID)
+			return
 		}
 	}
 
+	if r.Method == http.MethodPatch {
+		s.patchSession(w, r, sessionID)
+		return
+	}
+
 	session, err := s.manager.GetSession(r.Context(), sessionID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	mode, salt, err := parseSanitize(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.addNotes(r, session)
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(session)
+	json.NewEncoder(w).Encode(storage.SanitizeSession(session, mode, salt))
 }
 
 func (s *Server) getEvents(w http.ResponseWriter, r *http.Request, sessionID string) {
@@ -183,6 +322,50 @@ func (s *Server) getEvents(w http.ResponseWriter, r *http.Request, sessionID str
 	}
 	defer store.Close()
 
+	filter := parseEventFilter(r)
+	fields, err := parseFields(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events, err := store.ReadEvents(r.Context(), filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(selectFields(events, fields))
+}
+
+// getLifecycle returns the events of the lifecycle log of the session, which
+// holds all newgoroutine and goexit events even if they were sampled. It
+// accepts the filter and fields parameters of getEvents.
+func (s *Server) getLifecycle(w http.ResponseWriter, r *http.Request, sessionID string) {
+	fields, err := parseFields(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events, err := s.manager.ReadLifecycle(r.Context(), sessionID, parseEventFilter(r))
+	if errors.Is(err, storage.ErrNoLifecycleLog) || errors.Is(err, storage.ErrNoSession) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(selectFields(events, fields))
+}
+
+// parseEventFilter builds an event filter from the request's query
+// parameters. Malformed values are ignored.
+func parseEventFilter(r *http.Request) *storage.EventFilter {
 	filter := &storage.EventFilter{}
 
 	if goroutineStr := r.URL.Query().Get("goroutine"); goroutineStr != "" {
@@ -223,14 +406,7 @@ func (s *Server) getEvents(w http.ResponseWriter, r *http.Request, sessionID str
 		}
 	}
 
-	events, err := store.ReadEvents(r.Context(), filter)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(events)
+	return filter
 }
 
 func (s *Server) getGoroutines(w http.ResponseWriter, r *http.Request, sessionID string) {
@@ -280,6 +456,47 @@ func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleSessionConfig reads and replaces the view settings of a single
+// session, which are kept in the session directory next to the events.
+func (s *Server) handleSessionConfig(w http.ResponseWriter, r *http.Request, sessionID string) {
+	switch r.Method {
+	case http.MethodGet:
+		settings, err := s.manager.GetViewSettings(r.Context(), sessionID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(settings)
+
+	case http.MethodPost, http.MethodPut:
+		var settings storage.ViewSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := settings.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if settings.PinnedGoroutines == nil {
+			settings.PinnedGoroutines = []uint32{}
+		}
+
+		if err := s.manager.SaveViewSettings(r.Context(), sessionID, &settings); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(settings)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 func (s *Server) UpdateMetrics(metrics *Metrics) {
 	s.metricsMu.Lock()
 	s.metrics = metrics
@@ -293,18 +510,38 @@ func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	}
 
 	s.metricsMu.RLock()
-	metrics := s.metrics
+	metrics := *s.metrics
 	s.metricsMu.RUnlock()
 
+	metrics.StorageError = s.getStorageError()
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(metrics)
 }
 
+// readOnlyMiddleware rejects all requests that could change the sessions or
+// the server state if manager is read-only.
+func readOnlyMiddleware(manager *storage.Manager, next http.Handler) http.Handler {
+	if !manager.ReadOnly() {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+		default:
+			http.Error(w, "server is read-only", http.StatusForbidden)
+		}
+	})
+}
+
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-None-Match, If-Modified-Since")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, Last-Modified")
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// defaultSnapshotWindow is the length of the history copied by a snapshot
+// unless the window parameter is given.
+const defaultSnapshotWindow = 5 * time.Minute
+
+// handleSnapshot copies the last window of the live session into a new,
+// immutable session, while the capture goes on. It requires the live session
+// to be recorded in the memory format, i.e. in a flight recorder ring whose
+// history is otherwise overwritten.
+func (s *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	liveID := s.getLiveSessionID()
+	if liveID == "" {
+		http.Error(w, "no live session", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	window := defaultSnapshotWindow
+	if windowStr := query.Get("window"); windowStr != "" {
+		var err error
+		window, err = time.ParseDuration(windowStr)
+		if err != nil || window <= 0 {
+			http.Error(w, "invalid window", http.StatusBadRequest)
+			return
+		}
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = "protobuf"
+	}
+
+	snapshot := &storage.Session{ID: uuid.New().String()}
+	snapshot, err := s.manager.Snapshot(r.Context(), liveID, snapshot, window, format)
+	if errors.Is(err, storage.ErrNoFlightRecorder) {
+		http.Error(w, "live session is not recorded with -storage-format memory", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(snapshot)
+}
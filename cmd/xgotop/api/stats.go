@@ -0,0 +1,110 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"go.sazak.io/xgotop/cmd/xgotop/analysis"
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// SessionStats summarizes a recorded session.
+type SessionStats struct {
+	SessionID   string            `json:"session_id"`
+	EventCount  int64             `json:"event_count"`
+	EventCounts map[string]uint64 `json:"event_counts"`
+	// Totals extrapolate the event counts and allocated bytes of sampled
+	// sessions by the inverse of the sampling rates. Extrapolated is set if
+	// any of them is an estimate rather than a count.
+	Totals         map[string]analysis.EventTotals `json:"totals"`
+	Extrapolated   bool                            `json:"extrapolated"`
+	GoroutineCount int                             `json:"goroutine_count"`
+	FirstTimestamp uint64                          `json:"first_timestamp"`
+	LastTimestamp  uint64                          `json:"last_timestamp"`
+	Loss           []storage.LossBucket            `json:"loss"`
+	LossTotal      storage.LossBucket              `json:"loss_total"`
+	ThreadsCreated uint64                          `json:"threads_created"`
+	ThreadsExited  uint64                          `json:"threads_exited"`
+	Threads        []ThreadCount                   `json:"threads"`
+}
+
+// ThreadCount is the number of OS threads created minus the number of threads
+// exited since the start of the session, right after a newm or mexit event.
+type ThreadCount struct {
+	Timestamp uint64 `json:"timestamp"`
+	Count     int64  `json:"count"`
+}
+
+func (s *Server) getStats(w http.ResponseWriter, r *http.Request, sessionID string) {
+	store, err := s.manager.OpenSession(r.Context(), sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer store.Close()
+
+	session := store.GetSession()
+	stats := &SessionStats{
+		SessionID:   session.ID,
+		EventCounts: make(map[string]uint64),
+		Loss:        session.Loss,
+		Threads:     []ThreadCount{},
+	}
+	if stats.Loss == nil {
+		stats.Loss = []storage.LossBucket{}
+	}
+
+	goroutines := make(map[uint32]struct{})
+	totals := analysis.NewTotalsCounter(session.Sampling)
+	err = store.ScanEvents(r.Context(), 0, func(_ int64, event *storage.Event) error {
+		stats.EventCount++
+		totals.Observe(event)
+		stats.EventCounts[event.EventType.String()]++
+		goroutines[event.Goroutine] = struct{}{}
+
+		// Thread counts hold the change until they are accumulated below
+		switch event.EventType {
+		case storage.EventTypeNewM:
+			stats.ThreadsCreated++
+			stats.Threads = append(stats.Threads, ThreadCount{Timestamp: event.Timestamp, Count: 1})
+		case storage.EventTypeMExit:
+			stats.ThreadsExited++
+			stats.Threads = append(stats.Threads, ThreadCount{Timestamp: event.Timestamp, Count: -1})
+		}
+
+		if stats.FirstTimestamp == 0 || event.Timestamp < stats.FirstTimestamp {
+			stats.FirstTimestamp = event.Timestamp
+		}
+		stats.LastTimestamp = max(stats.LastTimestamp, event.Timestamp)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stats.GoroutineCount = len(goroutines)
+	stats.Totals = totals.Totals()
+	stats.Extrapolated = totals.Extrapolated()
+
+	// Events are not necessarily stored in timestamp order
+	sort.Slice(stats.Threads, func(i, j int) bool {
+		return stats.Threads[i].Timestamp < stats.Threads[j].Timestamp
+	})
+	var threads int64
+	for i := range stats.Threads {
+		threads += stats.Threads[i].Count
+		stats.Threads[i].Count = threads
+	}
+
+	for _, bucket := range stats.Loss {
+		stats.LossTotal.Kernel += bucket.Kernel
+		stats.LossTotal.Userspace += bucket.Userspace
+		stats.LossTotal.Shutdown += bucket.Shutdown
+		stats.LossTotal.Paused += bucket.Paused
+		stats.LossTotal.Shed += bucket.Shed
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// StorageStatus is the disk usage of the sessions and the state of the
+// capture's low disk space guard.
+type StorageStatus struct {
+	*storage.Usage
+	// CapturePaused is set while events are discarded because the disk is
+	// almost full.
+	CapturePaused bool   `json:"capture_paused"`
+	Error         string `json:"error,omitempty"`
+}
+
+// SetStorageError puts the server into an error state that is reported by
+// the storage and metrics endpoints, e.g. because the capture was paused. An
+// empty msg clears the error.
+func (s *Server) SetStorageError(msg string) {
+	s.storageMu.Lock()
+	s.storageError = msg
+	s.storageMu.Unlock()
+}
+
+func (s *Server) getStorageError() string {
+	s.storageMu.RLock()
+	defer s.storageMu.RUnlock()
+	return s.storageError
+}
+
+// handleStorage reports the on-disk size of every session, the total usage
+// and the free space left.
+func (s *Server) handleStorage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	usage, err := s.manager.Usage(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	storageError := s.getStorageError()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(StorageStatus{
+		Usage:         usage,
+		CapturePaused: storageError != "",
+		Error:         storageError,
+	})
+}
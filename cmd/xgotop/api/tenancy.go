@@ -0,0 +1,139 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// TenantToken is an API token granting access to the sessions of
+// Namespaces. Admin tokens are also granted access to the endpoints that
+// are not scoped to namespaces, see adminEndpoints.
+type TenantToken struct {
+	Token      string
+	Namespaces []string
+	Admin      bool
+}
+
+// tokenGrant is what a TenantToken grants access to.
+type tokenGrant struct {
+	namespaces []string
+	admin      bool
+}
+
+// liveEndpoints act on the live session, and are only served to tokens with
+// access to its namespace.
+var liveEndpoints = map[string]bool{
+	"/ws":            true,
+	"/api/live/poll": true,
+	"/api/metrics":   true,
+	"/api/markers":   true,
+	"/api/flagged":   true,
+	"/api/sampling":  true,
+	"/api/snapshot":  true,
+}
+
+// adminEndpoints act on the whole server and are only served to admin
+// tokens: the view settings shared by all tenants are only replaced by
+// POST /api/config, while /debug/vars exposes the command line and memory
+// statistics of the process.
+var adminEndpoints = map[string]string{
+	"/api/config": http.MethodPost,
+	"/debug/vars": "",
+}
+
+// adminOnly reports whether r requires an admin token.
+func adminOnly(r *http.Request) bool {
+	method, ok := adminEndpoints[r.URL.Path]
+	return ok && (method == "" || method == r.Method)
+}
+
+// EnableTenancy requires every API request to carry one of tokens as a
+// bearer token, and restricts it to the sessions of the token's namespaces.
+// It must be called before Start.
+func (s *Server) EnableTenancy(tokens []TenantToken) {
+	s.tenancyMu.Lock()
+	defer s.tenancyMu.Unlock()
+
+	// Only the hashes are compared, which takes the same time for all
+	// tokens
+	s.tokens = make(map[[sha256.Size]byte]tokenGrant, len(tokens))
+	for _, token := range tokens {
+		s.tokens[sha256.Sum256([]byte(token.Token))] = tokenGrant{namespaces: token.Namespaces, admin: token.Admin}
+	}
+}
+
+// tenancyMiddleware authenticates requests if tenancy is enabled, and
+// restricts their context to the namespaces of their token. The namespace
+// query parameter restricts requests further to a single namespace, e.g. to
+// list its sessions only, with or without tenancy.
+func (s *Server) tenancyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.tenancyMu.RLock()
+		tokens := s.tokens
+		s.tenancyMu.RUnlock()
+
+		var namespaces []string
+		restricted := false
+		if tokens != nil {
+			granted, ok := tokens[sha256.Sum256([]byte(bearerToken(r)))]
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="xgotop"`)
+				http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+				return
+			}
+			if adminOnly(r) && !granted.admin {
+				http.Error(w, "requires an admin token", http.StatusForbidden)
+				return
+			}
+			namespaces, restricted = granted.namespaces, true
+		}
+
+		if namespace := r.URL.Query().Get("namespace"); namespace != "" {
+			if restricted && !slices.Contains(namespaces, namespace) {
+				http.Error(w, storage.ErrNamespaceDenied.Error(), http.StatusForbidden)
+				return
+			}
+			namespaces, restricted = []string{namespace}, true
+		}
+
+		if restricted {
+			r = r.WithContext(storage.WithNamespaces(r.Context(), namespaces))
+			if liveEndpoints[r.URL.Path] && !s.liveInScope(r.Context()) {
+				http.Error(w, "live session is outside the permitted namespaces", http.StatusForbidden)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// liveInScope reports whether the live session, if any, is accessible with
+// ctx.
+func (s *Server) liveInScope(ctx context.Context) bool {
+	liveID := s.getLiveSessionID()
+	if liveID == "" {
+		return true
+	}
+	_, err := s.manager.GetSession(ctx, liveID)
+	return !errors.Is(err, storage.ErrNoSession)
+}
+
+// bearerToken returns the token of the Authorization header. WebSocket
+// clients in browsers cannot set headers, so /ws also accepts the token
+// query parameter.
+func bearerToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	if r.URL.Path == "/ws" {
+		return r.URL.Query().Get("token")
+	}
+	return ""
+}
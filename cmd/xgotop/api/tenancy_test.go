@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+func TestTenancyAdminEndpoints(t *testing.T) {
+	manager, err := storage.NewManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(manager, 0)
+	s.EnableTenancy([]TenantToken{
+		{Token: "tenant", Namespaces: []string{"payments"}},
+		{Token: "admin", Namespaces: []string{"payments"}, Admin: true},
+	})
+
+	tests := []struct {
+		method, path, token string
+		status              int
+	}{
+		{http.MethodGet, "/api/config", "tenant", http.StatusOK},
+		{http.MethodPost, "/api/config", "tenant", http.StatusForbidden},
+		{http.MethodPost, "/api/config", "admin", http.StatusOK},
+		{http.MethodGet, "/debug/vars", "tenant", http.StatusForbidden},
+		{http.MethodGet, "/debug/vars", "admin", http.StatusOK},
+		{http.MethodGet, "/debug/vars", "", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{"nanoseconds_per_pixel": 1000}`))
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		rec := httptest.NewRecorder()
+		s.httpServer.Handler.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s %s with token %q: status = %d, want %d", tt.method, tt.path, tt.token, rec.Code, tt.status)
+		}
+	}
+}
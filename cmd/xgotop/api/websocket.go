@@ -3,10 +3,13 @@ package api
 import (
 	"log"
 	"net/http"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
 )
 
 const (
@@ -14,6 +17,10 @@ const (
 	pongWait       = 60 * time.Second
 	pingPeriod     = (pongWait * 9) / 10
 	maxMessageSize = 512
+
+	// clientBuffer is the number of live messages queued to a client before
+	// the hub drops it as too slow.
+	clientBuffer = 256
 )
 
 var upgrader = websocket.Upgrader{
@@ -28,19 +35,37 @@ type Client struct {
 	hub  *Hub
 	conn *websocket.Conn
 	send chan []byte
+
+	sendMu sync.Mutex
+	// holding is set while the backfill of the client is read, and held
+	// are the live messages received meanwhile, see Server.subscribe
+	holding bool
+	held    []hubMessage
+	closed  bool
+}
+
+// hubMessage is a message broadcast to the clients. events are the events of
+// batch messages, to tell which of them a backfill already holds.
+type hubMessage struct {
+	data   []byte
+	events []*storage.Event
 }
 
 type Hub struct {
 	clients    map[*Client]bool
-	broadcast  chan []byte
+	broadcast  chan hubMessage
 	register   chan *Client
 	unregister chan *Client
 	mu         sync.RWMutex
+
+	// stall delays every message written to the clients, to test how slow
+	// clients are handled
+	stall time.Duration
 }
 
 func NewHub() *Hub {
 	return &Hub{
-		broadcast:  make(chan []byte, 256),
+		broadcast:  make(chan hubMessage, 256),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		clients:    make(map[*Client]bool),
@@ -54,27 +79,25 @@ func (h *Hub) Run() {
 			h.mu.Lock()
 			h.clients[client] = true
 			h.mu.Unlock()
-			log.Printf("WebSocket client connected (total: %d)", len(h.clients))
+			log.Printf("Live feed client connected (total: %d)", len(h.clients))
 
 		case client := <-h.unregister:
 			h.mu.Lock()
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
-				close(client.send)
+				client.close()
 			}
 			h.mu.Unlock()
-			log.Printf("WebSocket client disconnected (total: %d)", len(h.clients))
+			log.Printf("Live feed client disconnected (total: %d)", len(h.clients))
 
 		case message := <-h.broadcast:
 			h.mu.RLock()
 			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
+				if !client.deliver(message) {
 					h.mu.RUnlock()
 					h.mu.Lock()
 					delete(h.clients, client)
-					close(client.send)
+					client.close()
 					h.mu.Unlock()
 					h.mu.RLock()
 				}
@@ -85,7 +108,96 @@ func (h *Hub) Run() {
 }
 
 func (h *Hub) Broadcast(message []byte) {
-	h.broadcast <- message
+	h.broadcast <- hubMessage{data: message}
+}
+
+// broadcastBatch broadcasts the batch message data of events.
+func (h *Hub) broadcastBatch(data []byte, events []*storage.Event) {
+	h.broadcast <- hubMessage{data: data, events: events}
+}
+
+// newClient returns a client whose send channel has room for the largest
+// backfill on top of the live messages.
+func newClient(hub *Hub, conn *websocket.Conn) *Client {
+	return &Client{
+		hub:  hub,
+		conn: conn,
+		send: make(chan []byte, clientBuffer+maxBackfillEvents/backfillChunkSize),
+	}
+}
+
+// deliver queues message to the client, or holds it while the client
+// holds messages. It returns false if the client fell too far behind.
+func (c *Client) deliver(message hubMessage) bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if c.holding {
+		if len(c.held) >= clientBuffer {
+			return false
+		}
+		c.held = append(c.held, message)
+		return true
+	}
+
+	select {
+	case c.send <- message.data:
+		return true
+	default:
+		return false
+	}
+}
+
+// release queues the backfill messages, then the messages held since the
+// client was registered, without the events that are in backfilled already.
+func (c *Client) release(backfill [][]byte, backfilled []*storage.Event) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if c.closed {
+		return
+	}
+	for _, message := range backfill {
+		c.send <- message
+	}
+
+	seen := make(map[eventKey]bool, len(backfilled))
+	for _, event := range backfilled {
+		seen[keyOf(event)] = true
+	}
+	for _, message := range c.held {
+		data := message.data
+		if len(message.events) > 0 {
+			events := slices.DeleteFunc(slices.Clone(message.events), func(event *storage.Event) bool {
+				return seen[keyOf(event)]
+			})
+			if len(events) == 0 {
+				continue
+			}
+			if len(events) < len(message.events) {
+				var err error
+				if data, err = marshalBatch(events, false); err != nil {
+					log.Printf("Failed to marshal event batch: %v", err)
+					continue
+				}
+			}
+		}
+		c.send <- data
+	}
+
+	c.holding = false
+	c.held = nil
+}
+
+// close closes the send channel once the hub dropped the client.
+func (c *Client) close() {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	c.closed = true
+	c.holding = false
+	c.held = nil
+	close(c.send)
 }
 
 func (c *Client) readPump() {
@@ -122,6 +234,9 @@ func (c *Client) writePump() {
 	for {
 		select {
 		case message, ok := <-c.send:
+			if c.hub.stall > 0 {
+				time.Sleep(c.hub.stall)
+			}
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
@@ -153,20 +268,17 @@ func (c *Client) writePump() {
 	}
 }
 
-func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+// ServeWs upgrades the connection and hands a new client to subscribe, which
+// registers it with the hub.
+func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request, subscribe func(*Client)) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade error: %v", err)
 		return
 	}
 
-	client := &Client{
-		hub:  hub,
-		conn: conn,
-		send: make(chan []byte, 256),
-	}
-
-	client.hub.register <- client
+	client := newClient(hub, conn)
+	subscribe(client)
 
 	go client.writePump()
 	go client.readPump()
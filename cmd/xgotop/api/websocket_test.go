@@ -0,0 +1,47 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClientStall(t *testing.T) {
+	const stall = 50 * time.Millisecond
+	hub := NewHub()
+	hub.stall = stall
+	go hub.Run()
+
+	registered := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(hub, w, r, func(client *Client) {
+			hub.register <- client
+			close(registered)
+		})
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-registered
+
+	start := time.Now()
+	hub.Broadcast([]byte(`{"type":"test"}`))
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < stall {
+		t.Errorf("message written after %v, want at least %v", elapsed, stall)
+	}
+	if string(message) != `{"type":"test"}` {
+		t.Errorf("message = %s", message)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.sazak.io/xgotop/cmd/xgotop/analysis"
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+const (
+	// baselineAllocBytes is the metric of the rate of allocated bytes.
+	baselineAllocBytes = "alloc_bytes"
+	// baselineMinRate ignores divergences of rates, in events or bytes per
+	// second, that are too low to matter both live and in the baseline.
+	baselineMinRate = 1
+)
+
+// baselineLabels describe the metrics in the annotations, the rates of the
+// other event types are described by their event names.
+var baselineLabels = map[string]string{
+	storage.EventTypeNewGoroutine.String(): "goroutine creation rate",
+	storage.EventTypeGoExit.String():       "goroutine exit rate",
+	storage.EventTypeTimerCreate.String():  "timer creation rate",
+	storage.EventTypeNewM.String():         "thread creation rate",
+	baselineAllocBytes:                     "allocation rate",
+}
+
+// loadBaseline returns the rates per second of the events of every event
+// type of the session, and of the bytes they allocated, extrapolated from
+// the sampled events over the time from the first to the last event.
+func loadBaseline(ctx context.Context, manager *storage.Manager, id string) (map[string]float64, error) {
+	store, err := manager.OpenSession(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	totals := analysis.NewTotalsCounter(store.GetSession().Sampling)
+	var first, last uint64
+	err = store.ScanEvents(ctx, 0, func(_ int64, event *storage.Event) error {
+		totals.Observe(event)
+		if first == 0 || event.Timestamp < first {
+			first = event.Timestamp
+		}
+		last = max(last, event.Timestamp)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if last <= first {
+		return nil, fmt.Errorf("session %s has too few events to compare with", id)
+	}
+
+	seconds := float64(last-first) / float64(time.Second)
+	rates := make(map[string]float64)
+	var bytes float64
+	for name, t := range totals.Totals() {
+		rates[name] = t.EstimatedEvents / seconds
+		bytes += t.EstimatedBytes
+	}
+	if bytes > 0 {
+		rates[baselineAllocBytes] = bytes / seconds
+	}
+	return rates, nil
+}
+
+// baselineCounter counts the processed events of an event type and the
+// bytes they allocated, apart for flagged goroutines, whose events bypass
+// sampling. The counts are indexed by whether the goroutine was flagged.
+type baselineCounter struct {
+	events [2]atomic.Uint64
+	bytes  [2]atomic.Uint64
+	// prev are the counts of the last comparison, guarded by the mutex of
+	// the comparator
+	prev [2][2]uint64
+}
+
+// baselineSample are the extrapolated events of every metric in the stats
+// interval ending at end.
+type baselineSample struct {
+	end     time.Time
+	amounts map[string]float64
+}
+
+// openDivergence is a divergence that lasted up to the last comparison.
+type openDivergence struct {
+	annotation storage.Annotation
+	// worst is the ratio furthest from 1
+	worst float64
+}
+
+// baselineComparator continuously compares the rates of the capture with
+// the rates of a baseline session, and records the intervals in which a
+// rate diverges from the baseline by more than a threshold factor as
+// automatic annotations of the session. The live rates are averaged over a
+// rolling window, and extrapolated with the sampling rates in effect like
+// the baseline, except for the events of flagged goroutines. Only the event types of the baseline are compared, so that
+// probes attached in one capture only do not count as divergences.
+type baselineComparator struct {
+	baseline  map[string]float64
+	metrics   []string
+	threshold float64
+	window    time.Duration
+	interval  time.Duration
+	// rate returns the sampling rate of an event type in percent
+	rate func(storage.EventType) uint32
+	// flagged reports whether the events of a goroutine bypass sampling
+	flagged func(uint32) bool
+	// counters has the same keys from newBaselineComparator on, so it is
+	// read without locking
+	counters map[storage.EventType]*baselineCounter
+
+	mu          sync.Mutex
+	start       time.Time
+	windowStart time.Time
+	samples     []baselineSample
+	open        map[string]*openDivergence
+	annotations []storage.Annotation
+}
+
+// newBaselineComparator returns a comparator of the capture starting at
+// start with the baseline rates, comparing every interval.
+func newBaselineComparator(baseline map[string]float64, rate func(storage.EventType) uint32, flagged func(uint32) bool, threshold float64, window, interval time.Duration, start time.Time) *baselineComparator {
+	c := &baselineComparator{
+		baseline:    baseline,
+		metrics:     slices.Sorted(maps.Keys(baseline)),
+		threshold:   threshold,
+		window:      window,
+		interval:    interval,
+		rate:        rate,
+		flagged:     flagged,
+		counters:    make(map[storage.EventType]*baselineCounter),
+		start:       start,
+		windowStart: start,
+		open:        make(map[string]*openDivergence),
+	}
+	for name := range baseline {
+		if eventType, ok := storage.ParseEventType(name); ok {
+			c.counters[eventType] = &baselineCounter{}
+		}
+	}
+	return c
+}
+
+// observe counts event in the live rates.
+func (c *baselineComparator) observe(event *storage.Event) {
+	if c == nil {
+		return
+	}
+	counter, ok := c.counters[event.EventType]
+	if !ok {
+		return
+	}
+	i := 0
+	if c.flagged != nil && c.flagged(event.Goroutine) {
+		i = 1
+	}
+	counter.events[i].Add(1)
+	if bytes, ok := analysis.AllocatedBytes(event); ok && bytes > 0 {
+		counter.bytes[i].Add(bytes)
+	}
+}
+
+// compare compares the live rates over the window ending at now, whose
+// monotonic timestamp is ts, with the baseline.
+func (c *baselineComparator) compare(now time.Time, ts uint64) []storage.BaselineMetric {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sample := baselineSample{end: now, amounts: make(map[string]float64, len(c.baseline))}
+	for eventType, counter := range c.counters {
+		percent := c.rate(eventType)
+		for i, flagged := range []bool{false, true} {
+			events, bytes := counter.events[i].Load(), counter.bytes[i].Load()
+			prev := counter.prev[i]
+			counter.prev[i] = [2]uint64{events, bytes}
+
+			weight := storage.SamplingWeight(percent, flagged)
+			sample.amounts[eventType.String()] += float64(events-prev[0]) * weight
+			sample.amounts[baselineAllocBytes] += float64(bytes-prev[1]) * weight
+		}
+	}
+	c.samples = append(c.samples, sample)
+	for len(c.samples) > 1 && now.Sub(c.samples[0].end) >= c.window {
+		c.windowStart = c.samples[0].end
+		c.samples = c.samples[1:]
+	}
+
+	elapsed := now.Sub(c.windowStart).Seconds()
+	if elapsed <= 0 {
+		return nil
+	}
+	warm := now.Sub(c.start) >= c.window
+
+	metrics := make([]storage.BaselineMetric, 0, len(c.metrics))
+	for _, metric := range c.metrics {
+		var total float64
+		for _, s := range c.samples {
+			total += s.amounts[metric]
+		}
+		m := storage.BaselineMetric{
+			Metric:   metric,
+			Live:     total / elapsed,
+			Baseline: c.baseline[metric],
+		}
+		m.Ratio = m.Live / m.Baseline
+		m.Diverged = warm && max(m.Live, m.Baseline) >= baselineMinRate &&
+			(m.Ratio >= c.threshold || m.Ratio <= 1/c.threshold)
+		c.update(m, now, ts)
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// update opens, extends or closes the divergence of the metric of m.
+func (c *baselineComparator) update(m storage.BaselineMetric, now time.Time, ts uint64) {
+	d, ok := c.open[m.Metric]
+	if !m.Diverged {
+		if ok {
+			c.annotations = append(c.annotations, d.annotation)
+			delete(c.open, m.Metric)
+		}
+		return
+	}
+
+	if !ok {
+		d = &openDivergence{
+			annotation: storage.Annotation{
+				Kind:           storage.AnnotationBaselineDivergence,
+				StartTimestamp: ts - uint64(min(c.interval.Nanoseconds(), int64(ts))),
+				Start:          now.Add(-c.interval),
+				Automatic:      true,
+			},
+			worst: m.Ratio,
+		}
+		c.open[m.Metric] = d
+	}
+	d.annotation.EndTimestamp = ts
+	d.annotation.End = now
+	if !ok || divergence(m.Ratio) > divergence(d.worst) {
+		d.worst = m.Ratio
+		d.annotation.Detail = describeDivergence(m)
+	}
+	if !ok {
+		log.Printf("[Baseline] %s", d.annotation.Detail)
+	}
+}
+
+// finish closes the divergences going on and returns all annotations,
+// ordered by their end.
+func (c *baselineComparator) finish() []storage.Annotation {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, metric := range c.metrics {
+		if d, ok := c.open[metric]; ok {
+			c.annotations = append(c.annotations, d.annotation)
+			delete(c.open, metric)
+		}
+	}
+	return append([]storage.Annotation(nil), c.annotations...)
+}
+
+// divergence returns how far ratio is from 1, by the factor to or from the
+// baseline.
+func divergence(ratio float64) float64 {
+	if ratio == 0 {
+		return math.Inf(1)
+	}
+	return max(ratio, 1/ratio)
+}
+
+// describeDivergence describes m, e.g. "goroutine creation rate 3.0x
+// baseline (1200/s vs 400/s)".
+func describeDivergence(m storage.BaselineMetric) string {
+	label, ok := baselineLabels[m.Metric]
+	if !ok {
+		label = m.Metric + " rate"
+	}
+	rate := func(v float64) string {
+		if m.Metric == baselineAllocBytes {
+			return formatBytes(uint64(v)) + "/s"
+		}
+		return fmt.Sprintf("%.0f/s", v)
+	}
+
+	if m.Ratio >= 1 {
+		return fmt.Sprintf("%s %.1fx baseline (%s vs %s)", label, m.Ratio, rate(m.Live), rate(m.Baseline))
+	}
+	return fmt.Sprintf("%s %.0f%% of baseline (%s vs %s)", label, 100*m.Ratio, rate(m.Live), rate(m.Baseline))
+}
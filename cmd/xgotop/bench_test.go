@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand/v2"
+	"testing"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// benchRawEvents generates n ring buffer samples of the given detail level
+// with a fixed seed.
+func benchRawEvents(b *testing.B, n int, detail storage.EventDetail) [][]byte {
+	b.Helper()
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	raw := make([][]byte, n)
+	for i := range raw {
+		event := ebpfGoRuntimeEventT{
+			Timestamp:       uint64(1_000_000_000 + i*1000),
+			EventType:       uint32(rng.IntN(6)),
+			Goroutine:       uint32(rng.IntN(256) + 1),
+			ParentGoroutine: uint32(rng.IntN(16) + 1),
+			Attributes:      [5]uint64{rng.Uint64N(10), rng.Uint64N(1 << 20), rng.Uint64N(1 << 20), 0, 0},
+		}
+
+		var buf bytes.Buffer
+		var err error
+		switch detail {
+		case storage.EventDetailMinimal:
+			err = binary.Write(&buf, binary.LittleEndian, minimalEvent{Timestamp: event.Timestamp, EventType: event.EventType, Goroutine: event.Goroutine})
+		case storage.EventDetailFull:
+			// Thread and P IDs follow the standard event
+			err = binary.Write(&buf, binary.LittleEndian, event)
+			if err == nil {
+				err = binary.Write(&buf, binary.LittleEndian, [2]uint32{uint32(rng.IntN(8)), uint32(rng.IntN(4))})
+			}
+		default:
+			err = binary.Write(&buf, binary.LittleEndian, event)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+		raw[i] = buf.Bytes()
+	}
+	return raw
+}
+
+func BenchmarkDecodeEvent(b *testing.B) {
+	for _, detail := range []storage.EventDetail{storage.EventDetailMinimal, storage.EventDetailStandard, storage.EventDetailFull} {
+		b.Run(string(detail), func(b *testing.B) {
+			raw := benchRawEvents(b, 1024, detail)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := decodeEvent(raw[i%len(raw)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// benchSink keeps benchmarked results alive, so they are not optimized away.
+var benchSink *storage.Event
+
+func BenchmarkConvertToStorageEvent(b *testing.B) {
+	raw := benchRawEvents(b, 1024, storage.EventDetailFull)
+	events := make([]*runtimeEvent, len(raw))
+	for i := range raw {
+		event, err := decodeEvent(raw[i])
+		if err != nil {
+			b.Fatal(err)
+		}
+		events[i] = event
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchSink = convertToStorageEvent(events[i%len(events)])
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/cilium/ebpf"
+)
+
+// ebpfChecksums are the SHA256SUMS of the BPF objects, written by go
+// generate along with them.
+//
+//go:embed ebpf.sha256sums
+var ebpfChecksums string
+
+// bpfTargets maps GOARCH to the BPF object bpf2go compiles and embeds for it.
+var bpfTargets = map[string]string{
+	"amd64": "ebpf_x86_bpfel.o",
+	"arm64": "ebpf_arm64_bpfel.o",
+}
+
+// bpfObject is a BPF object loaded into a collection spec.
+type bpfObject struct {
+	spec *ebpf.CollectionSpec
+	// source is the name of the embedded object or the path of an external
+	// object
+	source string
+	sha256 string
+}
+
+// loadBPFObject parses the BPF object at file, or the object embedded for
+// the running architecture if file is empty. The embedded object is verified
+// against its checksum, so that a stale or corrupted object is not loaded.
+// If expectedSHA256 is set, the object must also have this digest, which
+// comes from outside the binary, e.g. from the checksums published with a
+// release.
+func loadBPFObject(file, expectedSHA256 string) (*bpfObject, error) {
+	data, source := _EbpfBytes, bpfTargets[runtime.GOARCH]
+	if file != "" {
+		var err error
+		if data, err = os.ReadFile(file); err != nil {
+			return nil, err
+		}
+		source = file
+	}
+
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	if file == "" {
+		sums, err := parseChecksums(ebpfChecksums)
+		if err != nil {
+			return nil, err
+		}
+		expected, ok := sums[source]
+		if !ok {
+			return nil, fmt.Errorf("no checksum for the embedded %s object %s", runtime.GOARCH, source)
+		}
+		if digest != expected {
+			return nil, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", source, expected, digest)
+		}
+	}
+	if expectedSHA256 != "" && !strings.EqualFold(digest, expectedSHA256) {
+		return nil, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", source, expectedSHA256, digest)
+	}
+
+	spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("parse BPF object %s: %w", source, err)
+	}
+	return &bpfObject{spec: spec, source: source, sha256: digest}, nil
+}
+
+// parseChecksums parses SHA256SUMS as written by sha256sum into digests by
+// file name.
+func parseChecksums(data string) (map[string]string, error) {
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		digest, name, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("invalid checksum line: %q", line)
+		}
+		// Binary mode marks the name with a '*'
+		sums[strings.TrimPrefix(strings.TrimSpace(name), "*")] = strings.ToLower(digest)
+	}
+	return sums, scanner.Err()
+}
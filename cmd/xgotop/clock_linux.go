@@ -0,0 +1,55 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// Kernel clock status, see adjtimex(2)
+const (
+	timexStatusUnsync = 0x0040 // STA_UNSYNC
+	timexStateError   = 5      // TIME_ERROR
+)
+
+// sampleClock relates the monotonic clock of event timestamps to the wall
+// clock, and records the synchronization status of the wall clock.
+func sampleClock() storage.ClockSample {
+	// The monotonic clock is read between two wall clock reads, so its
+	// offset is known up to the time between them
+	before := time.Now()
+	mono := getMonotonicNs()
+	after := time.Now()
+
+	readError := after.Sub(before)
+	wall := before.Add(readError / 2)
+	sample := storage.ClockSample{
+		Wall:        wall,
+		MonotonicNs: mono,
+		OffsetNs:    wall.UnixNano() - int64(mono),
+		ReadErrorNs: readError.Nanoseconds(),
+	}
+
+	var timex unix.Timex
+	state, err := unix.Adjtimex(&timex)
+	if err == nil {
+		sample.NTPSynchronized = state != timexStateError && timex.Status&timexStatusUnsync == 0
+		// Reported in microseconds
+		sample.NTPMaxErrorNs = int64(timex.Maxerror) * 1000
+		sample.NTPEstErrorNs = int64(timex.Esterror) * 1000
+	}
+
+	return sample
+}
+
+// newClockSync samples the clock at the start of a capture.
+func newClockSync() *storage.ClockSync {
+	hostname, _ := os.Hostname()
+	return &storage.ClockSync{Hostname: hostname, Start: sampleClock()}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "go.sazak.io/xgotop/cmd/xgotop/storage"
+
+func sampleClock() storage.ClockSample {
+	panic("unimplemented")
+}
+
+func newClockSync() *storage.ClockSync {
+	panic("unimplemented")
+}
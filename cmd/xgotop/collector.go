@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"go.sazak.io/xgotop/cmd/xgotop/api"
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// serveCollector stores the sessions pushed by agents started with -push-url
+// in the storage directory, and serves them like the sessions captured
+// locally, until interrupted.
+func serveCollector() {
+	opts, err := parseStorageOptions(*storageFileMode, *storageDirMode, *storageOwner)
+	must(err, "parsing storage options")
+	opts.MemoryCapacity = *memoryRing
+
+	manager, err := storage.NewManagerWithOptions(*storageDir, opts)
+	must(err, "opening storage directory")
+
+	quotas, err := parseQuotas(*storageQuota)
+	must(err, "parsing storage quotas")
+
+	tenants, err := loadTenancy(*tenancyFile)
+	must(err, "loading tenancy")
+	var retentions []storage.Retention
+	if tenants != nil {
+		quotas = append(quotas, tenants.quotas...)
+		retentions = tenants.retentions
+	}
+
+	apiServer := api.NewServer(manager, *webPort)
+	apiServer.EnableIngest(*storageFormat)
+	if tenants != nil {
+		apiServer.EnableTenancy(tenants.tokens)
+	}
+	go func() {
+		if err := apiServer.Start(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("API server error: %v", err)
+		}
+	}()
+
+	if len(quotas) > 0 || len(retentions) > 0 {
+		janitorCtx, stopJanitor := context.WithCancel(context.Background())
+		defer stopJanitor()
+		go runJanitor(janitorCtx, manager, quotas, retentions, *quotaInterval)
+	}
+
+	log.Printf("Collecting pushed sessions into %s: http://localhost:%d", *storageDir, *webPort)
+
+	waitAndStop(apiServer)
+}
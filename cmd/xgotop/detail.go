@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// Values of the event_detail map, as defined by enum event_detail in xgotop.h
+var eventDetailValues = map[storage.EventDetail]uint32{
+	storage.EventDetailStandard: 0,
+	storage.EventDetailMinimal:  1,
+	storage.EventDetailFull:     2,
+}
+
+// Sizes of the event variants written to the ring buffer, see
+// go_runtime_event_minimal_t and go_runtime_event_full_t in xgotop.h
+var (
+	minimalEventSize  = binary.Size(minimalEvent{})
+	standardEventSize = binary.Size(ebpfGoRuntimeEventT{})
+	fullEventSize     = standardEventSize + 8
+)
+
+// minimalEvent mirrors go_runtime_event_minimal_t in xgotop.h
+type minimalEvent struct {
+	Timestamp uint64
+	EventType uint32
+	Goroutine uint32
+}
+
+// noP is written in place of the P ID when the M held no P, see GO_NO_P in
+// xgotop.h
+const noP = 0xffffffff
+
+// runtimeEvent is an event read from the ring buffer, in any detail level.
+// Fields that were not captured are left zero.
+type runtimeEvent struct {
+	ebpfGoRuntimeEventT
+	Thread uint32
+	P      *uint32
+}
+
+// ringbufRecordSize returns the space a single event takes in the ring
+// buffer with the given detail level, including the 8 byte record header.
+func ringbufRecordSize(detail storage.EventDetail) int {
+	switch detail {
+	case storage.EventDetailMinimal:
+		return 8 + minimalEventSize
+	case storage.EventDetailFull:
+		return 8 + fullEventSize
+	default:
+		return 8 + standardEventSize
+	}
+}
+
+// decodeEvent decodes a raw ring buffer sample. The detail level is told
+// apart by the sample size, so samples written before the level was changed
+// are still decoded correctly.
+func decodeEvent(raw []byte) (*runtimeEvent, error) {
+	var event runtimeEvent
+
+	switch len(raw) {
+	case minimalEventSize:
+		var minimal minimalEvent
+		if err := binary.Read(bytes.NewBuffer(raw), binary.LittleEndian, &minimal); err != nil {
+			return nil, err
+		}
+		event.Timestamp = minimal.Timestamp
+		event.EventType = minimal.EventType
+		event.Goroutine = minimal.Goroutine
+	case standardEventSize, fullEventSize:
+		if err := binary.Read(bytes.NewBuffer(raw), binary.LittleEndian, &event.ebpfGoRuntimeEventT); err != nil {
+			return nil, err
+		}
+		if len(raw) == fullEventSize {
+			event.Thread = binary.LittleEndian.Uint32(raw[standardEventSize:])
+			if p := binary.LittleEndian.Uint32(raw[standardEventSize+4:]); p != noP {
+				event.P = &p
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unexpected event size %d", len(raw))
+	}
+
+	return &event, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// diskGuard pauses the capture when the free space of the storage directory
+// drops below a threshold, so that a long capture cannot fill up the disk of
+// the host and corrupt the session or other programs' data.
+type diskGuard struct {
+	dir     string
+	minFree uint64
+	paused  atomic.Bool
+
+	// onChange is called with the error message when the capture is paused,
+	// and with an empty message when it is resumed.
+	onChange func(msg string)
+}
+
+// check pauses or resumes the capture based on the current free space. The
+// capture is resumed only when the free space exceeds the threshold by 10%,
+// so that it does not flap around the threshold.
+func (g *diskGuard) check() {
+	free, err := storage.FreeSpace(g.dir)
+	if err != nil {
+		log.Printf("Error checking free disk space: %v", err)
+		return
+	}
+
+	switch {
+	case free < g.minFree:
+		// Logged on every check, so that the state cannot be missed
+		msg := fmt.Sprintf("free space on %s is %s, below -min-free-space %s: capture is paused and events are discarded until space is freed",
+			g.dir, formatBytes(free), formatBytes(g.minFree))
+		log.Printf("ERROR: %s", msg)
+		if !g.paused.Swap(true) && g.onChange != nil {
+			g.onChange(msg)
+		}
+	case g.paused.Load() && free >= g.minFree+g.minFree/10:
+		log.Printf("Free space on %s is %s again, capture resumed", g.dir, formatBytes(free))
+		g.paused.Store(false)
+		if g.onChange != nil {
+			g.onChange("")
+		}
+	}
+}
+
+// run checks the free space every interval until ctx is cancelled.
+func (g *diskGuard) run(ctx context.Context, interval time.Duration) {
+	g.check()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			g.check()
+		}
+	}
+}
+
+var byteSizeUnits = []struct {
+	suffix string
+	factor uint64
+}{
+	// Longest suffixes first, so that "MiB" is not taken for "B"
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// parseByteSize parses a size like "512MiB", "10GB" or "1048576".
+func parseByteSize(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	factor := uint64(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			factor = unit.factor
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return uint64(n * float64(factor)), nil
+}
+
+// formatBytes formats n with a binary unit, e.g. "1.5GiB".
+func formatBytes(n uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(n)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.1f%s", value, units[i])
+}
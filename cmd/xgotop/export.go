@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"go.sazak.io/xgotop/cmd/xgotop/analysis"
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// eventWriter encodes events into an export file.
+type eventWriter interface {
+	Write(event *storage.Event) error
+	Close() error
+}
+
+// exportFormat is a file format sessions can be exported to.
+type exportFormat struct {
+	ext       string
+	newWriter func(w io.Writer, session *storage.Session) (eventWriter, error)
+}
+
+var exportFormats = map[string]exportFormat{
+	"arrow": {
+		ext: ".arrow",
+		newWriter: func(w io.Writer, session *storage.Session) (eventWriter, error) {
+			return storage.NewArrowWriter(w, session)
+		},
+	},
+	"json": {
+		ext: ".jsonl",
+		newWriter: func(w io.Writer, session *storage.Session) (eventWriter, error) {
+			return &decodedJSONWriter{encoder: json.NewEncoder(w), session: session}, nil
+		},
+	},
+	"block": {
+		ext: ".pb.gz",
+		newWriter: func(w io.Writer, session *storage.Session) (eventWriter, error) {
+			return &blockProfileWriter{w: w, profiler: analysis.NewBlockProfiler(session)}, nil
+		},
+	},
+}
+
+// decodedJSONWriter writes one decoded JSON object per line.
+type decodedJSONWriter struct {
+	encoder *json.Encoder
+	session *storage.Session
+}
+
+func (w *decodedJSONWriter) Write(event *storage.Event) error {
+	return w.encoder.Encode(storage.DecodeEvent(event, w.session))
+}
+
+func (w *decodedJSONWriter) Close() error {
+	return nil
+}
+
+// blockProfileWriter writes the pprof block profile of the events once all
+// of them were written.
+type blockProfileWriter struct {
+	w        io.Writer
+	profiler *analysis.BlockProfiler
+}
+
+func (w *blockProfileWriter) Write(event *storage.Event) error {
+	w.profiler.Observe(event)
+	return nil
+}
+
+func (w *blockProfileWriter) Close() error {
+	return w.profiler.WriteProfile(w.w)
+}
+
+// runExport writes a recorded session to files, either a single file with
+// all events or one file per event type. Sessions are exported as Apache
+// Arrow IPC (Feather V2) files, as JSON lines with the attributes decoded
+// into named fields, or as the pprof block profile of their goroutines.
+// Arrow files carry the session metadata, which can be written to a file of
+// its own as well, sanitized with -sanitize for sharing the session outside
+// of its origin environment.
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	sessionID := fs.String("session", "", "ID of the session to export")
+	dir := fs.String("storage-dir", "./sessions", "Directory for storing session data")
+	format := fs.String("format", "arrow", "Export format: arrow, json for one decoded JSON object per line, or block for a pprof block profile")
+	out := fs.String("o", "", "Output file, - for stdout, or output directory with -per-type (default: <session>.arrow for arrow, stdout for json, <session> with -per-type)")
+	perType := fs.Bool("per-type", false, "Write one <event name> file per event type")
+	metadataOut := fs.String("metadata", "", "Also write the session metadata as JSON to this file")
+	sanitize := fs.String("sanitize", "none", "Sanitize the binary path, hostname, PID and label values of the exported metadata: none, redact to remove them, or hash to replace them with salted hashes")
+	hashSalt := fs.String("hash-salt", "", "Salt of the hashes of -sanitize hash, the same salt yields the same hashes across exports")
+	fs.Parse(args)
+
+	if *sessionID == "" {
+		log.Fatal("-session must be provided")
+	}
+	exportFmt, ok := exportFormats[*format]
+	if !ok {
+		log.Fatalf("unknown export format: %s (supported: arrow, json, block)", *format)
+	}
+	if *perType && *format == "block" {
+		log.Fatal("-per-type cannot be used with -format block")
+	}
+	sanitizeMode, err := storage.ParseSanitizeMode(*sanitize)
+	if err != nil {
+		log.Fatalf("-sanitize: %v", err)
+	}
+	if *hashSalt != "" && sanitizeMode != storage.SanitizeHash {
+		log.Fatal("-hash-salt requires -sanitize hash")
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	manager, err := storage.NewManager(*dir)
+	must(err, "creating storage manager")
+
+	store, err := manager.OpenSession(ctx, *sessionID)
+	must(err, "opening session")
+	defer store.Close()
+
+	session := storage.SanitizeSession(store.GetSession(), sanitizeMode, *hashSalt)
+	if *metadataOut != "" {
+		must(writeSessionMetadata(session, *metadataOut), "writing session metadata")
+		log.Printf("Exported session metadata to %s", *metadataOut)
+	}
+
+	var exported map[string]uint64
+	if *perType {
+		if *out == "" {
+			*out = *sessionID
+		}
+		exported, err = exportPerType(ctx, store, session, exportFmt, *out)
+	} else {
+		if *out == "" {
+			*out = *sessionID + exportFmt.ext
+			if *format == "json" {
+				*out = "-"
+			}
+		}
+		var count uint64
+		count, err = exportFile(ctx, store, session, exportFmt, *out)
+		exported = map[string]uint64{*out: count}
+	}
+	must(err, "exporting session")
+
+	for path, count := range exported {
+		if path == "-" {
+			path = "stdout"
+		}
+		log.Printf("Exported %d events to %s", count, path)
+	}
+}
+
+// writeSessionMetadata writes session as indented JSON to path.
+func writeSessionMetadata(session *storage.Session, path string) error {
+	data, err := json.MarshalIndent(session, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// exportFile writes all events of store, whose metadata is session, to path,
+// or to stdout if path is -.
+func exportFile(ctx context.Context, store storage.EventStore, session *storage.Session, format exportFormat, path string) (uint64, error) {
+	var f *os.File
+	if path == "-" {
+		f = os.Stdout
+	} else {
+		var err error
+		f, err = os.Create(path)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+	}
+
+	buf := bufio.NewWriter(f)
+	w, err := format.newWriter(buf, session)
+	if err != nil {
+		return 0, err
+	}
+
+	var count uint64
+	err = store.ScanEvents(ctx, 0, func(cursor int64, event *storage.Event) error {
+		count++
+		return w.Write(event)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	if err := buf.Flush(); err != nil {
+		return 0, err
+	}
+
+	if f == os.Stdout {
+		return count, nil
+	}
+	return count, f.Close()
+}
+
+// exportPerType writes the events of every event type of store, whose
+// metadata is session, to <dir>/<event name><ext> in a single pass.
+func exportPerType(ctx context.Context, store storage.EventStore, session *storage.Session, format exportFormat, dir string) (map[string]uint64, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create output directory: %w", err)
+	}
+
+	type typeFile struct {
+		path  string
+		file  *os.File
+		buf   *bufio.Writer
+		w     eventWriter
+		count uint64
+	}
+	files := make(map[storage.EventType]*typeFile)
+	defer func() {
+		for _, tf := range files {
+			tf.file.Close()
+		}
+	}()
+
+	err := store.ScanEvents(ctx, 0, func(cursor int64, event *storage.Event) error {
+		tf, ok := files[event.EventType]
+		if !ok {
+			path := filepath.Join(dir, getEventName(event.EventType)+format.ext)
+			f, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			buf := bufio.NewWriter(f)
+			w, err := format.newWriter(buf, session)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			tf = &typeFile{path: path, file: f, buf: buf, w: w}
+			files[event.EventType] = tf
+		}
+
+		tf.count++
+		return tf.w.Write(event)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	exported := make(map[string]uint64, len(files))
+	for _, tf := range files {
+		if err := tf.w.Close(); err != nil {
+			return nil, fmt.Errorf("write %s: %w", tf.path, err)
+		}
+		if err := tf.buf.Flush(); err != nil {
+			return nil, fmt.Errorf("write %s: %w", tf.path, err)
+		}
+		if err := tf.file.Close(); err != nil {
+			return nil, fmt.Errorf("close %s: %w", tf.path, err)
+		}
+		exported[tf.path] = tf.count
+	}
+
+	return exported, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"expvar"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// pipelineVars are the counters of the event pipeline published as the
+// "xgotop" expvar. Unlike the per-second metrics of /api/metrics, the
+// counters are cumulative since the probes were attached, so expvar
+// collectors can derive rates over their own scrape intervals.
+type pipelineVars struct {
+	EventsRead      uint64             `json:"events_read"`
+	EventsProcessed uint64             `json:"events_processed"`
+	EventsByType    map[string]uint64  `json:"events_by_type"`
+	Losses          storage.LossTotals `json:"losses"`
+	// EventsQueued and WriteQueueDepth are the events waiting for the
+	// processing workers and the batches waiting for the writer
+	EventsQueued    int64 `json:"events_queued"`
+	WriteQueueDepth int64 `json:"write_queue_depth"`
+	Threads         int64 `json:"threads"`
+	// RSSBytes is the RSS of xgotop, only measured with -memory-limit
+	RSSBytes uint64 `json:"rss_bytes,omitempty"`
+}
+
+// publishPipelineVars publishes the counters returned by read as the
+// "xgotop" expvar, which the API server serves on /debug/vars next to the
+// memstats and cmdline of the Go runtime. read is called on every request.
+func publishPipelineVars(read func() pipelineVars) {
+	expvar.Publish("xgotop", expvar.Func(func() any {
+		return read()
+	}))
+}
+
+// byName returns the counts by event name.
+func (c *eventCounts) byName() map[string]uint64 {
+	return map[string]uint64{
+		storage.EventTypeCasGStatus.String():   c.casGStatus.Load(),
+		storage.EventTypeMakeSlice.String():    c.makeSlice.Load(),
+		storage.EventTypeMakeMap.String():      c.makeMap.Load(),
+		storage.EventTypeNewObject.String():    c.newObject.Load(),
+		storage.EventTypeNewGoroutine.String(): c.newGoroutine.Load(),
+		storage.EventTypeGoExit.String():       c.goExit.Load(),
+		storage.EventTypeSemaBlock.String():    c.semaBlock.Load(),
+		storage.EventTypeTimerCreate.String():  c.timerCreate.Load(),
+		storage.EventTypeTimerStop.String():    c.timerStop.Load(),
+		storage.EventTypeIfaceConv.String():    c.ifaceConv.Load(),
+		storage.EventTypeStringAlloc.String():  c.stringAlloc.Load(),
+		storage.EventTypeSchedStats.String():   c.schedStats.Load(),
+		storage.EventTypeNewM.String():         c.newM.Load(),
+		storage.EventTypeMExit.String():        c.mExit.Load(),
+		storage.EventTypeGCAssist.String():     c.gcAssist.Load(),
+		storage.EventTypeGCMarkWorker.String(): c.gcMarkWorker.Load(),
+		storage.EventTypeMarker.String():       c.marker.Load(),
+		storage.EventTypeUSDT.String():         c.usdt.Load(),
+	}
+}
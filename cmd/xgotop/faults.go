@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// faultsEnv is the environment variable enabling fault injection, as a comma
+// separated list of fault:value pairs, e.g.
+// XGOTOP_FAULTS=storage-write-error:0.1,ringbuf-read-delay:5ms,ws-stall:2s
+const faultsEnv = "XGOTOP_FAULTS"
+
+// errInjectedFault is returned by the fault points failing on purpose.
+var errInjectedFault = errors.New("injected fault")
+
+// faults are the fault points injected into the event pipeline, so that the
+// handling of slow or failing stages can be exercised on demand. The zero
+// value injects no faults.
+type faults struct {
+	// storageWriteError is the fraction of batch writes failing
+	storageWriteError float64
+	// ringbufReadDelay is added after every ring buffer read
+	ringbufReadDelay time.Duration
+	// wsStall is added before every message written to a WebSocket client
+	wsStall time.Duration
+}
+
+// parseFaults parses the fault points enabled with XGOTOP_FAULTS.
+func parseFaults(spec string) (faults, error) {
+	var f faults
+	if spec == "" {
+		return f, nil
+	}
+
+	for _, pair := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			return faults{}, fmt.Errorf("invalid fault: %s (expected fault:value)", pair)
+		}
+
+		var err error
+		switch name {
+		case "storage-write-error":
+			f.storageWriteError, err = strconv.ParseFloat(value, 64)
+			if err == nil && (f.storageWriteError < 0 || f.storageWriteError > 1) {
+				err = fmt.Errorf("must be between 0 and 1")
+			}
+		case "ringbuf-read-delay":
+			f.ringbufReadDelay, err = time.ParseDuration(value)
+		case "ws-stall":
+			f.wsStall, err = time.ParseDuration(value)
+		default:
+			return faults{}, fmt.Errorf("unknown fault: %s (supported: storage-write-error, ringbuf-read-delay, ws-stall)", name)
+		}
+		if err != nil {
+			return faults{}, fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+
+	return f, nil
+}
+
+func (f faults) enabled() bool {
+	return f != faults{}
+}
+
+// String describes the enabled faults for logging.
+func (f faults) String() string {
+	var enabled []string
+	if f.storageWriteError > 0 {
+		enabled = append(enabled, fmt.Sprintf("storage-write-error:%g", f.storageWriteError))
+	}
+	if f.ringbufReadDelay > 0 {
+		enabled = append(enabled, "ringbuf-read-delay:"+f.ringbufReadDelay.String())
+	}
+	if f.wsStall > 0 {
+		enabled = append(enabled, "ws-stall:"+f.wsStall.String())
+	}
+	return strings.Join(enabled, ",")
+}
+
+// faultyStore fails a fraction of the batch writes to the wrapped store.
+type faultyStore struct {
+	storage.EventStore
+	rate float64
+	// roll returns a random number in [0, 1)
+	roll func() float64
+}
+
+func newFaultyStore(store storage.EventStore, rate float64) *faultyStore {
+	return &faultyStore{EventStore: store, rate: rate, roll: rand.Float64}
+}
+
+func (s *faultyStore) WriteBatch(ctx context.Context, events []*storage.Event) error {
+	if s.roll() < s.rate {
+		return fmt.Errorf("write %d events: %w", len(events), errInjectedFault)
+	}
+	return s.EventStore.WriteBatch(ctx, events)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+
+	"go.sazak.io/xgotop/cmd/xgotop/api"
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// maxFlaggedGoroutines is the capacity of the flagged_goroutines map.
+const maxFlaggedGoroutines = 4096
+
+// flagReasonTopAllocator is the reason of goroutines flagged by the top
+// allocators rule.
+const flagReasonTopAllocator = "top-allocator"
+
+var errTooManyFlagged = fmt.Errorf("at most %d goroutines can be flagged", maxFlaggedGoroutines)
+
+// goroutineFlagger maintains the goroutines in the flagged_goroutines map,
+// whose events bypass sampling and are captured in full detail. Goroutines are unflagged when they exit.
+// The periods every goroutine was flagged in are kept for the sampling
+// manifest.
+type goroutineFlagger struct {
+	m *ebpf.Map
+	// now returns the current time on the clock of the event timestamps
+	now func() uint64
+
+	// countAllocs enables counting allocations for the top allocators rule
+	countAllocs bool
+
+	mu      sync.Mutex
+	flagged map[uint32]string
+	// allocs counts the allocation events of every goroutine since the last
+	// run of the top allocators rule
+	allocs  map[uint32]uint64
+	history map[uint32][]storage.FlagPeriod
+}
+
+func newGoroutineFlagger(m *ebpf.Map, now func() uint64) *goroutineFlagger {
+	return &goroutineFlagger{
+		m:       m,
+		now:     now,
+		flagged: make(map[uint32]string),
+		allocs:  make(map[uint32]uint64),
+		history: make(map[uint32][]storage.FlagPeriod),
+	}
+}
+
+// Flag captures all events of goroutine gid from now on.
+func (f *goroutineFlagger) Flag(gid uint32, reason string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.flag(gid, reason)
+}
+
+func (f *goroutineFlagger) flag(gid uint32, reason string) error {
+	if _, ok := f.flagged[gid]; !ok && len(f.flagged) >= maxFlaggedGoroutines {
+		return errTooManyFlagged
+	}
+
+	key, value := uint64(gid), uint32(0)
+	if err := f.m.Update(&key, &value, ebpf.UpdateAny); err != nil {
+		return fmt.Errorf("flag goroutine %d: %w", gid, err)
+	}
+	if _, ok := f.flagged[gid]; !ok {
+		f.history[gid] = append(f.history[gid], storage.FlagPeriod{FromTimestamp: f.now()})
+	}
+	f.flagged[gid] = reason
+	return nil
+}
+
+// Unflag samples the events of goroutine gid again.
+func (f *goroutineFlagger) Unflag(gid uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.unflag(gid)
+}
+
+func (f *goroutineFlagger) unflag(gid uint32) error {
+	if _, ok := f.flagged[gid]; !ok {
+		return nil
+	}
+
+	key := uint64(gid)
+	if err := f.m.Delete(&key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return fmt.Errorf("unflag goroutine %d: %w", gid, err)
+	}
+	delete(f.flagged, gid)
+	if periods := f.history[gid]; len(periods) > 0 {
+		periods[len(periods)-1].ToTimestamp = f.now()
+	}
+	return nil
+}
+
+// periods returns the periods every goroutine was flagged in so far, nil if
+// none was flagged.
+func (f *goroutineFlagger) periods() map[uint32][]storage.FlagPeriod {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.history) == 0 {
+		return nil
+	}
+	periods := make(map[uint32][]storage.FlagPeriod, len(f.history))
+	for gid, history := range f.history {
+		periods[gid] = slices.Clone(history)
+	}
+	return periods
+}
+
+// isFlagged reports whether goroutine gid is flagged.
+func (f *goroutineFlagger) isFlagged(gid uint32) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.flagged[gid]
+	return ok
+}
+
+// Flagged lists the flagged goroutines, ordered by ID.
+func (f *goroutineFlagger) Flagged() []api.FlaggedGoroutine {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	flagged := make([]api.FlaggedGoroutine, 0, len(f.flagged))
+	for gid, reason := range f.flagged {
+		flagged = append(flagged, api.FlaggedGoroutine{Goroutine: gid, Reason: reason})
+	}
+	sort.Slice(flagged, func(i, j int) bool {
+		return flagged[i].Goroutine < flagged[j].Goroutine
+	})
+	return flagged
+}
+
+// observe counts the allocations of every goroutine for the top allocators
+// rule and unflags exited goroutines.
+func (f *goroutineFlagger) observe(event *runtimeEvent) {
+	switch storage.EventType(event.EventType) {
+	case storage.EventTypeMakeSlice, storage.EventTypeMakeMap, storage.EventTypeNewObject, storage.EventTypeStringAlloc:
+		if !f.countAllocs || event.Goroutine == 0 {
+			return
+		}
+		f.mu.Lock()
+		f.allocs[event.Goroutine]++
+		f.mu.Unlock()
+	case storage.EventTypeGoExit:
+		if err := f.Unflag(uint32(event.Attributes[0])); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+}
+
+// flagTopAllocators flags the n goroutines with the most allocation events
+// since the last call, and unflags the goroutines flagged by the previous
+// call that are no longer among them. Goroutines flagged for other reasons
+// are left alone.
+func (f *goroutineFlagger) flagTopAllocators(n int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	gids := make([]uint32, 0, len(f.allocs))
+	for gid := range f.allocs {
+		gids = append(gids, gid)
+	}
+	sort.Slice(gids, func(i, j int) bool {
+		if f.allocs[gids[i]] != f.allocs[gids[j]] {
+			return f.allocs[gids[i]] > f.allocs[gids[j]]
+		}
+		return gids[i] < gids[j]
+	})
+	top := make(map[uint32]bool, n)
+	for _, gid := range gids[:min(n, len(gids))] {
+		top[gid] = true
+	}
+	clear(f.allocs)
+
+	var errs []error
+	for gid, reason := range f.flagged {
+		if reason == flagReasonTopAllocator && !top[gid] {
+			errs = append(errs, f.unflag(gid))
+		}
+	}
+	for gid := range top {
+		if _, ok := f.flagged[gid]; !ok {
+			errs = append(errs, f.flag(gid, flagReasonTopAllocator))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// runTopAllocatorsRule applies the top allocators rule every interval until
+// ctx is done.
+func (f *goroutineFlagger) runTopAllocatorsRule(ctx context.Context, n int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := f.flagTopAllocators(n); err != nil {
+				log.Printf("Warning: flagging top allocators: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// importBatchSize is the number of events written to the new session at once.
+const importBatchSize = 1000
+
+// runImport validates an event file produced outside of xgotop, or copied out
+// of an older capture, and stores its events in a new session, so that they
+// can be browsed with the API and web UI.
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	file := fs.String("file", "", "Event file to import")
+	format := fs.String("format", "", "Format of the event file: jsonl or protobuf (default: from the file extension)")
+	binary := fs.String("binary", "", "Path of the program the events were captured from, recorded in the session metadata")
+	dir := fs.String("storage-dir", "./sessions", "Directory for storing session data")
+	storageFormat := fs.String("storage-format", "protobuf", "Storage format of the new session: protobuf or jsonl")
+	skipInvalid := fs.Bool("skip-invalid", false, "Skip invalid events instead of aborting the import")
+	fs.Parse(args)
+
+	if *file == "" {
+		log.Fatal("-file must be provided")
+	}
+
+	if *format == "" {
+		var err error
+		*format, err = storage.DetectFormat(*file)
+		must(err, "detecting format")
+	}
+
+	path, err := filepath.Abs(*file)
+	must(err, "resolving file path")
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	manager, err := storage.NewManager(*dir)
+	must(err, "creating storage manager")
+
+	session := &storage.Session{
+		ID:           uuid.New().String(),
+		StartTime:    time.Now(),
+		BinaryPath:   *binary,
+		ImportedFrom: path,
+	}
+
+	store, err := manager.CreateSession(ctx, session, *storageFormat)
+	must(err, "creating session")
+
+	imported, skipped, err := importEvents(ctx, store, path, *format, *skipInvalid)
+	if err == nil && imported == 0 {
+		err = fmt.Errorf("no valid events in %s", path)
+	}
+	if err != nil {
+		store.Close()
+		// ctx is done if the import was interrupted
+		if err := manager.DeleteSession(context.Background(), session.ID); err != nil {
+			log.Printf("Error removing incomplete session %s: %v", session.ID, err)
+		}
+		log.Fatalf("importing events: %v", err)
+	}
+
+	endTime := time.Now()
+	session = store.GetSession()
+	session.EventCount = imported
+	session.EndTime = &endTime
+	must(store.UpdateSession(session), "saving session metadata")
+	must(store.Close(), "closing session")
+
+	if skipped > 0 {
+		log.Printf("Skipped %d invalid events", skipped)
+	}
+	log.Printf("Imported %d events into session %s", imported, session.ID)
+}
+
+// importEvents copies the valid events of the event file at path to store.
+// Invalid events abort the import, unless skipInvalid is set.
+func importEvents(ctx context.Context, store storage.EventStore, path, format string, skipInvalid bool) (imported, skipped int64, err error) {
+	batch := make([]*storage.Event, 0, importBatchSize)
+
+	err = storage.ScanEventFile(ctx, path, format, func(cursor int64, event *storage.Event) error {
+		if err := storage.ValidateEvent(event); err != nil {
+			if !skipInvalid {
+				return fmt.Errorf("event %d: %w", cursor, err)
+			}
+			skipped++
+			return nil
+		}
+
+		batch = append(batch, event)
+		if len(batch) == importBatchSize {
+			if err := store.WriteBatch(ctx, batch); err != nil {
+				return fmt.Errorf("write events: %w", err)
+			}
+			imported += int64(len(batch))
+			batch = batch[:0]
+		}
+		return nil
+	})
+	if err != nil {
+		return imported, skipped, err
+	}
+
+	if len(batch) > 0 {
+		if err := store.WriteBatch(ctx, batch); err != nil {
+			return imported, skipped, fmt.Errorf("write events: %w", err)
+		}
+		imported += int64(len(batch))
+	}
+
+	return imported, skipped, nil
+}
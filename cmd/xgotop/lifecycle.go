@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math/rand/v2"
+	"sync"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// lifecycleSampler applies the sampling rates of the lifecycle event types
+// in userspace. The eBPF programs send all lifecycle events so that the
+// lifecycle log is complete, and the events are sampled for the session
+// afterwards, the same way the eBPF programs sample other events.
+type lifecycleSampler struct {
+	flagger *goroutineFlagger
+
+	mu sync.RWMutex
+	// rates are percentages, like the rates of the sampling_rates map
+	rates map[storage.EventType]uint32
+}
+
+func newLifecycleSampler(rates map[storage.EventType]uint32, flagger *goroutineFlagger) *lifecycleSampler {
+	return &lifecycleSampler{rates: rates, flagger: flagger}
+}
+
+// setRate changes the sampling rate of a lifecycle event type.
+func (s *lifecycleSampler) setRate(eventType storage.EventType, percent uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rates[eventType] = percent
+}
+
+// sample drops the lifecycle events that are not sampled from events. Events
+// of flagged goroutines bypass sampling, unless the rate of their type is 0.
+func (s *lifecycleSampler) sample(events []*storage.Event) []*storage.Event {
+	if s == nil {
+		return events
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.rates) == 0 {
+		return events
+	}
+
+	kept := events[:0]
+	for _, event := range events {
+		rate, ok := s.rates[event.EventType]
+		if !ok || (rate > 0 && s.flagger.isFlagged(event.Goroutine)) || rand.Uint32N(100) < rate {
+			kept = append(kept, event)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// liveSocketQueueSize is the number of frames queued per client of the live
+// socket before the client is disconnected.
+const liveSocketQueueSize = 256
+
+// liveSocket serves the live batch stream over a unix domain socket to
+// consumers on the same host, e.g. a separate UI backend. Every batch is a
+// frame holding a RuntimeEventBatch protobuf message, prefixed with its
+// length as a little endian uint32, which avoids the JSON encoding and TCP
+// stack of the WebSocket feed. Clients that do not keep up are disconnected
+// rather than slowing down the capture.
+type liveSocket struct {
+	listener net.Listener
+
+	mu      sync.Mutex
+	clients map[*liveSocketClient]struct{}
+}
+
+type liveSocketClient struct {
+	conn   net.Conn
+	frames chan []byte
+}
+
+// listenLiveSocket listens on the unix domain socket at path, replacing a
+// socket left behind by a previous run.
+func listenLiveSocket(path string, perms storage.Permissions) (*liveSocket, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("remove stale socket: %w", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := perms.ApplySocket(path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	s := &liveSocket{
+		listener: listener,
+		clients:  make(map[*liveSocketClient]struct{}),
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *liveSocket) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("[LiveSocket] Accept failed: %v", err)
+			continue
+		}
+
+		client := &liveSocketClient{conn: conn, frames: make(chan []byte, liveSocketQueueSize)}
+		s.mu.Lock()
+		s.clients[client] = struct{}{}
+		s.mu.Unlock()
+		go s.write(client)
+	}
+}
+
+// write sends the frames of client until it is removed or the connection
+// fails.
+func (s *liveSocket) write(client *liveSocketClient) {
+	for frame := range client.frames {
+		if _, err := client.conn.Write(frame); err != nil {
+			s.remove(client)
+			return
+		}
+	}
+}
+
+func (s *liveSocket) remove(client *liveSocketClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.clients[client]; ok {
+		s.disconnect(client)
+	}
+}
+
+// disconnect removes client, whose pending write fails once its connection
+// is closed. s.mu must be held.
+func (s *liveSocket) disconnect(client *liveSocketClient) {
+	delete(s.clients, client)
+	close(client.frames)
+	client.conn.Close()
+}
+
+// broadcast sends events to every client as a single frame. The batch is only
+// encoded if a client is connected.
+func (s *liveSocket) broadcast(events []*storage.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.clients) == 0 {
+		return
+	}
+
+	data, err := storage.MarshalBatch(events)
+	if err != nil {
+		log.Printf("[LiveSocket] Failed to encode batch: %v", err)
+		return
+	}
+	frame := storage.AppendFrame(nil, data)
+
+	for client := range s.clients {
+		select {
+		case client.frames <- frame:
+		default:
+			log.Printf("[LiveSocket] Client fell behind, disconnecting it")
+			s.disconnect(client)
+		}
+	}
+}
+
+// Close disconnects all clients and removes the socket.
+func (s *liveSocket) Close() error {
+	err := s.listener.Close()
+
+	s.mu.Lock()
+	for client := range s.clients {
+		s.disconnect(client)
+	}
+	s.mu.Unlock()
+	return err
+}
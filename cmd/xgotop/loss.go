@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cilium/ebpf"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// lossTracker accumulates the events lost at every stage of the pipeline and
+// splits them into one bucket per stats interval.
+type lossTracker struct {
+	userspace atomic.Uint64
+	paused    atomic.Uint64
+	shed      atomic.Uint64
+
+	mu            sync.Mutex
+	lastKernel    uint64
+	lastUserspace uint64
+	lastPaused    uint64
+	lastShed      uint64
+	buckets       []storage.LossBucket
+}
+
+// addUserspace records n events that were read from the ring buffer but lost
+// afterwards.
+func (t *lossTracker) addUserspace(n uint64) {
+	t.userspace.Add(n)
+}
+
+// addPaused records n events that were discarded because the capture was
+// paused.
+func (t *lossTracker) addPaused(n uint64) {
+	t.paused.Add(n)
+}
+
+// addShed records n events that were discarded because the memory watchdog
+// shrank the event queue.
+func (t *lossTracker) addShed(n uint64) {
+	t.shed.Add(n)
+}
+
+// sample closes the current bucket given the total number of events dropped
+// in the kernel so far, and returns it.
+func (t *lossTracker) sample(now time.Time, kernelTotal uint64) storage.LossBucket {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	userspaceTotal := t.userspace.Load()
+	pausedTotal := t.paused.Load()
+	shedTotal := t.shed.Load()
+	bucket := storage.LossBucket{
+		Time:      now,
+		Kernel:    kernelTotal - t.lastKernel,
+		Userspace: userspaceTotal - t.lastUserspace,
+		Paused:    pausedTotal - t.lastPaused,
+		Shed:      shedTotal - t.lastShed,
+	}
+	t.lastKernel = kernelTotal
+	t.lastUserspace = userspaceTotal
+	t.lastPaused = pausedTotal
+	t.lastShed = shedTotal
+
+	if bucket.Total() > 0 {
+		t.buckets = append(t.buckets, bucket)
+	}
+	return bucket
+}
+
+// addShutdown records n events that were still in the ring buffer when the
+// capture was stopped.
+func (t *lossTracker) addShutdown(now time.Time, n uint64) {
+	if n == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buckets = append(t.buckets, storage.LossBucket{Time: now, Shutdown: n})
+}
+
+// totals returns the events lost so far by cause, given the total number of
+// events dropped in the kernel so far.
+func (t *lossTracker) totals(kernelTotal uint64) storage.LossTotals {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	totals := storage.LossTotals{
+		Kernel:    kernelTotal,
+		Userspace: t.userspace.Load(),
+		Paused:    t.paused.Load(),
+		Shed:      t.shed.Load(),
+	}
+	for _, b := range t.buckets {
+		totals.Shutdown += b.Shutdown
+	}
+	return totals
+}
+
+func (t *lossTracker) Buckets() []storage.LossBucket {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]storage.LossBucket(nil), t.buckets...)
+}
+
+// readKernelDrops returns the number of events the eBPF programs failed to
+// submit because the ring buffer was full, summed over all CPUs.
+func readKernelDrops(m *ebpf.Map) (uint64, error) {
+	if m == nil {
+		return 0, nil
+	}
+
+	var (
+		key    uint32
+		perCPU []uint64
+	)
+	if err := m.Lookup(&key, &perCPU); err != nil {
+		return 0, fmt.Errorf("lookup dropped events: %w", err)
+	}
+
+	var total uint64
+	for _, n := range perCPU {
+		total += n
+	}
+	return total, nil
+}
@@ -1,17 +1,19 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -23,8 +25,10 @@ import (
 	"github.com/cilium/ebpf/rlimit"
 	"github.com/google/uuid"
 
+	"go.sazak.io/xgotop/cmd/xgotop/analysis"
 	"go.sazak.io/xgotop/cmd/xgotop/api"
 	"go.sazak.io/xgotop/cmd/xgotop/storage"
+	"go.sazak.io/xgotop/cmd/xgotop/transform"
 )
 
 var (
@@ -34,21 +38,105 @@ var (
 	processWorkers = flag.Int("pw", 5, "Number of event processing workers")
 
 	// Web mode flags
-	webMode       = flag.Bool("web", false, "Enable web mode with API server and WebSocket")
-	webPort       = flag.Int("web-port", 8080, "Port for web API server")
-	storageFormat = flag.String("storage-format", "protobuf", "Storage format: protobuf or jsonl")
-	storageDir    = flag.String("storage-dir", "./sessions", "Directory for storing session data")
+	webMode        = flag.Bool("web", false, "Enable web mode with API server and WebSocket")
+	webPort        = flag.Int("web-port", 8080, "Port for web API server")
+	storageFormat  = flag.String("storage-format", "protobuf", "Storage format: protobuf, jsonl, sqlite or memory")
+	storageRoutes  = flag.String("storage-routes", "", "Store event types in other formats than -storage-format, e.g. casgstatus:memory,allocations:protobuf,lifecycle:jsonl")
+	memoryRing     = flag.Int("memory-ring-size", storage.DefaultMemoryCapacity, "Number of events kept by the memory storage format, older events are overwritten")
+	storageDir     = flag.String("storage-dir", "./sessions", "Directory for storing session data")
+	storageTee     = flag.String("storage-tee", "", "Also write sessions to these storage directories, comma separated dir[:format] entries, e.g. /mnt/central/sessions:jsonl")
+	teeQueueSize   = flag.Int("storage-tee-queue", storage.DefaultTeeQueueSize, "Number of batches queued per -storage-tee directory before batches are dropped for it")
+	liveSocketPath = flag.String("live-socket", "", "Also stream the live event batches as length-prefixed protobuf frames over a unix domain socket at this path, for consumers on the same host (requires -web)")
+	readOnly       = flag.Bool("read-only", false, "Only serve the recorded sessions in -storage-dir without capturing, with all mutating endpoints disabled")
+
+	// Agent to collector push
+	collector     = flag.Bool("collector", false, "Only store the sessions pushed by agents started with -push-url in -storage-dir and serve them, without capturing")
+	pushURL       = flag.String("push-url", "", "Also push sessions to the collector at this URL, e.g. http://central:8080 (requires -web)")
+	pushTokenFile = flag.String("push-token-file", "", "File holding the API token sent to a -push-url collector started with -tenancy")
+	pushPending   = flag.Int("push-pending", storage.DefaultRemotePending, "Number of batches kept in memory until the collector acknowledges them, further batches are spooled with -remote-spool-dir or dropped and recorded as transfer gaps")
+
+	// Resilience of remote sinks
+	remoteSpoolDir   = flag.String("remote-spool-dir", "", "Spool the batches of remote sinks to this directory while the remote is unreachable, and replay them once it recovers")
+	remoteSpoolSize  = flag.String("remote-spool-size", "1GiB", "Maximum size of the spooled batches of every session")
+	remoteMaxBackoff = flag.Duration("remote-max-backoff", storage.DefaultRemoteMaxBackoff, "Maximum delay between retries of remote sinks, which grows exponentially while the remote is unreachable")
+
+	// Event transformation
+	transformStages  = flag.String("transform", "", "Transform events before storing them, comma separated stage[:config] entries, e.g. hash:newobject=1,drop:casgstatus (requires -web)")
+	transformPlugins = flag.String("transform-plugin", "", "Comma separated Go plugins registering transform stages usable in -transform")
+
+	// Storage permissions
+	storageFileMode = flag.String("storage-file-mode", "0644", "Octal mode of the created session files")
+	storageDirMode  = flag.String("storage-dir-mode", "0755", "Octal mode of the created session directories")
+	storageOwner    = flag.String("storage-owner", "", "Owner of the created session files and directories as uid:gid, either may be empty to keep it")
+
+	// Low disk space guard
+	minFreeSpace      = flag.String("min-free-space", "1GiB", "Pause the capture while the free space of -storage-dir is below this size (e.g. 512MiB, 10GB), 0 to disable")
+	diskCheckInterval = flag.Duration("disk-check-interval", 5*time.Second, "Interval of checking the free space of -storage-dir")
+
+	// Memory watchdog
+	memoryLimit         = flag.String("memory-limit", "0", "Shed load of the capture while the RSS of xgotop exceeds this size (e.g. 512MiB, 2GB): raise sampling, shrink the event queue and drop casgstatus events; 0 to disable")
+	memoryCheckInterval = flag.Duration("memory-check-interval", 5*time.Second, "Interval of checking the memory usage against -memory-limit")
+
+	// Session labels and storage quotas
+	sessionLabels = newLabelsFlag("label", "Label the session with key=value, e.g. service=api (repeatable)")
+	storageQuota  = flag.String("storage-quota", "", "Limit the total size of the sessions with a label, comma separated label=value:size entries (e.g. service=api:20GB); the oldest sessions over a quota are deleted")
+	quotaInterval = flag.Duration("quota-interval", time.Minute, "Interval of enforcing -storage-quota and the quotas and retentions of -tenancy")
+
+	// Multi-tenancy
+	sessionNamespace = flag.String("namespace", "", "Namespace of the captured session, see -tenancy")
+	tenancyFile      = flag.String("tenancy", "", "JSON file declaring namespaces with their quotas and retentions, and the API tokens granted access to them; every API request then requires a token and only sees the sessions of its namespaces")
+
+	// Capture limits
+	captureDuration = flag.Duration("duration", 0, "Stop the capture after this duration, 0 to capture until interrupted")
+	maxEvents       = flag.Int64("max-events", 0, "Stop the capture after reading this many events, 0 for no limit")
 
 	silent                = flag.Bool("s", false, "Enable silent mode")
 	metricFilePrefix      = flag.String("mfp", "", "Prefix for metric file name")
 	metricFileNoTimestamp = flag.Bool("mft", false, "Do not include timestamp in metric file name")
 
+	// Event configuration
+	eventDetail = flag.String("event-detail", "standard", "Data captured for every event: minimal (timestamp, type and goroutine only), standard or full (standard plus the IDs of the OS thread and the P)")
+
 	// Sampling configuration
-	samplingRates = flag.String("sample", "", "Sampling rates for events (e.g., newgoroutine:0.1,makemap:0.5)")
+	samplingRates     = flag.String("sample", "", "Sampling rates for events (e.g., newgoroutine:0.1,makemap:0.5), overriding the rates of -profile")
+	flagTopAllocators = flag.Int("flag-top-allocators", 0, "Capture all events of the N goroutines with the most allocations in every -flag-interval, bypassing sampling (0 to disable)")
+	flagInterval      = flag.Duration("flag-interval", 10*time.Second, "Interval of re-evaluating the goroutines flagged by -flag-top-allocators")
+
+	// Allocation summaries
+	allocSummaryInterval = flag.Duration("alloc-summary-interval", 0, "Store the allocated bytes of every goroutine as allocsummary events every interval, extrapolated from the sampled newobject and makeslice events, 0 to disable (requires -web)")
+
+	// Baseline comparison
+	baselineSession   = flag.String("baseline", "", "ID of a session in -storage-dir to continuously compare the rates of the capture with, annotating the session where they diverge (requires -web)")
+	baselineThreshold = flag.Float64("baseline-threshold", 2, "Factor by which a rate must diverge from the -baseline rate, in either direction, to be annotated")
+	baselineWindow    = flag.Duration("baseline-window", 30*time.Second, "Window over which the rates compared with the -baseline are averaged")
+
+	// Probe selection
+	probeProfile = flag.String("profile", "full", "Probes to attach with default sampling: alloc, scheduler, lifecycle or full")
+
+	// Probe attachment
+	attachOrder   = flag.String("attach-order", "", "Comma separated symbols of the probes to attach first, in this order, each optionally with the delay to wait before attaching it (e.g. runtime.newproc1,runtime.casgstatus:30s)")
+	attachStagger = flag.Duration("attach-stagger", 0, "Delay between attaching successive probes, the probes after the first delay are attached while capturing")
+
+	// Optional probes
+	traceIface = flag.Bool("trace-iface", false, "Trace interface conversions and type assertions (runtime.convT*, runtime.assertE2I), which are very frequent")
+
+	// USDT probes
+	usdtPatterns = flag.String("usdt", "", "Comma separated provider:name patterns of the USDT probes to attach (e.g. myapp:*), wildcards allowed")
+
+	// Scheduler sampling
+	schedStatsInterval = flag.Duration("schedstats-interval", 250*time.Millisecond, "Interval of sampling the run queue length of every P as schedstats events, 0 to disable (requires -pid)")
+
+	// BPF object
+	bpfObjectPath   = flag.String("bpf-object", "", "Load the BPF programs from this object file instead of the embedded one, e.g. for custom builds of xgotop.bpf.c")
+	bpfObjectSHA256 = flag.String("bpf-object-sha256", "", "Expected SHA256 of the BPF object, embedded or given with -bpf-object, e.g. from the published release checksums; other objects are not loaded")
+
+	// Pinning configuration
+	pinPath = flag.String("pin-path", "", "Pin eBPF maps and links under this bpffs directory (e.g. /sys/fs/bpf/xgotop) so a restarted xgotop can re-adopt them")
 
 	// Batch configuration
 	batchSize          = flag.Int("batch-size", 1000, "Number of events to batch before writing to storage")
 	batchFlushInterval = flag.Duration("batch-flush-interval", 100*time.Millisecond, "Maximum time to wait before flushing a batch")
+	writeQueueSize     = flag.Int("write-queue-size", 64, "Number of batches queued for the storage writer before the processing workers block")
 )
 
 const (
@@ -59,6 +147,39 @@ const (
 	symbolNewobject  = "runtime.newobject"
 	symbolNewproc1   = "runtime.newproc1"
 	symbolGoexit1    = "runtime.goexit1"
+	symbolSemacquire = "runtime.semacquire1"
+	symbolNewTimer   = "time.newTimer"
+	symbolModTimer   = "runtime.(*timer).modify"
+	symbolStopTimer  = "time.stopTimer"
+
+	// String building symbols
+	symbolConcatStrings     = "runtime.concatstrings"
+	symbolSliceByteToString = "runtime.slicebytetostring"
+
+	// OS thread symbols
+	symbolNewm  = "runtime.newm"
+	symbolMexit = "runtime.mexit"
+
+	// GC symbols
+	symbolGCAssistAlloc               = "runtime.gcAssistAlloc"
+	symbolGCDrainMarkWorkerDedicated  = "runtime.gcDrainMarkWorkerDedicated"
+	symbolGCDrainMarkWorkerFractional = "runtime.gcDrainMarkWorkerFractional"
+	symbolGCDrainMarkWorkerIdle       = "runtime.gcDrainMarkWorkerIdle"
+	symbolGCControllerMarkWorkerStop  = "runtime.(*gcControllerState).markWorkerStop"
+
+	// Marker symbols, only present in programs using go.sazak.io/xgotop/marker
+	symbolMarkerBegin = "go.sazak.io/xgotop/marker.Begin"
+	symbolMarkerEnd   = "go.sazak.io/xgotop/marker.End"
+
+	// Interface conversion symbols, only attached with -trace-iface
+	symbolConvT       = "runtime.convT"
+	symbolConvTnoptr  = "runtime.convTnoptr"
+	symbolConvT16     = "runtime.convT16"
+	symbolConvT32     = "runtime.convT32"
+	symbolConvT64     = "runtime.convT64"
+	symbolConvTstring = "runtime.convTstring"
+	symbolConvTslice  = "runtime.convTslice"
+	symbolAssertE2I   = "runtime.assertE2I"
 
 	statsInterval = 1000 * time.Millisecond
 )
@@ -76,6 +197,19 @@ var (
 		"newobject":    storage.EventTypeNewObject,
 		"newgoroutine": storage.EventTypeNewGoroutine,
 		"goexit":       storage.EventTypeGoExit,
+		"semablock":    storage.EventTypeSemaBlock,
+		"timercreate":  storage.EventTypeTimerCreate,
+		"timerstop":    storage.EventTypeTimerStop,
+		"ifaceconv":    storage.EventTypeIfaceConv,
+		"stringalloc":  storage.EventTypeStringAlloc,
+		"schedstats":   storage.EventTypeSchedStats,
+		"newm":         storage.EventTypeNewM,
+		"mexit":        storage.EventTypeMExit,
+		"gcassist":     storage.EventTypeGCAssist,
+		"gcmarkworker": storage.EventTypeGCMarkWorker,
+		"marker":       storage.EventTypeMarker,
+		"usdt":         storage.EventTypeUSDT,
+		"allocsummary": storage.EventTypeAllocSummary,
 	}
 )
 
@@ -87,15 +221,56 @@ type eventCounts struct {
 	newObject    atomic.Uint64
 	newGoroutine atomic.Uint64
 	goExit       atomic.Uint64
+	semaBlock    atomic.Uint64
+	timerCreate  atomic.Uint64
+	timerStop    atomic.Uint64
+	ifaceConv    atomic.Uint64
+	stringAlloc  atomic.Uint64
+	schedStats   atomic.Uint64
+	newM         atomic.Uint64
+	mExit        atomic.Uint64
+	gcAssist     atomic.Uint64
+	gcMarkWorker atomic.Uint64
+	marker       atomic.Uint64
+	usdt         atomic.Uint64
+}
+
+// threadCount returns the number of OS threads created minus the number of
+// threads exited since the probes were attached.
+func (c *eventCounts) threadCount() int64 {
+	return int64(c.newM.Load()) - int64(c.mExit.Load())
 }
 
 func main() {
 	log.SetPrefix("xgotop: ")
 	log.SetFlags(log.Ltime)
 
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			run(os.Args[2:])
+			return
+		}
+	}
+
 	flag.Parse()
 	validateFlags()
 
+	injected, err := parseFaults(os.Getenv(faultsEnv))
+	must(err, "parsing "+faultsEnv)
+	if injected.enabled() {
+		log.Printf("Warning: injecting faults: %s", injected)
+	}
+
+	if *readOnly {
+		serveReadOnly()
+		return
+	}
+
+	if *collector {
+		serveCollector()
+		return
+	}
+
 	// Determine the executable path
 	var executablePath string
 	if *pid != 0 {
@@ -110,26 +285,172 @@ func main() {
 		log.Printf("Attaching to executable: %s", executablePath)
 	}
 
+	var losses lossTracker
+	anomalies := newAnomalyDetector(statsInterval)
+	// sampling applies the sampling rates once the BPF objects are loaded
+	var sampling *samplingController
+
+	// session is only recorded in web mode
+	var session *storage.Session
+
+	// guard pauses storing events when the disk is almost full, only in web
+	// mode
+	var guard *diskGuard
+
+	// memwatch sheds load when xgotop exceeds -memory-limit, if set
+	var memwatch *memoryWatchdog
+
+	// baseline compares the capture with the rates of the -baseline
+	// session, only in web mode
+	var baseline *baselineComparator
+	var baselineRates map[string]float64
+
+	// attacher attaches the uprobes in the -attach-order and tracks their
+	// first events
+	var attacher *probeAttacher
+
+	// teeStore mirrors the session into the -storage-tee directories, only
+	// in web mode
+	var teeStore *storage.TeeStore
+
+	// writer writes the batches of the processing workers to eventStore, only
+	// in web mode
+	var writer *storageWriter
+
+	// symbols resolves the start and creation PCs of new goroutines to
+	// function names stored with the session, only in web mode
+	var symbols *symbolizer
+
+	// transforms transform the events between decoding and storage, only in
+	// web mode
+	var transforms *transform.Pipeline
+
+	// lifecycle persists the lifecycle events of the session unsampled, only
+	// in web mode
+	var lifecycle *storage.LifecycleLog
+
+	// stop stops the capture and records why for the session
+	stop := newCaptureStopper()
+
 	// Initialize web mode if enabled
 	if *webMode {
-		manager, err := storage.NewManager(*storageDir)
+		opts, err := parseStorageOptions(*storageFileMode, *storageDirMode, *storageOwner)
+		must(err, "parsing storage options")
+		opts.MemoryCapacity = *memoryRing
+
+		routes, err := parseStorageRoutes(*storageRoutes)
+		must(err, "parsing storage routes")
+
+		teeTargets, err := parseTeeTargets(*storageTee, *storageFormat)
+		must(err, "parsing storage tee")
+
+		quotas, err := parseQuotas(*storageQuota)
+		must(err, "parsing storage quotas")
+
+		tenants, err := loadTenancy(*tenancyFile)
+		must(err, "loading tenancy")
+		var retentions []storage.Retention
+		if tenants != nil {
+			quotas = append(quotas, tenants.quotas...)
+			retentions = tenants.retentions
+		}
+
+		if *transformPlugins != "" {
+			for _, path := range strings.Split(*transformPlugins, ",") {
+				must(transform.LoadPlugin(strings.TrimSpace(path)), "loading transform plugins")
+			}
+		}
+		if *transformStages != "" {
+			transforms, err = transform.Parse(*transformStages)
+			must(err, "parsing transforms")
+		}
+
+		manager, err := storage.NewManagerWithOptions(*storageDir, opts)
 		must(err, "creating storage manager")
 
-		session := &storage.Session{
-			ID:         uuid.New().String(),
-			StartTime:  time.Now(),
-			PID:        *pid,
-			BinaryPath: executablePath,
+		if *baselineSession != "" {
+			baselineRates, err = loadBaseline(context.Background(), manager, *baselineSession)
+			must(err, "loading baseline session")
+			log.Printf("Comparing with baseline session %s", *baselineSession)
+		}
+
+		session = &storage.Session{
+			ID:          uuid.New().String(),
+			StartTime:   time.Now(),
+			PID:         *pid,
+			BinaryPath:  executablePath,
+			EventDetail: storage.EventDetail(*eventDetail),
+			Clock:       newClockSync(),
+		}
+		if len(sessionLabels) > 0 {
+			session.Labels = maps.Clone(sessionLabels)
+		}
+		session.Namespace = *sessionNamespace
+		session.Baseline = *baselineSession
+		session.Transforms = transforms.Specs()
+		if len(routes) > 0 {
+			session.Routes = make(map[string]string, len(routes))
+			for eventType, format := range routes {
+				session.Routes[getEventName(eventType)] = format
+			}
+		}
+
+		symbols, err = newSymbolizer(executablePath, *pid)
+		if err != nil {
+			log.Printf("Warning: goroutine functions will not be resolved: %v", err)
 		}
 
-		eventStore, err = manager.CreateSession(context.Background(), session, *storageFormat)
+		eventStore, err = createSessionStore(context.Background(), manager, session, *storageFormat, routes)
 		must(err, "creating event store")
+		lifecycle, err = manager.CreateLifecycleLog(session.ID)
+		must(err, "creating lifecycle log")
+		defer lifecycle.Close()
+		var pushSinks []storage.TeeSink
+		if *pushURL != "" {
+			remoteOpts, err := remoteOptions(session.ID)
+			must(err, "parsing remote sink options")
+			remoteOpts.MaxPending = *pushPending
+			pushToken, err := readPushToken(*pushTokenFile)
+			must(err, "reading push token")
+			push, err := newPushStore(*pushURL, pushToken, session, remoteOpts)
+			must(err, "creating collector push")
+			pushSinks = append(pushSinks, storage.TeeSink{Name: *pushURL, Store: push})
+		}
+		if len(teeTargets) > 0 || len(pushSinks) > 0 {
+			teeStore, err = createTeeStore(context.Background(), eventStore, session, teeTargets, pushSinks, opts, *teeQueueSize)
+			must(err, "creating storage tee")
+			eventStore = teeStore
+		}
+		if injected.storageWriteError > 0 {
+			eventStore = newFaultyStore(eventStore, injected.storageWriteError)
+		}
 		defer eventStore.Close()
 
 		apiServer = api.NewServer(manager, *webPort)
+		apiServer.SetClientStall(injected.wsStall)
+		if tenants != nil {
+			apiServer.EnableTenancy(tenants.tokens)
+		}
+		broadcast := apiServer.BroadcastBatch
+		if *liveSocketPath != "" {
+			socket, err := listenLiveSocket(*liveSocketPath, opts.Permissions)
+			must(err, "listening on live socket")
+			defer socket.Close()
+			log.Printf("Streaming live batches to %s", *liveSocketPath)
+			broadcast = func(events []*storage.Event) {
+				apiServer.BroadcastBatch(events)
+				socket.broadcast(events)
+			}
+		}
+		writer = newStorageWriter(eventStore, *writeQueueSize, &losses, broadcast)
+		apiServer.SetLiveSession(session.ID)
+		apiServer.SetLiveEventCounter(func() int64 {
+			return eventStore.GetSession().EventCount
+		})
 		go func() {
 			if err := apiServer.Start(); err != nil && err != http.ErrServerClosed {
-				log.Fatalf("API server error: %v", err)
+				log.Printf("API server error: %v", err)
+				stop.stop(storage.TerminationError, fmt.Sprintf("API server: %v", err))
 			}
 		}()
 		defer func() {
@@ -144,12 +465,44 @@ func main() {
 		defer func() {
 			endTime := time.Now()
 			session.EndTime = &endTime
+			clockEnd := sampleClock()
+			session.Clock.End = &clockEnd
 			session.EventCount = eventStore.GetSession().EventCount
+			session.Loss = losses.Buckets()
+			session.Annotations = append(anomalies.finish(), baseline.finish()...)
+			slices.SortStableFunc(session.Annotations, func(a, b storage.Annotation) int { return a.End.Compare(b.End) })
+			session.Sampling = sampling.Manifest()
+			session.LoadShedding = memwatch.Actions()
+			if attacher != nil {
+				session.Probes = attacher.Statuses()
+			}
+			if symbols != nil {
+				session.Functions = symbols.resolved()
+			}
+			storageBytes, err := manager.SessionBytes(session.ID)
+			if err != nil {
+				log.Printf("Warning: size of session: %v", err)
+			}
+			session.Termination = stop.report(session.Loss, storageBytes)
+			session.LifecycleEvents = lifecycle.Count()
 			if err := eventStore.UpdateSession(session); err != nil {
 				log.Printf("Error updating session: %v", err)
 			}
 		}()
 
+		if minFree, _ := parseByteSize(*minFreeSpace); minFree > 0 {
+			guard = &diskGuard{dir: *storageDir, minFree: minFree, onChange: apiServer.SetStorageError}
+			guardCtx, stopGuard := context.WithCancel(context.Background())
+			defer stopGuard()
+			go guard.run(guardCtx, *diskCheckInterval)
+		}
+
+		if len(quotas) > 0 || len(retentions) > 0 {
+			janitorCtx, stopJanitor := context.WithCancel(context.Background())
+			defer stopJanitor()
+			go runJanitor(janitorCtx, manager, quotas, retentions, *quotaInterval)
+		}
+
 		log.Printf("Web mode enabled: http://localhost:%d", *webPort)
 		log.Printf("Session ID: %s", session.ID)
 		log.Printf("Storage format: %s", *storageFormat)
@@ -160,33 +513,103 @@ func main() {
 	signal.Notify(stopper, os.Interrupt, syscall.SIGTERM)
 
 	// Allow the current process to lock memory for eBPF resources.
-	err := rlimit.RemoveMemlock()
+	err = rlimit.RemoveMemlock()
 	must(err, "locking memory")
 
 	// Load pre-compiled programs and maps into the kernel.
+	bpfObj, err := loadBPFObject(*bpfObjectPath, *bpfObjectSHA256)
+	must(err, "loading BPF object")
+	log.Printf("Loaded BPF object %s (sha256 %s)", bpfObj.source, bpfObj.sha256)
+
 	objs := ebpfObjects{}
-	err = loadEbpfObjects(&objs, nil)
+	err = loadObjects(&objs, bpfObj.spec, *pinPath)
 	must(err, "loading objects")
 	defer objs.Close()
 
+	flagger := newGoroutineFlagger(objs.FlaggedGoroutines, getMonotonicNs)
+	flagger.countAllocs = *flagTopAllocators > 0
+	if apiServer != nil {
+		apiServer.SetGoroutineFlagger(flagger)
+	}
+
+	detail := storage.EventDetail(*eventDetail)
+	if detail != storage.EventDetailStandard {
+		key, value := uint32(0), eventDetailValues[detail]
+		err := objs.EventDetail.Update(&key, &value, ebpf.UpdateAny)
+		must(err, "setting event detail level")
+		log.Printf("Set event detail level to %s", detail)
+	}
+
 	// Parse and apply sampling rates
-	rates, err := parseSamplingRates(*samplingRates)
+	rates, err := profileSamplingRates(*probeProfile, *samplingRates)
 	if err != nil {
 		log.Fatalf("Failed to parse sampling rates: %v", err)
 	}
 
-	// Apply sampling rates to the eBPF map
-	if objs.SamplingRates != nil {
-		for eventType, rate := range rates {
-			key := uint32(eventType)
-			err := objs.SamplingRates.Update(&key, &rate, ebpf.UpdateAny)
-			if err != nil {
-				log.Fatalf("Failed to update sampling rate for event %d: %v", eventType, err)
+	// In web mode, the lifecycle event types are sampled in userspace, after
+	// writing all of them to the lifecycle log
+	var lifecycleSampling *lifecycleSampler
+	if lifecycle != nil {
+		lifecycleSampling = newLifecycleSampler(make(map[storage.EventType]uint32), flagger)
+	}
+
+	// Apply sampling rates to the eBPF map, they are in effect from the start
+	// of the session
+	sampling = newSamplingController(objs.SamplingRates, lifecycleSampling, getMonotonicNs)
+	sampling.flagger = flagger
+	for eventType, rate := range rates {
+		err := sampling.set(eventType, rate, 0)
+		if errors.Is(err, errNoSamplingMap) {
+			log.Printf("Warning: Sampling rates map not available, sampling of %s will not be applied", getEventName(eventType))
+			continue
+		}
+		if err != nil {
+			log.Fatalf("Failed to set sampling rate for event %d: %v", eventType, err)
+		}
+		log.Printf("Set sampling rate for %s to %d%%", getEventName(eventType), rate)
+	}
+	if session != nil {
+		session.Sampling = sampling.Manifest()
+		if err := eventStore.UpdateSession(session); err != nil {
+			log.Printf("Error updating session: %v", err)
+		}
+	}
+	if apiServer != nil {
+		apiServer.SetSamplingController(sampling)
+	}
+
+	if baselineRates != nil {
+		baseline = newBaselineComparator(baselineRates, sampling.rate, flagger.isFlagged, *baselineThreshold, *baselineWindow, statsInterval, time.Now())
+	}
+
+	// allocs summarizes the allocations of every goroutine, only in web mode
+	var allocs *allocSummarizer
+	// stopSummaries stores the last summaries once the processing workers
+	// are done
+	stopSummaries := func() {}
+	if writer != nil && *allocSummaryInterval > 0 {
+		allocs = newAllocSummarizer(sampling.rate, flagger.isFlagged, getMonotonicNs)
+		storeSummaries := func(events []*storage.Event) {
+			if guard != nil && guard.paused.Load() {
+				losses.addPaused(uint64(len(events)))
+				return
+			}
+			writer.enqueue(events)
+		}
+
+		summaryCtx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			allocs.run(summaryCtx, *allocSummaryInterval, storeSummaries)
+		}()
+		stopSummaries = func() {
+			cancel()
+			<-done
+			if events := allocs.summarize(); len(events) > 0 {
+				storeSummaries(events)
 			}
-			log.Printf("Set sampling rate for %v to %d%%", eventType, rate)
 		}
-	} else if *samplingRates != "" {
-		log.Printf("Warning: Sampling rates map not available, sampling will not be applied")
 	}
 
 	// Open an ELF binary and read its symbols.
@@ -200,8 +623,50 @@ func main() {
 		symbolNewobject:  objs.UprobeNewobject,
 		symbolNewproc1:   objs.UprobeNewproc1,
 		symbolGoexit1:    objs.UprobeGoexit1,
+		symbolSemacquire: objs.UprobeSemacquire1,
+		symbolNewTimer:   objs.UprobeNewtimer,
+		symbolModTimer:   objs.UprobeTimerModify,
+		symbolStopTimer:  objs.UprobeStoptimer,
+
+		symbolConcatStrings:     objs.UprobeConcatstrings,
+		symbolSliceByteToString: objs.UprobeSlicebytetostring,
+
+		symbolNewm:  objs.UprobeNewm,
+		symbolMexit: objs.UprobeMexit,
+
+		symbolGCAssistAlloc: objs.UprobeGcassistalloc,
+	}
+
+	// Probes on runtime functions that may be inlined or renamed depending on
+	// the Go version of the target. Failing to attach them only disables the
+	// events they emit.
+	optionalProbes := map[string]*ebpf.Program{
+		symbolGCDrainMarkWorkerDedicated:  objs.UprobeGcdrainmarkworkerdedicated,
+		symbolGCDrainMarkWorkerFractional: objs.UprobeGcdrainmarkworkerfractional,
+		symbolGCDrainMarkWorkerIdle:       objs.UprobeGcdrainmarkworkeridle,
+		symbolGCControllerMarkWorkerStop:  objs.UprobeMarkworkerstop,
+
+		symbolMarkerBegin: objs.UprobeMarkerBegin,
+		symbolMarkerEnd:   objs.UprobeMarkerEnd,
 	}
 
+	if *traceIface {
+		probes[symbolConvT] = objs.UprobeConvt
+		probes[symbolConvTnoptr] = objs.UprobeConvtnoptr
+		probes[symbolConvT16] = objs.UprobeConvt16
+		probes[symbolConvT32] = objs.UprobeConvt32
+		probes[symbolConvT64] = objs.UprobeConvt64
+		probes[symbolConvTstring] = objs.UprobeConvtstring
+		probes[symbolConvTslice] = objs.UprobeConvtslice
+		probes[symbolAssertE2I] = objs.UprobeAsserte2i
+	}
+
+	attached, err := profileSymbols(*probeProfile)
+	must(err, "selecting probes")
+	maps.DeleteFunc(probes, func(symbol string, _ *ebpf.Program) bool { return !attached(symbol) })
+	maps.DeleteFunc(optionalProbes, func(symbol string, _ *ebpf.Program) bool { return !attached(symbol) })
+	log.Printf("Using profile %s (%s)", *probeProfile, strings.Join(profiles[*probeProfile].groups, ", "))
+
 	// Configure uprobe options based on whether we're attaching to a PID
 	uprobeOpts := &link.UprobeOptions{}
 	if *pid != 0 {
@@ -211,23 +676,126 @@ func main() {
 
 	probesAttachedAt := time.Now()
 
-	for symbol, probe := range probes {
-		uprobe, err := ex.Uprobe(symbol, probe, uprobeOpts)
-		must(err, "attaching uprobe at "+symbol)
-		defer uprobe.Close()
+	addresses, err := symbolAddresses(executablePath)
+	if err != nil {
+		log.Printf("Warning: cannot resolve the addresses of the probed symbols: %v", err)
+	}
+
+	order, err := parseAttachOrder(*attachOrder)
+	must(err, "parsing attach order")
+	steps, err := planAttach(probes, optionalProbes, order, *attachStagger)
+	must(err, "planning probe attachment")
+	attacher = newProbeAttacher(steps, addresses, func(symbol string, prog *ebpf.Program) (link.Link, error) {
+		return attachUprobe(ex, symbol, prog, uprobeOpts, *pinPath)
+	}, getMonotonicNs)
+	defer attacher.close()
+
+	// The probes after the first delay are attached once the capture runs
+	attachErr := attacher.attach(context.Background(), true)
+	if attacher.pending() {
+		log.Printf("Attaching the remaining probes while capturing")
+	}
+
+	// Record the probes before failing, so the session tells which probe
+	// could not be attached
+	if session != nil {
+		session.Probes = attacher.Statuses()
+		if err := eventStore.UpdateSession(session); err != nil {
+			log.Printf("Error updating session: %v", err)
+		}
+	}
+	must(attachErr, "attaching uprobes")
+
+	if *usdtPatterns != "" {
+		usdtLinks, usdtProbes, err := attachUSDTProbes(&objs, executablePath, *pid, strings.Split(*usdtPatterns, ","), *pinPath)
+		must(err, "attaching USDT probes")
+		for _, l := range usdtLinks {
+			defer l.Close()
+		}
+		log.Printf("Attached %d USDT probes at %d locations", len(usdtProbes), len(usdtLinks))
+
+		if session != nil {
+			session.USDTProbes = usdtProbes
+			if err := eventStore.UpdateSession(session); err != nil {
+				log.Printf("Error updating session: %v", err)
+			}
+		}
+	}
+
+	if *schedStatsInterval > 0 && profiles[*probeProfile].schedStats {
+		if *pid == 0 {
+			log.Printf("Warning: schedstats sampling requires -pid, it is disabled")
+		} else {
+			stopSchedStats, err := startSchedStats(&objs, *pid, executablePath, *schedStatsInterval)
+			if err != nil {
+				log.Printf("Warning: cannot start schedstats sampling: %v", err)
+			} else {
+				defer stopSchedStats()
+			}
+		}
 	}
 
-	rd, err := ringbuf.NewReader(objs.Events)
-	must(err, "creating events ringbuf reader")
-	defer rd.Close()
+	// Pins are only left behind if xgotop crashes, so that the next run can
+	// continue where this one stopped.
+	if *pinPath != "" {
+		defer removePins(*pinPath)
+	}
 
-	eventCh := make(chan *ebpfGoRuntimeEventT, 1_000_000)
+	// source produces the events of the capture, read from the events ring
+	// buffer of the probes
+	var source eventSource
+	source, err = newRingbufSource(objs.Events, *readWorkers, detail, &losses, injected.ringbufReadDelay)
+	must(err, "creating event source")
+	defer source.Close()
+
+	eventCh := make(chan *runtimeEvent, 1_000_000)
+
+	if limit, _ := parseByteSize(*memoryLimit); limit > 0 {
+		// The GC works harder as the heap approaches the limit, before load
+		// is shed
+		debug.SetMemoryLimit(int64(limit))
+
+		// An action takes a few checks to show in the RSS
+		memwatch = newMemoryWatchdog(limit, 3**memoryCheckInterval, cap(eventCh), sampling)
+		memwatchCtx, stopMemwatch := context.WithCancel(context.Background())
+		defer stopMemwatch()
+		go memwatch.run(memwatchCtx, *memoryCheckInterval)
+	}
 
 	var eventCount atomic.Int64
+
+	// Injected markers are written to eventCh as well, which must not happen
+	// once it is closed
+	var injectMu sync.RWMutex
+	injectStopped := false
+	if apiServer != nil {
+		apiServer.SetMarkerInjector(func(marker *api.MarkerRequest) error {
+			injectMu.RLock()
+			defer injectMu.RUnlock()
+			if injectStopped {
+				return errors.New("capture stopped")
+			}
+
+			event := &runtimeEvent{}
+			event.Timestamp = getMonotonicNs()
+			event.EventType = uint32(storage.EventTypeMarker)
+			event.Goroutine = marker.Goroutine
+			event.Attributes[0] = marker.ID
+			if marker.Phase == api.MarkerPhaseEnd {
+				event.Attributes[1] = analysis.MarkerEnd
+			}
+
+			eventCh <- event
+			eventCount.Add(1)
+			return nil
+		})
+	}
 	var lastEventCount atomic.Int64
 
 	var readEventCount atomic.Uint64
-	var procEventCount atomic.Uint64
+	// totalReadEvents counts the events read, for -max-events and expvar
+	var totalReadEvents atomic.Int64
+	var procEventCount, totalProcEvents atomic.Uint64
 
 	var eventCountsByType eventCounts
 
@@ -237,10 +805,32 @@ func main() {
 	var processingTimeNsSum atomic.Int64
 	var processingTimeNsCount atomic.Int64
 
+	publishPipelineVars(func() pipelineVars {
+		// Read errors are logged by the stats loop every second
+		kernelDrops, _ := readKernelDrops(objs.DroppedEvents)
+		vars := pipelineVars{
+			EventsRead:      uint64(totalReadEvents.Load()),
+			EventsProcessed: totalProcEvents.Load(),
+			EventsByType:    eventCountsByType.byName(),
+			Losses:          losses.totals(kernelDrops),
+			EventsQueued:    eventCount.Load(),
+			Threads:         eventCountsByType.threadCount(),
+			RSSBytes:        memwatch.usage(),
+		}
+		if writer != nil {
+			vars.WriteQueueDepth = writer.queueDepth()
+		}
+		return vars
+	})
+
 	readersStopped := make(chan struct{})
 	ctx, cancel := context.WithCancel(context.Background())
 	var readWg, processWg sync.WaitGroup
 
+	if *flagTopAllocators > 0 {
+		go flagger.runTopAllocatorsRule(ctx, *flagTopAllocators, *flagInterval)
+	}
+
 	readWg.Add(*readWorkers)
 	processWg.Add(*processWorkers)
 
@@ -253,16 +843,56 @@ func main() {
 	metricBPS := make([]float64, 0, 1_000)
 	metricBFL := make([]float64, 0, 1_000)
 	metricQWL := make([]float64, 0, 1_000)
+	metricLOS := make([]float64, 0, 1_000)
+	metricTHR := make([]float64, 0, 1_000)
+	metricWQD := make([]float64, 0, 1_000)
 	metricTimestamps := make([]float64, 0, 1_000)
 
 	var batchesPerSecond, batchFlushLatencySum, batchFlushLatencyCount atomic.Int64
-	var queueWaitLatencySum, queueWaitLatencyCount atomic.Int64
 
 	go func() {
-		<-stopper
-		log.Printf("[Main] Received stop signal, closing ringbuffer reader")
-		if err := rd.Close(); err != nil {
-			log.Printf("[Main] Error closing ringbuffer reader: %v", err)
+		select {
+		case sig := <-stopper:
+			stop.stop(storage.TerminationSignal, sig.String())
+		case <-stop.done:
+		}
+	}()
+	if *captureDuration > 0 {
+		timer := time.AfterFunc(*captureDuration, func() {
+			stop.stop(storage.TerminationDuration, "captured for "+captureDuration.String())
+		})
+		defer timer.Stop()
+	}
+	if *pid != 0 {
+		go watchTarget(ctx, *pid, stop)
+	}
+	if attacher.pending() {
+		go func() {
+			if err := attacher.attach(ctx, false); err != nil {
+				log.Printf("Error attaching uprobes: %v", err)
+				stop.stop(storage.TerminationError, err.Error())
+			}
+		}()
+	}
+
+	go func() {
+		<-stop.done
+		unread := source.Stats().Unread
+		losses.addShutdown(time.Now(), uint64(unread))
+		queues := storage.QueueDepths{RingbufUnread: unread, Events: eventCount.Load()}
+		if writer != nil {
+			queues.WriteBatches = writer.queueDepth()
+		}
+		if teeStore != nil {
+			queues.Sinks = make(map[string]int64)
+			for _, sink := range teeStore.SinkStats() {
+				queues.Sinks[sink.Name] = sink.Queued
+			}
+		}
+		stop.setQueues(queues)
+		log.Printf("[Main] Closing event source (%d events left unread)", unread)
+		if err := source.Close(); err != nil {
+			log.Printf("[Main] Error closing event source: %v", err)
 		}
 		cancel()
 	}()
@@ -362,11 +992,49 @@ func main() {
 					batchFlushLatency = 0
 				}
 
+				kernelDrops, err := readKernelDrops(objs.DroppedEvents)
+				if err != nil {
+					log.Printf("[Stats] Failed to read kernel drops: %v", err)
+				}
+				loss := losses.sample(time.Now(), kernelDrops)
+				if !*silent && loss.Total() > 0 {
+					log.Printf("[Stats] LOS: %d events (kernel: %d, userspace: %d, paused: %d, shed: %d)", loss.Total(), loss.Kernel, loss.Userspace, loss.Paused, loss.Shed)
+				}
+
+				for _, probe := range attacher.newOnsets() {
+					if !*silent {
+						log.Printf("[Stats] ONSET: %s emitted its first event %s after attaching", probe.Symbol,
+							time.Duration(probe.FirstEventAt-probe.AttachedAt))
+					}
+				}
+
+				threads := eventCountsByType.threadCount()
+				if !*silent {
+					log.Printf("[Stats] THR: %d (created: %d, exited: %d)", threads, eventCountsByType.newM.Load(), eventCountsByType.mExit.Load())
+				}
+
+				var writeQueueDepth int64
+				if writer != nil {
+					writeQueueDepth = writer.queueDepth()
+					if !*silent {
+						log.Printf("[Stats] WQD: %d batches", writeQueueDepth)
+					}
+				}
+
+				var sinks []storage.SinkStats
+				if teeStore != nil {
+					sinks = teeStore.SinkStats()
+					for _, sink := range sinks {
+						if !*silent {
+							log.Printf("[Stats] TEE: %s queued: %d, written: %d, failed: %d, dropped: %d, lag: %d ns", sink.Name, sink.Queued, sink.Written, sink.Failed, sink.Dropped, sink.LagNs)
+						}
+					}
+				}
+
 				var queueWaitLatency float64
-				qwlCnt := queueWaitLatencyCount.Load()
-				if qwlCnt != 0 {
-					qwlSum := queueWaitLatencySum.Load()
-					qwlAvg := qwlSum / qwlCnt
+				sourceStats := source.Stats()
+				if qwlCnt := sourceStats.Waited; qwlCnt != 0 {
+					qwlAvg := sourceStats.WaitNs / qwlCnt
 					queueWaitLatency = float64(qwlAvg)
 					if !*silent {
 						log.Printf("[Stats] QWL: %d ns/event\n\n", qwlAvg)
@@ -378,6 +1046,9 @@ func main() {
 					queueWaitLatency = 0
 				}
 
+				active := anomalies.observe(time.Now(), getMonotonicNs(), metricSample{rps: rps, qwl: queueWaitLatency, drops: loss.Total()})
+				divergences := baseline.compare(time.Now(), getMonotonicNs())
+
 				metricRPS = append(metricRPS, rps)
 				metricPPS = append(metricPPS, pps)
 				metricEWP = append(metricEWP, float64(ec))
@@ -386,6 +1057,9 @@ func main() {
 				metricBPS = append(metricBPS, batchesPerSec)
 				metricBFL = append(metricBFL, batchFlushLatency)
 				metricQWL = append(metricQWL, queueWaitLatency)
+				metricLOS = append(metricLOS, float64(loss.Total()))
+				metricTHR = append(metricTHR, float64(threads))
+				metricWQD = append(metricWQD, float64(writeQueueDepth))
 				metricTimestamps = append(metricTimestamps, float64(time.Now().UTC().UnixNano()))
 
 				if apiServer != nil {
@@ -397,59 +1071,45 @@ func main() {
 						PRC: int64(procTime),
 						BFL: batchFlushLatency,
 						QWL: queueWaitLatency,
+						LOS: loss.Total(),
+						THR: threads,
+						WQD: writeQueueDepth,
+
+						MEM: memwatch.usage(),
+
+						Anomalies: active,
+						Baseline:  divergences,
+						Sinks:     sinks,
+						Shedding:  memwatch.Actions(),
 					})
 				}
 			}
 		}
 	}(readersStopped)
 
-	for i := range *readWorkers {
-		go func(ctx context.Context, id int, wg *sync.WaitGroup, rd *ringbuf.Reader) {
-			defer func() {
-				wg.Done()
-				log.Printf("[RW-%d] I'm done!", i)
-			}()
-			log.Printf("[RW-%d] I'm alive!", i)
-
-			for {
-				event, err := reader(rd)
-				if err != nil {
-					if errors.Is(err, ringbuf.ErrClosed) {
-						log.Printf("[RW-%d] Ringbuffer closed, exiting", i)
-						return
-					}
+	must(source.Start(ctx), "starting event source")
+	for range *readWorkers {
+		go func(wg *sync.WaitGroup) {
+			defer wg.Done()
 
-					log.Printf("[RW-%d] Read error: %v", i, err)
+			for event := range source.Events() {
+				if memwatch.queueFull(len(eventCh)) {
+					losses.addShed(1)
 					continue
 				}
 
-				readTimeKernel := getMonotonicNs()
-
-				if readTimeKernel >= event.Timestamp {
-					ringbufferWaitTime := int64(readTimeKernel - event.Timestamp)
-					queueWaitLatencySum.Add(ringbufferWaitTime)
-					queueWaitLatencyCount.Add(1)
-
-					if ringbufferWaitTime >= 100*time.Millisecond.Nanoseconds() {
-						// Log unusually high wait times
-						log.Printf("[RW-%d] High ringbuffer wait time: %d ns (%.2f ms)", i,
-							ringbufferWaitTime, float64(ringbufferWaitTime)/1e6)
-					}
-				} else {
-					// This shouldn't happen
-					log.Printf("[RW-%d] Time inconsistency: readTime=%d < eventTime=%d", i,
-						readTimeKernel, event.Timestamp)
-				}
-
 				eventCh <- event
 				eventCount.Add(1)
 				readEventCount.Add(1)
+				if n := totalReadEvents.Add(1); *maxEvents > 0 && n == *maxEvents {
+					stop.stop(storage.TerminationMaxEvents, fmt.Sprintf("read %d events", *maxEvents))
+				}
 			}
-		}(ctx, i, &readWg, rd)
+		}(&readWg)
 	}
 
 	for i := range *processWorkers {
-		go func(id int, wg *sync.WaitGroup, eventCh chan *ebpfGoRuntimeEventT, readersStopped chan struct{}) {
+		go func(id int, wg *sync.WaitGroup, eventCh chan *runtimeEvent, readersStopped chan struct{}) {
 			defer func() {
 				wg.Done()
 				log.Printf("[PW-%d] I'm done!", i)
@@ -457,7 +1117,7 @@ func main() {
 			log.Printf("[PW-%d] I'm alive!", i)
 
 			batch := make([]*storage.Event, 0, *batchSize)
-			batchEbpfEvents := make([]*ebpfGoRuntimeEventT, 0, *batchSize)
+			batchEbpfEvents := make([]*runtimeEvent, 0, *batchSize)
 			flushTimer := time.NewTimer(*batchFlushInterval)
 			lastBatchTime := time.Now()
 
@@ -468,14 +1128,19 @@ func main() {
 
 				batchStart := time.Now()
 
-				if *webMode && eventStore != nil {
-					if err := eventStore.WriteBatch(batch); err != nil {
-						log.Printf("[PW-%d] Failed to write batch to storage: %v", id, err)
+				if guard != nil && guard.paused.Load() {
+					losses.addPaused(uint64(len(batch)))
+				} else if writer != nil {
+					transformed := transforms.Transform(batch)
+					if err := lifecycle.Write(transformed); err != nil {
+						log.Printf("[PW-%d] Failed to write lifecycle events: %v", id, err)
 					}
-
-					if apiServer != nil {
-						apiServer.BroadcastBatch(batch)
+					transformed = lifecycleSampling.sample(transformed)
+					if len(transformed) > 0 {
+						writer.enqueue(transformed)
 					}
+					// The writer owns the batch from now on
+					batch = make([]*storage.Event, 0, *batchSize)
 				}
 
 				if !*webMode && !*silent {
@@ -507,6 +1172,7 @@ func main() {
 					for event := range eventCh {
 						eventCount.Add(-1)
 						procEventCount.Add(1)
+						totalProcEvents.Add(1)
 						probeDurationNsCount.Add(1)
 						probeDurationNsSum.Add(int64(event.ProbeDurationNs))
 						processStart := time.Now()
@@ -519,6 +1185,13 @@ func main() {
 						processingTimeNsSum.Add(processDuration)
 						processingTimeNsCount.Add(1)
 						updateEventCounts(&eventCountsByType, event)
+						if symbols != nil {
+							symbols.observe(event)
+						}
+						flagger.observe(event)
+						attacher.observe(event)
+						allocs.observe(event)
+						baseline.observe(storageEvent)
 
 						if len(batch) >= *batchSize {
 							flushBatch()
@@ -537,6 +1210,7 @@ func main() {
 
 					eventCount.Add(-1)
 					procEventCount.Add(1)
+					totalProcEvents.Add(1)
 					probeDurationNsCount.Add(1)
 					probeDurationNsSum.Add(int64(event.ProbeDurationNs))
 					processStart := time.Now()
@@ -549,6 +1223,13 @@ func main() {
 					processingTimeNsSum.Add(processDuration)
 					processingTimeNsCount.Add(1)
 					updateEventCounts(&eventCountsByType, event)
+					if symbols != nil {
+						symbols.observe(event)
+					}
+					flagger.observe(event)
+					attacher.observe(event)
+					allocs.observe(event)
+					baseline.observe(storageEvent)
 
 					if len(batch) >= *batchSize {
 						flushBatch()
@@ -564,12 +1245,33 @@ func main() {
 
 	log.Printf("All readers are done")
 	close(readersStopped) // signal to processors that no more events will be coming
+	injectMu.Lock()
+	injectStopped = true
+	injectMu.Unlock()
 	close(eventCh)
 
 	processWg.Wait()
 	log.Printf("All processors are done")
 
-	saveMetrics(metricRPS, metricPPS, metricEWP, metricLAT, metricPRC, metricBPS, metricBFL, metricQWL, metricTimestamps, &eventCountsByType)
+	stopSummaries()
+
+	if writer != nil {
+		writer.close()
+		log.Printf("Storage writer is done")
+	}
+
+	// Record the losses since the last stats interval
+	kernelDrops, err := readKernelDrops(objs.DroppedEvents)
+	if err != nil {
+		log.Printf("[Main] Failed to read kernel drops: %v", err)
+	}
+	losses.sample(time.Now(), kernelDrops)
+
+	saveMetrics(metricRPS, metricPPS, metricEWP, metricLAT, metricPRC, metricBPS, metricBFL, metricQWL, metricLOS, metricTHR, metricWQD, metricTimestamps, &eventCountsByType)
+}
+
+func getEventName(eventType storage.EventType) string {
+	return eventType.String()
 }
 
 func must(err error, op string) {
@@ -579,21 +1281,21 @@ func must(err error, op string) {
 }
 
 //go:inline
-func reader(rd *ringbuf.Reader) (*ebpfGoRuntimeEventT, error) {
+func reader(rd *ringbuf.Reader) (*runtimeEvent, error) {
 	record, err := rd.Read()
 	if err != nil {
 		return nil, err
 	}
-	var event ebpfGoRuntimeEventT
-	if err := binary.Read(bytes.NewBuffer(record.RawSample), binary.LittleEndian, &event); err != nil {
+	event, err := decodeEvent(record.RawSample)
+	if err != nil {
 		return nil, fmt.Errorf("parsing event: %v", err)
 	}
 
-	return &event, nil
+	return event, nil
 }
 
 //go:inline
-func updateEventCounts(counts *eventCounts, event *ebpfGoRuntimeEventT) {
+func updateEventCounts(counts *eventCounts, event *runtimeEvent) {
 	switch event.EventType {
 	case 0: // EventTypeCasGStatus
 		counts.casGStatus.Add(1)
@@ -607,102 +1309,110 @@ func updateEventCounts(counts *eventCounts, event *ebpfGoRuntimeEventT) {
 		counts.newGoroutine.Add(1)
 	case 5: // EventTypeGoExit
 		counts.goExit.Add(1)
+	case 6: // EventTypeSemaBlock
+		counts.semaBlock.Add(1)
+	case 7: // EventTypeTimerCreate
+		counts.timerCreate.Add(1)
+	case 8: // EventTypeTimerStop
+		counts.timerStop.Add(1)
+	case 9: // EventTypeIfaceConv
+		counts.ifaceConv.Add(1)
+	case 10: // EventTypeStringAlloc
+		counts.stringAlloc.Add(1)
+	case 11: // EventTypeSchedStats
+		counts.schedStats.Add(1)
+	case 12: // EventTypeNewM
+		counts.newM.Add(1)
+	case 13: // EventTypeMExit
+		counts.mExit.Add(1)
+	case 14: // EventTypeGCAssist
+		counts.gcAssist.Add(1)
+	case 15: // EventTypeGCMarkWorker
+		counts.gcMarkWorker.Add(1)
+	case 16: // EventTypeMarker
+		counts.marker.Add(1)
+	case 17: // EventTypeUSDT
+		counts.usdt.Add(1)
 	}
 }
 
 //go:inline
-func convertToStorageEvent(event *ebpfGoRuntimeEventT) *storage.Event {
+func convertToStorageEvent(event *runtimeEvent) *storage.Event {
 	return &storage.Event{
 		Timestamp:       event.Timestamp,
 		EventType:       storage.EventType(event.EventType),
 		Goroutine:       event.Goroutine,
 		ParentGoroutine: event.ParentGoroutine,
 		Attributes:      event.Attributes,
+		Thread:          event.Thread,
+		P:               event.P,
 	}
 }
 
 //go:inline
-func logEvent(id int, event *ebpfGoRuntimeEventT) {
+func logEvent(id int, event *runtimeEvent) {
 	switch event.EventType {
 	case 0:
 		log.Printf("[PW-%d] [ts:%d,lat:%d] goroutine %d state %d -> %d", id, event.Timestamp, event.ProbeDurationNs, event.Attributes[2], event.Attributes[0], event.Attributes[1])
 	case 1:
-		log.Printf("[PW-%d] [ts:%d,lat:%d] goroutine %d allocated slice []%s with length %d and capacity %d", id, event.Timestamp, event.ProbeDurationNs, event.Goroutine, kindToString(Kind(event.Attributes[1])), event.Attributes[2], event.Attributes[3])
+		log.Printf("[PW-%d] [ts:%d,lat:%d] goroutine %d allocated slice []%s with length %d and capacity %d", id, event.Timestamp, event.ProbeDurationNs, event.Goroutine, storage.Kind(event.Attributes[1]), event.Attributes[2], event.Attributes[3])
 	case 2:
-		log.Printf("[PW-%d] [ts:%d,lat:%d] goroutine %d allocated map[%s]%s with initial capacity %d", id, event.Timestamp, event.ProbeDurationNs, event.Goroutine, kindToString(Kind(event.Attributes[1])), kindToString(Kind(event.Attributes[2])), event.Attributes[3])
+		log.Printf("[PW-%d] [ts:%d,lat:%d] goroutine %d allocated map[%s]%s with initial capacity %d", id, event.Timestamp, event.ProbeDurationNs, event.Goroutine, storage.Kind(event.Attributes[1]), storage.Kind(event.Attributes[2]), event.Attributes[3])
 	case 3:
-		log.Printf("[PW-%d] [ts:%d,lat:%d] goroutine %d allocated object of size %d and kind %s", id, event.Timestamp, event.ProbeDurationNs, event.Goroutine, event.Attributes[0], kindToString(Kind(event.Attributes[1])))
+		log.Printf("[PW-%d] [ts:%d,lat:%d] goroutine %d allocated object of size %d and kind %s", id, event.Timestamp, event.ProbeDurationNs, event.Goroutine, event.Attributes[0], storage.Kind(event.Attributes[1]))
 	case 4:
 		log.Printf("[PW-%d] [ts:%d,lat:%d] goroutine %d created new goroutine %d", id, event.Timestamp, event.ProbeDurationNs, event.Attributes[0], event.Attributes[1])
 	case 5:
 		log.Printf("[PW-%d] [ts:%d,lat:%d] goroutine %d exited", id, event.Timestamp, event.ProbeDurationNs, event.Attributes[0])
+	case 6:
+		log.Printf("[PW-%d] [ts:%d,lat:%d] goroutine %d blocked for %d ns on semaphore 0x%x, released by goroutine %d", id, event.Timestamp, event.ProbeDurationNs, event.Goroutine, event.Attributes[0], event.Attributes[1], event.Attributes[3])
+	case 7:
+		log.Printf("[PW-%d] [ts:%d,lat:%d] goroutine %d created timer 0x%x with period %d", id, event.Timestamp, event.ProbeDurationNs, event.Goroutine, event.Attributes[0], event.Attributes[1])
+	case 8:
+		log.Printf("[PW-%d] [ts:%d,lat:%d] goroutine %d stopped timer 0x%x", id, event.Timestamp, event.ProbeDurationNs, event.Goroutine, event.Attributes[0])
+	case 9:
+		variant := storage.IfaceConvVariant(event.Attributes[2])
+		log.Printf("[PW-%d] [ts:%d,lat:%d] goroutine %d converted %s of size %d to an interface (%s)", id, event.Timestamp, event.ProbeDurationNs, event.Goroutine, storage.Kind(event.Attributes[0]), event.Attributes[1], variant)
+	case 10:
+		source := storage.StringAllocSource(event.Attributes[1])
+		log.Printf("[PW-%d] [ts:%d,lat:%d] goroutine %d built a string of length %d from %d operands (%s, on stack: %t)", id, event.Timestamp, event.ProbeDurationNs, event.Goroutine, event.Attributes[0], event.Attributes[2], source, event.Attributes[3] != 0)
+	case 11:
+		log.Printf("[PW-%d] [ts:%d,lat:%d] P %d/%d has %d runnable goroutines queued (status: %d)", id, event.Timestamp, event.ProbeDurationNs, event.Attributes[0], event.Attributes[3], event.Attributes[1], event.Attributes[2])
+	case 12:
+		if event.Attributes[1] != 0 {
+			log.Printf("[PW-%d] [ts:%d,lat:%d] goroutine %d started OS thread M%d for P%d", id, event.Timestamp, event.ProbeDurationNs, event.Goroutine, event.Attributes[0], event.Attributes[2])
+		} else {
+			log.Printf("[PW-%d] [ts:%d,lat:%d] goroutine %d started OS thread M%d", id, event.Timestamp, event.ProbeDurationNs, event.Goroutine, event.Attributes[0])
+		}
+	case 13:
+		log.Printf("[PW-%d] [ts:%d,lat:%d] OS thread M%d exited", id, event.Timestamp, event.ProbeDurationNs, event.Attributes[0])
+	case 14:
+		if event.Attributes[1] != 0 {
+			log.Printf("[PW-%d] [ts:%d,lat:%d] goroutine %d assists the GC to pay off %d bytes of allocation debt", id, event.Timestamp, event.ProbeDurationNs, event.Goroutine, event.Attributes[0])
+		} else {
+			log.Printf("[PW-%d] [ts:%d,lat:%d] goroutine %d assists the GC", id, event.Timestamp, event.ProbeDurationNs, event.Goroutine)
+		}
+	case 15:
+		mode := storage.GCMarkWorkerMode(event.Attributes[1])
+		if event.Attributes[0] == 0 {
+			log.Printf("[PW-%d] [ts:%d,lat:%d] %s GC mark worker started", id, event.Timestamp, event.ProbeDurationNs, mode)
+		} else {
+			log.Printf("[PW-%d] [ts:%d,lat:%d] %s GC mark worker goroutine %d stopped after %d ns", id, event.Timestamp, event.ProbeDurationNs, mode, event.Goroutine, event.Attributes[2])
+		}
+	case 16:
+		phase := "began"
+		if event.Attributes[1] == analysis.MarkerEnd {
+			phase = "ended"
+		}
+		log.Printf("[PW-%d] [ts:%d,lat:%d] goroutine %d %s operation %d", id, event.Timestamp, event.ProbeDurationNs, event.Goroutine, phase, event.Attributes[0])
+	case 17:
+		log.Printf("[PW-%d] [ts:%d,lat:%d] USDT probe %d fired with arguments %v", id, event.Timestamp, event.ProbeDurationNs, event.Attributes[0], event.Attributes[1:])
 	default:
 		log.Printf("[PW-%d] UNKNOWN EVENT TYPE: %d", id, event.EventType)
 	}
 }
 
 //go:inline
-func kindToString(kind Kind) string {
-	switch kind {
-	case Invalid:
-		return "INVALID"
-	case Bool:
-		return "bool"
-	case Int:
-		return "int"
-	case Int8:
-		return "int8"
-	case Int16:
-		return "int16"
-	case Int32:
-		return "int32"
-	case Int64:
-		return "int64"
-	case Uint:
-		return "uint"
-	case Uint8:
-		return "uint8"
-	case Uint16:
-		return "uint16"
-	case Uint32:
-		return "uint32"
-	case Uint64:
-		return "uint64"
-	case Uintptr:
-		return "uintptr"
-	case Float32:
-		return "float32"
-	case Float64:
-		return "float64"
-	case Complex64:
-		return "complex64"
-	case Complex128:
-		return "complex128"
-	case Array:
-		return "ARRAY"
-	case Chan:
-		return "chan T"
-	case Func:
-		return "func"
-	case Interface:
-		return "interface{}"
-	case Map:
-		return "map[K]V"
-	case Pointer:
-		return "*T"
-	case Slice:
-		return "[]T"
-	case String:
-		return "string"
-	case Struct:
-		return "struct{}"
-	case UnsafePointer:
-		return "unsafe.Pointer"
-	default:
-		return fmt.Sprintf("Unknown kind: %d", kind)
-	}
-}
-
 func validateFlags() {
 	if *readWorkers <= 0 {
 		log.Fatal("-rw must be positive")
@@ -712,6 +1422,23 @@ func validateFlags() {
 		log.Fatal("-pw must be positive")
 	}
 
+	if *readOnly {
+		if *binaryPath != "" || *pid != 0 {
+			log.Fatal("-read-only does not capture, -b and -pid cannot be provided")
+		}
+		return
+	}
+
+	if *collector {
+		if *binaryPath != "" || *pid != 0 {
+			log.Fatal("-collector does not capture, -b and -pid cannot be provided")
+		}
+		if !storageFormats[*storageFormat] {
+			log.Fatalf("unknown -storage-format %s", *storageFormat)
+		}
+		return
+	}
+
 	if *binaryPath == "" && *pid == 0 {
 		log.Fatal("either -b or -pid must be provided")
 	}
@@ -719,6 +1446,99 @@ func validateFlags() {
 	if *binaryPath != "" && *pid != 0 {
 		log.Fatal("only one of -b or -pid can be provided")
 	}
+
+	if _, ok := profiles[*probeProfile]; !ok {
+		log.Fatalf("unknown -profile %s", *probeProfile)
+	}
+
+	if *memoryRing <= 0 {
+		log.Fatal("-memory-ring-size must be positive")
+	}
+
+	if _, err := parseByteSize(*minFreeSpace); err != nil {
+		log.Fatal("-min-free-space must be a size like 512MiB or 10GB")
+	}
+
+	if _, err := parseByteSize(*memoryLimit); err != nil {
+		log.Fatal("-memory-limit must be a size like 512MiB or 2GB")
+	}
+	if *memoryCheckInterval <= 0 {
+		log.Fatal("-memory-check-interval must be positive")
+	}
+
+	if *pushURL != "" && !*webMode {
+		log.Fatal("-push-url requires -web")
+	}
+	if *pushTokenFile != "" && *pushURL == "" {
+		log.Fatal("-push-token-file requires -push-url")
+	}
+	if *sessionNamespace != "" {
+		if err := storage.ValidateNamespace(*sessionNamespace); err != nil {
+			log.Fatalf("-namespace: %v", err)
+		}
+	}
+	if *pushPending <= 0 {
+		log.Fatal("-push-pending must be positive")
+	}
+
+	if _, err := parseByteSize(*remoteSpoolSize); err != nil {
+		log.Fatal("-remote-spool-size must be a size like 512MiB or 10GB")
+	}
+	if *remoteMaxBackoff <= 0 {
+		log.Fatal("-remote-max-backoff must be positive")
+	}
+
+	if *transformStages != "" && !*webMode {
+		log.Fatal("-transform requires -web")
+	}
+	if *allocSummaryInterval < 0 {
+		log.Fatal("-alloc-summary-interval must not be negative")
+	}
+	if *attachStagger < 0 {
+		log.Fatal("-attach-stagger must not be negative")
+	}
+	if *allocSummaryInterval > 0 && !*webMode {
+		log.Fatal("-alloc-summary-interval requires -web")
+	}
+	if *baselineSession != "" && !*webMode {
+		log.Fatal("-baseline requires -web")
+	}
+	if *baselineThreshold <= 1 {
+		log.Fatal("-baseline-threshold must be greater than 1")
+	}
+	if *baselineWindow <= 0 {
+		log.Fatal("-baseline-window must be positive")
+	}
+	if *liveSocketPath != "" && !*webMode {
+		log.Fatal("-live-socket requires -web")
+	}
+
+	if *captureDuration < 0 {
+		log.Fatal("-duration must not be negative")
+	}
+	if *maxEvents < 0 {
+		log.Fatal("-max-events must not be negative")
+	}
+
+	if *diskCheckInterval <= 0 {
+		log.Fatal("-disk-check-interval must be positive")
+	}
+	if *flagTopAllocators < 0 {
+		log.Fatal("-flag-top-allocators must not be negative")
+	}
+	if *flagTopAllocators > maxFlaggedGoroutines {
+		log.Fatalf("-flag-top-allocators must be at most %d", maxFlaggedGoroutines)
+	}
+	if *quotaInterval <= 0 {
+		log.Fatal("-quota-interval must be positive")
+	}
+	if *flagInterval <= 0 {
+		log.Fatal("-flag-interval must be positive")
+	}
+
+	if _, ok := eventDetailValues[storage.EventDetail(*eventDetail)]; !ok {
+		log.Fatal("-event-detail must be one of minimal, standard or full")
+	}
 }
 
 func saveMetrics(
@@ -730,6 +1550,9 @@ func saveMetrics(
 	metricBPS []float64,
 	metricBFL []float64,
 	metricQWL []float64,
+	metricLOS []float64,
+	metricTHR []float64,
+	metricWQD []float64,
 	metricTimestamps []float64,
 	eventCountsByType *eventCounts,
 ) {
@@ -742,6 +1565,9 @@ func saveMetrics(
 		Bps         []float64      `json:"bps"`
 		Bfl         []float64      `json:"bfl"`
 		Qwl         []float64      `json:"qwl"`
+		Los         []float64      `json:"los"`
+		Thr         []float64      `json:"thr"`
+		Wqd         []float64      `json:"wqd"`
 		Ts          []float64      `json:"ts"`
 		EventCounts map[int]uint64 `json:"event_counts"`
 	}{
@@ -753,14 +1579,29 @@ func saveMetrics(
 		Bps: metricBPS,
 		Bfl: metricBFL,
 		Qwl: metricQWL,
+		Los: metricLOS,
+		Thr: metricTHR,
+		Wqd: metricWQD,
 		Ts:  metricTimestamps,
 		EventCounts: map[int]uint64{
-			0: eventCountsByType.casGStatus.Load(),
-			1: eventCountsByType.makeSlice.Load(),
-			2: eventCountsByType.makeMap.Load(),
-			3: eventCountsByType.newObject.Load(),
-			4: eventCountsByType.newGoroutine.Load(),
-			5: eventCountsByType.goExit.Load(),
+			0:  eventCountsByType.casGStatus.Load(),
+			1:  eventCountsByType.makeSlice.Load(),
+			2:  eventCountsByType.makeMap.Load(),
+			3:  eventCountsByType.newObject.Load(),
+			4:  eventCountsByType.newGoroutine.Load(),
+			5:  eventCountsByType.goExit.Load(),
+			6:  eventCountsByType.semaBlock.Load(),
+			7:  eventCountsByType.timerCreate.Load(),
+			8:  eventCountsByType.timerStop.Load(),
+			9:  eventCountsByType.ifaceConv.Load(),
+			10: eventCountsByType.stringAlloc.Load(),
+			11: eventCountsByType.schedStats.Load(),
+			12: eventCountsByType.newM.Load(),
+			13: eventCountsByType.mExit.Load(),
+			14: eventCountsByType.gcAssist.Load(),
+			15: eventCountsByType.gcMarkWorker.Load(),
+			16: eventCountsByType.marker.Load(),
+			17: eventCountsByType.usdt.Load(),
 		},
 	}
 	b, err := json.MarshalIndent(metrics, "", "  ")
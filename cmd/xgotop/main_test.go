@@ -3,9 +3,26 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/ringbuf"
+
+	"go.sazak.io/xgotop/cmd/xgotop/analysis"
+	"go.sazak.io/xgotop/cmd/xgotop/api"
 	"go.sazak.io/xgotop/cmd/xgotop/storage"
+	"go.sazak.io/xgotop/cmd/xgotop/transform"
 )
 
 func TestParseSamplingRates(t *testing.T) {
@@ -229,6 +246,18 @@ func TestGetEventName(t *testing.T) {
 		{storage.EventTypeNewObject, "newobject"},
 		{storage.EventTypeNewGoroutine, "newgoroutine"},
 		{storage.EventTypeGoExit, "goexit"},
+		{storage.EventTypeSemaBlock, "semablock"},
+		{storage.EventTypeTimerCreate, "timercreate"},
+		{storage.EventTypeTimerStop, "timerstop"},
+		{storage.EventTypeIfaceConv, "ifaceconv"},
+		{storage.EventTypeStringAlloc, "stringalloc"},
+		{storage.EventTypeSchedStats, "schedstats"},
+		{storage.EventTypeNewM, "newm"},
+		{storage.EventTypeMExit, "mexit"},
+		{storage.EventTypeGCAssist, "gcassist"},
+		{storage.EventTypeGCMarkWorker, "gcmarkworker"},
+		{storage.EventTypeMarker, "marker"},
+		{storage.EventTypeUSDT, "usdt"},
 		{storage.EventType(999), "unknown(999)"}, // Invalid event type
 	}
 
@@ -242,6 +271,95 @@ func TestGetEventName(t *testing.T) {
 	}
 }
 
+func TestParseUSDTArg(t *testing.T) {
+	tests := []struct {
+		name     string
+		arch     string
+		input    string
+		expected usdtArgSpec
+		wantErr  bool
+	}{
+		{
+			name:     "amd64 register",
+			arch:     "amd64",
+			input:    "8@%rdi",
+			expected: usdtArgSpec{ArgType: usdtArgReg, RegOff: 112},
+		},
+		{
+			name:     "amd64 signed 32-bit register",
+			arch:     "amd64",
+			input:    "-4@%esi",
+			expected: usdtArgSpec{ArgType: usdtArgReg, RegOff: 104, ArgSigned: 1, ArgBitshift: 32},
+		},
+		{
+			name:     "amd64 dereference",
+			arch:     "amd64",
+			input:    "8@-16(%rbp)",
+			expected: usdtArgSpec{ArgType: usdtArgRegDeref, RegOff: 32, ValOff: ^uint64(15)},
+		},
+		{
+			name:     "amd64 constant",
+			arch:     "amd64",
+			input:    "2@$42",
+			expected: usdtArgSpec{ArgType: usdtArgConst, ValOff: 42, ArgBitshift: 48},
+		},
+		{
+			name:     "arm64 register",
+			arch:     "arm64",
+			input:    "8@x1",
+			expected: usdtArgSpec{ArgType: usdtArgReg, RegOff: 8},
+		},
+		{
+			name:     "arm64 dereference",
+			arch:     "arm64",
+			input:    "-4@[sp, 12]",
+			expected: usdtArgSpec{ArgType: usdtArgRegDeref, RegOff: 248, ValOff: 12, ArgSigned: 1, ArgBitshift: 32},
+		},
+		{
+			name:     "arm64 constant",
+			arch:     "arm64",
+			input:    "1@7",
+			expected: usdtArgSpec{ArgType: usdtArgConst, ValOff: 7, ArgBitshift: 56},
+		},
+		{
+			name:    "invalid size",
+			arch:    "amd64",
+			input:   "3@%rdi",
+			wantErr: true,
+		},
+		{
+			name:    "unknown register",
+			arch:    "arm64",
+			input:   "8@q0",
+			wantErr: true,
+		},
+		{
+			name:    "unsupported architecture",
+			arch:    "riscv64",
+			input:   "8@a0",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseUSDTArg(tt.arch, tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, result)
+			}
+		})
+	}
+}
+
 // Helper function
 func contains(s, substr string) bool {
 	return len(s) >= len(substr) && (s == substr || len(s) > 0 && (s[:len(substr)] == substr || contains(s[1:], substr)))
@@ -266,3 +384,1479 @@ func BenchmarkParseSamplingRates(b *testing.B) {
 		})
 	}
 }
+
+func TestParseStorageOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileMode string
+		dirMode  string
+		owner    string
+		expected storage.Permissions
+		wantErr  bool
+	}{
+		{
+			name:     "defaults",
+			fileMode: "0644",
+			dirMode:  "0755",
+			expected: storage.DefaultPermissions,
+		},
+		{
+			name:     "private modes",
+			fileMode: "600",
+			dirMode:  "0700",
+			expected: storage.Permissions{FileMode: 0600, DirMode: 0700, UID: -1, GID: -1},
+		},
+		{
+			name:     "owner",
+			fileMode: "0640",
+			dirMode:  "0750",
+			owner:    "0:1000",
+			expected: storage.Permissions{FileMode: 0640, DirMode: 0750, UID: 0, GID: 1000},
+		},
+		{
+			name:     "group only",
+			fileMode: "0640",
+			dirMode:  "0750",
+			owner:    ":1000",
+			expected: storage.Permissions{FileMode: 0640, DirMode: 0750, UID: -1, GID: 1000},
+		},
+		{
+			name:     "non-octal mode",
+			fileMode: "0648",
+			dirMode:  "0755",
+			wantErr:  true,
+		},
+		{
+			name:     "mode with special bits",
+			fileMode: "0644",
+			dirMode:  "1777",
+			wantErr:  true,
+		},
+		{
+			name:     "owner without separator",
+			fileMode: "0644",
+			dirMode:  "0755",
+			owner:    "1000",
+			wantErr:  true,
+		},
+		{
+			name:     "negative uid",
+			fileMode: "0644",
+			dirMode:  "0755",
+			owner:    "-1:0",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseStorageOptions(tt.fileMode, tt.dirMode, tt.owner)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result.ReadOnly {
+				t.Errorf("expected writable options")
+			}
+			if result.Permissions != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, result.Permissions)
+			}
+		})
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected uint64
+		wantErr  bool
+	}{
+		{name: "plain bytes", input: "1048576", expected: 1 << 20},
+		{name: "bytes suffix", input: "512B", expected: 512},
+		{name: "binary units", input: "512MiB", expected: 512 << 20},
+		{name: "fractional binary units", input: "1.5GiB", expected: 3 << 29},
+		{name: "decimal units", input: "10GB", expected: 10_000_000_000},
+		{name: "space before unit", input: "2 KiB", expected: 2048},
+		{name: "zero disables", input: "0", expected: 0},
+		{name: "unknown unit", input: "5PB", wantErr: true},
+		{name: "negative", input: "-1GiB", wantErr: true},
+		{name: "empty", input: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseByteSize(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got %d", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("expected %d, got %d", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestParseStorageRoutes(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected map[storage.EventType]string
+		wantErr  bool
+	}{
+		{
+			name:     "empty",
+			input:    "",
+			expected: map[storage.EventType]string{},
+		},
+		{
+			name:  "single event",
+			input: "casgstatus:memory",
+			expected: map[storage.EventType]string{
+				storage.EventTypeCasGStatus: "memory",
+			},
+		},
+		{
+			name:  "groups and joined events",
+			input: "casgstatus:memory, allocations:protobuf,newgoroutine+goexit:JSONL",
+			expected: map[storage.EventType]string{
+				storage.EventTypeCasGStatus:   "memory",
+				storage.EventTypeMakeSlice:    "protobuf",
+				storage.EventTypeMakeMap:      "protobuf",
+				storage.EventTypeNewObject:    "protobuf",
+				storage.EventTypeStringAlloc:  "protobuf",
+				storage.EventTypeNewGoroutine: "jsonl",
+				storage.EventTypeGoExit:       "jsonl",
+			},
+		},
+		{
+			name:    "missing format",
+			input:   "casgstatus",
+			wantErr: true,
+		},
+		{
+			name:    "unknown format",
+			input:   "casgstatus:parquet",
+			wantErr: true,
+		},
+		{
+			name:    "unknown event",
+			input:   "gcstop:memory",
+			wantErr: true,
+		},
+		{
+			name:    "conflicting routes",
+			input:   "allocations:protobuf,makemap:memory",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseStorageRoutes(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(result) != len(tt.expected) {
+				t.Fatalf("expected %d routes, got %d: %v", len(tt.expected), len(result), result)
+			}
+			for eventType, format := range tt.expected {
+				if result[eventType] != format {
+					t.Errorf("%s: expected %s, got %s", eventType, format, result[eventType])
+				}
+			}
+		})
+	}
+}
+
+func TestParseTeeTargets(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []teeTarget
+		wantErr  bool
+	}{
+		{
+			name:  "empty",
+			input: "",
+		},
+		{
+			name:  "default format",
+			input: "/mnt/sessions",
+			expected: []teeTarget{
+				{dir: "/mnt/sessions", format: "protobuf"},
+			},
+		},
+		{
+			name:  "multiple targets",
+			input: "/mnt/sessions:JSONL, ./backup",
+			expected: []teeTarget{
+				{dir: "/mnt/sessions", format: "jsonl"},
+				{dir: "./backup", format: "protobuf"},
+			},
+		},
+		{
+			name:    "unknown format",
+			input:   "/mnt/sessions:parquet",
+			wantErr: true,
+		},
+		{
+			name:    "missing directory",
+			input:   ":jsonl",
+			wantErr: true,
+		},
+		{
+			name:    "duplicate directory",
+			input:   "/mnt/sessions,/mnt/sessions:jsonl",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseTeeTargets(tt.input, "protobuf")
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(result) != len(tt.expected) {
+				t.Fatalf("expected %d targets, got %d: %v", len(tt.expected), len(result), result)
+			}
+			for i, target := range tt.expected {
+				if result[i] != target {
+					t.Errorf("target %d: expected %v, got %v", i, target, result[i])
+				}
+			}
+		})
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	for name, p := range profiles {
+		for _, group := range p.groups {
+			if _, ok := probeGroups[group]; !ok {
+				t.Errorf("profile %s: unknown probe group %s", name, group)
+			}
+		}
+		if _, err := parseSamplingRates(p.sampling); err != nil {
+			t.Errorf("profile %s: invalid sampling rates: %v", name, err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		profile  string
+		rates    string
+		attached map[string]bool
+		expected map[storage.EventType]uint32
+		wantErr  bool
+	}{
+		{
+			name:    "full",
+			profile: "full",
+			attached: map[string]bool{
+				symbolCasgstatus:  true,
+				symbolNewobject:   true,
+				symbolMarkerBegin: true,
+			},
+			expected: map[storage.EventType]uint32{},
+		},
+		{
+			name:    "lifecycle",
+			profile: "lifecycle",
+			attached: map[string]bool{
+				symbolNewproc1:      true,
+				symbolCasgstatus:    true,
+				symbolNewobject:     false,
+				symbolGCAssistAlloc: false,
+				symbolMarkerBegin:   true,
+			},
+			expected: map[storage.EventType]uint32{
+				storage.EventTypeCasGStatus: 0,
+			},
+		},
+		{
+			name:    "alloc with override",
+			profile: "alloc",
+			rates:   "newobject:1,makeslice:0.2",
+			attached: map[string]bool{
+				symbolCasgstatus: false,
+				symbolMakemap:    true,
+			},
+			expected: map[storage.EventType]uint32{
+				storage.EventTypeNewObject:   100,
+				storage.EventTypeMakeSlice:   20,
+				storage.EventTypeMakeMap:     50,
+				storage.EventTypeStringAlloc: 50,
+			},
+		},
+		{
+			name:    "unknown profile",
+			profile: "network",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attached, err := profileSymbols(tt.profile)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for symbol, expected := range tt.attached {
+				if attached(symbol) != expected {
+					t.Errorf("%s: expected attached %t, got %t", symbol, expected, !expected)
+				}
+			}
+
+			rates, err := profileSamplingRates(tt.profile, tt.rates)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(rates) != len(tt.expected) {
+				t.Fatalf("expected %d rates, got %d: %v", len(tt.expected), len(rates), rates)
+			}
+			for eventType, rate := range tt.expected {
+				if got, ok := rates[eventType]; !ok || got != rate {
+					t.Errorf("%s: expected %d, got %d", eventType, rate, got)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFaults(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected faults
+		wantErr  bool
+	}{
+		{
+			name:  "disabled",
+			input: "",
+		},
+		{
+			name:  "all faults",
+			input: "storage-write-error:0.25, ringbuf-read-delay:5ms,ws-stall:2s",
+			expected: faults{
+				storageWriteError: 0.25,
+				ringbufReadDelay:  5 * time.Millisecond,
+				wsStall:           2 * time.Second,
+			},
+		},
+		{
+			name:    "error rate above 1",
+			input:   "storage-write-error:1.5",
+			wantErr: true,
+		},
+		{
+			name:    "invalid duration",
+			input:   "ws-stall:2",
+			wantErr: true,
+		},
+		{
+			name:    "unknown fault",
+			input:   "disk-full:1",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseFaults(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestStorageWriterFaults(t *testing.T) {
+	memory := storage.NewMemoryStore(&storage.Session{ID: "faults"}, 0)
+	store := newFaultyStore(memory, 0.5)
+	// Every other batch fails
+	var rolls int
+	store.roll = func() float64 {
+		rolls++
+		return float64(rolls%2) * 0.9
+	}
+
+	var losses lossTracker
+	var broadcast int
+	writer := newStorageWriter(store, 1, &losses, func(batch []*storage.Event) {
+		broadcast += len(batch)
+	})
+	for i := range 10 {
+		batch := make([]*storage.Event, i+1)
+		for j := range batch {
+			batch[j] = &storage.Event{Timestamp: uint64(i)}
+		}
+		writer.enqueue(batch)
+	}
+	writer.close()
+
+	// The second, fourth, ... batches of sizes 2, 4, ... fail
+	if lost := losses.userspace.Load(); lost != 2+4+6+8+10 {
+		t.Errorf("expected 30 lost events, got %d", lost)
+	}
+	events, err := memory.ReadEvents(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(events) != 1+3+5+7+9 {
+		t.Errorf("expected 25 stored events, got %d", len(events))
+	}
+	// Failed batches are still broadcast
+	if broadcast != 55 {
+		t.Errorf("expected 55 broadcast events, got %d", broadcast)
+	}
+}
+
+func TestRingbufReadDelayFault(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	// Three events and a read error before the ring buffer is closed
+	results := []error{nil, nil, errors.New("short record"), nil, ringbuf.ErrClosed}
+	var losses lossTracker
+	source := &ringbufSource{
+		losses:    &losses,
+		readDelay: delay,
+		events:    make(chan *runtimeEvent, len(results)),
+		next: func() (*runtimeEvent, error) {
+			err := results[0]
+			results = results[1:]
+			if err != nil {
+				return nil, err
+			}
+			return &runtimeEvent{}, nil
+		},
+	}
+
+	start := time.Now()
+	source.wg.Add(1)
+	source.readEvents(0)
+
+	// Every read is delayed, including the failed ones
+	if elapsed := time.Since(start); elapsed < 5*delay {
+		t.Errorf("read for %v, want at least %v", elapsed, 5*delay)
+	}
+	if len(source.events) != 3 {
+		t.Errorf("expected 3 events, got %d", len(source.events))
+	}
+	if lost := losses.userspace.Load(); lost != 1 {
+		t.Errorf("expected 1 lost event, got %d", lost)
+	}
+}
+
+func TestLoadBPFObjectChecksum(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "custom.o")
+	if err := os.WriteFile(file, []byte("not an ELF file"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("not an ELF file"))
+	digest := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name     string
+		file     string
+		expected string
+		mismatch bool
+	}{
+		{name: "mismatch", file: file, expected: strings.Repeat("0", 64), mismatch: true},
+		{name: "match", file: file, expected: strings.ToUpper(digest)},
+		{name: "unverified", file: file},
+		// The embedded object matches the checksums generated with it
+		{name: "embedded"},
+		{name: "embedded mismatch", expected: strings.Repeat("0", 64), mismatch: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Matching objects are parsed, and external ones fail as they
+			// are not ELF
+			_, err := loadBPFObject(tt.file, tt.expected)
+			if mismatch := err != nil && strings.Contains(err.Error(), "checksum mismatch"); mismatch != tt.mismatch {
+				t.Errorf("error = %v, want checksum mismatch %v", err, tt.mismatch)
+			}
+		})
+	}
+}
+
+func TestParseChecksums(t *testing.T) {
+	sums, err := parseChecksums("AB12  ebpf_x86_bpfel.o\n\ncd34 *ebpf_arm64_bpfel.o\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]string{
+		"ebpf_x86_bpfel.o":   "ab12",
+		"ebpf_arm64_bpfel.o": "cd34",
+	}
+	if !reflect.DeepEqual(sums, expected) {
+		t.Errorf("checksums = %v, want %v", sums, expected)
+	}
+
+	if _, err := parseChecksums("ab12\n"); err == nil {
+		t.Error("expected an error for a line without file name")
+	}
+}
+
+func TestParseQuotas(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []storage.Quota
+		wantErr  bool
+	}{
+		{
+			name:  "empty",
+			input: "",
+		},
+		{
+			name:  "multiple quotas",
+			input: "service=api:20GB, service=batch:512MiB,team=core:0",
+			expected: []storage.Quota{
+				{Label: "service", Value: "api", MaxBytes: 20e9},
+				{Label: "service", Value: "batch", MaxBytes: 512 << 20},
+				{Label: "team", Value: "core", MaxBytes: 0},
+			},
+		},
+		{
+			name:    "missing size",
+			input:   "service=api",
+			wantErr: true,
+		},
+		{
+			name:    "missing value",
+			input:   "service:20GB",
+			wantErr: true,
+		},
+		{
+			name:    "invalid size",
+			input:   "service=api:lots",
+			wantErr: true,
+		},
+		{
+			name:    "duplicate quota",
+			input:   "service=api:20GB,service=api:10GB",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseQuotas(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(result) != len(tt.expected) {
+				t.Fatalf("expected %d quotas, got %d: %v", len(tt.expected), len(result), result)
+			}
+			for i, quota := range tt.expected {
+				if result[i] != quota {
+					t.Errorf("quota %d: expected %+v, got %+v", i, quota, result[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseTenancy(t *testing.T) {
+	tests := []struct {
+		name           string
+		input          string
+		wantTokens     []api.TenantToken
+		wantQuotas     []storage.Quota
+		wantRetentions []storage.Retention
+		wantErr        bool
+	}{
+		{
+			name: "namespaces and tokens",
+			input: `{
+				"namespaces": {"search": {}, "payments": {"quota": "1KB", "retention": "24h"}},
+				"tokens": [{"token": "a", "namespaces": ["payments"]}, {"token": "b", "namespaces": ["payments", "search"], "admin": true}]
+			}`,
+			wantTokens: []api.TenantToken{
+				{Token: "a", Namespaces: []string{"payments"}},
+				{Token: "b", Namespaces: []string{"payments", "search"}, Admin: true},
+			},
+			wantQuotas:     []storage.Quota{{Namespace: "payments", MaxBytes: 1000}},
+			wantRetentions: []storage.Retention{{Namespace: "payments", MaxAge: 24 * time.Hour}},
+		},
+		{
+			name:    "no tokens",
+			input:   `{"namespaces": {"payments": {}}}`,
+			wantErr: true,
+		},
+		{
+			name:    "undeclared namespace",
+			input:   `{"namespaces": {"payments": {}}, "tokens": [{"token": "a", "namespaces": ["search"]}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid namespace",
+			input:   `{"namespaces": {"Payments": {}}, "tokens": [{"token": "a", "namespaces": ["Payments"]}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "duplicate token",
+			input:   `{"namespaces": {"payments": {}}, "tokens": [{"token": "a", "namespaces": ["payments"]}, {"token": "a", "namespaces": ["payments"]}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid retention",
+			input:   `{"namespaces": {"payments": {"retention": "-1h"}}, "tokens": [{"token": "a", "namespaces": ["payments"]}]}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseTenancy([]byte(tt.input))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(result.tokens, tt.wantTokens) {
+				t.Errorf("tokens = %+v, want %+v", result.tokens, tt.wantTokens)
+			}
+			if !reflect.DeepEqual(result.quotas, tt.wantQuotas) {
+				t.Errorf("quotas = %+v, want %+v", result.quotas, tt.wantQuotas)
+			}
+			if !reflect.DeepEqual(result.retentions, tt.wantRetentions) {
+				t.Errorf("retentions = %+v, want %+v", result.retentions, tt.wantRetentions)
+			}
+		})
+	}
+}
+
+func TestCaptureStopper(t *testing.T) {
+	stop := newCaptureStopper()
+	stop.stop(storage.TerminationMaxEvents, "read 100 events")
+	stop.stop(storage.TerminationSignal, "interrupt")
+
+	select {
+	case <-stop.done:
+	default:
+		t.Fatal("expected done to be closed")
+	}
+
+	losses := []storage.LossBucket{
+		{Kernel: 2, Userspace: 1},
+		{Kernel: 3, Shutdown: 4, Paused: 5},
+	}
+	report := stop.report(losses, 1024)
+	if report.Reason != storage.TerminationMaxEvents || report.Detail != "read 100 events" {
+		t.Errorf("expected the first reason, got %s (%s)", report.Reason, report.Detail)
+	}
+	want := storage.LossTotals{Kernel: 5, Userspace: 1, Shutdown: 4, Paused: 5}
+	if report.Drops != want {
+		t.Errorf("expected drops %+v, got %+v", want, report.Drops)
+	}
+	if report.StorageBytes != 1024 {
+		t.Errorf("expected 1024 storage bytes, got %d", report.StorageBytes)
+	}
+}
+
+func TestTransformStages(t *testing.T) {
+	tests := []struct {
+		name    string
+		specs   string
+		wantErr bool
+	}{
+		{name: "drop", specs: "drop:casgstatus+timers"},
+		{name: "hash", specs: "hash:allocations=0+1"},
+		{name: "pipeline", specs: "hash:newobject=1, drop:casgstatus"},
+		{name: "unknown stage", specs: "redact:newobject", wantErr: true},
+		{name: "drop without events", specs: "drop", wantErr: true},
+		{name: "hash without attributes", specs: "hash:newobject", wantErr: true},
+		{name: "hash invalid attribute", specs: "hash:newobject=5", wantErr: true},
+		{name: "unknown event", specs: "drop:mallocgc", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := transform.Parse(tt.specs)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+
+	pipeline, err := transform.Parse("hash:newobject=1,drop:casgstatus")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	kind := uint64(storage.KindStruct)
+	events := []*storage.Event{
+		{EventType: storage.EventTypeNewObject, Attributes: [5]uint64{16, kind}},
+		{EventType: storage.EventTypeCasGStatus, Attributes: [5]uint64{1, 2}},
+		{EventType: storage.EventTypeNewObject, Attributes: [5]uint64{32, kind}},
+		{EventType: storage.EventTypeMakeSlice, Attributes: [5]uint64{0, kind}},
+	}
+	kept := pipeline.Transform(events)
+
+	if len(kept) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(kept))
+	}
+	if kept[0].Attributes[1] == kind || kept[0].Attributes[1] != kept[1].Attributes[1] {
+		t.Errorf("expected equal values to hash equally, got %x and %x", kept[0].Attributes[1], kept[1].Attributes[1])
+	}
+	if kept[0].Attributes[0] != 16 || kept[1].Attributes[0] != 32 {
+		t.Errorf("expected other attributes to be kept, got %v and %v", kept[0].Attributes, kept[1].Attributes)
+	}
+	if kept[2].Attributes[1] != kind {
+		t.Errorf("expected other event types to be kept, got %v", kept[2].Attributes)
+	}
+}
+
+func TestLifecycleSampler(t *testing.T) {
+	lifecycleRates := map[storage.EventType]uint32{
+		storage.EventTypeNewGoroutine: 0,
+		storage.EventTypeGoExit:       0,
+	}
+
+	// Rate 0 disables lifecycle events even for flagged goroutines
+	flagger := newGoroutineFlagger(nil, nil)
+	flagger.flagged[1] = "test"
+	sampler := newLifecycleSampler(lifecycleRates, flagger)
+	events := []*storage.Event{
+		{EventType: storage.EventTypeNewGoroutine, Goroutine: 1},
+		{EventType: storage.EventTypeMakeMap, Goroutine: 1},
+		{EventType: storage.EventTypeGoExit, Goroutine: 2},
+	}
+	kept := sampler.sample(events)
+	if len(kept) != 1 || kept[0].EventType != storage.EventTypeMakeMap {
+		t.Errorf("expected only the makemap event, got %+v", kept)
+	}
+
+	// Flagged goroutines bypass sampling
+	sampler.setRate(storage.EventTypeGoExit, 1)
+	events = []*storage.Event{
+		{EventType: storage.EventTypeGoExit, Goroutine: 1},
+	}
+	if kept := sampler.sample(events); len(kept) != 1 {
+		t.Errorf("expected the goexit event of the flagged goroutine, got %+v", kept)
+	}
+}
+
+func TestSymbolAddresses(t *testing.T) {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addresses, err := symbolAddresses(executable)
+	if err != nil {
+		t.Fatalf("symbolAddresses: %v", err)
+	}
+	for _, symbol := range []string{symbolCasgstatus, symbolNewproc1, symbolGoexit1} {
+		if addresses[symbol] == 0 {
+			t.Errorf("address of %s not resolved", symbol)
+		}
+	}
+	if _, ok := addresses["runtime.doesNotExist"]; ok {
+		t.Error("resolved a symbol missing from the binary")
+	}
+}
+
+func TestAnomalyDetector(t *testing.T) {
+	d := newAnomalyDetector(time.Second)
+	start := time.Unix(1000, 0)
+
+	samples := []metricSample{
+		{rps: 1000, qwl: 10_000}, {rps: 1100, qwl: 12_000}, {rps: 900, qwl: 9_000}, {rps: 1000, qwl: 11_000}, {rps: 1000, qwl: 10_000},
+		// Collapsing read rate while events are lost
+		{rps: 100, qwl: 10_000, drops: 50},
+		{rps: 50, qwl: 10_000, drops: 20},
+		{rps: 1000, qwl: 10_000},
+		// Latency spike
+		{rps: 1000, qwl: 500_000},
+		{rps: 1000, qwl: 10_000},
+	}
+	var active [][]storage.AnnotationKind
+	for i, sample := range samples {
+		active = append(active, d.observe(start.Add(time.Duration(i+1)*time.Second), uint64(i+1)*1e9, sample))
+	}
+
+	if len(active[4]) != 0 {
+		t.Errorf("anomalies during the warmup: %v", active[4])
+	}
+	if len(active[6]) != 2 {
+		t.Errorf("active anomalies = %v, want rps-collapse and drop-burst", active[6])
+	}
+
+	annotations := d.finish()
+	want := []struct {
+		kind       storage.AnnotationKind
+		start, end uint64
+		detail     string
+	}{
+		{storage.AnnotationRPSCollapse, 5e9, 7e9, "read rate fell to 50 ev/s, baseline 1000 ev/s"},
+		{storage.AnnotationDropBurst, 5e9, 7e9, "70 events lost"},
+		{storage.AnnotationQWLSpike, 8e9, 9e9, "queue wait latency rose to 500000 ns/event, baseline 10205 ns/event"},
+	}
+	if len(annotations) != len(want) {
+		t.Fatalf("got %d annotations, want %d: %+v", len(annotations), len(want), annotations)
+	}
+	for i, w := range want {
+		a := annotations[i]
+		if a.Kind != w.kind || a.StartTimestamp != w.start || a.EndTimestamp != w.end || a.Detail != w.detail || !a.Automatic {
+			t.Errorf("annotation %d = %+v, want %s [%d, %d] %q", i, a, w.kind, w.start, w.end, w.detail)
+		}
+	}
+}
+
+func TestSamplingController(t *testing.T) {
+	now := uint64(0)
+	lifecycle := newLifecycleSampler(make(map[storage.EventType]uint32), nil)
+	controller := newSamplingController(nil, lifecycle, func() uint64 { return now })
+
+	if err := controller.set(storage.EventTypeNewGoroutine, 10, 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	// Without the sampling rates map, only lifecycle event types are sampled
+	if err := controller.set(storage.EventTypeNewObject, 10, 0); !errors.Is(err, errNoSamplingMap) {
+		t.Errorf("expected errNoSamplingMap, got %v", err)
+	}
+
+	now = 500
+	if err := controller.SetSamplingRate("newgoroutine", 0.5); err != nil {
+		t.Fatalf("SetSamplingRate: %v", err)
+	}
+	if err := controller.SetSamplingRate("newgoroutine", 2); err == nil {
+		t.Error("expected an error for a rate above 1")
+	}
+	if err := controller.SetSamplingRate("nosuchevent", 0.5); err == nil {
+		t.Error("expected an error for an unknown event")
+	}
+
+	expected := &storage.SamplingManifest{Rates: map[string][]storage.SamplingPeriod{
+		"newgoroutine": {
+			{Percent: 10, FromTimestamp: 0, ToTimestamp: 500},
+			{Percent: 50, FromTimestamp: 500},
+		},
+	}}
+	if manifest := controller.Manifest(); !reflect.DeepEqual(manifest, expected) {
+		t.Errorf("manifest = %+v, want %+v", manifest, expected)
+	}
+	if rates := controller.SamplingRates(); rates["newgoroutine"] != 0.5 {
+		t.Errorf("rates = %v, want newgoroutine at 0.5", rates)
+	}
+	if lifecycle.rates[storage.EventTypeNewGoroutine] != 50 {
+		t.Errorf("lifecycle sampler rate = %d, want 50", lifecycle.rates[storage.EventTypeNewGoroutine])
+	}
+}
+
+func TestLiveSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "live.sock")
+	socket, err := listenLiveSocket(path, storage.DefaultPermissions)
+	if err != nil {
+		t.Fatalf("listenLiveSocket: %v", err)
+	}
+	defer socket.Close()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	// Wait for the client to be registered
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		socket.mu.Lock()
+		n := len(socket.clients)
+		socket.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("client not registered")
+		}
+	}
+
+	batches := [][]*storage.Event{
+		{{Timestamp: 1, EventType: storage.EventTypeNewObject, Goroutine: 7, Attributes: [5]uint64{16}}},
+		{{Timestamp: 2, EventType: storage.EventTypeGoExit, Goroutine: 7}, {Timestamp: 3, EventType: storage.EventTypeMakeMap, Goroutine: 8}},
+	}
+	for _, batch := range batches {
+		socket.broadcast(batch)
+	}
+
+	for i, want := range batches {
+		data, err := storage.ReadFrame(conn)
+		if err != nil {
+			t.Fatalf("ReadFrame: %v", err)
+		}
+		events, err := storage.UnmarshalBatch(data)
+		if err != nil {
+			t.Fatalf("UnmarshalBatch: %v", err)
+		}
+		if !reflect.DeepEqual(events, want) {
+			t.Errorf("batch %d = %+v, want %+v", i, events, want)
+		}
+	}
+}
+
+func TestMemoryWatchdog(t *testing.T) {
+	rates := map[storage.EventType]uint32{storage.EventTypeNewObject: 4}
+	rss := uint64(200)
+	w := &memoryWatchdog{
+		limit: 100,
+		rate: func(eventType storage.EventType) uint32 {
+			if percent, ok := rates[eventType]; ok {
+				return percent
+			}
+			return 100
+		},
+		setRate: func(eventType storage.EventType, percent uint32) error {
+			rates[eventType] = percent
+			return nil
+		},
+		now:        func() uint64 { return 1 },
+		readMemory: func() (uint64, uint64, error) { return rss, rss / 2, nil },
+	}
+	w.queueLimit.Store(4 * minShedQueue)
+
+	var kinds []storage.ShedActionKind
+	for range 12 {
+		w.check()
+	}
+	for _, action := range w.Actions() {
+		kinds = append(kinds, action.Kind)
+	}
+
+	// The queue reaches its floor after the second shrink, the rates after
+	// the sixth raise, and then nothing is left to shed
+	expected := []storage.ShedActionKind{
+		storage.ShedRaiseSampling, storage.ShedShrinkBuffers, storage.ShedDropCasGStatus,
+		storage.ShedShrinkBuffers, storage.ShedRaiseSampling, storage.ShedRaiseSampling,
+		storage.ShedRaiseSampling, storage.ShedRaiseSampling, storage.ShedRaiseSampling,
+	}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Errorf("actions = %v, want %v", kinds, expected)
+	}
+	if rates[storage.EventTypeCasGStatus] != 0 || rates[storage.EventTypeNewObject] != minShedRate || rates[storage.EventTypeMakeSlice] != minShedRate {
+		t.Errorf("rates = %v, want casgstatus dropped and the others at %d%%", rates, minShedRate)
+	}
+	if limit := w.queueLimit.Load(); limit != minShedQueue {
+		t.Errorf("queue limit = %d, want %d", limit, minShedQueue)
+	}
+	if !w.queueFull(minShedQueue) || w.queueFull(minShedQueue-1) {
+		t.Error("queueFull does not follow the queue limit")
+	}
+
+	// Nothing is shed below the limit
+	rss = 50
+	w.check()
+	if n := len(w.Actions()); n != len(expected) {
+		t.Errorf("%d actions below the limit, want %d", n, len(expected))
+	}
+}
+
+func TestAllocSummarizer(t *testing.T) {
+	rates := map[storage.EventType]uint32{storage.EventTypeNewObject: 25}
+	summarizer := newAllocSummarizer(
+		func(eventType storage.EventType) uint32 {
+			if percent, ok := rates[eventType]; ok {
+				return percent
+			}
+			return 100
+		},
+		func(gid uint32) bool { return gid == 9 },
+		func() uint64 { return 1000 },
+	)
+	event := func(eventType storage.EventType, gid uint32, attrs ...uint64) *runtimeEvent {
+		e := &runtimeEvent{}
+		e.EventType = uint32(eventType)
+		e.Goroutine = gid
+		copy(e.Attributes[:], attrs)
+		return e
+	}
+
+	for _, e := range []*runtimeEvent{
+		// Sampled at 25%, so every newobject event stands for 4 objects
+		event(storage.EventTypeNewObject, 7, 16),
+		event(storage.EventTypeNewObject, 7, 32),
+		// 8 byte elements with a capacity of 10, unsampled
+		event(storage.EventTypeMakeSlice, 7, 8, 0, 5, 10),
+		// Flagged goroutines bypass sampling
+		event(storage.EventTypeNewObject, 9, 64),
+		event(storage.EventTypeGoExit, 9, 9),
+		event(storage.EventTypeMakeMap, 8, 8, 0, 8, 0, 100),
+	} {
+		summarizer.observe(e)
+	}
+
+	summaries := func() map[uint32][5]uint64 {
+		byGoroutine := make(map[uint32][5]uint64)
+		for _, e := range summarizer.summarize() {
+			if e.EventType != storage.EventTypeAllocSummary || e.Timestamp != 1000 {
+				t.Errorf("unexpected summary %+v", e)
+			}
+			byGoroutine[e.Goroutine] = e.Attributes
+		}
+		return byGoroutine
+	}
+
+	expected := map[uint32][5]uint64{
+		7: {4*16 + 4*32 + 80, 4 + 4 + 1, 4*16 + 4*32 + 80, 9, 3},
+		9: {64, 1, 64, 1, 1},
+	}
+	if got := summaries(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("summaries = %v, want %v", got, expected)
+	}
+
+	// Only goroutines that allocated since are summarized, with their
+	// running totals, and exited goroutines are forgotten
+	summarizer.observe(event(storage.EventTypeMakeSlice, 7, 4, 0, 1, 1))
+	expected = map[uint32][5]uint64{7: {4, 1, 4*16 + 4*32 + 80 + 4, 10, 1}}
+	if got := summaries(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("summaries = %v, want %v", got, expected)
+	}
+	if _, ok := summarizer.goroutines[9]; ok {
+		t.Error("exited goroutine 9 is still tracked")
+	}
+}
+
+func TestPipelineVars(t *testing.T) {
+	var counts eventCounts
+	for _, eventType := range []storage.EventType{storage.EventTypeNewObject, storage.EventTypeUSDT} {
+		event := &runtimeEvent{}
+		event.EventType = uint32(eventType)
+		updateEventCounts(&counts, event)
+	}
+
+	byName := counts.byName()
+	if len(byName) != 18 {
+		t.Errorf("expected counts of 18 event types, got %d", len(byName))
+	}
+	if byName["newobject"] != 1 || byName["usdt"] != 1 || byName["makemap"] != 0 {
+		t.Errorf("unexpected counts %v", byName)
+	}
+
+	var losses lossTracker
+	losses.addUserspace(2)
+	losses.addShed(3)
+	losses.sample(time.Now(), 5)
+	losses.addPaused(1)
+	losses.addShutdown(time.Now(), 4)
+
+	// The totals include the losses of the current interval
+	expected := storage.LossTotals{Kernel: 7, Userspace: 2, Shutdown: 4, Paused: 1, Shed: 3}
+	if totals := losses.totals(7); totals != expected {
+		t.Errorf("totals = %+v, want %+v", totals, expected)
+	}
+}
+
+// closedLink is a link.Link counting the times it was closed.
+type closedLink struct {
+	link.Link
+	closed *int
+}
+
+func (l closedLink) Close() error {
+	*l.closed++
+	return nil
+}
+
+func TestProbeAttacher(t *testing.T) {
+	program := &ebpf.Program{}
+	probes := map[string]*ebpf.Program{symbolNewproc1: program, symbolCasgstatus: program, symbolNewobject: program}
+	optionalProbes := map[string]*ebpf.Program{symbolMarkerBegin: program}
+
+	order, err := parseAttachOrder("runtime.newproc1, runtime.newobject:0s,go.sazak.io/xgotop/marker.Begin:1h")
+	if err != nil {
+		t.Fatalf("parseAttachOrder: %v", err)
+	}
+	steps, err := planAttach(probes, optionalProbes, order, time.Millisecond)
+	if err != nil {
+		t.Fatalf("planAttach: %v", err)
+	}
+	var plan []string
+	for _, step := range steps {
+		plan = append(plan, step.symbol+":"+step.delay.String())
+	}
+	expected := []string{"runtime.newproc1:0s", "runtime.newobject:0s", "go.sazak.io/xgotop/marker.Begin:1h0m0s", "runtime.casgstatus:1ms"}
+	if !reflect.DeepEqual(plan, expected) {
+		t.Errorf("plan = %v, want %v", plan, expected)
+	}
+	for _, invalid := range []string{"runtime.mexit", "runtime.newproc1,runtime.newproc1"} {
+		order, err := parseAttachOrder(invalid)
+		if err == nil {
+			_, err = planAttach(probes, optionalProbes, order, 0)
+		}
+		if err == nil {
+			t.Errorf("expected an error for attach order %q", invalid)
+		}
+	}
+	if _, err := parseAttachOrder("runtime.newproc1:-1s"); err == nil {
+		t.Error("expected an error for a negative delay")
+	}
+
+	var now uint64 = 100
+	closed := 0
+	attacher := newProbeAttacher(steps, nil, func(symbol string, _ *ebpf.Program) (link.Link, error) {
+		now += 10
+		if symbol == symbolNewobject {
+			return nil, errors.New("inlined")
+		}
+		return closedLink{closed: &closed}, nil
+	}, func() uint64 { return now })
+
+	// The required newobject probe fails before the delayed marker probe
+	if err := attacher.attach(context.Background(), true); err == nil {
+		t.Fatal("expected newobject to fail")
+	}
+	newGoroutine := func(ts uint64) *runtimeEvent {
+		event := &runtimeEvent{}
+		event.Timestamp = ts
+		event.EventType = uint32(storage.EventTypeNewGoroutine)
+		return event
+	}
+	attacher.observe(newGoroutine(99))
+	attacher.observe(newGoroutine(150))
+	attacher.observe(newGoroutine(120))
+
+	statuses := attacher.Statuses()
+	if len(statuses) != 4 {
+		t.Fatalf("expected 4 statuses, got %+v", statuses)
+	}
+	if s := statuses[0]; !s.Attached || s.AttachedAt != 100 || s.FirstEventAt != 120 {
+		t.Errorf("unexpected newproc1 status %+v", s)
+	}
+	if s := statuses[1]; s.Attached || s.Error != "inlined" {
+		t.Errorf("unexpected newobject status %+v", s)
+	}
+	if s := statuses[2]; !s.Pending || s.DelayNanos != time.Hour.Nanoseconds() {
+		t.Errorf("unexpected marker status %+v", s)
+	}
+	if onsets := attacher.newOnsets(); len(onsets) != 1 || onsets[0].Symbol != symbolNewproc1 {
+		t.Errorf("unexpected onsets %+v", onsets)
+	}
+	if onsets := attacher.newOnsets(); len(onsets) != 0 {
+		t.Errorf("onsets reported twice: %+v", onsets)
+	}
+
+	// Cancelling the wait for the delay leaves the probes pending
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := attacher.attach(ctx, false); err != nil || !attacher.pending() {
+		t.Errorf("attach = %v, pending = %v", err, attacher.pending())
+	}
+	attacher.close()
+	if closed != 1 {
+		t.Errorf("expected 1 closed link, got %d", closed)
+	}
+}
+
+func TestParseQueryFile(t *testing.T) {
+	file := `{"queries": [
+		{"name": "timer leaks", "analysis": "timer-leaks", "max": 0},
+		{
+			"name": "large allocations",
+			"filter": {"event": ["newobject", "makeslice"], "where": {"size": ">=1024", "kind": "struct"}},
+			"group_by": ["goroutine"],
+			"sum": "size",
+			"top": 5
+		},
+		{
+			"name": "sleep after alloc",
+			"pattern": [{"event": "newobject"}, {"event": "casgstatus", "where": {"new_status": "waiting"}}],
+			"within": "500ms"
+		}
+	]}`
+	one, zero := 1.0, 0.0
+	expected := []analysis.QuerySpec{
+		{Name: "timer leaks", Analysis: "timer-leaks", Max: &zero},
+		{
+			Name: "large allocations",
+			Filter: analysis.EventMatch{
+				Events: analysis.Names{"newobject", "makeslice"},
+				Where:  map[string]any{"size": ">=1024", "kind": "struct"},
+			},
+			GroupBy: analysis.Names{"goroutine"},
+			Sum:     "size",
+			Top:     5,
+		},
+		{
+			Name: "sleep after alloc",
+			Pattern: []analysis.EventMatch{
+				{Events: analysis.Names{"newobject"}},
+				{Events: analysis.Names{"casgstatus"}, Where: map[string]any{"new_status": "waiting"}},
+			},
+			Within: "500ms",
+		},
+	}
+
+	specs, err := parseQueryFile([]byte(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(specs, expected) {
+		t.Errorf("specs = %+v, want %+v", specs, expected)
+	}
+
+	// The same queries in YAML
+	specs, err = parseQueryFile([]byte(`queries:
+  # comment
+  - {name: timer leaks, analysis: timer-leaks, max: 0}
+  - name: large allocations
+    filter:
+      event: [newobject, makeslice]
+      where: {size: ">=1024", kind: struct}
+    group_by: goroutine
+    sum: size
+    top: 5
+  - name: sleep after alloc
+    pattern:
+      - event: newobject
+      - event: casgstatus
+        where:
+          new_status: waiting
+    within: 500ms
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(specs, expected) {
+		t.Errorf("YAML specs = %+v, want %+v", specs, expected)
+	}
+
+	// A list of queries in JSON
+	specs, err = parseQueryFile([]byte(`[{"name": "allocs", "filter": {"event": "newobject"}, "min": 1}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 1 || specs[0].Filter.Events[0] != "newobject" || *specs[0].Min != one {
+		t.Errorf("unexpected specs %+v", specs)
+	}
+
+	for _, invalid := range []string{
+		"",
+		`{"queries": []}`,
+		`[{"name": "a"}, {"name": "a"}]`,
+		`{"queries": [{"name": "a", "unknown": 1}]}`,
+		`[{"name": "a", "filter": {"where": 1}}]`,
+		"queries:\n  - name: a\n  - name: a\n",
+		"queries: [",
+	} {
+		if _, err := parseQueryFile([]byte(invalid)); err == nil {
+			t.Errorf("parseQueryFile(%q) succeeded", invalid)
+		}
+	}
+}
+
+func TestBaselineComparator(t *testing.T) {
+	baseline := map[string]float64{
+		storage.EventTypeNewGoroutine.String(): 10,
+		storage.EventTypeNewObject.String():    100,
+		baselineAllocBytes:                     1600,
+	}
+	// newobject events are sampled at 50%
+	rate := func(eventType storage.EventType) uint32 {
+		if eventType == storage.EventTypeNewObject {
+			return 50
+		}
+		return 100
+	}
+	// Goroutine 7 is flagged, its events are not sampled
+	flagged := func(gid uint32) bool { return gid == 7 }
+	start := time.Unix(1000, 0)
+	c := newBaselineComparator(baseline, rate, flagged, 2, 2*time.Second, time.Second, start)
+
+	// Goroutines are created at 4x the baseline rate in the 3rd and 4th
+	// seconds
+	goroutines := []int{10, 10, 40, 40, 10, 10}
+	var metrics [][]storage.BaselineMetric
+	for i, n := range goroutines {
+		for range n {
+			c.observe(&storage.Event{EventType: storage.EventTypeNewGoroutine})
+		}
+		for range 40 {
+			c.observe(&storage.Event{EventType: storage.EventTypeNewObject, Attributes: [5]uint64{16}})
+		}
+		for range 20 {
+			c.observe(&storage.Event{EventType: storage.EventTypeNewObject, Goroutine: 7, Attributes: [5]uint64{16}})
+		}
+		// Not compared without baseline
+		c.observe(&storage.Event{EventType: storage.EventTypeMakeMap})
+		metrics = append(metrics, c.compare(start.Add(time.Duration(i+1)*time.Second), uint64(i+1)*1e9))
+	}
+
+	expected := []storage.BaselineMetric{
+		{Metric: baselineAllocBytes, Live: 1600, Baseline: 1600, Ratio: 1},
+		{Metric: "newgoroutine", Live: 40, Baseline: 10, Ratio: 4, Diverged: true},
+		{Metric: "newobject", Live: 100, Baseline: 100, Ratio: 1},
+	}
+	if !reflect.DeepEqual(metrics[3], expected) {
+		t.Errorf("metrics = %+v, want %+v", metrics[3], expected)
+	}
+
+	annotations := c.finish()
+	if len(annotations) != 1 {
+		t.Fatalf("got %d annotations, want 1: %+v", len(annotations), annotations)
+	}
+	a := annotations[0]
+	if a.Kind != storage.AnnotationBaselineDivergence || a.StartTimestamp != 2e9 || a.EndTimestamp != 5e9 || !a.Automatic ||
+		a.Detail != "goroutine creation rate 4.0x baseline (40/s vs 10/s)" {
+		t.Errorf("unexpected annotation %+v", a)
+	}
+}
+
+func TestPinName(t *testing.T) {
+	tests := map[string]string{
+		"runtime.casgstatus":         "runtime_casgstatus",
+		"runtime.(*mcache).nextFree": "runtime___mcache__nextFree",
+		"usdt_myapp_req-start_3":     "usdt_myapp_req-start_3",
+		"main/pkg.Func":              "main_pkg_Func",
+	}
+	for symbol, expected := range tests {
+		if name := pinName(symbol); name != expected {
+			t.Errorf("pinName(%q) = %q, want %q", symbol, name, expected)
+		}
+	}
+}
+
+func TestEventSources(t *testing.T) {
+	p := uint32(2)
+	recorded := []*storage.Event{
+		{Timestamp: 100, EventType: storage.EventTypeNewGoroutine, Goroutine: 1, Attributes: [5]uint64{1, 2}},
+		{Timestamp: 200, EventType: storage.EventTypeNewObject, Goroutine: 2, ParentGoroutine: 1, Attributes: [5]uint64{64, 25}, Thread: 7, P: &p},
+		{Timestamp: 300, EventType: storage.EventTypeGoExit, Goroutine: 2},
+	}
+	newReplay := func() eventSource {
+		store := storage.NewMemoryStore(&storage.Session{ID: "recorded"}, 0)
+		store.WriteBatch(context.Background(), recorded)
+		return newReplaySource(store)
+	}
+
+	tests := []struct {
+		name   string
+		source func() eventSource
+		want   []*storage.Event
+		count  int
+	}{
+		{
+			name:   "synthetic",
+			source: func() eventSource { return newSyntheticSource(10, time.Microsecond, 1) },
+			count:  10,
+		},
+		{
+			name:   "replay",
+			source: newReplay,
+			want:   recorded,
+			count:  3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := tt.source()
+			if err := source.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			var got []*storage.Event
+			for event := range source.Events() {
+				got = append(got, convertToStorageEvent(event))
+			}
+			if len(got) != tt.count {
+				t.Fatalf("got %d events, want %d", len(got), tt.count)
+			}
+			for i := 1; i < len(got); i++ {
+				if got[i].Timestamp <= got[i-1].Timestamp {
+					t.Errorf("event %d at %d, after %d", i, got[i].Timestamp, got[i-1].Timestamp)
+				}
+			}
+			if tt.want != nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events = %v, want %v", got, tt.want)
+			}
+			if stats := source.Stats(); stats.Read != uint64(tt.count) || stats.Unread != 0 {
+				t.Errorf("stats = %+v, want %d read", stats, tt.count)
+			}
+		})
+
+		t.Run(tt.name+" canceled", func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			source := tt.source()
+			if err := source.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			cancel()
+			// The source buffers the events, so it only stops once the
+			// buffer is drained
+			timeout := time.After(5 * time.Second)
+			for {
+				select {
+				case _, ok := <-source.Events():
+					if !ok {
+						return
+					}
+				case <-timeout:
+					t.Fatal("events not closed after cancel")
+				}
+			}
+		})
+	}
+
+	// An endless synthetic source stops once closed
+	source := newSyntheticSource(0, time.Microsecond, 1)
+	source.Start(context.Background())
+	<-source.Events()
+	source.Close()
+	for range source.Events() {
+	}
+}
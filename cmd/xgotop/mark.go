@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.sazak.io/xgotop/cmd/xgotop/api"
+)
+
+// runMark injects a marker event into the session captured by a running
+// xgotop instance in web mode.
+func runMark(args []string) {
+	fs := flag.NewFlagSet("mark", flag.ExitOnError)
+	apiURL := fs.String("api", "http://localhost:8080", "URL of the xgotop API server")
+	id := fs.Uint64("id", 0, "ID of the marked operation")
+	phase := fs.String("phase", "begin", "Marker phase: begin or end")
+	goroutine := fs.Uint("goroutine", 0, "Goroutine the marker is attributed to")
+	fs.Parse(args)
+
+	body, err := json.Marshal(&api.MarkerRequest{
+		ID:        *id,
+		Phase:     api.MarkerPhase(*phase),
+		Goroutine: uint32(*goroutine),
+	})
+	must(err, "marshaling marker")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(strings.TrimSuffix(*apiURL, "/")+"/api/markers", "application/json", bytes.NewReader(body))
+	must(err, "sending marker")
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		var msg bytes.Buffer
+		msg.ReadFrom(resp.Body)
+		log.Fatalf("sending marker: %s: %s", resp.Status, strings.TrimSpace(msg.String()))
+	}
+}
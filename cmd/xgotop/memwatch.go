@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// shedEventTypes are the event types whose sampling rates the memory
+// watchdog raises. The other event types are rare, or needed to follow the
+// goroutines and threads of the session.
+var shedEventTypes = []storage.EventType{
+	storage.EventTypeCasGStatus,
+	storage.EventTypeMakeSlice,
+	storage.EventTypeMakeMap,
+	storage.EventTypeNewObject,
+	storage.EventTypeSemaBlock,
+	storage.EventTypeTimerCreate,
+	storage.EventTypeTimerStop,
+	storage.EventTypeIfaceConv,
+	storage.EventTypeStringAlloc,
+}
+
+const (
+	// minShedRate is the lowest sampling rate, in percent, the memory
+	// watchdog lowers a rate to
+	minShedRate = 1
+	// minShedQueue is the smallest number of queued events the memory
+	// watchdog shrinks the event queue to
+	minShedQueue = 10_000
+)
+
+// memoryWatchdog sheds the load of the capture when the memory usage of
+// xgotop exceeds a limit, so that a capture during an incident degrades
+// instead of getting xgotop OOM-killed. Every check over the limit takes the
+// next action of the ladder: raise the sampling rates, shrink the event
+// queue, stop capturing casgstatus events, and then raise the rates and
+// shrink the queue again until nothing is left to shed. Shed load is not
+// restored when the usage drops, the rates can be adjusted through the API.
+type memoryWatchdog struct {
+	limit uint64
+	// settle is the time to wait after an action for the memory to be
+	// released, before taking the next one
+	settle time.Duration
+
+	// rate and setRate read and apply the sampling rate of an event type in
+	// percent
+	rate    func(storage.EventType) uint32
+	setRate func(storage.EventType, uint32) error
+	// now returns the current time on the clock of the event timestamps
+	now func() uint64
+	// readMemory returns the RSS and heap size of xgotop
+	readMemory func() (rss, heap uint64, err error)
+
+	// queueLimit is the number of queued events over which read events are
+	// discarded
+	queueLimit atomic.Int64
+	rss, heap  atomic.Uint64
+
+	mu         sync.Mutex
+	step       int
+	lastAction time.Time
+	exhausted  bool
+	actions    []storage.ShedAction
+}
+
+func newMemoryWatchdog(limit uint64, settle time.Duration, queueSize int, sampling *samplingController) *memoryWatchdog {
+	w := &memoryWatchdog{
+		limit:  limit,
+		settle: settle,
+		rate:   sampling.rate,
+		setRate: func(eventType storage.EventType, percent uint32) error {
+			return sampling.set(eventType, percent, sampling.now())
+		},
+		now:        sampling.now,
+		readMemory: readMemory,
+	}
+	w.queueLimit.Store(int64(queueSize))
+	return w
+}
+
+// queueFull reports whether an event must be discarded instead of queued
+// behind depth events.
+func (w *memoryWatchdog) queueFull(depth int) bool {
+	return w != nil && int64(depth) >= w.queueLimit.Load()
+}
+
+// check sheds load if the memory usage exceeds the limit.
+func (w *memoryWatchdog) check() {
+	rss, heap, err := w.readMemory()
+	if err != nil {
+		log.Printf("Error reading memory usage: %v", err)
+		return
+	}
+	w.rss.Store(rss)
+	w.heap.Store(heap)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if rss <= w.limit {
+		w.exhausted = false
+		return
+	}
+	if time.Since(w.lastAction) < w.settle || w.exhausted {
+		return
+	}
+
+	// Actions that have nothing left to shed are skipped, the next 4 steps
+	// cover every action
+	for range 4 {
+		kind, detail, ok := w.shed(w.step)
+		w.step++
+		if !ok {
+			continue
+		}
+
+		action := storage.ShedAction{
+			Time:      time.Now(),
+			Timestamp: w.now(),
+			Kind:      kind,
+			Detail:    detail,
+			RSSBytes:  rss,
+			HeapBytes: heap,
+		}
+		w.actions = append(w.actions, action)
+		w.lastAction = action.Time
+		log.Printf("Warning: RSS of xgotop is %s, over -memory-limit %s: shedding load, %s",
+			formatBytes(rss), formatBytes(w.limit), detail)
+
+		// Return the memory of the shed load to the OS right away
+		debug.FreeOSMemory()
+		return
+	}
+
+	w.exhausted = true
+	log.Printf("ERROR: RSS of xgotop is %s, over -memory-limit %s, and there is no load left to shed",
+		formatBytes(rss), formatBytes(w.limit))
+}
+
+// shed takes the action of step of the ladder. It returns false if the
+// action has nothing left to shed.
+func (w *memoryWatchdog) shed(step int) (storage.ShedActionKind, string, bool) {
+	switch {
+	case step == 2:
+		if w.rate(storage.EventTypeCasGStatus) == 0 {
+			return "", "", false
+		}
+		if err := w.setRate(storage.EventTypeCasGStatus, 0); err != nil {
+			log.Printf("Warning: cannot stop capturing casgstatus events: %v", err)
+			return "", "", false
+		}
+		return storage.ShedDropCasGStatus, "stopped capturing casgstatus events", true
+	case step%2 == 0:
+		var raised []string
+		for _, eventType := range shedEventTypes {
+			percent := w.rate(eventType)
+			if percent <= minShedRate {
+				continue
+			}
+			percent = max(percent/2, minShedRate)
+			if err := w.setRate(eventType, percent); err != nil {
+				log.Printf("Warning: cannot raise sampling of %s: %v", eventType, err)
+				continue
+			}
+			raised = append(raised, fmt.Sprintf("%s:%d%%", eventType, percent))
+		}
+		if len(raised) == 0 {
+			return "", "", false
+		}
+		return storage.ShedRaiseSampling, fmt.Sprintf("sampling rates lowered to %s", strings.Join(raised, ", ")), true
+	default:
+		limit := w.queueLimit.Load()
+		if limit <= minShedQueue {
+			return "", "", false
+		}
+		limit = max(limit/2, minShedQueue)
+		w.queueLimit.Store(limit)
+		return storage.ShedShrinkBuffers, fmt.Sprintf("event queue shrunk to %d events", limit), true
+	}
+}
+
+// run checks the memory usage every interval until ctx is cancelled.
+func (w *memoryWatchdog) run(ctx context.Context, interval time.Duration) {
+	w.check()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+// usage returns the RSS of xgotop at the last check.
+func (w *memoryWatchdog) usage() uint64 {
+	if w == nil {
+		return 0
+	}
+	return w.rss.Load()
+}
+
+// Actions returns the actions taken so far.
+func (w *memoryWatchdog) Actions() []storage.ShedAction {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return slices.Clone(w.actions)
+}
+
+// readMemory returns the resident set size of xgotop, which the OOM killer
+// goes by, and the size of its Go heap. The RSS also covers the memory of
+// the ring buffer pages that were read.
+func readMemory() (rss, heap uint64, err error) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	heap = stats.HeapInuse
+
+	// The second field of statm is the number of resident pages
+	data, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, 0, fmt.Errorf("read RSS: %w", err)
+	}
+	fields := bytes.Fields(data)
+	if len(fields) < 2 {
+		return 0, 0, fmt.Errorf("read RSS: malformed statm %q", data)
+	}
+	pages, err := strconv.ParseUint(string(fields[1]), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("read RSS: %w", err)
+	}
+	return pages * uint64(os.Getpagesize()), heap, nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/ringbuf"
+	"github.com/cilium/ebpf/rlimit"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// overheadCase is a probe measured by the overhead subcommand, together with
+// the workload operation that hits it.
+type overheadCase struct {
+	symbol    string
+	op        string
+	eventType storage.EventType
+	prog      func(objs *ebpfObjects) *ebpf.Program
+}
+
+var overheadCases = []overheadCase{
+	{symbolCasgstatus, "goroutine", storage.EventTypeCasGStatus, func(o *ebpfObjects) *ebpf.Program { return o.UprobeCasgstatus }},
+	{symbolNewproc1, "goroutine", storage.EventTypeNewGoroutine, func(o *ebpfObjects) *ebpf.Program { return o.UprobeNewproc1 }},
+	{symbolGoexit1, "goroutine", storage.EventTypeGoExit, func(o *ebpfObjects) *ebpf.Program { return o.UprobeGoexit1 }},
+	{symbolMakeslice, "makeslice", storage.EventTypeMakeSlice, func(o *ebpfObjects) *ebpf.Program { return o.UprobeMakeslice }},
+	{symbolMakemap, "makemap", storage.EventTypeMakeMap, func(o *ebpfObjects) *ebpf.Program { return o.UprobeMakemap }},
+	{symbolNewobject, "newobject", storage.EventTypeNewObject, func(o *ebpfObjects) *ebpf.Program { return o.UprobeNewobject }},
+	{symbolSemacquire, "mutex", storage.EventTypeSemaBlock, func(o *ebpfObjects) *ebpf.Program { return o.UprobeSemacquire1 }},
+	{symbolNewTimer, "timer", storage.EventTypeTimerCreate, func(o *ebpfObjects) *ebpf.Program { return o.UprobeNewtimer }},
+	{symbolModTimer, "timer", storage.EventTypeTimerCreate, func(o *ebpfObjects) *ebpf.Program { return o.UprobeTimerModify }},
+	{symbolStopTimer, "timer", storage.EventTypeTimerStop, func(o *ebpfObjects) *ebpf.Program { return o.UprobeStoptimer }},
+	{symbolConcatStrings, "concat", storage.EventTypeStringAlloc, func(o *ebpfObjects) *ebpf.Program { return o.UprobeConcatstrings }},
+	{symbolSliceByteToString, "bytestostring", storage.EventTypeStringAlloc, func(o *ebpfObjects) *ebpf.Program { return o.UprobeSlicebytetostring }},
+	{symbolConvT64, "iface", storage.EventTypeIfaceConv, func(o *ebpfObjects) *ebpf.Program { return o.UprobeConvt64 }},
+}
+
+// overheadResult is the measurement of a single probe.
+type overheadResult struct {
+	symbol string
+	// hitsPerOp is the number of events emitted per workload operation
+	// without sampling
+	hitsPerOp float64
+	baseNs    float64
+	probedNs  float64
+	sampledNs float64
+}
+
+func (r overheadResult) perHit(ns float64) float64 {
+	if r.hitsPerOp == 0 {
+		return math.NaN()
+	}
+	return (ns - r.baseNs) / r.hitsPerOp
+}
+
+// overheadBench runs the workload generator with and without probes attached
+// and counts the events the probes emit.
+type overheadBench struct {
+	objs     *ebpfObjects
+	ex       *link.Executable
+	workload string
+	n        int
+	runs     int
+	events   atomic.Uint64
+	rd       *ringbuf.Reader
+}
+
+// runOverhead measures the per-hit overhead of every probe on the workload
+// generator and prints it as a table.
+func runOverhead(args []string) {
+	fs := flag.NewFlagSet("overhead", flag.ExitOnError)
+	workload := fs.String("workload", "./workload", "Path to the workload generator binary built from cmd/workload")
+	n := fs.Int("n", 1_000_000, "Number of workload operations per run")
+	runs := fs.Int("runs", 3, "Number of runs per measurement, the fastest run is used")
+	rate := fs.Float64("sample", 0.1, "Sampling rate of the sampled measurement")
+	symbols := fs.String("symbols", "", "Comma separated symbols to measure (default: all)")
+	fs.Parse(args)
+
+	if *rate < 0 || *rate > 1 {
+		log.Fatal("-sample must be between 0 and 1")
+	}
+
+	err := rlimit.RemoveMemlock()
+	must(err, "locking memory")
+
+	objs := ebpfObjects{}
+	err = loadEbpfObjects(&objs, nil)
+	must(err, "loading objects")
+	defer objs.Close()
+
+	ex, err := link.OpenExecutable(*workload)
+	must(err, "opening workload")
+
+	rd, err := ringbuf.NewReader(objs.Events)
+	must(err, "creating events ringbuf reader")
+	defer rd.Close()
+
+	bench := &overheadBench{objs: &objs, ex: ex, workload: *workload, n: *n, runs: *runs, rd: rd}
+	go bench.countEvents()
+
+	selected := make(map[string]bool)
+	for _, symbol := range strings.Split(*symbols, ",") {
+		if symbol != "" {
+			selected[symbol] = true
+		}
+	}
+
+	baselines := make(map[string]float64)
+	var results []overheadResult
+
+	for _, c := range overheadCases {
+		if len(selected) > 0 && !selected[c.symbol] {
+			continue
+		}
+
+		base, ok := baselines[c.op]
+		if !ok {
+			base, _, err = bench.measure(c.op, "", nil)
+			must(err, "measuring baseline of "+c.op)
+			baselines[c.op] = base
+		}
+
+		probed, events, err := bench.measure(c.op, c.symbol, c.prog(&objs))
+		must(err, "measuring "+c.symbol)
+
+		key, pct := uint32(c.eventType), uint32(math.Round(*rate*100))
+		err = objs.SamplingRates.Update(&key, &pct, ebpf.UpdateAny)
+		must(err, "setting sampling rate")
+		sampled, _, err := bench.measure(c.op, c.symbol, c.prog(&objs))
+		must(err, "measuring sampled "+c.symbol)
+		err = objs.SamplingRates.Delete(&key)
+		must(err, "resetting sampling rate")
+
+		results = append(results, overheadResult{
+			symbol:    c.symbol,
+			hitsPerOp: float64(events) / float64(*n),
+			baseNs:    base,
+			probedNs:  probed,
+			sampledNs: sampled,
+		})
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "SYMBOL\tHITS/OP\tBASE ns/op\tPROBED ns/op\tns/HIT\tSAMPLED %d%% ns/op\tSAMPLED ns/HIT\t\n", int(math.Round(*rate*100)))
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%.2f\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t\n",
+			r.symbol, r.hitsPerOp, r.baseNs, r.probedNs, r.perHit(r.probedNs), r.sampledNs, r.perHit(r.sampledNs))
+	}
+	w.Flush()
+}
+
+// countEvents drains the ring buffer and counts the events, until it is closed.
+func (b *overheadBench) countEvents() {
+	for {
+		if _, err := b.rd.Read(); err != nil {
+			if errors.Is(err, ringbuf.ErrClosed) {
+				return
+			}
+			continue
+		}
+		b.events.Add(1)
+	}
+}
+
+// measure runs the workload operation op b.runs times with prog attached at
+// symbol, or without any probe if prog is nil. It returns the nanoseconds
+// per operation of the fastest run and the events emitted during that run.
+func (b *overheadBench) measure(op, symbol string, prog *ebpf.Program) (float64, uint64, error) {
+	best, bestEvents := math.Inf(1), uint64(0)
+	for range b.runs {
+		elapsed, events, err := b.run(op, symbol, prog)
+		if err != nil {
+			return 0, 0, err
+		}
+		if nsPerOp := float64(elapsed) / float64(b.n); nsPerOp < best {
+			best, bestEvents = nsPerOp, events
+		}
+	}
+	return best, bestEvents, nil
+}
+
+func (b *overheadBench) run(op, symbol string, prog *ebpf.Program) (int64, uint64, error) {
+	cmd := exec.Command(b.workload, "-op", op, "-n", strconv.Itoa(b.n))
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return 0, 0, err
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return 0, 0, fmt.Errorf("start workload: %w", err)
+	}
+
+	if prog != nil {
+		l, err := b.ex.Uprobe(symbol, prog, &link.UprobeOptions{PID: cmd.Process.Pid})
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return 0, 0, fmt.Errorf("attach uprobe: %w", err)
+		}
+		defer l.Close()
+	}
+
+	b.events.Store(0)
+	if _, err := stdin.Write([]byte("\n")); err != nil {
+		return 0, 0, fmt.Errorf("start workload: %w", err)
+	}
+	stdin.Close()
+
+	if err := cmd.Wait(); err != nil {
+		return 0, 0, fmt.Errorf("run workload: %w", err)
+	}
+
+	// Let the counter catch up with the events still in the ring buffer
+	for b.rd.AvailableBytes() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	elapsed, err := strconv.ParseInt(strings.TrimSpace(out.String()), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse workload output %q: %w", out.String(), err)
+	}
+
+	return elapsed, b.events.Load(), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// loadObjects loads the eBPF programs and maps of spec into the kernel. If
+// pinPath is set, all maps are pinned under it, and maps already pinned there
+// by a previous xgotop process are re-used instead of being created again.
+func loadObjects(objs *ebpfObjects, spec *ebpf.CollectionSpec, pinPath string) error {
+	if pinPath == "" {
+		return spec.LoadAndAssign(objs, nil)
+	}
+
+	if err := os.MkdirAll(filepath.Join(pinPath, "links"), 0700); err != nil {
+		return fmt.Errorf("create pin directory: %w", err)
+	}
+
+	for _, m := range spec.Maps {
+		m.Pinning = ebpf.PinByName
+	}
+
+	return spec.LoadAndAssign(objs, &ebpf.CollectionOptions{
+		Maps: ebpf.MapOptions{PinPath: pinPath},
+	})
+}
+
+// attachUprobe attaches prog to symbol. If pinPath is set and a previous
+// xgotop process left a pinned link for symbol behind, that link is adopted
+// instead, so the probe keeps feeding the pinned ring buffer without being
+// detached in between. Newly created links are pinned so that they survive a
+// crash of this process.
+func attachUprobe(ex *link.Executable, symbol string, prog *ebpf.Program, opts *link.UprobeOptions, pinPath string) (link.Link, error) {
+	if pinPath == "" {
+		return ex.Uprobe(symbol, prog, opts)
+	}
+
+	linkPath := filepath.Join(pinPath, "links", pinName(symbol))
+	if _, err := os.Stat(linkPath); err == nil {
+		l, err := link.LoadPinnedLink(linkPath, nil)
+		if err == nil {
+			log.Printf("Re-adopted pinned uprobe at %s", symbol)
+			return l, nil
+		}
+		log.Printf("Warning: cannot load pinned uprobe at %s, re-attaching: %v", symbol, err)
+		if err := os.Remove(linkPath); err != nil {
+			return nil, fmt.Errorf("remove stale pin: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("stat pinned link: %w", err)
+	}
+
+	l, err := ex.Uprobe(symbol, prog, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := l.Pin(linkPath); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("pin uprobe at %s: %w", symbol, err)
+	}
+
+	return l, nil
+}
+
+// pinName returns the name of the pinned link of symbol. bpffs only accepts
+// names without dots, so every character other than letters, digits, '-'
+// and '_' is replaced by '_', e.g. runtime.(*mcache).nextFree is pinned as
+// runtime___mcache__nextFree.
+func pinName(symbol string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, symbol)
+}
+
+// removePins deletes everything pinned under pinPath. It is called on a clean
+// shutdown so that the probes are detached once their file descriptors are
+// closed.
+func removePins(pinPath string) {
+	if err := os.RemoveAll(pinPath); err != nil {
+		log.Printf("Error removing pinned objects under %s: %v", pinPath, err)
+	}
+}
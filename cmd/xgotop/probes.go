@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// symbolAddresses returns the entry addresses of the functions of the Go
+// binary at path. They are read from its function table, which unlike the
+// symbol table survives stripping.
+func symbolAddresses(path string) (map[string]uint64, error) {
+	s, err := newSymbolizer(path, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := make(map[string]uint64, len(s.table.Funcs))
+	for _, fn := range s.table.Funcs {
+		addresses[fn.Name] = fn.Entry
+	}
+	return addresses, nil
+}
+
+// probeEventTypes are the event types emitted by the probe at every symbol,
+// to tell when a probe emitted its first event.
+var probeEventTypes = map[string]storage.EventType{
+	symbolCasgstatus:                  storage.EventTypeCasGStatus,
+	symbolMakeslice:                   storage.EventTypeMakeSlice,
+	symbolMakemap:                     storage.EventTypeMakeMap,
+	symbolNewobject:                   storage.EventTypeNewObject,
+	symbolNewproc1:                    storage.EventTypeNewGoroutine,
+	symbolGoexit1:                     storage.EventTypeGoExit,
+	symbolSemacquire:                  storage.EventTypeSemaBlock,
+	symbolNewTimer:                    storage.EventTypeTimerCreate,
+	symbolModTimer:                    storage.EventTypeTimerCreate,
+	symbolStopTimer:                   storage.EventTypeTimerStop,
+	symbolConcatStrings:               storage.EventTypeStringAlloc,
+	symbolSliceByteToString:           storage.EventTypeStringAlloc,
+	symbolNewm:                        storage.EventTypeNewM,
+	symbolMexit:                       storage.EventTypeMExit,
+	symbolGCAssistAlloc:               storage.EventTypeGCAssist,
+	symbolGCDrainMarkWorkerDedicated:  storage.EventTypeGCMarkWorker,
+	symbolGCDrainMarkWorkerFractional: storage.EventTypeGCMarkWorker,
+	symbolGCDrainMarkWorkerIdle:       storage.EventTypeGCMarkWorker,
+	symbolGCControllerMarkWorkerStop:  storage.EventTypeGCMarkWorker,
+	symbolMarkerBegin:                 storage.EventTypeMarker,
+	symbolMarkerEnd:                   storage.EventTypeMarker,
+	symbolConvT:                       storage.EventTypeIfaceConv,
+	symbolConvTnoptr:                  storage.EventTypeIfaceConv,
+	symbolConvT16:                     storage.EventTypeIfaceConv,
+	symbolConvT32:                     storage.EventTypeIfaceConv,
+	symbolConvT64:                     storage.EventTypeIfaceConv,
+	symbolConvTstring:                 storage.EventTypeIfaceConv,
+	symbolConvTslice:                  storage.EventTypeIfaceConv,
+	symbolAssertE2I:                   storage.EventTypeIfaceConv,
+}
+
+// attachOrderEntry is a probe of -attach-order, with the delay to wait
+// before attaching it if one was given.
+type attachOrderEntry struct {
+	symbol   string
+	delay    time.Duration
+	hasDelay bool
+}
+
+// parseAttachOrder parses the -attach-order flag, a comma separated list of
+// symbols, each optionally followed by :<delay>, e.g.
+// "runtime.newproc1,runtime.casgstatus:30s".
+func parseAttachOrder(orderStr string) ([]attachOrderEntry, error) {
+	var order []attachOrderEntry
+	if orderStr == "" {
+		return order, nil
+	}
+	for _, item := range strings.Split(orderStr, ",") {
+		symbol, delayStr, hasDelay := strings.Cut(strings.TrimSpace(item), ":")
+		entry := attachOrderEntry{symbol: symbol, hasDelay: hasDelay}
+		if symbol == "" {
+			return nil, fmt.Errorf("invalid attach order entry: %q", item)
+		}
+		if hasDelay {
+			delay, err := time.ParseDuration(delayStr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid delay for %s: %v", symbol, err)
+			}
+			if delay < 0 {
+				return nil, fmt.Errorf("delay for %s must not be negative, got %s", symbol, delay)
+			}
+			entry.delay = delay
+		}
+		order = append(order, entry)
+	}
+	return order, nil
+}
+
+// attachStep is a uprobe to attach, and how long to wait before attaching
+// it.
+type attachStep struct {
+	symbol   string
+	program  *ebpf.Program
+	optional bool
+	delay    time.Duration
+}
+
+// planAttach orders the probes and the optional probes for attaching: the
+// symbols of order first, in its order, then the other probes and the other
+// optional probes, each in the order of their symbols. Every probe but the
+// first waits stagger before it is attached, unless order gives it a delay
+// of its own.
+func planAttach(probes, optionalProbes map[string]*ebpf.Program, order []attachOrderEntry, stagger time.Duration) ([]attachStep, error) {
+	delays := make(map[string]time.Duration)
+	var steps []attachStep
+	add := func(symbol string) error {
+		step := attachStep{symbol: symbol, program: probes[symbol]}
+		if step.program == nil {
+			step.program, step.optional = optionalProbes[symbol], true
+		}
+		if step.program == nil {
+			return fmt.Errorf("%s is not probed, see -profile and -trace-iface", symbol)
+		}
+		if len(steps) > 0 {
+			step.delay = stagger
+		}
+		if delay, ok := delays[symbol]; ok {
+			step.delay = delay
+		}
+		steps = append(steps, step)
+		return nil
+	}
+
+	ordered := make(map[string]bool)
+	for _, entry := range order {
+		if ordered[entry.symbol] {
+			return nil, fmt.Errorf("%s is listed twice", entry.symbol)
+		}
+		ordered[entry.symbol] = true
+		if entry.hasDelay {
+			delays[entry.symbol] = entry.delay
+		}
+		if err := add(entry.symbol); err != nil {
+			return nil, err
+		}
+	}
+	for _, set := range []map[string]*ebpf.Program{probes, optionalProbes} {
+		for _, symbol := range slices.Sorted(maps.Keys(set)) {
+			if ordered[symbol] {
+				continue
+			}
+			if err := add(symbol); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return steps, nil
+}
+
+// probeAttacher attaches the uprobes of a capture step by step, reports the
+// outcome of every attachment and records when every probe emitted its
+// first event, to tell which probe destabilizes a fragile target. The steps
+// up to the first delay are attached before the capture starts, the others
+// while it runs.
+type probeAttacher struct {
+	steps     []attachStep
+	addresses map[string]uint64
+	// attachUprobe attaches the uprobe of a step
+	attachUprobe func(symbol string, program *ebpf.Program) (link.Link, error)
+	// now returns the current time on the clock of the event timestamps
+	now func() uint64
+
+	// byType are the indices of the steps emitting every event type
+	byType [][]int
+	// attachedAt are the timestamps the steps were attached at, zero until
+	// they are, and onsets the timestamps of their first events
+	attachedAt []atomic.Uint64
+	onsets     []atomic.Uint64
+	// reported marks the onsets returned by newOnsets
+	reported []bool
+
+	mu       sync.Mutex
+	next     int
+	closed   bool
+	links    []link.Link
+	statuses []storage.ProbeStatus
+}
+
+func newProbeAttacher(steps []attachStep, addresses map[string]uint64, attachUprobe func(string, *ebpf.Program) (link.Link, error), now func() uint64) *probeAttacher {
+	a := &probeAttacher{
+		steps:        steps,
+		addresses:    addresses,
+		attachUprobe: attachUprobe,
+		now:          now,
+		attachedAt:   make([]atomic.Uint64, len(steps)),
+		onsets:       make([]atomic.Uint64, len(steps)),
+		reported:     make([]bool, len(steps)),
+	}
+	for _, eventType := range probeEventTypes {
+		if int(eventType) >= len(a.byType) {
+			a.byType = make([][]int, eventType+1)
+		}
+	}
+	for i, step := range steps {
+		if eventType, ok := probeEventTypes[step.symbol]; ok {
+			a.byType[eventType] = append(a.byType[eventType], i)
+		}
+	}
+	return a
+}
+
+// attach attaches the remaining steps in order, waiting for their delays
+// until ctx is done. With untilDelay, it returns at the first step with a
+// delay instead. Required probes stop at the first failure, which is
+// returned. Optional probes failing to attach only disable their events.
+func (a *probeAttacher) attach(ctx context.Context, untilDelay bool) error {
+	for {
+		a.mu.Lock()
+		i := a.next
+		a.mu.Unlock()
+		if i == len(a.steps) {
+			return nil
+		}
+
+		step := a.steps[i]
+		if step.delay > 0 {
+			if untilDelay {
+				return nil
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(step.delay):
+			}
+		}
+
+		status := storage.ProbeStatus{
+			Symbol:     step.symbol,
+			Optional:   step.optional,
+			Address:    a.addresses[step.symbol],
+			DelayNanos: step.delay.Nanoseconds(),
+		}
+
+		// Events emitted while attaching count as the onset of the probe
+		attachedAt := a.now()
+		start := time.Now()
+		uprobe, err := a.attachUprobe(step.symbol, step.program)
+		status.AttachNanos = time.Since(start).Nanoseconds()
+
+		a.mu.Lock()
+		a.next++
+		if err == nil && a.closed {
+			// The capture stopped while attaching
+			uprobe.Close()
+			err = errors.New("capture stopped")
+		}
+		if err != nil {
+			status.Error = err.Error()
+			a.statuses = append(a.statuses, status)
+			a.mu.Unlock()
+			if !step.optional {
+				return fmt.Errorf("attach uprobe at %s: %w", step.symbol, err)
+			}
+			log.Printf("Warning: cannot attach uprobe at %s, its events are disabled: %v", step.symbol, err)
+			continue
+		}
+
+		status.Attached = true
+		status.AttachedAt = attachedAt
+		a.attachedAt[i].Store(attachedAt)
+		a.statuses = append(a.statuses, status)
+		a.links = append(a.links, uprobe)
+		a.mu.Unlock()
+		if step.delay > 0 {
+			log.Printf("Attached uprobe at %s after %s", step.symbol, step.delay)
+		}
+	}
+}
+
+// pending reports whether steps are left to attach.
+func (a *probeAttacher) pending() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.next < len(a.steps)
+}
+
+// observe records the onset of the probes emitting event. Probes sharing an
+// event type cannot be told apart, so the onset of a probe is the first
+// event of its type at or after it was attached.
+func (a *probeAttacher) observe(event *runtimeEvent) {
+	if a == nil || int(event.EventType) >= len(a.byType) {
+		return
+	}
+	for _, i := range a.byType[event.EventType] {
+		attachedAt := a.attachedAt[i].Load()
+		if attachedAt == 0 || event.Timestamp < attachedAt {
+			continue
+		}
+		// Keep the earliest event of the processing workers
+		for {
+			onset := a.onsets[i].Load()
+			if onset != 0 && onset <= event.Timestamp {
+				break
+			}
+			if a.onsets[i].CompareAndSwap(onset, event.Timestamp) {
+				break
+			}
+		}
+	}
+}
+
+// Statuses returns the outcome of every attachment so far, followed by the
+// steps still pending.
+func (a *probeAttacher) Statuses() []storage.ProbeStatus {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	statuses := slices.Clone(a.statuses)
+	for i := range statuses {
+		statuses[i].FirstEventAt = a.onsets[i].Load()
+	}
+	for _, step := range a.steps[a.next:] {
+		statuses = append(statuses, storage.ProbeStatus{
+			Symbol:     step.symbol,
+			Optional:   step.optional,
+			Address:    a.addresses[step.symbol],
+			DelayNanos: step.delay.Nanoseconds(),
+			Pending:    true,
+		})
+	}
+	return statuses
+}
+
+// newOnsets returns the statuses of the probes that emitted their first
+// event since the last call. It must not be called concurrently.
+func (a *probeAttacher) newOnsets() []storage.ProbeStatus {
+	if a == nil {
+		return nil
+	}
+	var onsets []storage.ProbeStatus
+	for i := range a.steps {
+		if a.reported[i] || a.onsets[i].Load() == 0 {
+			continue
+		}
+		a.reported[i] = true
+		onsets = append(onsets, storage.ProbeStatus{
+			Symbol:       a.steps[i].symbol,
+			AttachedAt:   a.attachedAt[i].Load(),
+			FirstEventAt: a.onsets[i].Load(),
+		})
+	}
+	return onsets
+}
+
+// close detaches the uprobes, and stops attaching the pending ones.
+func (a *probeAttacher) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.closed = true
+	for _, l := range a.links {
+		l.Close()
+	}
+	a.links = nil
+}
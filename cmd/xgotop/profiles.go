@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// probeGroups are the symbols probed for every group of events. Symbols not
+// in any group, such as the marker symbols, are attached by every profile.
+var probeGroups = map[string][]string{
+	// casgstatus also emits the goexit events of goroutines that called
+	// goexit1
+	"lifecycle": {symbolNewproc1, symbolGoexit1, symbolCasgstatus},
+	"scheduler": {symbolCasgstatus, symbolSemacquire},
+	"alloc":     {symbolMakeslice, symbolMakemap, symbolNewobject, symbolConcatStrings, symbolSliceByteToString},
+	"timers":    {symbolNewTimer, symbolModTimer, symbolStopTimer},
+	"threads":   {symbolNewm, symbolMexit},
+	"gc": {
+		symbolGCAssistAlloc,
+		symbolGCDrainMarkWorkerDedicated, symbolGCDrainMarkWorkerFractional, symbolGCDrainMarkWorkerIdle,
+		symbolGCControllerMarkWorkerStop,
+	},
+}
+
+// profile is a preset of probe groups to attach, with default sampling rates
+// that keep the overhead low for the events it focuses on.
+type profile struct {
+	groups []string
+	// sampling are the default sampling rates in the -sample format
+	sampling string
+	// schedStats enables sampling the run queues of the Ps
+	schedStats bool
+}
+
+// profiles are the presets selectable with -profile.
+var profiles = map[string]profile{
+	"full": {
+		groups:     slices.Sorted(maps.Keys(probeGroups)),
+		schedStats: true,
+	},
+	"scheduler": {
+		groups:     []string{"lifecycle", "scheduler", "threads"},
+		schedStats: true,
+	},
+	"lifecycle": {
+		groups: []string{"lifecycle"},
+		// casgstatus is only probed to detect goroutine exits
+		sampling: "casgstatus:0",
+	},
+	"alloc": {
+		groups:   []string{"alloc", "gc"},
+		sampling: "newobject:0.1,makeslice:0.5,makemap:0.5,stringalloc:0.5",
+	},
+}
+
+// profileSymbols returns whether each probed symbol is attached with the
+// named profile.
+func profileSymbols(name string) (func(symbol string) bool, error) {
+	p, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile: %s (supported: %s)", name, strings.Join(slices.Sorted(maps.Keys(profiles)), ", "))
+	}
+
+	grouped := make(map[string]bool)
+	for _, symbols := range probeGroups {
+		for _, symbol := range symbols {
+			grouped[symbol] = true
+		}
+	}
+	enabled := make(map[string]bool)
+	for _, group := range p.groups {
+		for _, symbol := range probeGroups[group] {
+			enabled[symbol] = true
+		}
+	}
+
+	return func(symbol string) bool {
+		return !grouped[symbol] || enabled[symbol]
+	}, nil
+}
+
+// profileSamplingRates returns the sampling rates of the named profile,
+// overridden by the rates given with -sample.
+func profileSamplingRates(name, ratesStr string) (map[storage.EventType]uint32, error) {
+	p, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile: %s", name)
+	}
+
+	rates, err := parseSamplingRates(p.sampling)
+	if err != nil {
+		return nil, fmt.Errorf("profile %s: %w", name, err)
+	}
+
+	overrides, err := parseSamplingRates(ratesStr)
+	if err != nil {
+		return nil, err
+	}
+	maps.Copy(rates, overrides)
+
+	return rates, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.sazak.io/xgotop/cmd/xgotop/api"
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// pushTransport pushes a session to a collector started with -collector.
+// Every batch carries its sequence number and a checksum, so the collector
+// stores every batch once and in order, and rejects batches corrupted in
+// transfer. Batches dropped by the storage.RemoteSink are declared lost to
+// the collector, which records them as transfer gaps of the session instead
+// of silently missing them.
+type pushTransport struct {
+	sessionURL string
+	client     *http.Client
+	// token authenticates the agent to collectors started with -tenancy
+	token string
+	// acked is the sequence number the collector expects next, pushed with
+	// the session so that a collector that lost track of the session
+	// resumes it there
+	acked atomic.Uint64
+}
+
+// newPushStore pushes session to the collector at baseURL through the
+// resilience layer of remote sinks.
+func newPushStore(baseURL, token string, session *storage.Session, opts storage.RemoteOptions) (*storage.RemoteSink, error) {
+	transport := &pushTransport{
+		sessionURL: strings.TrimSuffix(baseURL, "/") + "/api/ingest/" + session.ID,
+		client:     storage.NewRemoteHTTPClient(10 * time.Second),
+		token:      token,
+	}
+	return storage.NewRemoteSink(transport, session, opts)
+}
+
+func (t *pushTransport) Encode(events []*storage.Event) ([]byte, error) {
+	return json.Marshal(events)
+}
+
+// Send pushes batch. A collector that does not know the session, which
+// happens after it restarted, answers 404, and the session is pushed again
+// before the batch is retried. A conflict means that the collector expects
+// another batch, and is retried like any other error.
+func (t *pushTransport) Send(ctx context.Context, batch storage.RemoteBatch) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.sessionURL+"/batch", bytes.NewReader(batch.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(api.IngestSeqHeader, strconv.FormatUint(batch.Seq, 10))
+	req.Header.Set(api.IngestChecksumHeader, api.BatchChecksum(batch.Body))
+	if batch.LostFrom < batch.Seq {
+		req.Header.Set(api.IngestLostFromHeader, strconv.FormatUint(batch.LostFrom, 10))
+	}
+	t.authorize(req)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %w", storage.ErrRemoteSessionLost, responseError(resp))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	var ack api.IngestAck
+	if err := json.NewDecoder(resp.Body).Decode(&ack); err != nil {
+		return fmt.Errorf("decode acknowledgement: %w", err)
+	}
+	if ack.NextSeq <= batch.Seq {
+		return fmt.Errorf("collector did not acknowledge the batch, it expects batch %d", ack.NextSeq)
+	}
+	t.acked.Store(ack.NextSeq)
+	return nil
+}
+
+// SendSession sends the session metadata. The end time is only sent once
+// final, as it makes the collector close the session.
+func (t *pushTransport) SendSession(ctx context.Context, session *storage.Session, final bool) error {
+	pushed := *session
+	if !final {
+		pushed.EndTime = nil
+	}
+	body, err := json.Marshal(pushed)
+	if err != nil {
+		return fmt.Errorf("encode session: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.sessionURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(api.IngestSeqHeader, strconv.FormatUint(t.acked.Load(), 10))
+	t.authorize(req)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("push session: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("push session: %w", responseError(resp))
+	}
+	return nil
+}
+
+func (t *pushTransport) authorize(req *http.Request) {
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+}
+
+// remoteOptions returns the options of the remote sinks of a session given
+// with the -remote-* flags.
+func remoteOptions(sessionID string) (storage.RemoteOptions, error) {
+	spoolSize, err := parseByteSize(*remoteSpoolSize)
+	if err != nil {
+		return storage.RemoteOptions{}, fmt.Errorf("parse -remote-spool-size: %w", err)
+	}
+
+	opts := storage.RemoteOptions{
+		MaxSpoolBytes: int64(spoolSize),
+		MaxBackoff:    *remoteMaxBackoff,
+	}
+	if *remoteSpoolDir != "" {
+		opts.SpoolDir = filepath.Join(*remoteSpoolDir, sessionID)
+	}
+	return opts, nil
+}
+
+func responseError(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
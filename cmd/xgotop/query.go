@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"go.sazak.io/xgotop/cmd/xgotop/analysis"
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// queryFile is the YAML or JSON file of queries run by the query
+// subcommand. It can be a list of queries too.
+type queryFile struct {
+	Queries []analysis.QuerySpec `json:"queries"`
+}
+
+// queryReport is the combined result of the queries of a query file.
+type queryReport struct {
+	SessionID string                  `json:"session_id"`
+	Events    uint64                  `json:"events"`
+	Queries   []*analysis.QueryResult `json:"queries"`
+	// Passed is false if a query with min or max failed
+	Passed bool `json:"passed"`
+}
+
+// runQuery evaluates the queries of a file over a recorded session in a
+// single pass and prints their results as JSON, so that recurring analyses
+// can run without the API server. It exits with status 1 after printing the
+// report if a check failed.
+func runQuery(args []string) {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	sessionID := fs.String("session", "", "ID of the session to query")
+	dir := fs.String("storage-dir", "./sessions", "Directory for storing session data")
+	file := fs.String("f", "", "YAML or JSON file of the queries to run")
+	out := fs.String("o", "-", "Output file of the report, - for stdout")
+	fs.Parse(args)
+
+	if *sessionID == "" {
+		log.Fatal("-session must be provided")
+	}
+	if *file == "" {
+		log.Fatal("-f must be provided")
+	}
+
+	data, err := os.ReadFile(*file)
+	must(err, "reading query file")
+	specs, err := parseQueryFile(data)
+	if err != nil {
+		log.Fatalf("parsing query file %s: %v", *file, err)
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	manager, err := storage.NewManager(*dir)
+	must(err, "creating storage manager")
+
+	store, err := manager.OpenSession(ctx, *sessionID)
+	must(err, "opening session")
+	defer store.Close()
+
+	report, err := evaluateQueries(ctx, store, specs)
+	must(err, "evaluating queries")
+
+	output := os.Stdout
+	if *out != "-" {
+		output, err = os.Create(*out)
+		must(err, "creating report file")
+		defer output.Close()
+	}
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	must(encoder.Encode(report), "writing report")
+
+	if !report.Passed {
+		var failed int
+		for _, result := range report.Queries {
+			if result.Passed != nil && !*result.Passed {
+				failed++
+			}
+		}
+		log.Fatalf("%d checks failed", failed)
+	}
+}
+
+// parseQueryFile returns the queries of a query file. JSON is YAML too, so
+// the file is read as YAML, then converted to JSON to decode the queries with
+// their JSON field names.
+func parseQueryFile(data []byte) ([]analysis.QuerySpec, error) {
+	var doc any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var qf queryFile
+	var v any = &qf
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		v = &qf.Queries
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return nil, err
+	}
+	if len(qf.Queries) == 0 {
+		return nil, errors.New("no queries")
+	}
+
+	names := make(map[string]bool, len(qf.Queries))
+	for _, spec := range qf.Queries {
+		if names[spec.Name] {
+			return nil, fmt.Errorf("duplicate query name: %s", spec.Name)
+		}
+		names[spec.Name] = true
+	}
+	return qf.Queries, nil
+}
+
+// evaluateQueries runs specs over the events of store in a single pass.
+// The events are decoded at most once, and only if a query needs their
+// fields.
+func evaluateQueries(ctx context.Context, store storage.EventStore, specs []analysis.QuerySpec) (*queryReport, error) {
+	session := store.GetSession()
+	queries := make([]*analysis.Query, len(specs))
+	for i, spec := range specs {
+		q, err := analysis.NewQuery(spec, session)
+		if err != nil {
+			return nil, err
+		}
+		queries[i] = q
+	}
+
+	report := &queryReport{SessionID: session.ID, Passed: true}
+	err := store.ScanEvents(ctx, 0, func(_ int64, event *storage.Event) error {
+		report.Events++
+		var decoded *storage.DecodedEvent
+		decode := func() *storage.DecodedEvent {
+			if decoded == nil {
+				decoded = storage.DecodeEvent(event, session)
+			}
+			return decoded
+		}
+		for _, q := range queries {
+			q.Observe(event, decode)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, q := range queries {
+		result := q.Result()
+		if result.Passed != nil && !*result.Passed {
+			report.Passed = false
+		}
+		report.Queries = append(report.Queries, result)
+	}
+	return report, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// labelsFlag collects the key=value pairs of a repeatable flag.
+type labelsFlag map[string]string
+
+// newLabelsFlag defines a repeatable key=value flag.
+func newLabelsFlag(name, usage string) labelsFlag {
+	labels := make(labelsFlag)
+	flag.Var(labels, name, usage)
+	return labels
+}
+
+func (l labelsFlag) String() string {
+	pairs := make([]string, 0, len(l))
+	for _, key := range slices.Sorted(maps.Keys(l)) {
+		pairs = append(pairs, key+"="+l[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (l labelsFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return fmt.Errorf("invalid label: %s (expected key=value)", value)
+	}
+	l[key] = strings.TrimSpace(val)
+	return nil
+}
+
+// parseQuotas parses the value of -storage-quota, comma separated
+// label=value:size entries, e.g. "service=api:20GB,service=batch:5GB".
+func parseQuotas(spec string) ([]storage.Quota, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	var quotas []storage.Quota
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		selector, sizeStr, ok := strings.Cut(entry, ":")
+		label, value, hasValue := strings.Cut(selector, "=")
+		label = strings.TrimSpace(label)
+		if !ok || !hasValue || label == "" {
+			return nil, fmt.Errorf("invalid storage quota: %s (expected label=value:size)", entry)
+		}
+
+		size, err := parseByteSize(sizeStr)
+		if err != nil {
+			return nil, fmt.Errorf("storage quota %s: %w", selector, err)
+		}
+
+		quota := storage.Quota{Label: label, Value: strings.TrimSpace(value), MaxBytes: int64(size)}
+		if seen[quota.String()] {
+			return nil, fmt.Errorf("duplicate storage quota: %s", quota)
+		}
+		seen[quota.String()] = true
+		quotas = append(quotas, quota)
+	}
+
+	return quotas, nil
+}
+
+// runJanitor enforces the storage quotas and the retentions of namespaces
+// every interval until ctx is cancelled.
+func runJanitor(ctx context.Context, manager *storage.Manager, quotas []storage.Quota, retentions []storage.Retention, interval time.Duration) {
+	enforce := func() {
+		if len(retentions) > 0 {
+			deletions, err := manager.EnforceRetentions(ctx, retentions, time.Now())
+			for _, deletion := range deletions {
+				log.Printf("Deleted session %s to enforce the retention of %s in namespace %s",
+					deletion.SessionID, deletion.Retention.MaxAge, deletion.Retention.Namespace)
+			}
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Error enforcing retentions: %v", err)
+			}
+		}
+
+		deletions, err := manager.EnforceQuotas(ctx, quotas)
+		for _, deletion := range deletions {
+			log.Printf("Deleted session %s (%s) to enforce the storage quota of %s",
+				deletion.SessionID, formatBytes(uint64(deletion.Bytes)), deletion.Quota)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Error enforcing storage quotas: %v", err)
+		}
+	}
+
+	enforce()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			enforce()
+		}
+	}
+}
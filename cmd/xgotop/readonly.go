@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.sazak.io/xgotop/cmd/xgotop/api"
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// serveReadOnly serves the sessions recorded in the storage directory until
+// interrupted, without capturing events. Sessions and settings cannot be
+// changed through the API.
+func serveReadOnly() {
+	manager, err := storage.NewManagerWithOptions(*storageDir, storage.Options{ReadOnly: true})
+	must(err, "opening storage directory")
+
+	// Quotas and retentions are not enforced, as no session can be deleted
+	tenants, err := loadTenancy(*tenancyFile)
+	must(err, "loading tenancy")
+
+	apiServer := api.NewServer(manager, *webPort)
+	if tenants != nil {
+		apiServer.EnableTenancy(tenants.tokens)
+	}
+	go func() {
+		if err := apiServer.Start(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("API server error: %v", err)
+		}
+	}()
+
+	log.Printf("Serving sessions in %s read-only: http://localhost:%d", *storageDir, *webPort)
+
+	waitAndStop(apiServer)
+}
+
+// waitAndStop stops apiServer once interrupted.
+func waitAndStop(apiServer *api.Server) {
+	stopper := make(chan os.Signal, 1)
+	signal.Notify(stopper, os.Interrupt, syscall.SIGTERM)
+	<-stopper
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := apiServer.Stop(ctx); err != nil {
+		log.Printf("Error stopping API server: %v", err)
+	}
+}
+
+// parseStorageOptions builds the storage options from the values of the
+// -storage-file-mode, -storage-dir-mode and -storage-owner flags.
+func parseStorageOptions(fileModeStr, dirModeStr, owner string) (storage.Options, error) {
+	perms := storage.DefaultPermissions
+
+	fileMode, err := strconv.ParseUint(fileModeStr, 8, 32)
+	if err != nil || fileMode > 0777 {
+		return storage.Options{}, fmt.Errorf("invalid -storage-file-mode %q", fileModeStr)
+	}
+	perms.FileMode = os.FileMode(fileMode)
+
+	dirMode, err := strconv.ParseUint(dirModeStr, 8, 32)
+	if err != nil || dirMode > 0777 {
+		return storage.Options{}, fmt.Errorf("invalid -storage-dir-mode %q", dirModeStr)
+	}
+	perms.DirMode = os.FileMode(dirMode)
+
+	if owner != "" {
+		uid, gid, ok := strings.Cut(owner, ":")
+		if !ok {
+			return storage.Options{}, fmt.Errorf("invalid -storage-owner %q, expected uid:gid", owner)
+		}
+		if uid != "" {
+			if perms.UID, err = strconv.Atoi(uid); err != nil || perms.UID < 0 {
+				return storage.Options{}, fmt.Errorf("invalid uid %q in -storage-owner", uid)
+			}
+		}
+		if gid != "" {
+			if perms.GID, err = strconv.Atoi(gid); err != nil || perms.GID < 0 {
+				return storage.Options{}, fmt.Errorf("invalid gid %q in -storage-owner", gid)
+			}
+		}
+	}
+
+	return storage.Options{Permissions: perms}, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// eventGroups are names for related event types usable in -storage-routes
+// and -transform.
+var eventGroups = map[string][]storage.EventType{
+	"allocations": {storage.EventTypeMakeSlice, storage.EventTypeMakeMap, storage.EventTypeNewObject, storage.EventTypeStringAlloc},
+	"lifecycle":   {storage.EventTypeNewGoroutine, storage.EventTypeGoExit},
+	"timers":      {storage.EventTypeTimerCreate, storage.EventTypeTimerStop},
+	"threads":     {storage.EventTypeNewM, storage.EventTypeMExit},
+	"gc":          {storage.EventTypeGCAssist, storage.EventTypeGCMarkWorker},
+}
+
+// storageFormats are the formats events can be stored in.
+var storageFormats = map[string]bool{
+	"protobuf": true,
+	"jsonl":    true,
+	"sqlite":   true,
+	"memory":   true,
+}
+
+// parseStorageRoutes parses routes like
+// "casgstatus:memory,allocations:protobuf,newgoroutine+goexit:jsonl", which
+// store event types, or groups of them, in other formats than the default.
+func parseStorageRoutes(routesStr string) (map[storage.EventType]string, error) {
+	routes := make(map[storage.EventType]string)
+	if routesStr == "" {
+		return routes, nil
+	}
+
+	for _, route := range strings.Split(routesStr, ",") {
+		names, format, ok := strings.Cut(route, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid storage route format: %s", route)
+		}
+
+		format = strings.ToLower(strings.TrimSpace(format))
+		if !storageFormats[format] {
+			return nil, fmt.Errorf("unknown storage format %s in route %s", format, route)
+		}
+
+		eventTypes, err := parseEventNames(names)
+		if err != nil {
+			return nil, err
+		}
+		for _, eventType := range eventTypes {
+			if previous, ok := routes[eventType]; ok && previous != format {
+				return nil, fmt.Errorf("%s is routed to both %s and %s", getEventName(eventType), previous, format)
+			}
+			routes[eventType] = format
+		}
+	}
+
+	return routes, nil
+}
+
+// parseEventNames parses "+" joined event names and groups of eventGroups.
+func parseEventNames(names string) ([]storage.EventType, error) {
+	var eventTypes []storage.EventType
+	for _, name := range strings.Split(names, "+") {
+		name = strings.TrimSpace(name)
+		if group, ok := eventGroups[name]; ok {
+			eventTypes = append(eventTypes, group...)
+			continue
+		}
+		eventType, ok := eventNameToType[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown event name: %s", name)
+		}
+		eventTypes = append(eventTypes, eventType)
+	}
+	return eventTypes, nil
+}
+
+// createSessionStore creates the store of a new session in the default
+// format. If event types are routed to other formats, a store is created for
+// every format and the returned store routes the events between them.
+func createSessionStore(ctx context.Context, manager *storage.Manager, session *storage.Session, format string, routes map[storage.EventType]string) (storage.EventStore, error) {
+	fallback, err := manager.CreateSession(ctx, session, format)
+	if err != nil {
+		return nil, err
+	}
+
+	stores := map[string]storage.EventStore{format: fallback}
+	routeStores := make(map[storage.EventType]storage.EventStore)
+	for eventType, routeFormat := range routes {
+		store, ok := stores[routeFormat]
+		if !ok {
+			store, err = manager.CreateSession(ctx, session, routeFormat)
+			if err != nil {
+				for _, store := range stores {
+					store.Close()
+				}
+				return nil, fmt.Errorf("create %s store: %w", routeFormat, err)
+			}
+			stores[routeFormat] = store
+		}
+		routeStores[eventType] = store
+	}
+
+	if len(routeStores) == 0 {
+		return fallback, nil
+	}
+	return storage.NewRoutedStore(fallback, routeStores), nil
+}
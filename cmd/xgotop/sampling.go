@@ -1,14 +1,25 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"math"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/cilium/ebpf"
 
 	"go.sazak.io/xgotop/cmd/xgotop/storage"
 )
 
+var errNoSamplingMap = errors.New("sampling rates map not available")
+
+// errAllocSummaryUnsampled is returned for sampling rates of allocsummary
+// events, which are synthesized in userspace rather than captured.
+var errAllocSummaryUnsampled = errors.New("allocsummary events are not sampled, see -alloc-summary-interval")
+
 // parseSamplingRates parses the sampling rates from the command line flag
 func parseSamplingRates(ratesStr string) (map[storage.EventType]uint32, error) {
 	rates := make(map[storage.EventType]uint32)
@@ -27,6 +38,9 @@ func parseSamplingRates(ratesStr string) (map[storage.EventType]uint32, error) {
 		if !ok {
 			return nil, fmt.Errorf("unknown event name: %s", eventName)
 		}
+		if eventType == storage.EventTypeAllocSummary {
+			return nil, errAllocSummaryUnsampled
+		}
 
 		rate, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
 		if err != nil {
@@ -43,3 +57,116 @@ func parseSamplingRates(ratesStr string) (map[storage.EventType]uint32, error) {
 
 	return rates, nil
 }
+
+// samplingController applies the sampling rates of the capture, and records
+// every rate in effect in the sampling manifest of the session, so that the
+// analysis can extrapolate the sampled events. Rates can be adjusted during
+// the capture through the API.
+type samplingController struct {
+	// m is the sampling_rates map, nil if the BPF object has none
+	m *ebpf.Map
+	// lifecycle samples the lifecycle event types in userspace, if set
+	lifecycle *lifecycleSampler
+	// now returns the current time on the clock of the event timestamps
+	now func() uint64
+	// flagger records the flagged goroutines of the manifest, if set
+	flagger *goroutineFlagger
+
+	mu      sync.Mutex
+	rates   map[storage.EventType]uint32
+	periods map[string][]storage.SamplingPeriod
+}
+
+func newSamplingController(m *ebpf.Map, lifecycle *lifecycleSampler, now func() uint64) *samplingController {
+	return &samplingController{
+		m:         m,
+		lifecycle: lifecycle,
+		now:       now,
+		rates:     make(map[storage.EventType]uint32),
+		periods:   make(map[string][]storage.SamplingPeriod),
+	}
+}
+
+// set applies the rate of eventType, in percent, and records that it is in
+// effect from timestamp ts on.
+func (c *samplingController) set(eventType storage.EventType, percent uint32, ts uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.lifecycle != nil && storage.IsLifecycleEvent(eventType) {
+		c.lifecycle.setRate(eventType, percent)
+	} else if c.m != nil {
+		key := uint32(eventType)
+		if err := c.m.Update(&key, &percent, ebpf.UpdateAny); err != nil {
+			return fmt.Errorf("update sampling rate of %s: %w", eventType, err)
+		}
+	} else {
+		return errNoSamplingMap
+	}
+
+	name := eventType.String()
+	periods := c.periods[name]
+	if n := len(periods); n > 0 {
+		periods[n-1].ToTimestamp = ts
+	}
+	c.periods[name] = append(periods, storage.SamplingPeriod{Percent: percent, FromTimestamp: ts})
+	c.rates[eventType] = percent
+	return nil
+}
+
+// rate returns the rate of eventType in percent, 100 if it is unsampled.
+func (c *samplingController) rate(eventType storage.EventType) uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if percent, ok := c.rates[eventType]; ok {
+		return percent
+	}
+	return 100
+}
+
+// SamplingRates returns the rates in effect by event name, between 0 and 1.
+func (c *samplingController) SamplingRates() map[string]float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rates := make(map[string]float64, len(c.rates))
+	for eventType, percent := range c.rates {
+		rates[eventType.String()] = float64(percent) / 100
+	}
+	return rates
+}
+
+// SetSamplingRate adjusts the rate of the named event type from now on.
+func (c *samplingController) SetSamplingRate(eventName string, rate float64) error {
+	eventType, ok := eventNameToType[eventName]
+	if !ok {
+		return fmt.Errorf("unknown event name: %s", eventName)
+	}
+	if eventType == storage.EventTypeAllocSummary {
+		return errAllocSummaryUnsampled
+	}
+	if rate < 0 || rate > 1 {
+		return fmt.Errorf("sampling rate must be between 0 and 1, got %f", rate)
+	}
+	return c.set(eventType, uint32(math.Round(rate*100)), c.now())
+}
+
+// Manifest returns the sampling manifest of the session so far, or nil if
+// no event type was sampled.
+func (c *samplingController) Manifest() *storage.SamplingManifest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.periods) == 0 {
+		return nil
+	}
+	manifest := &storage.SamplingManifest{Rates: make(map[string][]storage.SamplingPeriod, len(c.periods))}
+	for name, periods := range c.periods {
+		manifest.Rates[name] = slices.Clone(periods)
+	}
+	if c.flagger != nil {
+		manifest.Flagged = c.flagger.periods()
+	}
+	return manifest
+}
@@ -0,0 +1,165 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// schedStatsOversampling is how many times per interval the perf event fires
+// on every CPU. The program only samples when it interrupts a thread of the
+// traced process, so firing more often than the interval makes it less likely
+// that a whole interval is missed.
+const schedStatsOversampling = 4
+
+// schedConfig mirrors sched_config_t in xgotop.h
+type schedConfig struct {
+	Tgid       uint32
+	_          uint32
+	AllpAddr   uint64
+	IntervalNs uint64
+}
+
+// startSchedStats attaches the schedstats program to a CPU clock perf event on
+// every CPU, so that the run queue of each P of the process pid is sampled once
+// per interval. The returned function detaches the program again.
+func startSchedStats(objs *ebpfObjects, pid int, executablePath string, interval time.Duration) (func(), error) {
+	allpAddr, err := lookupSymbolAddr(pid, executablePath, "runtime.allp")
+	if err != nil {
+		return nil, err
+	}
+
+	key := uint32(0)
+	config := schedConfig{
+		Tgid:       uint32(pid),
+		AllpAddr:   allpAddr,
+		IntervalNs: uint64(interval.Nanoseconds()),
+	}
+	if err := objs.SchedConfig.Update(&key, &config, ebpf.UpdateAny); err != nil {
+		return nil, fmt.Errorf("update sched config: %w", err)
+	}
+
+	cpus, err := ebpf.PossibleCPU()
+	if err != nil {
+		return nil, fmt.Errorf("get possible cpus: %w", err)
+	}
+
+	var fds []int
+	closeAll := func() {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+	}
+
+	attr := unix.PerfEventAttr{
+		Type:   unix.PERF_TYPE_SOFTWARE,
+		Config: unix.PERF_COUNT_SW_CPU_CLOCK,
+		Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
+		Sample: uint64(interval.Nanoseconds() / schedStatsOversampling),
+	}
+
+	for cpu := 0; cpu < cpus; cpu++ {
+		fd, err := unix.PerfEventOpen(&attr, -1, cpu, -1, unix.PERF_FLAG_FD_CLOEXEC)
+		if errors.Is(err, unix.ENODEV) {
+			// The CPU is offline
+			continue
+		}
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("open perf event on cpu %d: %w", cpu, err)
+		}
+		fds = append(fds, fd)
+
+		if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_SET_BPF, objs.PerfEventSchedstats.FD()); err != nil {
+			closeAll()
+			return nil, fmt.Errorf("attach program on cpu %d: %w", cpu, err)
+		}
+		if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_ENABLE, 0); err != nil {
+			closeAll()
+			return nil, fmt.Errorf("enable perf event on cpu %d: %w", cpu, err)
+		}
+	}
+
+	return closeAll, nil
+}
+
+// lookupSymbolAddr returns the address of the symbol name in the memory of
+// the process pid running executablePath.
+func lookupSymbolAddr(pid int, executablePath, name string) (uint64, error) {
+	f, err := elf.Open(executablePath)
+	if err != nil {
+		return 0, fmt.Errorf("open executable: %w", err)
+	}
+	defer f.Close()
+
+	symbols, err := f.Symbols()
+	if err != nil {
+		return 0, fmt.Errorf("read symbols: %w", err)
+	}
+
+	var addr uint64
+	for _, sym := range symbols {
+		if sym.Name == name {
+			addr = sym.Value
+			break
+		}
+	}
+	if addr == 0 {
+		return 0, fmt.Errorf("symbol %s not found in %s", name, executablePath)
+	}
+
+	if f.Type != elf.ET_DYN {
+		return addr, nil
+	}
+
+	// Position independent executables are loaded at a random base address
+	base, err := loadBaseAddr(pid, executablePath)
+	if err != nil {
+		return 0, err
+	}
+
+	return base + addr, nil
+}
+
+// loadBaseAddr returns the address the first segment of executablePath is
+// mapped at in the process pid.
+func loadBaseAddr(pid int, executablePath string) (uint64, error) {
+	maps, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return 0, fmt.Errorf("open memory maps: %w", err)
+	}
+	defer maps.Close()
+
+	scanner := bufio.NewScanner(maps)
+	for scanner.Scan() {
+		// 55d4a8c00000-55d4a8e4a000 r-xp 00000000 fd:01 1234 /path/to/binary
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[5] != executablePath || fields[2] != "00000000" {
+			continue
+		}
+
+		start, _, _ := strings.Cut(fields[0], "-")
+		base, err := strconv.ParseUint(start, 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parse mapping address %q: %w", start, err)
+		}
+		return base, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("read memory maps: %w", err)
+	}
+
+	return 0, fmt.Errorf("no mapping of %s found in process %d", executablePath, pid)
+}
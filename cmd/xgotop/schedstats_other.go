@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "time"
+
+func startSchedStats(objs *ebpfObjects, pid int, executablePath string, interval time.Duration) (func(), error) {
+	panic("unimplemented")
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/ringbuf"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// sourceQueueSize is the number of events a source buffers for the
+// pipeline.
+const sourceQueueSize = 4096
+
+// eventSource produces the events of a capture. The processing pipeline,
+// the storage and the API only see the events of the source, so collectors
+// other than the eBPF probes, e.g. runtime/trace ingestion, plug into the
+// capture by implementing it, main only choosing which source to start.
+type eventSource interface {
+	// Start starts producing events, until the source is exhausted, closed
+	// or ctx is done.
+	Start(ctx context.Context) error
+	// Events returns the produced events. The channel is closed once the
+	// source stopped producing events.
+	Events() <-chan *runtimeEvent
+	// Stats returns the counters of the source.
+	Stats() sourceStats
+	// Close stops the source. Events already produced are still delivered
+	// before Events is closed.
+	Close() error
+}
+
+// sourceStats are the counters of an event source since it was started.
+type sourceStats struct {
+	// Read counts the events produced, and Errors the events that could not
+	// be read or decoded
+	Read   uint64
+	Errors uint64
+	// Unread is the number of events waiting in the source, e.g. in the
+	// ring buffer
+	Unread int
+	// WaitNs sums the time Waited events spent between their timestamp and
+	// being read, i.e. their queue wait latency
+	WaitNs int64
+	Waited int64
+}
+
+// ringbufSource reads the events written by the eBPF probes to the events
+// ring buffer with concurrent read workers.
+type ringbufSource struct {
+	rd         *ringbuf.Reader
+	workers    int
+	recordSize int
+	losses     *lossTracker
+	// next reads the next event of rd
+	next func() (*runtimeEvent, error)
+	// readDelay is added after every read, see -inject-faults
+	readDelay time.Duration
+
+	events chan *runtimeEvent
+	wg     sync.WaitGroup
+
+	read, errors   atomic.Uint64
+	waitNs, waited atomic.Int64
+}
+
+// newRingbufSource returns a source of the events of the ring buffer m,
+// read by workers with the given detail level. Events that cannot be read
+// are counted as userspace losses.
+func newRingbufSource(m *ebpf.Map, workers int, detail storage.EventDetail, losses *lossTracker, readDelay time.Duration) (*ringbufSource, error) {
+	rd, err := ringbuf.NewReader(m)
+	if err != nil {
+		return nil, fmt.Errorf("creating events ringbuf reader: %w", err)
+	}
+	return &ringbufSource{
+		rd:         rd,
+		next:       func() (*runtimeEvent, error) { return reader(rd) },
+		workers:    workers,
+		recordSize: ringbufRecordSize(detail),
+		losses:     losses,
+		readDelay:  readDelay,
+		events:     make(chan *runtimeEvent, sourceQueueSize),
+	}, nil
+}
+
+// Start starts the read workers, which read until the source is closed or
+// ctx is done, which closes the ring buffer.
+func (s *ringbufSource) Start(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() { s.rd.Close() })
+	s.wg.Add(s.workers)
+	for i := range s.workers {
+		go s.readEvents(i)
+	}
+	go func() {
+		s.wg.Wait()
+		stop()
+		close(s.events)
+	}()
+	return nil
+}
+
+func (s *ringbufSource) readEvents(id int) {
+	defer func() {
+		s.wg.Done()
+		log.Printf("[RW-%d] I'm done!", id)
+	}()
+	log.Printf("[RW-%d] I'm alive!", id)
+
+	for {
+		event, err := s.next()
+		if s.readDelay > 0 {
+			time.Sleep(s.readDelay)
+		}
+		if err != nil {
+			if errors.Is(err, ringbuf.ErrClosed) {
+				log.Printf("[RW-%d] Ringbuffer closed, exiting", id)
+				return
+			}
+
+			log.Printf("[RW-%d] Read error: %v", id, err)
+			s.errors.Add(1)
+			s.losses.addUserspace(1)
+			continue
+		}
+
+		readTimeKernel := getMonotonicNs()
+
+		if readTimeKernel >= event.Timestamp {
+			ringbufferWaitTime := int64(readTimeKernel - event.Timestamp)
+			s.waitNs.Add(ringbufferWaitTime)
+			s.waited.Add(1)
+
+			if ringbufferWaitTime >= 100*time.Millisecond.Nanoseconds() {
+				// Log unusually high wait times
+				log.Printf("[RW-%d] High ringbuffer wait time: %d ns (%.2f ms)", id,
+					ringbufferWaitTime, float64(ringbufferWaitTime)/1e6)
+			}
+		} else {
+			// This shouldn't happen
+			log.Printf("[RW-%d] Time inconsistency: readTime=%d < eventTime=%d", id,
+				readTimeKernel, event.Timestamp)
+		}
+
+		s.read.Add(1)
+		s.events <- event
+	}
+}
+
+func (s *ringbufSource) Events() <-chan *runtimeEvent {
+	return s.events
+}
+
+func (s *ringbufSource) Stats() sourceStats {
+	return sourceStats{
+		Read:   s.read.Load(),
+		Errors: s.errors.Load(),
+		Unread: s.rd.AvailableBytes() / s.recordSize,
+		WaitNs: s.waitNs.Load(),
+		Waited: s.waited.Load(),
+	}
+}
+
+// Close closes the ring buffer, which interrupts the read workers.
+func (s *ringbufSource) Close() error {
+	return s.rd.Close()
+}
+
+// syntheticSource generates random allocation and goroutine events, e.g. to
+// exercise the pipeline without a traced program.
+type syntheticSource struct {
+	// count is the number of events generated, zero to generate events
+	// until the source is closed
+	count int
+	// interval separates the timestamps of consecutive events
+	interval time.Duration
+	rng      *rand.Rand
+
+	events    chan *runtimeEvent
+	done      chan struct{}
+	closeOnce sync.Once
+	read      atomic.Uint64
+}
+
+// newSyntheticSource returns a source of count events, generated with the
+// given seed.
+func newSyntheticSource(count int, interval time.Duration, seed uint64) *syntheticSource {
+	return &syntheticSource{
+		count:    count,
+		interval: interval,
+		rng:      rand.New(rand.NewPCG(seed, seed)),
+		events:   make(chan *runtimeEvent, sourceQueueSize),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start generates the events on a goroutine of its own, with timestamps
+// from now on.
+func (s *syntheticSource) Start(ctx context.Context) error {
+	go func() {
+		defer close(s.events)
+
+		ts := getMonotonicNs()
+		for i := 0; s.count == 0 || i < s.count; i++ {
+			event := &runtimeEvent{ebpfGoRuntimeEventT: ebpfGoRuntimeEventT{
+				Timestamp:       ts,
+				EventType:       uint32(s.rng.IntN(6)),
+				Goroutine:       uint32(s.rng.IntN(256) + 1),
+				ParentGoroutine: uint32(s.rng.IntN(16) + 1),
+				Attributes:      [5]uint64{s.rng.Uint64N(10), s.rng.Uint64N(1 << 20), s.rng.Uint64N(1 << 20), 0, 0},
+			}}
+			select {
+			case s.events <- event:
+				s.read.Add(1)
+			case <-s.done:
+				return
+			case <-ctx.Done():
+				return
+			}
+			ts += uint64(s.interval)
+		}
+	}()
+	return nil
+}
+
+func (s *syntheticSource) Events() <-chan *runtimeEvent {
+	return s.events
+}
+
+func (s *syntheticSource) Stats() sourceStats {
+	return sourceStats{Read: s.read.Load()}
+}
+
+// Close stops generating events.
+func (s *syntheticSource) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	return nil
+}
+
+// replaySource reads the events of a recorded session from its store, in
+// the order they were stored. The store stays open once the source is
+// closed.
+type replaySource struct {
+	store storage.EventStore
+	// total is the number of events of the session
+	total int64
+
+	events    chan *runtimeEvent
+	done      chan struct{}
+	closeOnce sync.Once
+	read      atomic.Uint64
+	errors    atomic.Uint64
+}
+
+func newReplaySource(store storage.EventStore) *replaySource {
+	return &replaySource{
+		store:  store,
+		total:  store.GetSession().EventCount,
+		events: make(chan *runtimeEvent, sourceQueueSize),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start scans the store on a goroutine of its own.
+func (s *replaySource) Start(ctx context.Context) error {
+	go func() {
+		defer close(s.events)
+
+		err := s.store.ScanEvents(ctx, 0, func(_ int64, event *storage.Event) error {
+			select {
+			case s.events <- convertFromStorageEvent(event):
+				s.read.Add(1)
+				return nil
+			case <-s.done:
+				return storage.ErrStopScan
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Warning: replaying session %s: %v", s.store.GetSession().ID, err)
+			s.errors.Add(1)
+		}
+	}()
+	return nil
+}
+
+func (s *replaySource) Events() <-chan *runtimeEvent {
+	return s.events
+}
+
+func (s *replaySource) Stats() sourceStats {
+	return sourceStats{
+		Read:   s.read.Load(),
+		Errors: s.errors.Load(),
+		Unread: int(max(s.total-int64(s.read.Load()), 0)),
+	}
+}
+
+// Close stops the scan of the store.
+func (s *replaySource) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	return nil
+}
+
+// convertFromStorageEvent is the inverse of convertToStorageEvent. The probe
+// durations are not stored, so they are left zero.
+func convertFromStorageEvent(event *storage.Event) *runtimeEvent {
+	return &runtimeEvent{
+		ebpfGoRuntimeEventT: ebpfGoRuntimeEventT{
+			Timestamp:       event.Timestamp,
+			EventType:       uint32(event.EventType),
+			Goroutine:       event.Goroutine,
+			ParentGoroutine: event.ParentGoroutine,
+			Attributes:      event.Attributes,
+		},
+		Thread: event.Thread,
+		P:      event.P,
+	}
+}
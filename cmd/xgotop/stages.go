@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+	"go.sazak.io/xgotop/cmd/xgotop/transform"
+)
+
+// The built-in transform stages
+func init() {
+	transform.Register("drop", newDropStage)
+	transform.Register("hash", newHashStage)
+}
+
+// dropStage drops the events of some event types, e.g. "drop:casgstatus".
+type dropStage struct {
+	drop map[storage.EventType]bool
+}
+
+func newDropStage(config string) (transform.Stage, error) {
+	if config == "" {
+		return nil, fmt.Errorf("event names must be given, e.g. drop:casgstatus")
+	}
+	eventTypes, err := parseEventNames(config)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &dropStage{drop: make(map[storage.EventType]bool)}
+	for _, eventType := range eventTypes {
+		s.drop[eventType] = true
+	}
+	return s, nil
+}
+
+func (s *dropStage) Transform(events []*storage.Event) []*storage.Event {
+	kept := events[:0]
+	for _, event := range events {
+		if !s.drop[event.EventType] {
+			kept = append(kept, event)
+		}
+	}
+	return kept
+}
+
+// hashStage replaces attribute values by a keyed hash, e.g. "hash:newobject=1"
+// hashes the types of new objects. The key is random for every
+// session, so equal values still hash equally within the session, but cannot
+// be recovered or correlated across sessions.
+type hashStage struct {
+	key [32]byte
+	// attrs are the indices of the hashed attributes of every event type
+	attrs map[storage.EventType][]int
+}
+
+func newHashStage(config string) (transform.Stage, error) {
+	names, attrsStr, ok := strings.Cut(config, "=")
+	if !ok {
+		return nil, fmt.Errorf("attributes must be given as <events>=<attributes>, e.g. hash:newobject=0+1")
+	}
+	eventTypes, err := parseEventNames(names)
+	if err != nil {
+		return nil, err
+	}
+
+	var attrs []int
+	for _, attrStr := range strings.Split(attrsStr, "+") {
+		attr, err := strconv.Atoi(strings.TrimSpace(attrStr))
+		if err != nil || attr < 0 || attr >= len(storage.Event{}.Attributes) {
+			return nil, fmt.Errorf("invalid attribute index %q", attrStr)
+		}
+		attrs = append(attrs, attr)
+	}
+
+	s := &hashStage{attrs: make(map[storage.EventType][]int)}
+	if _, err := rand.Read(s.key[:]); err != nil {
+		return nil, fmt.Errorf("generate key: %w", err)
+	}
+	for _, eventType := range eventTypes {
+		s.attrs[eventType] = attrs
+	}
+	return s, nil
+}
+
+func (s *hashStage) Transform(events []*storage.Event) []*storage.Event {
+	var buf [len(s.key) + 8]byte
+	copy(buf[:], s.key[:])
+
+	for _, event := range events {
+		for _, attr := range s.attrs[event.EventType] {
+			binary.LittleEndian.PutUint64(buf[len(s.key):], event.Attributes[attr])
+			sum := sha256.Sum256(buf[:])
+			event.Attributes[attr] = binary.LittleEndian.Uint64(sum[:8])
+		}
+	}
+	return events
+}
@@ -0,0 +1,51 @@
+package storage
+
+import "time"
+
+// AnnotationKind tells what an annotation marks.
+type AnnotationKind string
+
+const (
+	// AnnotationRPSCollapse marks intervals in which the rate of events read
+	// from the ring buffer collapsed compared to the rest of the capture.
+	AnnotationRPSCollapse AnnotationKind = "rps-collapse"
+	// AnnotationQWLSpike marks intervals in which events waited unusually
+	// long in the processing queue.
+	AnnotationQWLSpike AnnotationKind = "qwl-spike"
+	// AnnotationDropBurst marks intervals in which events were lost.
+	AnnotationDropBurst AnnotationKind = "drop-burst"
+	// AnnotationBaselineDivergence marks intervals in which a rate of the
+	// capture diverged from the same rate of the baseline session.
+	AnnotationBaselineDivergence AnnotationKind = "baseline-divergence"
+)
+
+// Annotation marks an interval of the session timeline. The intervals marked
+// by automatic annotations are those whose events are not to be trusted as
+// much as the others, e.g. because events were lost or the pipeline stalled,
+// or whose behavior diverged from the baseline session.
+type Annotation struct {
+	Kind AnnotationKind `json:"kind"`
+	// StartTimestamp and EndTimestamp bound the interval on the clock of the
+	// event timestamps
+	StartTimestamp uint64    `json:"start_timestamp"`
+	EndTimestamp   uint64    `json:"end_timestamp"`
+	Start          time.Time `json:"start"`
+	End            time.Time `json:"end"`
+	Detail         string    `json:"detail"`
+	// Automatic annotations were added by xgotop during the capture
+	Automatic bool `json:"automatic"`
+}
+
+// BaselineMetric compares a rate of the capture, over the last comparison
+// window, with the same rate of the baseline session.
+type BaselineMetric struct {
+	// Metric is an event name for the rate of its events, or alloc_bytes
+	// for the rate of allocated bytes
+	Metric   string  `json:"metric"`
+	Live     float64 `json:"live"`
+	Baseline float64 `json:"baseline"`
+	// Ratio is Live divided by Baseline
+	Ratio float64 `json:"ratio"`
+	// Diverged is set while the ratio is beyond the -baseline-threshold
+	Diverged bool `json:"diverged"`
+}
@@ -0,0 +1,360 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
+// ArrowBatchRows is the number of events written per Arrow record batch.
+const ArrowBatchRows = 64 * 1024
+
+// ArrowSessionKey is the key of the custom metadata of the schema of
+// exported Arrow files holding the session metadata as JSON.
+const ArrowSessionKey = "xgotop.session"
+
+// Arrow IPC constants, see format/Message.fbs and format/Schema.fbs of the
+// Apache Arrow project.
+const (
+	arrowMetadataV5 = 4
+
+	arrowHeaderSchema      = 1
+	arrowHeaderRecordBatch = 3
+
+	arrowTypeInt  = 2
+	arrowTypeUtf8 = 5
+
+	arrowContinuation = 0xFFFFFFFF
+)
+
+var arrowMagic = []byte("ARROW1")
+
+// arrowColumn is a column of the exported Arrow files. Integer columns are
+// unsigned with the given bit width, columns without a width hold strings.
+type arrowColumn struct {
+	name     string
+	width    int
+	nullable bool
+	value    func(event *Event) (uint64, bool)
+	text     func(event *Event) string
+}
+
+// arrowColumns are the columns of the exported Arrow files, in order.
+var arrowColumns = []arrowColumn{
+	{name: "timestamp", width: 64, value: func(e *Event) (uint64, bool) { return e.Timestamp, true }},
+	{name: "event_type", width: 8, value: func(e *Event) (uint64, bool) { return uint64(e.EventType), true }},
+	{name: "event_name", text: func(e *Event) string { return e.EventType.String() }},
+	{name: "goroutine", width: 32, value: func(e *Event) (uint64, bool) { return uint64(e.Goroutine), true }},
+	{name: "parent_goroutine", width: 32, value: func(e *Event) (uint64, bool) { return uint64(e.ParentGoroutine), true }},
+	{name: "attr0", width: 64, value: func(e *Event) (uint64, bool) { return e.Attributes[0], true }},
+	{name: "attr1", width: 64, value: func(e *Event) (uint64, bool) { return e.Attributes[1], true }},
+	{name: "attr2", width: 64, value: func(e *Event) (uint64, bool) { return e.Attributes[2], true }},
+	{name: "attr3", width: 64, value: func(e *Event) (uint64, bool) { return e.Attributes[3], true }},
+	{name: "attr4", width: 64, value: func(e *Event) (uint64, bool) { return e.Attributes[4], true }},
+	{name: "thread", width: 32, value: func(e *Event) (uint64, bool) { return uint64(e.Thread), true }},
+	{name: "p", width: 32, nullable: true, value: func(e *Event) (uint64, bool) {
+		if e.P == nil {
+			return 0, false
+		}
+		return uint64(*e.P), true
+	}},
+}
+
+// arrowBlock locates a record batch message in an Arrow file.
+type arrowBlock struct {
+	offset         int64
+	metaDataLength int32
+	bodyLength     int64
+}
+
+// ArrowWriter writes events as an Apache Arrow IPC file, which is the same
+// as a Feather V2 file, so it can be loaded with e.g. pyarrow.feather or
+// pandas.read_feather. Events are buffered and written in record batches of
+// ArrowBatchRows rows.
+type ArrowWriter struct {
+	w        io.Writer
+	pos      int64
+	rows     []Event
+	batches  []arrowBlock
+	metadata map[string]string
+}
+
+// NewArrowWriter writes the file header and schema to w. If session is not
+// nil, its metadata is stored in the schema under ArrowSessionKey, e.g. in
+// schema.metadata of pyarrow.
+func NewArrowWriter(w io.Writer, session *Session) (*ArrowWriter, error) {
+	a := &ArrowWriter{w: w, rows: make([]Event, 0, ArrowBatchRows)}
+	if session != nil {
+		data, err := json.Marshal(session)
+		if err != nil {
+			return nil, fmt.Errorf("encode session metadata: %w", err)
+		}
+		a.metadata = map[string]string{ArrowSessionKey: string(data)}
+	}
+
+	// The magic is padded to 8 bytes at the start of the file
+	if err := a.write(append([]byte("ARROW1"), 0, 0)); err != nil {
+		return nil, err
+	}
+
+	b := flatbuffers.NewBuilder(1024)
+	schema := buildArrowSchema(b, a.metadata)
+	if _, err := a.writeMessage(b, arrowHeaderSchema, schema, nil); err != nil {
+		return nil, fmt.Errorf("write schema: %w", err)
+	}
+
+	return a, nil
+}
+
+// Write adds event to the file.
+func (a *ArrowWriter) Write(event *Event) error {
+	a.rows = append(a.rows, *event)
+	if len(a.rows) >= ArrowBatchRows {
+		return a.flush()
+	}
+	return nil
+}
+
+// Close writes the buffered events and the file footer. It does not close
+// the underlying writer.
+func (a *ArrowWriter) Close() error {
+	if err := a.flush(); err != nil {
+		return err
+	}
+
+	// End-of-stream marker
+	eos := make([]byte, 8)
+	binary.LittleEndian.PutUint32(eos, arrowContinuation)
+	if err := a.write(eos); err != nil {
+		return err
+	}
+
+	b := flatbuffers.NewBuilder(1024)
+	schema := buildArrowSchema(b, a.metadata)
+	b.StartVector(24, 0, 8)
+	dictionaries := b.EndVector(0)
+	b.StartVector(24, len(a.batches), 8)
+	for i := len(a.batches) - 1; i >= 0; i-- {
+		block := a.batches[i]
+		b.Prep(8, 24)
+		b.PrependInt64(block.bodyLength)
+		b.Pad(4)
+		b.PrependInt32(block.metaDataLength)
+		b.PrependInt64(block.offset)
+	}
+	batches := b.EndVector(len(a.batches))
+
+	b.StartObject(5)
+	b.PrependInt16Slot(0, arrowMetadataV5, 0)
+	b.PrependUOffsetTSlot(1, schema, 0)
+	b.PrependUOffsetTSlot(2, dictionaries, 0)
+	b.PrependUOffsetTSlot(3, batches, 0)
+	b.Finish(b.EndObject())
+	footer := b.FinishedBytes()
+
+	trailer := binary.LittleEndian.AppendUint32(nil, uint32(len(footer)))
+	trailer = append(trailer, arrowMagic...)
+	if err := a.write(footer); err != nil {
+		return err
+	}
+	return a.write(trailer)
+}
+
+// flush writes the buffered events as a record batch.
+func (a *ArrowWriter) flush() error {
+	if len(a.rows) == 0 {
+		return nil
+	}
+
+	type bufferSpec struct{ offset, length int64 }
+	type nodeSpec struct{ length, nullCount int64 }
+
+	var body []byte
+	var buffers []bufferSpec
+	var nodes []nodeSpec
+
+	addBuffer := func(data []byte) {
+		buffers = append(buffers, bufferSpec{offset: int64(len(body)), length: int64(len(data))})
+		body = append(body, data...)
+		body = append(body, make([]byte, padding8(len(data)))...)
+	}
+
+	n := len(a.rows)
+	for _, col := range arrowColumns {
+		if col.text != nil {
+			offsets := make([]byte, 0, (n+1)*4)
+			var data []byte
+			offsets = binary.LittleEndian.AppendUint32(offsets, 0)
+			for i := range a.rows {
+				data = append(data, col.text(&a.rows[i])...)
+				offsets = binary.LittleEndian.AppendUint32(offsets, uint32(len(data)))
+			}
+			nodes = append(nodes, nodeSpec{length: int64(n)})
+			addBuffer(nil)
+			addBuffer(offsets)
+			addBuffer(data)
+			continue
+		}
+
+		validity := make([]byte, (n+7)/8)
+		values := make([]byte, 0, n*col.width/8)
+		var nullCount int64
+		for i := range a.rows {
+			value, ok := col.value(&a.rows[i])
+			if ok {
+				validity[i/8] |= 1 << (i % 8)
+			} else {
+				nullCount++
+			}
+			switch col.width {
+			case 8:
+				values = append(values, byte(value))
+			case 32:
+				values = binary.LittleEndian.AppendUint32(values, uint32(value))
+			default:
+				values = binary.LittleEndian.AppendUint64(values, value)
+			}
+		}
+
+		nodes = append(nodes, nodeSpec{length: int64(n), nullCount: nullCount})
+		if nullCount == 0 {
+			// The validity bitmap may be omitted when there are no nulls
+			validity = nil
+		}
+		addBuffer(validity)
+		addBuffer(values)
+	}
+
+	b := flatbuffers.NewBuilder(1024)
+	b.StartVector(16, len(nodes), 8)
+	for i := len(nodes) - 1; i >= 0; i-- {
+		b.Prep(8, 16)
+		b.PrependInt64(nodes[i].nullCount)
+		b.PrependInt64(nodes[i].length)
+	}
+	nodesVec := b.EndVector(len(nodes))
+	b.StartVector(16, len(buffers), 8)
+	for i := len(buffers) - 1; i >= 0; i-- {
+		b.Prep(8, 16)
+		b.PrependInt64(buffers[i].length)
+		b.PrependInt64(buffers[i].offset)
+	}
+	buffersVec := b.EndVector(len(buffers))
+
+	b.StartObject(5)
+	b.PrependInt64Slot(0, int64(n), 0)
+	b.PrependUOffsetTSlot(1, nodesVec, 0)
+	b.PrependUOffsetTSlot(2, buffersVec, 0)
+	batch := b.EndObject()
+
+	block, err := a.writeMessage(b, arrowHeaderRecordBatch, batch, body)
+	if err != nil {
+		return fmt.Errorf("write record batch: %w", err)
+	}
+	a.batches = append(a.batches, block)
+	a.rows = a.rows[:0]
+
+	return nil
+}
+
+// writeMessage writes an encapsulated IPC message with the given header
+// table, built with b, followed by body.
+func (a *ArrowWriter) writeMessage(b *flatbuffers.Builder, headerType byte, header flatbuffers.UOffsetT, body []byte) (arrowBlock, error) {
+	b.StartObject(5)
+	b.PrependInt64Slot(3, int64(len(body)), 0)
+	b.PrependUOffsetTSlot(2, header, 0)
+	b.PrependByteSlot(1, headerType, 0)
+	b.PrependInt16Slot(0, arrowMetadataV5, 0)
+	b.Finish(b.EndObject())
+	meta := b.FinishedBytes()
+
+	// The metadata is padded so that the body starts 8-byte aligned
+	metaLen := len(meta) + padding8(len(meta))
+	prefix := binary.LittleEndian.AppendUint32(nil, arrowContinuation)
+	prefix = binary.LittleEndian.AppendUint32(prefix, uint32(metaLen))
+
+	block := arrowBlock{
+		offset:         a.pos,
+		metaDataLength: int32(len(prefix) + metaLen),
+		bodyLength:     int64(len(body)),
+	}
+
+	for _, data := range [][]byte{prefix, meta, make([]byte, padding8(len(meta))), body} {
+		if err := a.write(data); err != nil {
+			return arrowBlock{}, err
+		}
+	}
+
+	return block, nil
+}
+
+func (a *ArrowWriter) write(data []byte) error {
+	n, err := a.w.Write(data)
+	a.pos += int64(n)
+	return err
+}
+
+// buildArrowSchema builds the Schema table describing arrowColumns.
+func buildArrowSchema(b *flatbuffers.Builder, metadata map[string]string) flatbuffers.UOffsetT {
+	fields := make([]flatbuffers.UOffsetT, len(arrowColumns))
+	for i, col := range arrowColumns {
+		name := b.CreateString(col.name)
+
+		var typeType byte
+		var typ flatbuffers.UOffsetT
+		if col.text != nil {
+			typeType = arrowTypeUtf8
+			b.StartObject(0)
+			typ = b.EndObject()
+		} else {
+			typeType = arrowTypeInt
+			b.StartObject(2)
+			b.PrependInt32Slot(0, int32(col.width), 0)
+			b.PrependBoolSlot(1, false, false)
+			typ = b.EndObject()
+		}
+
+		// Readers expect the children vector even if it is empty
+		b.StartVector(4, 0, 4)
+		children := b.EndVector(0)
+
+		b.StartObject(7)
+		b.PrependUOffsetTSlot(0, name, 0)
+		b.PrependBoolSlot(1, col.nullable, false)
+		b.PrependByteSlot(2, typeType, 0)
+		b.PrependUOffsetTSlot(3, typ, 0)
+		b.PrependUOffsetTSlot(5, children, 0)
+		fields[i] = b.EndObject()
+	}
+	fieldsVec := b.CreateVectorOfTables(fields)
+
+	var metadataVec flatbuffers.UOffsetT
+	if len(metadata) > 0 {
+		var pairs []flatbuffers.UOffsetT
+		for _, key := range slices.Sorted(maps.Keys(metadata)) {
+			k := b.CreateString(key)
+			v := b.CreateString(metadata[key])
+			b.StartObject(2)
+			b.PrependUOffsetTSlot(0, k, 0)
+			b.PrependUOffsetTSlot(1, v, 0)
+			pairs = append(pairs, b.EndObject())
+		}
+		metadataVec = b.CreateVectorOfTables(pairs)
+	}
+
+	b.StartObject(4)
+	b.PrependUOffsetTSlot(1, fieldsVec, 0)
+	if metadataVec != 0 {
+		b.PrependUOffsetTSlot(2, metadataVec, 0)
+	}
+	return b.EndObject()
+}
+
+func padding8(n int) int {
+	return (8 - n%8) % 8
+}
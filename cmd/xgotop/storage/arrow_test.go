@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"testing"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
+// arrowTable reads a flatbuffers table of the Arrow IPC format.
+type arrowTable struct {
+	flatbuffers.Table
+}
+
+func rootArrowTable(buf []byte) arrowTable {
+	return arrowTable{flatbuffers.Table{Bytes: buf, Pos: flatbuffers.GetUOffsetT(buf)}}
+}
+
+// field returns the vtable offset of field i, zero if it is absent.
+func (t arrowTable) field(i int) flatbuffers.UOffsetT {
+	return flatbuffers.UOffsetT(t.Offset(flatbuffers.VOffsetT(4 + 2*i)))
+}
+
+// slot returns the position of field i, zero if it is absent.
+func (t arrowTable) slot(i int) flatbuffers.UOffsetT {
+	if o := t.field(i); o != 0 {
+		return t.Pos + o
+	}
+	return 0
+}
+
+func (t arrowTable) table(i int) arrowTable {
+	return arrowTable{flatbuffers.Table{Bytes: t.Bytes, Pos: t.Indirect(t.slot(i))}}
+}
+
+func (t arrowTable) tables(i int) []arrowTable {
+	o := t.field(i)
+	if o == 0 {
+		return nil
+	}
+	start := t.Vector(o)
+	tables := make([]arrowTable, t.VectorLen(o))
+	for j := range tables {
+		tables[j] = arrowTable{flatbuffers.Table{Bytes: t.Bytes, Pos: t.Indirect(start + flatbuffers.UOffsetT(4*j))}}
+	}
+	return tables
+}
+
+// structs returns the structs of vector field i, which are size bytes each.
+func (t arrowTable) structs(i, size int) [][]byte {
+	o := t.field(i)
+	if o == 0 {
+		return nil
+	}
+	start := int(t.Vector(o))
+	structs := make([][]byte, t.VectorLen(o))
+	for j := range structs {
+		structs[j] = t.Bytes[start+j*size : start+(j+1)*size]
+	}
+	return structs
+}
+
+// readArrowMessage reads the encapsulated message at offset of data and
+// returns it, the length of its padded metadata and its body.
+func readArrowMessage(t *testing.T, data []byte, offset int) (arrowTable, int, []byte) {
+	t.Helper()
+
+	if cont := binary.LittleEndian.Uint32(data[offset:]); cont != arrowContinuation {
+		t.Fatalf("message at %d: continuation = %#x", offset, cont)
+	}
+	metaLen := int(binary.LittleEndian.Uint32(data[offset+4:]))
+	if (8+metaLen)%8 != 0 {
+		t.Errorf("message at %d: metadata length %d is not padded to 8 bytes", offset, metaLen)
+	}
+	msg := rootArrowTable(data[offset+8 : offset+8+metaLen])
+	if version := msg.GetInt16Slot(4, 0); version != arrowMetadataV5 {
+		t.Errorf("message at %d: version = %d, want %d", offset, version, arrowMetadataV5)
+	}
+	bodyStart := offset + 8 + metaLen
+	bodyLen := int(msg.GetInt64Slot(10, 0))
+	return msg, metaLen, data[bodyStart : bodyStart+bodyLen]
+}
+
+func checkArrowSchema(t *testing.T, schema arrowTable, sessionID string) {
+	t.Helper()
+
+	fields := schema.tables(1)
+	if len(fields) != len(arrowColumns) {
+		t.Fatalf("schema has %d fields, want %d", len(fields), len(arrowColumns))
+	}
+	for i, col := range arrowColumns {
+		field := fields[i]
+		if name := field.String(field.slot(0)); name != col.name {
+			t.Errorf("field %d: name = %q, want %q", i, name, col.name)
+		}
+		if nullable := field.GetBoolSlot(6, false); nullable != col.nullable {
+			t.Errorf("field %s: nullable = %t, want %t", col.name, nullable, col.nullable)
+		}
+		if field.slot(5) == 0 {
+			t.Errorf("field %s: no children vector", col.name)
+		}
+		typ := field.table(3)
+		switch typeType := field.GetByteSlot(8, 0); {
+		case col.text != nil:
+			if typeType != arrowTypeUtf8 {
+				t.Errorf("field %s: type = %d, want utf8", col.name, typeType)
+			}
+		case typeType != arrowTypeInt:
+			t.Errorf("field %s: type = %d, want int", col.name, typeType)
+		default:
+			if width := typ.GetInt32Slot(4, 0); int(width) != col.width {
+				t.Errorf("field %s: bit width = %d, want %d", col.name, width, col.width)
+			}
+			if typ.GetBoolSlot(6, false) {
+				t.Errorf("field %s: signed", col.name)
+			}
+		}
+	}
+
+	metadata := schema.tables(2)
+	if len(metadata) != 1 {
+		t.Fatalf("schema has %d metadata entries, want 1", len(metadata))
+	}
+	if key := metadata[0].String(metadata[0].slot(0)); key != ArrowSessionKey {
+		t.Errorf("metadata key = %q, want %q", key, ArrowSessionKey)
+	}
+	var session Session
+	if err := json.Unmarshal(metadata[0].ByteVector(metadata[0].slot(1)), &session); err != nil {
+		t.Fatal(err)
+	}
+	if session.ID != sessionID {
+		t.Errorf("session ID = %q, want %q", session.ID, sessionID)
+	}
+}
+
+func TestArrowWriter(t *testing.T) {
+	// Two record batches, the second one with rows of odd sizes
+	events := make([]*Event, ArrowBatchRows+3)
+	for i := range events {
+		events[i] = &Event{
+			Timestamp:       uint64(i) + 1,
+			EventType:       EventType(i % 19),
+			Goroutine:       uint32(i % 100),
+			ParentGoroutine: uint32(i % 7),
+			Attributes:      [5]uint64{uint64(i), uint64(i) << 32, 0, 3, math.MaxUint64},
+			Thread:          uint32(i % 5),
+		}
+		if i%3 != 0 {
+			p := uint32(i % 4)
+			events[i].P = &p
+		}
+	}
+
+	var buf bytes.Buffer
+	w, err := NewArrowWriter(&buf, &Session{ID: "s1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range events {
+		if err := w.Write(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	if !bytes.Equal(data[:8], []byte("ARROW1\x00\x00")) {
+		t.Fatalf("file starts with %q", data[:8])
+	}
+	if !bytes.Equal(data[len(data)-6:], arrowMagic) {
+		t.Fatalf("file ends with %q", data[len(data)-6:])
+	}
+	footerLen := int(binary.LittleEndian.Uint32(data[len(data)-10:]))
+	footerStart := len(data) - 10 - footerLen
+	if eos := data[footerStart-8 : footerStart]; !bytes.Equal(eos, []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}) {
+		t.Errorf("end-of-stream marker = %x", eos)
+	}
+	footer := rootArrowTable(data[footerStart : footerStart+footerLen])
+	checkArrowSchema(t, footer.table(1), "s1")
+
+	schemaMsg, _, body := readArrowMessage(t, data, 8)
+	if headerType := schemaMsg.GetByteSlot(6, 0); headerType != arrowHeaderSchema {
+		t.Fatalf("first message type = %d, want schema", headerType)
+	}
+	if len(body) != 0 {
+		t.Errorf("schema message has a body of %d bytes", len(body))
+	}
+	checkArrowSchema(t, schemaMsg.table(2), "s1")
+
+	blocks := footer.structs(3, 24)
+	if len(blocks) != 2 {
+		t.Fatalf("footer has %d record batches, want 2", len(blocks))
+	}
+	row := 0
+	for i, block := range blocks {
+		offset := int(binary.LittleEndian.Uint64(block[0:]))
+		blockMetaLen := int(binary.LittleEndian.Uint32(block[8:]))
+		blockBodyLen := int(binary.LittleEndian.Uint64(block[16:]))
+		if offset%8 != 0 {
+			t.Errorf("batch %d: offset %d is not 8-byte aligned", i, offset)
+		}
+
+		msg, metaLen, body := readArrowMessage(t, data, offset)
+		if headerType := msg.GetByteSlot(6, 0); headerType != arrowHeaderRecordBatch {
+			t.Fatalf("batch %d: message type = %d, want record batch", i, headerType)
+		}
+		if blockMetaLen != 8+metaLen || blockBodyLen != len(body) {
+			t.Errorf("batch %d: block lengths = %d, %d, want %d, %d", i, blockMetaLen, blockBodyLen, 8+metaLen, len(body))
+		}
+
+		batch := msg.table(2)
+		length := int(batch.GetInt64Slot(4, 0))
+		nodes := batch.structs(1, 16)
+		buffers := batch.structs(2, 16)
+		if len(nodes) != len(arrowColumns) {
+			t.Fatalf("batch %d: %d nodes, want %d", i, len(nodes), len(arrowColumns))
+		}
+
+		// Every buffer starts 8-byte aligned right after the zero padding of
+		// the previous one
+		bufs := make([][]byte, len(buffers))
+		next := 0
+		for j, b := range buffers {
+			bufOffset := int(binary.LittleEndian.Uint64(b[0:]))
+			bufLen := int(binary.LittleEndian.Uint64(b[8:]))
+			if bufOffset != next {
+				t.Fatalf("batch %d: buffer %d at %d, want %d", i, j, bufOffset, next)
+			}
+			bufs[j] = body[bufOffset : bufOffset+bufLen]
+			next = bufOffset + bufLen + padding8(bufLen)
+			if padding := body[bufOffset+bufLen : next]; !bytes.Equal(padding, make([]byte, len(padding))) {
+				t.Errorf("batch %d: buffer %d padding = %x", i, j, padding)
+			}
+		}
+		if next != len(body) {
+			t.Errorf("batch %d: buffers end at %d, body has %d bytes", i, next, len(body))
+		}
+
+		for c, col := range arrowColumns {
+			if nodeLen := int(binary.LittleEndian.Uint64(nodes[c][0:])); nodeLen != length {
+				t.Errorf("batch %d: column %s has %d rows, want %d", i, col.name, nodeLen, length)
+			}
+			nullCount := int(binary.LittleEndian.Uint64(nodes[c][8:]))
+			validity := bufs[0]
+			nulls := 0
+			for r := range length {
+				event := events[row+r]
+				if col.text != nil {
+					offsets := bufs[1]
+					start := binary.LittleEndian.Uint32(offsets[4*r:])
+					end := binary.LittleEndian.Uint32(offsets[4*(r+1):])
+					if text := string(bufs[2][start:end]); text != col.text(event) {
+						t.Fatalf("batch %d: %s of row %d = %q, want %q", i, col.name, r, text, col.text(event))
+					}
+					continue
+				}
+
+				want, ok := col.value(event)
+				if valid := len(validity) == 0 || validity[r/8]&(1<<(r%8)) != 0; valid != ok {
+					t.Fatalf("batch %d: %s of row %d valid = %t, want %t", i, col.name, r, valid, ok)
+				}
+				if !ok {
+					nulls++
+					continue
+				}
+				var value uint64
+				switch col.width {
+				case 8:
+					value = uint64(bufs[1][r])
+				case 32:
+					value = uint64(binary.LittleEndian.Uint32(bufs[1][4*r:]))
+				default:
+					value = binary.LittleEndian.Uint64(bufs[1][8*r:])
+				}
+				if value != want {
+					t.Fatalf("batch %d: %s of row %d = %d, want %d", i, col.name, r, value, want)
+				}
+			}
+			if nullCount != nulls {
+				t.Errorf("batch %d: column %s null count = %d, want %d", i, col.name, nullCount, nulls)
+			}
+			if col.text != nil {
+				bufs = bufs[3:]
+			} else {
+				bufs = bufs[2:]
+			}
+		}
+		row += length
+	}
+	if row != len(events) {
+		t.Errorf("file has %d rows, want %d", row, len(events))
+	}
+}
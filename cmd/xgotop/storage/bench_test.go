@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+// benchFormats are the formats of the store benchmarks.
+var benchFormats = []string{"jsonl", "protobuf", "sqlite", "memory"}
+
+// benchEvents generates n events with a fixed seed, so that every run
+// benchmarks the same fixture. The event type mix and attribute values
+// roughly follow a capture of the testserver under load.
+func benchEvents(n int) []*Event {
+	rng := rand.New(rand.NewPCG(1, 2))
+	types := []EventType{
+		EventTypeCasGStatus, EventTypeCasGStatus, EventTypeCasGStatus,
+		EventTypeMakeSlice, EventTypeMakeMap, EventTypeNewObject, EventTypeNewObject,
+		EventTypeNewGoroutine, EventTypeGoExit,
+	}
+
+	events := make([]*Event, n)
+	ts := uint64(1_000_000_000)
+	for i := range events {
+		ts += uint64(rng.IntN(2000))
+		events[i] = &Event{
+			Timestamp:       ts,
+			EventType:       types[rng.IntN(len(types))],
+			Goroutine:       uint32(rng.IntN(256) + 1),
+			ParentGoroutine: uint32(rng.IntN(16) + 1),
+			Attributes:      [5]uint64{rng.Uint64N(10), rng.Uint64N(1 << 20), rng.Uint64N(1 << 20), 0, 0},
+		}
+	}
+	return events
+}
+
+func newBenchStore(b *testing.B, format string) (*Manager, EventStore) {
+	b.Helper()
+
+	manager, err := NewManager(b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+	session := &Session{ID: fmt.Sprintf("bench-%s", format), StartTime: time.Now()}
+	store, err := manager.CreateSession(context.Background(), session, format)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return manager, store
+}
+
+func BenchmarkWriteBatch(b *testing.B) {
+	for _, format := range benchFormats {
+		for _, batchSize := range []int{100, 1000, 10000} {
+			b.Run(fmt.Sprintf("%s/batch=%d", format, batchSize), func(b *testing.B) {
+				_, store := newBenchStore(b, format)
+				defer store.Close()
+				batch := benchEvents(batchSize)
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := store.WriteBatch(context.Background(), batch); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(b.N*batchSize)/b.Elapsed().Seconds(), "events/s")
+			})
+		}
+	}
+}
+
+func BenchmarkReadEvents(b *testing.B) {
+	const sessionEvents = 100000
+
+	events := benchEvents(sessionEvents)
+	goroutine := events[0].Goroutine
+	eventType := EventTypeNewGoroutine
+	startTime := events[sessionEvents/2].Timestamp
+	endTime := events[sessionEvents/2+1000].Timestamp
+
+	filters := []struct {
+		name   string
+		filter *EventFilter
+	}{
+		{"limit", &EventFilter{Limit: 1000}},
+		{"offset", &EventFilter{Offset: sessionEvents / 2, Limit: 1000}},
+		{"goroutine", &EventFilter{Goroutine: &goroutine}},
+		{"event_type", &EventFilter{EventType: &eventType}},
+		{"time_range", &EventFilter{StartTime: &startTime, EndTime: &endTime}},
+	}
+
+	for _, format := range benchFormats {
+		b.Run(format, func(b *testing.B) {
+			manager, store := newBenchStore(b, format)
+			if err := store.WriteBatch(context.Background(), events); err != nil {
+				b.Fatal(err)
+			}
+			id := store.GetSession().ID
+			if err := store.Close(); err != nil {
+				b.Fatal(err)
+			}
+
+			store, err := manager.OpenSession(context.Background(), id)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer store.Close()
+
+			for _, f := range filters {
+				b.Run(f.name, func(b *testing.B) {
+					b.ReportAllocs()
+					for i := 0; i < b.N; i++ {
+						if _, err := store.ReadEvents(context.Background(), f.filter); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			}
+		})
+	}
+}
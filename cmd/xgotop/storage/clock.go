@@ -0,0 +1,69 @@
+package storage
+
+import "time"
+
+// ClockSample relates the monotonic clock of event timestamps to the wall
+// clock of the capturing host at one point in time.
+type ClockSample struct {
+	Wall        time.Time `json:"wall"`
+	MonotonicNs uint64    `json:"monotonic_ns"`
+	// OffsetNs converts event timestamps to Unix time in nanoseconds:
+	// unix ns = timestamp + OffsetNs.
+	OffsetNs int64 `json:"offset_ns"`
+	// ReadErrorNs is the time it took to read both clocks, which bounds the
+	// error of OffsetNs.
+	ReadErrorNs int64 `json:"read_error_ns"`
+
+	// NTPSynchronized reports whether the kernel considered the wall clock
+	// synchronized, e.g. by NTP or PTP.
+	NTPSynchronized bool `json:"ntp_synchronized"`
+	// NTPMaxErrorNs is the maximum error of the wall clock estimated by the
+	// kernel. It is only meaningful while synchronized.
+	NTPMaxErrorNs int64 `json:"ntp_max_error_ns"`
+	NTPEstErrorNs int64 `json:"ntp_est_error_ns"`
+}
+
+// ClockSync is the clock metadata of a session, sampled when the capture
+// starts and ends, so that sessions captured on different hosts can be
+// aligned on a common timeline.
+type ClockSync struct {
+	Hostname string       `json:"hostname"`
+	Start    ClockSample  `json:"start"`
+	End      *ClockSample `json:"end,omitempty"`
+}
+
+// DriftNs returns how much the offset between the wall and monotonic clocks
+// changed during the capture, e.g. because of NTP adjustments. It is zero
+// until the end of the capture is sampled.
+func (c *ClockSync) DriftNs() int64 {
+	if c.End == nil {
+		return 0
+	}
+	return c.End.OffsetNs - c.Start.OffsetNs
+}
+
+// ErrorBoundNs returns the bound of the error of converting event timestamps
+// of the session to wall clock time with the start offset: the offset
+// measurement error, the drift during the capture and, if the clock was
+// synchronized, its maximum error. It returns -1 if the wall clock was not
+// synchronized, since its error is then unknown.
+func (c *ClockSync) ErrorBoundNs() int64 {
+	samples := []*ClockSample{&c.Start}
+	if c.End != nil {
+		samples = append(samples, c.End)
+	}
+
+	var maxError int64
+	for _, sample := range samples {
+		if !sample.NTPSynchronized {
+			return -1
+		}
+		maxError = max(maxError, sample.NTPMaxErrorNs+sample.ReadErrorNs)
+	}
+
+	drift := c.DriftNs()
+	if drift < 0 {
+		drift = -drift
+	}
+	return maxError + drift
+}
@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+var (
+	// Goroutine status names by the runtime's _G* constants
+	goroutineStatuses = []string{
+		"idle", "runnable", "running", "syscall", "waiting", "moribund", "dead", "enqueue", "copystack", "preempted",
+	}
+
+	// runtime.gcMarkWorkerMode names by the mode attribute of mark worker events
+	gcMarkWorkerModes = []string{"none", "dedicated", "fractional", "idle"}
+
+	// Runtime function names by the source attribute of string allocation
+	// events, as defined by go_string_alloc_source in xgotop.h
+	stringAllocSources = []string{"concatstrings", "slicebytetostring"}
+
+	// Runtime function names by the variant attribute of interface conversion
+	// events, as defined by go_iface_conv_variant in xgotop.h
+	ifaceConvVariants = []string{
+		"convT", "convTnoptr", "convT16", "convT32", "convT64", "convTstring", "convTslice", "assertE2I",
+	}
+)
+
+// goroutineStatusScan is the bit set in the status of goroutines whose stack
+// is being scanned.
+const goroutineStatusScan = 0x1000
+
+func lookupName(names []string, v uint64) string {
+	if v < uint64(len(names)) {
+		return names[v]
+	}
+	return "unknown"
+}
+
+// GoroutineStatus returns the name of a goroutine status as recorded by
+// casgstatus events.
+func GoroutineStatus(v uint64) string {
+	if v&goroutineStatusScan != 0 {
+		return "scan" + lookupName(goroutineStatuses, v&^goroutineStatusScan)
+	}
+	return lookupName(goroutineStatuses, v)
+}
+
+// GCMarkWorkerMode returns the name of the mode attribute of mark worker
+// events.
+func GCMarkWorkerMode(v uint64) string {
+	return lookupName(gcMarkWorkerModes, v)
+}
+
+// StringAllocSource returns the runtime function name of the source attribute
+// of string allocation events.
+func StringAllocSource(v uint64) string {
+	return lookupName(stringAllocSources, v)
+}
+
+// IfaceConvVariant returns the runtime function name of the variant
+// attribute of interface conversion events.
+func IfaceConvVariant(v uint64) string {
+	return lookupName(ifaceConvVariants, v)
+}
+
+// DecodedField is a named field of a decoded event.
+type DecodedField struct {
+	Name  string
+	Value any
+}
+
+// DecodedEvent is an event with its attributes decoded into named fields,
+// see xgotop.h for the attributes of every event type. It is encoded as a
+// flat JSON object with the fields in order, so it can be processed with
+// e.g. jq without knowing the attribute layout.
+type DecodedEvent struct {
+	Fields []DecodedField
+}
+
+// DecodeEvent decodes the attributes of event. If session is not nil, it is
+// used to resolve the names of USDT probes and goroutine functions, and the
+// fields its detail level does not record are left out.
+func DecodeEvent(event *Event, session *Session) *DecodedEvent {
+	d := &DecodedEvent{}
+	d.add("timestamp", event.Timestamp)
+	d.add("event", event.EventType.String())
+	d.add("goroutine", event.Goroutine)
+	// Minimal events have no parent goroutine nor attributes. Events with
+	// attributes or a thread were captured in full detail, like the events of
+	// flagged goroutines, or written by xgotop itself, like the allocation
+	// summaries and the markers injected through the API.
+	if session != nil && session.EventDetail == EventDetailMinimal && event.EventType != EventTypeAllocSummary && event.Attributes == [5]uint64{} && event.Thread == 0 {
+		return d
+	}
+	d.add("parent_goroutine", event.ParentGoroutine)
+	if event.Thread != 0 {
+		d.add("thread", event.Thread)
+	}
+	if event.P != nil {
+		d.add("p", *event.P)
+	}
+
+	attrs := event.Attributes
+	switch event.EventType {
+	case EventTypeCasGStatus:
+		d.add("old_status", GoroutineStatus(attrs[0]))
+		d.add("new_status", GoroutineStatus(attrs[1]))
+		d.add("target_goroutine", attrs[2])
+	case EventTypeMakeSlice:
+		d.add("elem_size", attrs[0])
+		d.add("elem_kind", Kind(attrs[1]).String())
+		d.add("len", attrs[2])
+		d.add("cap", attrs[3])
+	case EventTypeMakeMap:
+		d.add("key_size", attrs[0])
+		d.add("key_kind", Kind(attrs[1]).String())
+		d.add("elem_size", attrs[2])
+		d.add("elem_kind", Kind(attrs[3]).String())
+		d.add("hint", attrs[4])
+	case EventTypeNewObject:
+		d.add("size", attrs[0])
+		d.add("kind", Kind(attrs[1]).String())
+	case EventTypeNewGoroutine:
+		d.add("creator_goroutine", attrs[0])
+		d.add("new_goroutine", attrs[1])
+		d.add("start_pc", hexAddr(attrs[2]))
+		d.add("go_pc", hexAddr(attrs[3]))
+		if session != nil {
+			if name, ok := session.Functions[attrs[2]]; ok {
+				d.add("start_func", name)
+			}
+			if name, ok := session.Functions[attrs[3]]; ok {
+				d.add("created_by", name)
+			}
+		}
+	case EventTypeGoExit:
+		d.add("exited_goroutine", attrs[0])
+		d.add("exit_timestamp", attrs[1])
+	case EventTypeSemaBlock:
+		d.add("blocked_ns", attrs[0])
+		d.add("addr", hexAddr(attrs[1]))
+		d.add("wait_reason", attrs[2])
+		d.add("waker_goroutine", attrs[3])
+	case EventTypeTimerCreate:
+		d.add("timer", hexAddr(attrs[0]))
+		d.add("period", attrs[1])
+		d.add("when", attrs[2])
+	case EventTypeTimerStop:
+		d.add("timer", hexAddr(attrs[0]))
+	case EventTypeIfaceConv:
+		d.add("kind", Kind(attrs[0]).String())
+		d.add("size", attrs[1])
+		d.add("variant", IfaceConvVariant(attrs[2]))
+	case EventTypeStringAlloc:
+		d.add("len", attrs[0])
+		d.add("source", StringAllocSource(attrs[1]))
+		d.add("operands", attrs[2])
+		d.add("on_stack", attrs[3] != 0)
+	case EventTypeSchedStats:
+		d.add("p_id", attrs[0])
+		d.add("runq_len", attrs[1])
+		d.add("p_status", attrs[2])
+		d.add("gomaxprocs", attrs[3])
+	case EventTypeNewM:
+		d.add("m_id", attrs[0])
+		if attrs[1] != 0 {
+			d.add("p_id", attrs[2])
+		}
+	case EventTypeMExit:
+		d.add("m_id", attrs[0])
+		d.add("os_stack", attrs[1] != 0)
+	case EventTypeGCAssist:
+		if attrs[1] != 0 {
+			d.add("debt_bytes", attrs[0])
+		}
+	case EventTypeGCMarkWorker:
+		d.add("mode", GCMarkWorkerMode(attrs[1]))
+		if attrs[0] == 0 {
+			d.add("phase", "start")
+		} else {
+			d.add("phase", "stop")
+			d.add("duration_ns", attrs[2])
+		}
+	case EventTypeMarker:
+		d.add("marker_id", attrs[0])
+		// Phases as defined by marker_phase in xgotop.h
+		if attrs[1] == 0 {
+			d.add("phase", "begin")
+		} else {
+			d.add("phase", "end")
+		}
+	case EventTypeUSDT:
+		d.add("probe_id", attrs[0])
+		if session != nil {
+			for _, probe := range session.USDTProbes {
+				if uint64(probe.ID) == attrs[0] {
+					d.add("probe", probe.Provider+":"+probe.Name)
+					break
+				}
+			}
+		}
+		d.add("args", attrs[1:])
+	case EventTypeAllocSummary:
+		d.add("bytes", attrs[0])
+		d.add("allocs", attrs[1])
+		d.add("total_bytes", attrs[2])
+		d.add("total_allocs", attrs[3])
+		d.add("sampled_allocs", attrs[4])
+	default:
+		d.add("attributes", attrs)
+	}
+
+	return d
+}
+
+func (d *DecodedEvent) add(name string, value any) {
+	d.Fields = append(d.Fields, DecodedField{Name: name, Value: value})
+}
+
+// MarshalJSON encodes the fields as a JSON object, in order.
+func (d *DecodedEvent) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range d.Fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(field.Name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(field.Value)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", field.Name, err)
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func hexAddr(addr uint64) string {
+	return fmt.Sprintf("0x%x", addr)
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDecodeEventDetail(t *testing.T) {
+	newObject := &Event{Timestamp: 1, EventType: EventTypeNewObject, Goroutine: 7, Attributes: [5]uint64{48, uint64(KindStruct)}}
+	summary := &Event{Timestamp: 2, EventType: EventTypeAllocSummary, Attributes: [5]uint64{64, 2, 128, 4, 1}}
+	// Minimal events of the probes carry no attributes, unlike the markers
+	// injected through the API
+	minimalObject := &Event{Timestamp: 1, EventType: EventTypeNewObject, Goroutine: 7}
+	probeMarker := &Event{Timestamp: 3, EventType: EventTypeMarker, Goroutine: 7}
+	injectedMarker := &Event{Timestamp: 4, EventType: EventTypeMarker, Goroutine: 7, Attributes: [5]uint64{5, 1}}
+	// Flagged goroutines are captured in full detail
+	p := uint32(3)
+	flaggedMarker := &Event{Timestamp: 5, EventType: EventTypeMarker, Goroutine: 7, Thread: 12, P: &p}
+
+	tests := []struct {
+		name     string
+		event    *Event
+		session  *Session
+		expected string
+	}{
+		{
+			name:     "standard",
+			event:    newObject,
+			session:  &Session{EventDetail: EventDetailStandard},
+			expected: `{"timestamp":1,"event":"newobject","goroutine":7,"parent_goroutine":0,"size":48,"kind":"struct{}"}`,
+		},
+		{
+			name:     "minimal",
+			event:    minimalObject,
+			session:  &Session{EventDetail: EventDetailMinimal},
+			expected: `{"timestamp":1,"event":"newobject","goroutine":7}`,
+		},
+		{
+			name:     "minimal summary",
+			event:    summary,
+			session:  &Session{EventDetail: EventDetailMinimal},
+			expected: `{"timestamp":2,"event":"allocsummary","goroutine":0,"parent_goroutine":0,"bytes":64,"allocs":2,"total_bytes":128,"total_allocs":4,"sampled_allocs":1}`,
+		},
+		{
+			name:     "minimal probe marker",
+			event:    probeMarker,
+			session:  &Session{EventDetail: EventDetailMinimal},
+			expected: `{"timestamp":3,"event":"marker","goroutine":7}`,
+		},
+		{
+			name:     "minimal injected marker",
+			event:    injectedMarker,
+			session:  &Session{EventDetail: EventDetailMinimal},
+			expected: `{"timestamp":4,"event":"marker","goroutine":7,"parent_goroutine":0,"marker_id":5,"phase":"end"}`,
+		},
+		{
+			name:     "minimal flagged goroutine",
+			event:    flaggedMarker,
+			session:  &Session{EventDetail: EventDetailMinimal},
+			expected: `{"timestamp":5,"event":"marker","goroutine":7,"parent_goroutine":0,"thread":12,"p":3,"marker_id":0,"phase":"begin"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(DecodeEvent(tt.event, tt.session))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.expected {
+				t.Errorf("decoded = %s, want %s", data, tt.expected)
+			}
+		})
+	}
+}
@@ -30,6 +30,8 @@ type RuntimeEvent struct {
 	Goroutine       uint32                 `protobuf:"varint,3,opt,name=goroutine,proto3" json:"goroutine,omitempty"`
 	ParentGoroutine uint32                 `protobuf:"varint,4,opt,name=parent_goroutine,json=parentGoroutine,proto3" json:"parent_goroutine,omitempty"`
 	Attributes      []uint64               `protobuf:"varint,5,rep,packed,name=attributes,proto3" json:"attributes,omitempty"`
+	Thread          uint32                 `protobuf:"varint,6,opt,name=thread,proto3" json:"thread,omitempty"`
+	P               *uint32                `protobuf:"varint,7,opt,name=p,proto3,oneof" json:"p,omitempty"`
 	unknownFields   protoimpl.UnknownFields
 	sizeCache       protoimpl.SizeCache
 }
@@ -99,6 +101,20 @@ func (x *RuntimeEvent) GetAttributes() []uint64 {
 	return nil
 }
 
+func (x *RuntimeEvent) GetThread() uint32 {
+	if x != nil {
+		return x.Thread
+	}
+	return 0
+}
+
+func (x *RuntimeEvent) GetP() uint32 {
+	if x != nil && x.P != nil {
+		return *x.P
+	}
+	return 0
+}
+
 // RuntimeEventBatch represents a batch of events for efficient storage
 type RuntimeEventBatch struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
@@ -288,7 +304,7 @@ var File_cmd_xgotop_storage_event_proto protoreflect.FileDescriptor
 
 const file_cmd_xgotop_storage_event_proto_rawDesc = "" +
 	"\n" +
-	"\x1ecmd/xgotop/storage/event.proto\x12\astorage\"\xb4\x01\n" +
+	"\x1ecmd/xgotop/storage/event.proto\x12\astorage\"\xe5\x01\n" +
 	"\fRuntimeEvent\x12\x1c\n" +
 	"\ttimestamp\x18\x01 \x01(\x04R\ttimestamp\x12\x1d\n" +
 	"\n" +
@@ -297,7 +313,10 @@ const file_cmd_xgotop_storage_event_proto_rawDesc = "" +
 	"\x10parent_goroutine\x18\x04 \x01(\rR\x0fparentGoroutine\x12\x1e\n" +
 	"\n" +
 	"attributes\x18\x05 \x03(\x04R\n" +
-	"attributes\"B\n" +
+	"attributes\x12\x16\n" +
+	"\x06thread\x18\x06 \x01(\rR\x06thread\x12\x11\n" +
+	"\x01p\x18\a \x01(\rH\x00R\x01p\x88\x01\x01B\x04\n" +
+	"\x02_p\"B\n" +
 	"\x11RuntimeEventBatch\x12-\n" +
 	"\x06events\x18\x01 \x03(\v2\x15.storage.RuntimeEventR\x06events\"\xbb\x01\n" +
 	"\tPBSession\x12\x0e\n" +
@@ -348,6 +367,7 @@ func file_cmd_xgotop_storage_event_proto_init() {
 	if File_cmd_xgotop_storage_event_proto != nil {
 		return
 	}
+	file_cmd_xgotop_storage_event_proto_msgTypes[0].OneofWrappers = []any{}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
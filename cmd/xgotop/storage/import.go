@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxJSONLLineSize is the longest line accepted in an imported JSONL file.
+const maxJSONLLineSize = 1 << 20
+
+// DetectFormat returns the storage format of an event file from its
+// extension: jsonl for .jsonl, .ndjson and .json files, protobuf for .pb files.
+func DetectFormat(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".ndjson", ".json":
+		return "jsonl", nil
+	case ".pb":
+		return "protobuf", nil
+	default:
+		return "", fmt.Errorf("cannot detect the format of %s, set it explicitly", path)
+	}
+}
+
+// ScanEventFile streams the events of an event file that is not part of a
+// managed session, e.g. one produced by another tool or copied out of an
+// older session directory, to fn. JSONL files hold one event per line, as
+// written by JSONLStore or the ND-JSON export. Protobuf files use the
+// framing of ProtobufStore.
+func ScanEventFile(ctx context.Context, path, format string, fn ScanFunc) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open event file: %w", err)
+	}
+	defer file.Close()
+
+	switch strings.ToLower(format) {
+	case "jsonl", "json":
+	case "protobuf", "pb", "proto":
+		return scanProtobufEvents(ctx, file, 0, fn)
+	default:
+		return fmt.Errorf("unknown format: %s (supported: jsonl, protobuf)", format)
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxJSONLLineSize)
+	cursor := int64(0)
+	line := 0
+
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("line %d: unmarshal event: %w", line, err)
+		}
+
+		if err := fn(cursor, &event); err != nil {
+			if errors.Is(err, ErrStopScan) {
+				return nil
+			}
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		cursor++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("scan file: %w", err)
+	}
+
+	return nil
+}
+
+// ValidateEvent checks that an externally produced event can be stored and
+// shown like a captured one.
+func ValidateEvent(event *Event) error {
+	if event.Timestamp == 0 {
+		return errors.New("missing timestamp")
+	}
+	if _, ok := eventTypeNames[event.EventType]; !ok {
+		return fmt.Errorf("unknown event type %d", uint64(event.EventType))
+	}
+	return nil
+}
@@ -2,9 +2,12 @@ package storage
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
@@ -17,20 +20,21 @@ type JSONLStore struct {
 	mu         sync.RWMutex
 	eventCount int64
 	baseDir    string
+	opts       Options
 }
 
-func NewJSONLStore(baseDir string, session *Session) (*JSONLStore, error) {
-	if err := os.MkdirAll(baseDir, 0755); err != nil {
+func NewJSONLStore(baseDir string, session *Session, opts Options) (*JSONLStore, error) {
+	if err := opts.Permissions.mkdirAll(baseDir); err != nil {
 		return nil, fmt.Errorf("create base directory: %w", err)
 	}
 
 	sessionDir := filepath.Join(baseDir, session.ID)
-	if err := os.MkdirAll(sessionDir, 0755); err != nil {
+	if err := opts.Permissions.mkdirAll(sessionDir); err != nil {
 		return nil, fmt.Errorf("create session directory: %w", err)
 	}
 
 	filePath := filepath.Join(sessionDir, "events.jsonl")
-	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	file, err := opts.Permissions.openFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND)
 	if err != nil {
 		return nil, fmt.Errorf("open jsonl file: %w", err)
 	}
@@ -40,12 +44,15 @@ func NewJSONLStore(baseDir string, session *Session) (*JSONLStore, error) {
 		writer:  bufio.NewWriter(file),
 		session: session,
 		baseDir: baseDir,
+		opts:    opts,
 	}
 
 	return store, nil
 }
 
-func OpenJSONLStore(baseDir string, sessionID string) (*JSONLStore, error) {
+// OpenJSONLStore opens the events of an existing session for reading. Events
+// cannot be appended to an opened JSONL store.
+func OpenJSONLStore(baseDir string, sessionID string, opts Options) (*JSONLStore, error) {
 	sessionDir := filepath.Join(baseDir, sessionID)
 	filePath := filepath.Join(sessionDir, "events.jsonl")
 
@@ -57,6 +64,7 @@ func OpenJSONLStore(baseDir string, sessionID string) (*JSONLStore, error) {
 	store := &JSONLStore{
 		file:    file,
 		baseDir: baseDir,
+		opts:    opts,
 	}
 
 	session, err := loadSessionMetadata(sessionDir)
@@ -66,13 +74,46 @@ func OpenJSONLStore(baseDir string, sessionID string) (*JSONLStore, error) {
 	}
 	store.session = session
 
+	// The count of the metadata is the one of the whole session, which can
+	// have events routed to other stores
+	if store.eventCount, err = countJSONLEvents(filePath); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("count events: %w", err)
+	}
+
 	return store, nil
 }
 
+// countJSONLEvents counts the lines of the JSONL file at path.
+func countJSONLEvents(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var count int64
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := file.Read(buf)
+		count += int64(bytes.Count(buf[:n], []byte{'\n'}))
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
 func (s *JSONLStore) WriteEvent(event *Event) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.writer == nil {
+		return ErrReadOnly
+	}
+
 	data, err := json.Marshal(event)
 	if err != nil {
 		return fmt.Errorf("marshal event: %w", err)
@@ -90,11 +131,23 @@ func (s *JSONLStore) WriteEvent(event *Event) error {
 	return nil
 }
 
-func (s *JSONLStore) WriteBatch(events []*Event) error {
+func (s *JSONLStore) WriteBatch(ctx context.Context, events []*Event) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.writer == nil {
+		return ErrReadOnly
+	}
+
 	for _, event := range events {
+		if err := ctx.Err(); err != nil {
+			// Keep the events written so far
+			if flushErr := s.writer.Flush(); flushErr != nil {
+				return fmt.Errorf("flush writer: %w", flushErr)
+			}
+			return err
+		}
+
 		data, err := json.Marshal(event)
 		if err != nil {
 			return fmt.Errorf("marshal event: %w", err)
@@ -178,6 +231,51 @@ func (s *JSONLStore) ReadEvents(ctx context.Context, filter *EventFilter) ([]*Ev
 	return events, nil
 }
 
+func (s *JSONLStore) ScanEvents(ctx context.Context, fromCursor int64, fn ScanFunc) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Open a separate handle so scanning works on stores opened for writing.
+	file, err := os.Open(filepath.Join(s.baseDir, s.session.ID, "events.jsonl"))
+	if err != nil {
+		return fmt.Errorf("open file for reading: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	cursor := int64(0)
+
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if cursor < fromCursor {
+			cursor++
+			continue
+		}
+
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("unmarshal event: %w", err)
+		}
+
+		if err := fn(cursor, &event); err != nil {
+			if errors.Is(err, ErrStopScan) {
+				return nil
+			}
+			return err
+		}
+		cursor++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("scan file: %w", err)
+	}
+
+	return nil
+}
+
 func (s *JSONLStore) GetGoroutines(ctx context.Context) ([]uint32, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -236,14 +334,21 @@ func (s *JSONLStore) Close() error {
 func (s *JSONLStore) GetSession() *Session {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.session
+
+	sessionCopy := *s.session
+	sessionCopy.EventCount = s.eventCount
+	return &sessionCopy
 }
 
 func (s *JSONLStore) UpdateSession(session *Session) error {
+	if s.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	s.session = session
 	sessionDir := filepath.Join(s.baseDir, session.ID)
-	return saveSessionMetadata(sessionDir, session)
+	return saveSessionMetadata(sessionDir, session, s.opts.Permissions)
 }
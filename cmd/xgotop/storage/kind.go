@@ -0,0 +1,100 @@
+package storage
+
+import "fmt"
+
+// Taken from https://github.com/golang/go/blob/release-branch.go1.25/src/internal/abi/type.go
+
+// Kind is the kind of a Go type, recorded by allocation and interface
+// conversion events.
+type Kind uint8
+
+const (
+	KindInvalid Kind = iota
+	KindBool
+	KindInt
+	KindInt8
+	KindInt16
+	KindInt32
+	KindInt64
+	KindUint
+	KindUint8
+	KindUint16
+	KindUint32
+	KindUint64
+	KindUintptr
+	KindFloat32
+	KindFloat64
+	KindComplex64
+	KindComplex128
+	KindArray
+	KindChan
+	KindFunc
+	KindInterface
+	KindMap
+	KindPointer
+	KindSlice
+	KindString
+	KindStruct
+	KindUnsafePointer
+)
+
+func (kind Kind) String() string {
+	switch kind {
+	case KindInvalid:
+		return "INVALID"
+	case KindBool:
+		return "bool"
+	case KindInt:
+		return "int"
+	case KindInt8:
+		return "int8"
+	case KindInt16:
+		return "int16"
+	case KindInt32:
+		return "int32"
+	case KindInt64:
+		return "int64"
+	case KindUint:
+		return "uint"
+	case KindUint8:
+		return "uint8"
+	case KindUint16:
+		return "uint16"
+	case KindUint32:
+		return "uint32"
+	case KindUint64:
+		return "uint64"
+	case KindUintptr:
+		return "uintptr"
+	case KindFloat32:
+		return "float32"
+	case KindFloat64:
+		return "float64"
+	case KindComplex64:
+		return "complex64"
+	case KindComplex128:
+		return "complex128"
+	case KindArray:
+		return "ARRAY"
+	case KindChan:
+		return "chan T"
+	case KindFunc:
+		return "func"
+	case KindInterface:
+		return "interface{}"
+	case KindMap:
+		return "map[K]V"
+	case KindPointer:
+		return "*T"
+	case KindSlice:
+		return "[]T"
+	case KindString:
+		return "string"
+	case KindStruct:
+		return "struct{}"
+	case KindUnsafePointer:
+		return "unsafe.Pointer"
+	default:
+		return fmt.Sprintf("Unknown kind: %d", uint8(kind))
+	}
+}
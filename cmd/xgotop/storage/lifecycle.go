@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// lifecycleFile is the lifecycle log in the session directory.
+const lifecycleFile = "lifecycle.bin"
+
+// lifecycleRecordSize is the size of a lifecycle log record: the timestamp,
+// event type, goroutine, parent goroutine and the first four attributes,
+// little endian. The last attribute is unused by lifecycle events.
+const lifecycleRecordSize = 8 + 1 + 4 + 4 + 4*8
+
+// ErrNoLifecycleLog is returned for sessions recorded without lifecycle log.
+var ErrNoLifecycleLog = errors.New("session has no lifecycle log")
+
+// IsLifecycleEvent reports whether events of type t create or end
+// goroutines.
+func IsLifecycleEvent(t EventType) bool {
+	return t == EventTypeNewGoroutine || t == EventTypeGoExit
+}
+
+// LifecycleLog persists the goroutine lifecycle events of a session in a
+// compact file next to its events, independently of the session's format.
+// Lifecycle events are written to it unsampled, so the goroutine timelines
+// of a session are complete however heavily the session is sampled.
+type LifecycleLog struct {
+	mu     sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	count  int64
+}
+
+// CreateLifecycleLog creates the lifecycle log of a session created with
+// CreateSession.
+func (m *Manager) CreateLifecycleLog(sessionID string) (*LifecycleLog, error) {
+	if m.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
+	path := filepath.Join(m.baseDir, sessionID, lifecycleFile)
+	file, err := m.opts.Permissions.openFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		return nil, fmt.Errorf("create lifecycle log: %w", err)
+	}
+
+	return &LifecycleLog{
+		file:   file,
+		writer: bufio.NewWriterSize(file, 64*lifecycleRecordSize),
+	}, nil
+}
+
+// Write appends the lifecycle events among events, other events are
+// ignored. The events are flushed to the file before Write returns, so they
+// can be read while the capture goes on.
+func (l *LifecycleLog) Write(events []*Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var record [lifecycleRecordSize]byte
+	written := 0
+	for _, event := range events {
+		if !IsLifecycleEvent(event.EventType) {
+			continue
+		}
+
+		binary.LittleEndian.PutUint64(record[0:], event.Timestamp)
+		record[8] = byte(event.EventType)
+		binary.LittleEndian.PutUint32(record[9:], event.Goroutine)
+		binary.LittleEndian.PutUint32(record[13:], event.ParentGoroutine)
+		for i := range 4 {
+			binary.LittleEndian.PutUint64(record[17+8*i:], event.Attributes[i])
+		}
+		if _, err := l.writer.Write(record[:]); err != nil {
+			return fmt.Errorf("write lifecycle event: %w", err)
+		}
+		written++
+	}
+	if written == 0 {
+		return nil
+	}
+
+	if err := l.writer.Flush(); err != nil {
+		return fmt.Errorf("flush lifecycle log: %w", err)
+	}
+	l.count += int64(written)
+	return nil
+}
+
+// Count returns the number of events written.
+func (l *LifecycleLog) Count() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.count
+}
+
+func (l *LifecycleLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.writer.Flush(); err != nil {
+		l.file.Close()
+		return fmt.Errorf("flush lifecycle log: %w", err)
+	}
+	return l.file.Close()
+}
+
+// ReadLifecycle returns the events of the lifecycle log of a session that
+// match filter, in the order they were written. A record truncated by a
+// crash at the end of the log is ignored.
+func (m *Manager) ReadLifecycle(ctx context.Context, id string, filter *EventFilter) ([]*Event, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if err := checkScope(ctx, filepath.Join(m.baseDir, id)); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filepath.Join(m.baseDir, id, lifecycleFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoLifecycleLog
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open lifecycle log: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	events := make([]*Event, 0)
+	skipped := 0
+	var record [lifecycleRecordSize]byte
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if _, err := io.ReadFull(reader, record[:]); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("read lifecycle log: %w", err)
+		}
+
+		event := &Event{
+			Timestamp:       binary.LittleEndian.Uint64(record[0:]),
+			EventType:       EventType(record[8]),
+			Goroutine:       binary.LittleEndian.Uint32(record[9:]),
+			ParentGoroutine: binary.LittleEndian.Uint32(record[13:]),
+		}
+		for i := range 4 {
+			event.Attributes[i] = binary.LittleEndian.Uint64(record[17+8*i:])
+		}
+
+		if !filter.Matches(event) {
+			continue
+		}
+		if filter != nil && skipped < filter.Offset {
+			skipped++
+			continue
+		}
+		events = append(events, event)
+		if filter != nil && filter.Limit > 0 && len(events) >= filter.Limit {
+			break
+		}
+	}
+
+	return events, nil
+}
@@ -11,19 +11,41 @@ import (
 
 type Manager struct {
 	baseDir string
+	opts    Options
 	mu      sync.RWMutex
+
+	// memory holds the MemoryStores of the sessions, which are only
+	// readable while this process runs.
+	memory map[string]*MemoryStore
 }
 
 func NewManager(baseDir string) (*Manager, error) {
-	if err := os.MkdirAll(baseDir, 0755); err != nil {
+	return NewManagerWithOptions(baseDir, DefaultOptions)
+}
+
+// NewManagerWithOptions creates a Manager for the sessions in baseDir. A
+// read-only Manager requires baseDir to exist already.
+func NewManagerWithOptions(baseDir string, opts Options) (*Manager, error) {
+	if opts.ReadOnly {
+		if _, err := os.Stat(baseDir); err != nil {
+			return nil, fmt.Errorf("open base directory: %w", err)
+		}
+	} else if err := opts.Permissions.mkdirAll(baseDir); err != nil {
 		return nil, fmt.Errorf("create base directory: %w", err)
 	}
 
 	return &Manager{
 		baseDir: baseDir,
+		opts:    opts,
+		memory:  make(map[string]*MemoryStore),
 	}, nil
 }
 
+// ReadOnly reports whether the Manager rejects changes to the sessions.
+func (m *Manager) ReadOnly() bool {
+	return m.opts.ReadOnly
+}
+
 func (m *Manager) ListSessions(ctx context.Context) ([]*Session, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -35,13 +57,16 @@ func (m *Manager) ListSessions(ctx context.Context) ([]*Session, error) {
 
 	var sessions []*Session
 	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		if !entry.IsDir() {
 			continue
 		}
 
 		sessionDir := filepath.Join(m.baseDir, entry.Name())
 		session, err := loadSessionMetadata(sessionDir)
-		if err != nil {
+		if err != nil || !inScope(ctx, session) {
 			continue
 		}
 
@@ -55,55 +80,159 @@ func (m *Manager) GetSession(ctx context.Context, id string) (*Session, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	sessionDir := filepath.Join(m.baseDir, id)
-	return loadSessionMetadata(sessionDir)
+	session, err := loadSessionMetadata(sessionDir)
+	if err != nil {
+		return nil, err
+	}
+	if !inScope(ctx, session) {
+		return nil, ErrNoSession
+	}
+	return session, nil
 }
 
 func (m *Manager) OpenSession(ctx context.Context, id string) (EventStore, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	sessionDir := filepath.Join(m.baseDir, id)
+	if err := checkScope(ctx, sessionDir); err != nil {
+		return nil, err
+	}
+
+	// Sessions with routed event types have events in several stores
+	var stores []EventStore
+	closeAll := func() {
+		for _, store := range stores {
+			store.Close()
+		}
+	}
 
 	if _, err := os.Stat(filepath.Join(sessionDir, "events.pb")); err == nil {
-		return OpenProtobufStore(m.baseDir, id)
+		store, err := OpenProtobufStore(m.baseDir, id, m.opts)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, store)
 	}
 	if _, err := os.Stat(filepath.Join(sessionDir, "events.jsonl")); err == nil {
-		return OpenJSONLStore(m.baseDir, id)
+		store, err := OpenJSONLStore(m.baseDir, id, m.opts)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		stores = append(stores, store)
+	}
+	if _, err := os.Stat(filepath.Join(sessionDir, "events.db")); err == nil {
+		store, err := OpenSQLiteStore(m.baseDir, id, m.opts)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		stores = append(stores, store)
+	}
+	if store, ok := m.memory[id]; ok {
+		stores = append(stores, store)
 	}
 
-	return nil, fmt.Errorf("no event store found for session %s", id)
+	switch len(stores) {
+	case 0:
+		return nil, fmt.Errorf("no event store found for session %s", id)
+	case 1:
+		return stores[0], nil
+	default:
+		return newUnionStore(stores), nil
+	}
 }
 
 func (m *Manager) CreateSession(ctx context.Context, session *Session, format string) (EventStore, error) {
+	if m.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	// The lock can be held by long maintenance operations, the caller may
+	// have given up waiting for it
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if session.Namespace != "" {
+		if err := ValidateNamespace(session.Namespace); err != nil {
+			return nil, err
+		}
+	}
+	// Restricted to a single namespace, sessions are created in it by
+	// default
+	if namespaces, ok := Namespaces(ctx); ok {
+		if session.Namespace == "" && len(namespaces) == 1 {
+			session.Namespace = namespaces[0]
+		}
+		if !inScope(ctx, session) {
+			return nil, fmt.Errorf("%w: %s", ErrNamespaceDenied, NamespaceOf(session))
+		}
+	}
+
 	sessionDir := filepath.Join(m.baseDir, session.ID)
-	if err := os.MkdirAll(sessionDir, 0755); err != nil {
+	if err := m.opts.Permissions.mkdirAll(sessionDir); err != nil {
 		return nil, fmt.Errorf("create session directory: %w", err)
 	}
 
-	if err := saveSessionMetadata(sessionDir, session); err != nil {
+	if err := saveSessionMetadata(sessionDir, session, m.opts.Permissions); err != nil {
 		return nil, fmt.Errorf("save session metadata: %w", err)
 	}
 
 	format = strings.ToLower(format)
 	switch format {
 	case "jsonl", "json":
-		return NewJSONLStore(m.baseDir, session)
+		return NewJSONLStore(m.baseDir, session, m.opts)
 	case "protobuf", "pb", "proto":
-		return NewProtobufStore(m.baseDir, session)
+		return NewProtobufStore(m.baseDir, session, m.opts)
+	case "sqlite":
+		return NewSQLiteStore(m.baseDir, session, m.opts)
+	case "memory":
+		store := NewMemoryStore(session, m.opts.MemoryCapacity)
+		store.sessionDir = sessionDir
+		store.perms = m.opts.Permissions
+		m.memory[session.ID] = store
+		return store, nil
 	default:
-		return nil, fmt.Errorf("unknown format: %s (supported: jsonl, protobuf)", format)
+		return nil, fmt.Errorf("unknown format: %s (supported: jsonl, protobuf, sqlite, memory)", format)
 	}
 }
 
 func (m *Manager) DeleteSession(ctx context.Context, id string) error {
+	if m.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	sessionDir := filepath.Join(m.baseDir, id)
+	if err := checkScope(ctx, sessionDir); err != nil {
+		return err
+	}
+	if session, err := loadSessionMetadata(sessionDir); err == nil && session.Immutable {
+		return ErrImmutable
+	}
+
+	delete(m.memory, id)
+
 	return os.RemoveAll(sessionDir)
 }
 
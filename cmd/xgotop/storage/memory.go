@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// DefaultMemoryCapacity is the number of events kept by a MemoryStore unless
+// Options.MemoryCapacity is set.
+const DefaultMemoryCapacity = 1_000_000
+
+// MemoryStore keeps the most recent events of a session in a fixed size ring
+// in memory, overwriting the oldest events once it is full. It is meant for
+// noisy event types whose recent history is enough, and its events are lost
+// when xgotop exits.
+type MemoryStore struct {
+	session *Session
+	events  []*Event
+	// start is the index of the oldest event in events
+	start      int
+	count      int
+	eventCount int64
+	mu         sync.RWMutex
+
+	// sessionDir is set for stores created by a Manager, which keeps the
+	// session metadata on disk.
+	sessionDir string
+	perms      Permissions
+}
+
+func NewMemoryStore(session *Session, capacity int) *MemoryStore {
+	if capacity <= 0 {
+		capacity = DefaultMemoryCapacity
+	}
+	return &MemoryStore{
+		session: session,
+		events:  make([]*Event, capacity),
+	}
+}
+
+func (s *MemoryStore) WriteEvent(event *Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.push(event)
+	return nil
+}
+
+func (s *MemoryStore) WriteBatch(ctx context.Context, events []*Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, event := range events {
+		s.push(event)
+	}
+	return nil
+}
+
+func (s *MemoryStore) push(event *Event) {
+	if s.count < len(s.events) {
+		s.events[(s.start+s.count)%len(s.events)] = event
+		s.count++
+	} else {
+		s.events[s.start] = event
+		s.start = (s.start + 1) % len(s.events)
+	}
+	s.eventCount++
+}
+
+func (s *MemoryStore) ReadEvents(ctx context.Context, filter *EventFilter) ([]*Event, error) {
+	var events []*Event
+
+	err := s.ScanEvents(ctx, 0, func(cursor int64, event *Event) error {
+		if filter != nil && filter.Offset > 0 && cursor < int64(filter.Offset) {
+			return nil
+		}
+		if !filter.Matches(event) {
+			return nil
+		}
+
+		events = append(events, event)
+		if filter != nil && filter.Limit > 0 && len(events) >= filter.Limit {
+			return ErrStopScan
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// ScanEvents streams the events currently held, oldest first. Cursors are
+// positions in the ring, so they shift once the ring is full.
+func (s *MemoryStore) ScanEvents(ctx context.Context, fromCursor int64, fn ScanFunc) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for i := int(max(fromCursor, 0)); i < s.count; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(int64(i), s.events[(s.start+i)%len(s.events)]); err != nil {
+			if errors.Is(err, ErrStopScan) {
+				return nil
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) GetGoroutines(ctx context.Context) ([]uint32, error) {
+	goroutineMap := make(map[uint32]bool)
+	err := s.ScanEvents(ctx, 0, func(_ int64, event *Event) error {
+		goroutineMap[event.Goroutine] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	goroutines := make([]uint32, 0, len(goroutineMap))
+	for gid := range goroutineMap {
+		goroutines = append(goroutines, gid)
+	}
+
+	return goroutines, nil
+}
+
+// Close keeps the events, so that they can still be read while xgotop runs.
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) GetSession() *Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sessionCopy := *s.session
+	sessionCopy.EventCount = s.eventCount
+	return &sessionCopy
+}
+
+// UpdateSession also saves the session metadata if the store was created by
+// a Manager.
+func (s *MemoryStore) UpdateSession(session *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.session = session
+	if s.sessionDir == "" {
+		return nil
+	}
+	return saveSessionMetadata(s.sessionDir, session, s.perms)
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+// DefaultNamespace is the namespace of the sessions created without one,
+// including all sessions recorded before namespaces existed.
+const DefaultNamespace = "default"
+
+var (
+	// ErrNoSession is returned for sessions outside the namespaces a context
+	// is restricted to, as if they did not exist.
+	ErrNoSession = errors.New("session not found")
+	// ErrNamespaceDenied is returned when creating a session in a namespace
+	// outside the namespaces a context is restricted to.
+	ErrNamespaceDenied = errors.New("namespace not permitted")
+)
+
+var namespacePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// ValidateNamespace checks that name is a valid namespace name: lowercase
+// letters, digits, '-' and '_', starting with a letter or digit.
+func ValidateNamespace(name string) error {
+	if !namespacePattern.MatchString(name) {
+		return fmt.Errorf("invalid namespace %q", name)
+	}
+	return nil
+}
+
+// NamespaceOf returns the namespace of session.
+func NamespaceOf(session *Session) string {
+	if session.Namespace == "" {
+		return DefaultNamespace
+	}
+	return session.Namespace
+}
+
+type namespacesKey struct{}
+
+// WithNamespaces restricts the Manager calls made with the returned context
+// to the sessions in namespaces. The sessions of other namespaces are
+// neither listed nor accessible, and no session can be created in them.
+func WithNamespaces(ctx context.Context, namespaces []string) context.Context {
+	return context.WithValue(ctx, namespacesKey{}, namespaces)
+}
+
+// Namespaces returns the namespaces ctx is restricted to, and whether it is
+// restricted at all.
+func Namespaces(ctx context.Context) ([]string, bool) {
+	namespaces, ok := ctx.Value(namespacesKey{}).([]string)
+	return namespaces, ok
+}
+
+// inScope reports whether session is accessible with ctx.
+func inScope(ctx context.Context, session *Session) bool {
+	namespaces, ok := Namespaces(ctx)
+	return !ok || slices.Contains(namespaces, NamespaceOf(session))
+}
+
+// checkScope returns ErrNoSession if the session in sessionDir is not
+// accessible with ctx.
+func checkScope(ctx context.Context, sessionDir string) error {
+	if _, ok := Namespaces(ctx); !ok {
+		return nil
+	}
+	session, err := loadSessionMetadata(sessionDir)
+	if err != nil {
+		return err
+	}
+	if !inScope(ctx, session) {
+		return ErrNoSession
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// notesFile is the name of the file holding the notes in a session
+// directory.
+const notesFile = "notes.json"
+
+const (
+	// MaxNotesBytes is the largest size of the notes of a session.
+	MaxNotesBytes = 1 << 20
+	// MaxNoteEntryBytes is the largest size of the text of a journal entry.
+	MaxNoteEntryBytes = 64 << 10
+)
+
+var (
+	// ErrNotesTooLarge is returned when notes or a journal entry exceed
+	// their size limit.
+	ErrNotesTooLarge = errors.New("notes too large")
+	// ErrNoNoteEntry is returned when deleting a journal entry that does not
+	// exist.
+	ErrNoNoteEntry = errors.New("journal entry not found")
+)
+
+// NoteEntry is a timestamped entry of the investigation journal of a
+// session.
+type NoteEntry struct {
+	ID   uint64    `json:"id"`
+	Time time.Time `json:"time"`
+	// Timestamp is the event timestamp the entry refers to, zero if it
+	// refers to the session as a whole
+	Timestamp uint64 `json:"timestamp,omitempty"`
+	Text      string `json:"text"`
+}
+
+// SessionNotes are the findings of an investigation of a session. They are
+// stored in the session directory next to the events, apart from the
+// metadata, which the capture rewrites. Snapshots can be annotated too.
+type SessionNotes struct {
+	// Notes is free-form markdown
+	Notes   string      `json:"notes"`
+	Journal []NoteEntry `json:"journal"`
+}
+
+// GetNotes returns the notes of the session, or empty notes if none were
+// written yet.
+func (m *Manager) GetNotes(ctx context.Context, id string) (*SessionNotes, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	sessionDir := filepath.Join(m.baseDir, id)
+	if session, err := loadSessionMetadata(sessionDir); err != nil {
+		return nil, err
+	} else if !inScope(ctx, session) {
+		return nil, ErrNoSession
+	}
+	return loadNotes(sessionDir)
+}
+
+// SetNotes replaces the free-form notes of the session, keeping its
+// journal.
+func (m *Manager) SetNotes(ctx context.Context, id string, text string) (*SessionNotes, error) {
+	if len(text) > MaxNotesBytes {
+		return nil, fmt.Errorf("%w: notes exceed %d bytes", ErrNotesTooLarge, MaxNotesBytes)
+	}
+	return m.updateNotes(ctx, id, func(notes *SessionNotes) error {
+		notes.Notes = text
+		return nil
+	})
+}
+
+// AddNoteEntry appends entry to the journal of the session. Its ID is
+// assigned, and its time set to now unless given.
+func (m *Manager) AddNoteEntry(ctx context.Context, id string, entry NoteEntry) (*NoteEntry, error) {
+	if len(entry.Text) > MaxNoteEntryBytes {
+		return nil, fmt.Errorf("%w: journal entry exceeds %d bytes", ErrNotesTooLarge, MaxNoteEntryBytes)
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	_, err := m.updateNotes(ctx, id, func(notes *SessionNotes) error {
+		entry.ID = 1
+		for _, e := range notes.Journal {
+			entry.ID = max(entry.ID, e.ID+1)
+		}
+		notes.Journal = append(notes.Journal, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// DeleteNoteEntry removes the journal entry with the given ID from the
+// session.
+func (m *Manager) DeleteNoteEntry(ctx context.Context, id string, entryID uint64) error {
+	_, err := m.updateNotes(ctx, id, func(notes *SessionNotes) error {
+		i := slices.IndexFunc(notes.Journal, func(e NoteEntry) bool { return e.ID == entryID })
+		if i < 0 {
+			return ErrNoNoteEntry
+		}
+		notes.Journal = slices.Delete(notes.Journal, i, i+1)
+		return nil
+	})
+	return err
+}
+
+// updateNotes applies update to the notes of the session and saves them.
+func (m *Manager) updateNotes(ctx context.Context, id string, update func(*SessionNotes) error) (*SessionNotes, error) {
+	if m.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	sessionDir := filepath.Join(m.baseDir, id)
+	if session, err := loadSessionMetadata(sessionDir); err != nil {
+		return nil, err
+	} else if !inScope(ctx, session) {
+		return nil, ErrNoSession
+	}
+
+	notes, err := loadNotes(sessionDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := update(notes); err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(notes, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("marshal notes: %w", err)
+	}
+
+	// Write to a temporary file first so that a crash cannot leave truncated
+	// notes behind
+	path := filepath.Join(sessionDir, notesFile)
+	if err := m.opts.Permissions.writeFile(path+".tmp", data); err != nil {
+		return nil, fmt.Errorf("write notes: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return nil, fmt.Errorf("write notes: %w", err)
+	}
+
+	return notes, nil
+}
+
+func loadNotes(sessionDir string) (*SessionNotes, error) {
+	notes := &SessionNotes{Journal: []NoteEntry{}}
+
+	data, err := os.ReadFile(filepath.Join(sessionDir, notesFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return notes, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read notes: %w", err)
+	}
+
+	if err := json.Unmarshal(data, notes); err != nil {
+		return nil, fmt.Errorf("unmarshal notes: %w", err)
+	}
+	if notes.Journal == nil {
+		notes.Journal = []NoteEntry{}
+	}
+	return notes, nil
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionNotes(t *testing.T) {
+	ctx := context.Background()
+	manager, err := NewManager(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	store, err := manager.CreateSession(ctx, &Session{ID: "notes", StartTime: time.Now()}, "jsonl")
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	store.Close()
+
+	if _, err := manager.SetNotes(ctx, "notes", "## Findings"); err != nil {
+		t.Fatalf("SetNotes: %v", err)
+	}
+	for _, text := range []string{"first", "second"} {
+		if _, err := manager.AddNoteEntry(ctx, "notes", NoteEntry{Text: text, Timestamp: 42}); err != nil {
+			t.Fatalf("AddNoteEntry: %v", err)
+		}
+	}
+	if err := manager.DeleteNoteEntry(ctx, "notes", 1); err != nil {
+		t.Fatalf("DeleteNoteEntry: %v", err)
+	}
+	if err := manager.DeleteNoteEntry(ctx, "notes", 1); !errors.Is(err, ErrNoNoteEntry) {
+		t.Errorf("expected ErrNoNoteEntry deleting an entry twice, got %v", err)
+	}
+	entry, err := manager.AddNoteEntry(ctx, "notes", NoteEntry{Text: "third"})
+	if err != nil {
+		t.Fatalf("AddNoteEntry: %v", err)
+	}
+	if entry.ID != 3 || entry.Time.IsZero() {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+
+	notes, err := manager.GetNotes(ctx, "notes")
+	if err != nil {
+		t.Fatalf("GetNotes: %v", err)
+	}
+	if notes.Notes != "## Findings" || len(notes.Journal) != 2 || notes.Journal[0].Text != "second" || notes.Journal[0].Timestamp != 42 {
+		t.Errorf("unexpected notes %+v", notes)
+	}
+
+	if _, err := manager.SetNotes(ctx, "notes", strings.Repeat("x", MaxNotesBytes+1)); !errors.Is(err, ErrNotesTooLarge) {
+		t.Errorf("expected ErrNotesTooLarge, got %v", err)
+	}
+	if _, err := manager.SetNotes(ctx, "missing", "notes"); err == nil {
+		t.Error("expected an error for a missing session")
+	}
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrReadOnly is returned for every change to the sessions of a read-only
+// Manager and its stores.
+var ErrReadOnly = errors.New("storage is read-only")
+
+// Options configure how a Manager and its stores access the storage
+// directory.
+type Options struct {
+	// ReadOnly opens all stores read-only and rejects creating, changing and
+	// deleting sessions.
+	ReadOnly    bool
+	Permissions Permissions
+	// MemoryCapacity is the number of events kept by the MemoryStores of
+	// the sessions.
+	MemoryCapacity int
+}
+
+// DefaultOptions are the options used by NewManager.
+var DefaultOptions = Options{Permissions: DefaultPermissions, MemoryCapacity: DefaultMemoryCapacity}
+
+// Permissions are the modes and ownership of the files and directories
+// created for sessions.
+type Permissions struct {
+	FileMode os.FileMode
+	DirMode  os.FileMode
+	// UID and GID own the created files and directories. -1 leaves them
+	// owned by the user and group of the process.
+	UID int
+	GID int
+}
+
+// DefaultPermissions make the session data readable by every user of the
+// host, which is unsuitable for sensitive hosts.
+var DefaultPermissions = Permissions{FileMode: 0644, DirMode: 0755, UID: -1, GID: -1}
+
+// apply sets the mode and owner of an existing path. The mode is set
+// explicitly because the umask of the process may have masked it on
+// creation.
+func (p Permissions) apply(path string, mode os.FileMode) error {
+	if err := os.Chmod(path, mode); err != nil {
+		return fmt.Errorf("chmod %s: %w", path, err)
+	}
+	if p.UID != -1 || p.GID != -1 {
+		if err := os.Lchown(path, p.UID, p.GID); err != nil {
+			return fmt.Errorf("chown %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// ApplySocket lets the users who can read the session files connect to the
+// unix domain socket at path, which requires write permission, and gives it
+// the owner of the session files.
+func (p Permissions) ApplySocket(path string) error {
+	read := p.FileMode & 0444
+	return p.apply(path, read|read>>1)
+}
+
+// mkdirAll creates the directory path and applies the directory mode and
+// owner to it. Missing parents are created with the same mode, but keep the
+// owner of the process.
+func (p Permissions) mkdirAll(path string) error {
+	if err := os.MkdirAll(path, p.DirMode); err != nil {
+		return err
+	}
+	return p.apply(path, p.DirMode)
+}
+
+// openFile opens the file at path, creating it with the file mode and owner
+// if it does not exist.
+func (p Permissions) openFile(path string, flag int) (*os.File, error) {
+	file, err := os.OpenFile(path, flag, p.FileMode)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.apply(path, p.FileMode); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// writeFile writes data to the file at path with the file mode and owner.
+func (p Permissions) writeFile(path string, data []byte) error {
+	if err := os.WriteFile(path, data, p.FileMode); err != nil {
+		return err
+	}
+	return p.apply(path, p.FileMode)
+}
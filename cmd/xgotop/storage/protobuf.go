@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -20,21 +21,22 @@ type ProtobufStore struct {
 	writer     *bufio.Writer
 	session    *Session
 	eventCount int64
+	opts       Options
 	mu         sync.RWMutex
 }
 
-func NewProtobufStore(baseDir string, session *Session) (EventStore, error) {
+func NewProtobufStore(baseDir string, session *Session, opts Options) (EventStore, error) {
 	sessionDir := filepath.Join(baseDir, session.ID)
-	if err := os.MkdirAll(sessionDir, 0755); err != nil {
+	if err := opts.Permissions.mkdirAll(sessionDir); err != nil {
 		return nil, fmt.Errorf("create session directory: %w", err)
 	}
 
-	if err := saveSessionMetadata(sessionDir, session); err != nil {
+	if err := saveSessionMetadata(sessionDir, session, opts.Permissions); err != nil {
 		return nil, fmt.Errorf("save session metadata: %w", err)
 	}
 
 	eventsPath := filepath.Join(sessionDir, "events.pb")
-	file, err := os.OpenFile(eventsPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	file, err := opts.Permissions.openFile(eventsPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND)
 	if err != nil {
 		return nil, fmt.Errorf("create events file: %w", err)
 	}
@@ -45,12 +47,15 @@ func NewProtobufStore(baseDir string, session *Session) (EventStore, error) {
 		file:      file,
 		writer:    bufio.NewWriterSize(file, 64*1024),
 		session:   session,
+		opts:      opts,
 	}
 
 	return store, nil
 }
 
-func OpenProtobufStore(baseDir, sessionID string) (EventStore, error) {
+// OpenProtobufStore opens an existing session. Events can be appended to it,
+// unless opts is read-only.
+func OpenProtobufStore(baseDir, sessionID string, opts Options) (EventStore, error) {
 	sessionDir := filepath.Join(baseDir, sessionID)
 
 	session, err := loadSessionMetadata(sessionDir)
@@ -58,8 +63,13 @@ func OpenProtobufStore(baseDir, sessionID string) (EventStore, error) {
 		return nil, fmt.Errorf("load session metadata: %w", err)
 	}
 
+	flag := os.O_RDWR | os.O_APPEND
+	if opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+
 	eventsPath := filepath.Join(sessionDir, "events.pb")
-	file, err := os.OpenFile(eventsPath, os.O_RDWR|os.O_APPEND, 0644)
+	file, err := os.OpenFile(eventsPath, flag, 0)
 	if err != nil {
 		return nil, fmt.Errorf("open events file: %w", err)
 	}
@@ -74,9 +84,12 @@ func OpenProtobufStore(baseDir, sessionID string) (EventStore, error) {
 		baseDir:    baseDir,
 		sessionID:  sessionID,
 		file:       file,
-		writer:     bufio.NewWriterSize(file, 64*1024),
 		session:    session,
 		eventCount: eventCount,
+		opts:       opts,
+	}
+	if !opts.ReadOnly {
+		store.writer = bufio.NewWriterSize(file, 64*1024)
 	}
 
 	return store, nil
@@ -86,12 +99,18 @@ func (s *ProtobufStore) WriteEvent(event *Event) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.writer == nil {
+		return ErrReadOnly
+	}
+
 	pbEvent := &RuntimeEvent{
 		Timestamp:       event.Timestamp,
 		EventType:       uint64(event.EventType),
 		Goroutine:       event.Goroutine,
 		ParentGoroutine: event.ParentGoroutine,
 		Attributes:      event.Attributes[:],
+		Thread:          event.Thread,
+		P:               event.P,
 	}
 
 	data, err := proto.Marshal(pbEvent)
@@ -113,27 +132,22 @@ func (s *ProtobufStore) WriteEvent(event *Event) error {
 	return nil
 }
 
-func (s *ProtobufStore) WriteBatch(events []*Event) error {
+// WriteBatch writes events as a single batch, so a cancelled batch is never
+// partially stored.
+func (s *ProtobufStore) WriteBatch(ctx context.Context, events []*Event) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	batch := &RuntimeEventBatch{
-		Events: make([]*RuntimeEvent, len(events)),
+	if s.writer == nil {
+		return ErrReadOnly
 	}
-
-	for i, event := range events {
-		batch.Events[i] = &RuntimeEvent{
-			Timestamp:       event.Timestamp,
-			EventType:       uint64(event.EventType),
-			Goroutine:       event.Goroutine,
-			ParentGoroutine: event.ParentGoroutine,
-			Attributes:      event.Attributes[:],
-		}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	data, err := proto.Marshal(batch)
+	data, err := MarshalBatch(events)
 	if err != nil {
-		return fmt.Errorf("marshal batch: %w", err)
+		return err
 	}
 
 	batchMarker := make([]byte, 4)
@@ -161,24 +175,62 @@ func (s *ProtobufStore) WriteBatch(events []*Event) error {
 }
 
 func (s *ProtobufStore) ReadEvents(ctx context.Context, filter *EventFilter) ([]*Event, error) {
+	var events []*Event
+
+	err := s.ScanEvents(ctx, 0, func(cursor int64, event *Event) error {
+		if filter != nil && filter.Offset > 0 && cursor < int64(filter.Offset) {
+			return nil
+		}
+		if !filter.Matches(event) {
+			return nil
+		}
+
+		events = append(events, event)
+		if filter != nil && filter.Limit > 0 && len(events) >= filter.Limit {
+			return ErrStopScan
+		}
+		return nil
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return events, err
+		}
+		return nil, err
+	}
+
+	return events, nil
+}
+
+func (s *ProtobufStore) ScanEvents(ctx context.Context, fromCursor int64, fn ScanFunc) error {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	file, err := os.Open(filepath.Join(s.baseDir, s.sessionID, "events.pb"))
 	if err != nil {
-		return nil, fmt.Errorf("open file for reading: %w", err)
+		return fmt.Errorf("open file for reading: %w", err)
 	}
 	defer file.Close()
 
-	reader := bufio.NewReader(file)
-	var events []*Event
-	offset := 0
+	return scanProtobufEvents(ctx, file, fromCursor, fn)
+}
+
+// scanProtobufEvents streams the events of r, which holds length-prefixed
+// events and batches as written by ProtobufStore, to fn.
+func scanProtobufEvents(ctx context.Context, r io.Reader, fromCursor int64, fn ScanFunc) error {
+	reader := bufio.NewReader(r)
+	cursor := int64(0)
+
+	emit := func(pbEvent *RuntimeEvent) error {
+		defer func() { cursor++ }()
+		if cursor < fromCursor {
+			return nil
+		}
+		return fn(cursor, convertFromProto(pbEvent))
+	}
 
 	for {
-		select {
-		case <-ctx.Done():
-			return events, ctx.Err()
-		default:
+		if err := ctx.Err(); err != nil {
+			return err
 		}
 
 		lengthBuf := make([]byte, 4)
@@ -186,7 +238,7 @@ func (s *ProtobufStore) ReadEvents(ctx context.Context, filter *EventFilter) ([]
 			if err == io.EOF {
 				break
 			}
-			return nil, fmt.Errorf("read length: %w", err)
+			return fmt.Errorf("read length: %w", err)
 		}
 
 		length := binary.LittleEndian.Uint32(lengthBuf)
@@ -195,52 +247,49 @@ func (s *ProtobufStore) ReadEvents(ctx context.Context, filter *EventFilter) ([]
 		if length == 0xFFFFFFFF {
 			// Read batch length
 			if _, err := io.ReadFull(reader, lengthBuf); err != nil {
-				return nil, fmt.Errorf("read batch length: %w", err)
+				return fmt.Errorf("read batch length: %w", err)
 			}
 			length = binary.LittleEndian.Uint32(lengthBuf)
 
 			data := make([]byte, length)
 			if _, err := io.ReadFull(reader, data); err != nil {
-				return nil, fmt.Errorf("read batch data: %w", err)
+				return fmt.Errorf("read batch data: %w", err)
 			}
 
 			batch := &RuntimeEventBatch{}
 			if err := proto.Unmarshal(data, batch); err != nil {
-				return nil, fmt.Errorf("unmarshal batch: %w", err)
+				return fmt.Errorf("unmarshal batch: %w", err)
 			}
 
 			for _, pbEvent := range batch.Events {
-				if shouldIncludeEvent(pbEvent, filter, offset, len(events)) {
-					events = append(events, convertFromProto(pbEvent))
-				}
-				offset++
-				if filter != nil && filter.Limit > 0 && len(events) >= filter.Limit {
-					return events, nil
+				if err := emit(pbEvent); err != nil {
+					if errors.Is(err, ErrStopScan) {
+						return nil
+					}
+					return err
 				}
 			}
 		} else {
 			data := make([]byte, length)
 			if _, err := io.ReadFull(reader, data); err != nil {
-				return nil, fmt.Errorf("read event data: %w", err)
+				return fmt.Errorf("read event data: %w", err)
 			}
 
 			pbEvent := &RuntimeEvent{}
 			if err := proto.Unmarshal(data, pbEvent); err != nil {
-				return nil, fmt.Errorf("unmarshal event: %w", err)
+				return fmt.Errorf("unmarshal event: %w", err)
 			}
 
-			if shouldIncludeEvent(pbEvent, filter, offset, len(events)) {
-				events = append(events, convertFromProto(pbEvent))
-			}
-			offset++
-
-			if filter != nil && filter.Limit > 0 && len(events) >= filter.Limit {
-				return events, nil
+			if err := emit(pbEvent); err != nil {
+				if errors.Is(err, ErrStopScan) {
+					return nil
+				}
+				return err
 			}
 		}
 	}
 
-	return events, nil
+	return nil
 }
 
 func (s *ProtobufStore) GetGoroutines(ctx context.Context) ([]uint32, error) {
@@ -291,12 +340,16 @@ func (s *ProtobufStore) GetSession() *Session {
 }
 
 func (s *ProtobufStore) UpdateSession(session *Session) error {
+	if s.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	s.session = session
 	sessionDir := filepath.Join(s.baseDir, s.sessionID)
-	return saveSessionMetadata(sessionDir, session)
+	return saveSessionMetadata(sessionDir, session, s.opts.Permissions)
 }
 
 func countProtobufEvents(path string) (int64, error) {
@@ -353,32 +406,44 @@ func countProtobufEvents(path string) (int64, error) {
 	return count, nil
 }
 
-func shouldIncludeEvent(pbEvent *RuntimeEvent, filter *EventFilter, offset int, currentCount int) bool {
-	if filter == nil {
-		return true
-	}
-
-	if filter.Offset > 0 && offset < filter.Offset {
-		return false
+// MarshalBatch encodes events as a RuntimeEventBatch message.
+func MarshalBatch(events []*Event) ([]byte, error) {
+	batch := &RuntimeEventBatch{
+		Events: make([]*RuntimeEvent, len(events)),
 	}
 
-	if filter.Goroutine != nil && pbEvent.Goroutine != *filter.Goroutine {
-		return false
+	for i, event := range events {
+		batch.Events[i] = &RuntimeEvent{
+			Timestamp:       event.Timestamp,
+			EventType:       uint64(event.EventType),
+			Goroutine:       event.Goroutine,
+			ParentGoroutine: event.ParentGoroutine,
+			Attributes:      event.Attributes[:],
+			Thread:          event.Thread,
+			P:               event.P,
+		}
 	}
 
-	if filter.EventType != nil && EventType(pbEvent.EventType) != *filter.EventType {
-		return false
+	data, err := proto.Marshal(batch)
+	if err != nil {
+		return nil, fmt.Errorf("marshal batch: %w", err)
 	}
+	return data, nil
+}
 
-	if filter.StartTime != nil && pbEvent.Timestamp < *filter.StartTime {
-		return false
+// UnmarshalBatch decodes a RuntimeEventBatch message encoded by
+// MarshalBatch.
+func UnmarshalBatch(data []byte) ([]*Event, error) {
+	batch := &RuntimeEventBatch{}
+	if err := proto.Unmarshal(data, batch); err != nil {
+		return nil, fmt.Errorf("unmarshal batch: %w", err)
 	}
 
-	if filter.EndTime != nil && pbEvent.Timestamp > *filter.EndTime {
-		return false
+	events := make([]*Event, len(batch.Events))
+	for i, pbEvent := range batch.Events {
+		events[i] = convertFromProto(pbEvent)
 	}
-
-	return true
+	return events, nil
 }
 
 func convertFromProto(pbEvent *RuntimeEvent) *Event {
@@ -387,9 +452,39 @@ func convertFromProto(pbEvent *RuntimeEvent) *Event {
 		EventType:       EventType(pbEvent.EventType),
 		Goroutine:       pbEvent.Goroutine,
 		ParentGoroutine: pbEvent.ParentGoroutine,
+		Thread:          pbEvent.Thread,
+		P:               pbEvent.P,
 	}
 
 	copy(event.Attributes[:], pbEvent.Attributes)
 
 	return event
 }
+
+// MaxFrameSize limits the size of the frames read by ReadFrame.
+const MaxFrameSize = 64 << 20
+
+// AppendFrame appends data to buf as a frame prefixed with its length as a
+// little endian uint32, the framing of the live batch stream.
+func AppendFrame(buf, data []byte) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(data)))
+	return append(buf, data...)
+}
+
+// ReadFrame reads the data of a frame written by AppendFrame.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var lengthBuf [4]byte
+	if _, err := io.ReadFull(r, lengthBuf[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.LittleEndian.Uint32(lengthBuf[:])
+	if length > MaxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds the limit of %d bytes", length, MaxFrameSize)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("read frame: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Quota limits the total on-disk size of the sessions labeled Label=Value,
+// or of the sessions in Namespace if it is set.
+type Quota struct {
+	Label     string
+	Value     string
+	Namespace string
+	MaxBytes  int64
+}
+
+func (q Quota) String() string {
+	if q.Namespace != "" {
+		return "namespace " + q.Namespace
+	}
+	return fmt.Sprintf("%s=%s", q.Label, q.Value)
+}
+
+// Matches reports whether session is subject to the quota.
+func (q Quota) Matches(session *Session) bool {
+	if q.Namespace != "" {
+		return NamespaceOf(session) == q.Namespace
+	}
+	value, ok := session.Labels[q.Label]
+	return ok && value == q.Value
+}
+
+// QuotaDeletion is a session deleted to enforce a quota.
+type QuotaDeletion struct {
+	Quota     Quota
+	SessionID string
+	Bytes     int64
+}
+
+// EnforceQuotas deletes the oldest sessions of every quota until the total
+// size of its sessions fits into the quota, so a noisy service only evicts
+// its own captures. Sessions still being captured, i.e. without an end time,
+// and immutable sessions are never deleted, but count towards the quota.
+func (m *Manager) EnforceQuotas(ctx context.Context, quotas []Quota) ([]QuotaDeletion, error) {
+	if m.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
+	sessions, err := m.ListSessions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartTime.Before(sessions[j].StartTime)
+	})
+
+	sizes := make(map[string]int64, len(sessions))
+	// A session matching several quotas is only deleted once
+	deleted := make(map[string]bool)
+	var deletions []QuotaDeletion
+	var errs []error
+	for _, quota := range quotas {
+		var total int64
+		var matching []*Session
+		for _, session := range sessions {
+			if !quota.Matches(session) || deleted[session.ID] {
+				continue
+			}
+			size, ok := sizes[session.ID]
+			if !ok {
+				size, err = dirSize(ctx, filepath.Join(m.baseDir, session.ID))
+				if err != nil {
+					return deletions, fmt.Errorf("size of session %s: %w", session.ID, err)
+				}
+				sizes[session.ID] = size
+			}
+			total += size
+			matching = append(matching, session)
+		}
+
+		for _, session := range matching {
+			if total <= quota.MaxBytes {
+				break
+			}
+			if session.EndTime == nil || session.Immutable {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return deletions, err
+			}
+
+			if err := m.DeleteSession(ctx, session.ID); err != nil {
+				errs = append(errs, fmt.Errorf("delete session %s: %w", session.ID, err))
+				continue
+			}
+			total -= sizes[session.ID]
+			deleted[session.ID] = true
+			deletions = append(deletions, QuotaDeletion{Quota: quota, SessionID: session.ID, Bytes: sizes[session.ID]})
+		}
+	}
+
+	return deletions, errors.Join(errs...)
+}
+
+// Retention limits how long the sessions of Namespace are kept after they
+// ended.
+type Retention struct {
+	Namespace string
+	MaxAge    time.Duration
+}
+
+// RetentionDeletion is a session deleted to enforce a retention.
+type RetentionDeletion struct {
+	Retention Retention
+	SessionID string
+}
+
+// EnforceRetentions deletes the sessions that ended longer than the
+// retention of their namespace before now. Sessions still being captured and
+// immutable sessions are never deleted.
+func (m *Manager) EnforceRetentions(ctx context.Context, retentions []Retention, now time.Time) ([]RetentionDeletion, error) {
+	if m.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
+	sessions, err := m.ListSessions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byNamespace := make(map[string]Retention, len(retentions))
+	for _, retention := range retentions {
+		byNamespace[retention.Namespace] = retention
+	}
+
+	var deletions []RetentionDeletion
+	var errs []error
+	for _, session := range sessions {
+		retention, ok := byNamespace[NamespaceOf(session)]
+		if !ok || session.EndTime == nil || session.Immutable || now.Sub(*session.EndTime) <= retention.MaxAge {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return deletions, err
+		}
+
+		if err := m.DeleteSession(ctx, session.ID); err != nil {
+			errs = append(errs, fmt.Errorf("delete session %s: %w", session.ID, err))
+			continue
+		}
+		deletions = append(deletions, RetentionDeletion{Retention: retention, SessionID: session.ID})
+	}
+
+	return deletions, errors.Join(errs...)
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// createEndedSession creates a session with events events, which ended at end
+// unless end is zero.
+func createEndedSession(t *testing.T, manager *Manager, session *Session, end time.Time, events int) {
+	t.Helper()
+
+	if !end.IsZero() {
+		session.EndTime = &end
+	}
+	store, err := manager.CreateSession(context.Background(), session, "jsonl")
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	for i := range events {
+		if err := store.WriteEvent(&Event{Timestamp: uint64(i), EventType: EventTypeNewObject}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sessionIDs(t *testing.T, manager *Manager) []string {
+	t.Helper()
+
+	sessions, err := manager.ListSessions(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, session := range sessions {
+		ids = append(ids, session.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestEnforceQuotas(t *testing.T) {
+	ctx := context.Background()
+	baseDir := t.TempDir()
+	manager, err := NewManager(baseDir)
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	api := map[string]string{"service": "api"}
+	sessions := []struct {
+		session *Session
+		ended   bool
+	}{
+		// Oldest first, the active and the immutable sessions are kept
+		{session: &Session{ID: "active", StartTime: start, Labels: api}},
+		{session: &Session{ID: "frozen", StartTime: start.Add(time.Hour), Labels: api, Immutable: true}, ended: true},
+		{session: &Session{ID: "old", StartTime: start.Add(2 * time.Hour), Labels: api}, ended: true},
+		{session: &Session{ID: "older", StartTime: start.Add(90 * time.Minute), Labels: api}, ended: true},
+		{session: &Session{ID: "new", StartTime: start.Add(3 * time.Hour), Labels: api}, ended: true},
+		// Another service is not evicted for the quota of api
+		{session: &Session{ID: "web", StartTime: start, Labels: map[string]string{"service": "web"}}, ended: true},
+	}
+	for _, s := range sessions {
+		var end time.Time
+		if s.ended {
+			end = s.session.StartTime.Add(time.Minute)
+		}
+		createEndedSession(t, manager, s.session, end, 100)
+	}
+
+	size := func(id string) int64 {
+		size, err := dirSize(ctx, filepath.Join(baseDir, id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return size
+	}
+	// Room for the sessions that cannot be deleted and the newest one
+	quota := Quota{Label: "service", Value: "api", MaxBytes: size("active") + size("frozen") + size("new")}
+	want := []QuotaDeletion{
+		{Quota: quota, SessionID: "older", Bytes: size("older")},
+		{Quota: quota, SessionID: "old", Bytes: size("old")},
+	}
+
+	deletions, err := manager.EnforceQuotas(ctx, []Quota{quota})
+	if err != nil {
+		t.Fatalf("EnforceQuotas: %v", err)
+	}
+	if !reflect.DeepEqual(deletions, want) {
+		t.Errorf("deletions = %+v, want %+v", deletions, want)
+	}
+	if ids, want := sessionIDs(t, manager), []string{"active", "frozen", "new", "web"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("sessions = %v, want %v", ids, want)
+	}
+
+	// A quota the sessions that cannot be deleted exceed on their own
+	quota.MaxBytes = 1
+	deletions, err = manager.EnforceQuotas(ctx, []Quota{quota})
+	if err != nil {
+		t.Fatalf("EnforceQuotas: %v", err)
+	}
+	if len(deletions) != 1 || deletions[0].SessionID != "new" {
+		t.Errorf("deletions = %+v, want new", deletions)
+	}
+	if ids, want := sessionIDs(t, manager), []string{"active", "frozen", "web"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("sessions = %v, want %v", ids, want)
+	}
+}
+
+func TestEnforceRetentions(t *testing.T) {
+	ctx := context.Background()
+	manager, err := NewManager(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+
+	now := time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC)
+	sessions := []struct {
+		session *Session
+		end     time.Time
+	}{
+		{session: &Session{ID: "expired", Namespace: "team-a"}, end: now.Add(-48 * time.Hour)},
+		{session: &Session{ID: "recent", Namespace: "team-a"}, end: now.Add(-time.Hour)},
+		{session: &Session{ID: "active", Namespace: "team-a"}},
+		{session: &Session{ID: "frozen", Namespace: "team-a", Immutable: true}, end: now.Add(-48 * time.Hour)},
+		// Namespaces without a retention are kept
+		{session: &Session{ID: "other", Namespace: "team-b"}, end: now.Add(-48 * time.Hour)},
+		// The default namespace can have a retention too
+		{session: &Session{ID: "default"}, end: now.Add(-3 * time.Hour)},
+	}
+	for _, s := range sessions {
+		s.session.StartTime = now.Add(-72 * time.Hour)
+		createEndedSession(t, manager, s.session, s.end, 1)
+	}
+
+	retentions := []Retention{
+		{Namespace: "team-a", MaxAge: 24 * time.Hour},
+		{Namespace: DefaultNamespace, MaxAge: 2 * time.Hour},
+	}
+	deletions, err := manager.EnforceRetentions(ctx, retentions, now)
+	if err != nil {
+		t.Fatalf("EnforceRetentions: %v", err)
+	}
+	sort.Slice(deletions, func(i, j int) bool {
+		return deletions[i].SessionID < deletions[j].SessionID
+	})
+	want := []RetentionDeletion{
+		{Retention: retentions[1], SessionID: "default"},
+		{Retention: retentions[0], SessionID: "expired"},
+	}
+	if !reflect.DeepEqual(deletions, want) {
+		t.Errorf("deletions = %+v, want %+v", deletions, want)
+	}
+	if ids, want := sessionIDs(t, manager), []string{"active", "frozen", "other", "recent"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("sessions = %v, want %v", ids, want)
+	}
+}
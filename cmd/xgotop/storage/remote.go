@@ -0,0 +1,572 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Defaults of RemoteOptions
+const (
+	DefaultRemotePending      = 1024
+	DefaultRemoteMinBackoff   = 500 * time.Millisecond
+	DefaultRemoteMaxBackoff   = 30 * time.Second
+	DefaultRemoteCloseTimeout = 30 * time.Second
+)
+
+// ErrRemoteRead is returned by the read methods of a RemoteSink.
+var ErrRemoteRead = errors.New("sessions written to a remote sink cannot be read back")
+
+// ErrRemoteSessionLost is wrapped by the errors of RemoteTransport.Send if
+// the backend does not know the session, e.g. after it restarted.
+var ErrRemoteSessionLost = errors.New("remote backend lost track of the session")
+
+// RemoteBatch is a batch of events encoded by a RemoteTransport.
+type RemoteBatch struct {
+	// Seq numbers the batches of a session from 0
+	Seq  uint64
+	Body []byte
+	// LostFrom is the sequence number of the first batch that was dropped
+	// before being delivered, if the batches from LostFrom up to Seq were
+	// dropped. It equals Seq if no batch was dropped.
+	LostFrom uint64
+}
+
+// RemoteTransport is the protocol of a remote backend, e.g. a collector.
+type RemoteTransport interface {
+	// Encode encodes a batch of events.
+	Encode(events []*Event) ([]byte, error)
+	// Send delivers a batch. Batches are sent in order, and a failed batch
+	// is sent again after a backoff, so Send must tolerate duplicates. If
+	// the error wraps ErrRemoteSessionLost, the session is sent again
+	// before the batch.
+	Send(ctx context.Context, batch RemoteBatch) error
+	// SendSession delivers the session metadata. It is sent before the
+	// first batch, whenever it changes, and with final set once the session
+	// ended and all batches were delivered.
+	SendSession(ctx context.Context, session *Session, final bool) error
+}
+
+// RemoteOptions configure a RemoteSink.
+type RemoteOptions struct {
+	// MaxPending is the number of batches kept in memory until delivered
+	MaxPending int
+	// SpoolDir is the directory batches beyond MaxPending are spooled to
+	// during outages. Without it, such batches are dropped.
+	SpoolDir string
+	// MaxSpoolBytes bounds the size of the spooled batches, batches beyond
+	// it are dropped
+	MaxSpoolBytes int64
+	// MinBackoff and MaxBackoff bound the exponentially growing delay
+	// between retries
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// CloseTimeout bounds delivering the remaining batches on Close
+	CloseTimeout time.Duration
+}
+
+// SinkHealth is the connection state of a remote sink.
+type SinkHealth struct {
+	// Connected is false while deliveries fail
+	Connected           bool `json:"connected"`
+	ConsecutiveFailures int  `json:"consecutive_failures"`
+	// Reconnects counts the recoveries from outages
+	Reconnects uint64 `json:"reconnects"`
+	// BackoffNs is the delay before the next retry while disconnected
+	BackoffNs      int64 `json:"backoff_ns"`
+	PendingBatches int   `json:"pending_batches"`
+	SpooledBatches int   `json:"spooled_batches"`
+	SpooledBytes   int64 `json:"spooled_bytes"`
+	// DroppedBatches counts the batches dropped because both memory and
+	// spool were full, or because they could not be read from the spool
+	DroppedBatches uint64 `json:"dropped_batches"`
+	LastError      string `json:"last_error,omitempty"`
+}
+
+// HealthReporter is implemented by sinks reporting their connection state
+// in SinkStats.
+type HealthReporter interface {
+	Health() SinkHealth
+}
+
+var remoteHTTPTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	ForceAttemptHTTP2:   true,
+	MaxIdleConns:        64,
+	MaxIdleConnsPerHost: 8,
+	IdleConnTimeout:     90 * time.Second,
+	TLSHandshakeTimeout: 5 * time.Second,
+}
+
+// NewRemoteHTTPClient returns a client for HTTP based remote backends. All
+// clients share a pool of keep-alive connections.
+func NewRemoteHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: remoteHTTPTransport, Timeout: timeout}
+}
+
+// backoff computes exponentially growing retry delays with jitter, so
+// agents do not retry in lockstep after a collector outage.
+type backoff struct {
+	min, max time.Duration
+	cur      time.Duration
+}
+
+func (b *backoff) next() time.Duration {
+	if b.cur == 0 {
+		b.cur = b.min
+	} else {
+		b.cur = min(2*b.cur, b.max)
+	}
+	return b.cur/2 + rand.N(b.cur/2+1)
+}
+
+func (b *backoff) reset() {
+	b.cur = 0
+}
+
+// remoteBatch is a batch waiting for delivery in memory.
+type remoteBatch struct {
+	seq  uint64
+	body []byte
+}
+
+// spooledBatch is a batch waiting for delivery in the spool.
+type spooledBatch struct {
+	seq  uint64
+	size int64
+}
+
+// RemoteSink is the resilience layer of remote backends. It writes a
+// session through a RemoteTransport in the background: failed deliveries
+// are retried with exponential backoff, batches are spooled to the local
+// disk while the backend is unreachable and replayed in order once it
+// recovers. Once both memory and spool are full, the oldest spooled
+// batches, or the oldest batches in memory without spool, are dropped and
+// declared lost with the next delivered batch. Its connection state is
+// reported by Health.
+type RemoteSink struct {
+	transport RemoteTransport
+	opts      RemoteOptions
+
+	// writeMu serializes writes, and spoolMu the accesses to the spool,
+	// which are done without holding mu
+	writeMu sync.Mutex
+	spoolMu sync.Mutex
+
+	mu      sync.Mutex
+	session Session
+	// sessionDirty is set when the session changed since it was last sent
+	sessionDirty bool
+	nextSeq      uint64
+	// delivered is the sequence number following the last delivered batch
+	delivered uint64
+	pending   []remoteBatch
+	// spooled are the spooled batches, which are all newer than the pending
+	// ones
+	spooled      []spooledBatch
+	spooledBytes int64
+	health       SinkHealth
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewRemoteSink starts writing session through transport. Batches left in
+// opts.SpoolDir by an earlier sink are not replayed.
+func NewRemoteSink(transport RemoteTransport, session *Session, opts RemoteOptions) (*RemoteSink, error) {
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = DefaultRemotePending
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultRemoteMaxBackoff
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = min(DefaultRemoteMinBackoff, opts.MaxBackoff)
+	}
+	if opts.CloseTimeout <= 0 {
+		opts.CloseTimeout = DefaultRemoteCloseTimeout
+	}
+	if opts.SpoolDir != "" {
+		if err := os.MkdirAll(opts.SpoolDir, 0o700); err != nil {
+			return nil, fmt.Errorf("create spool directory: %w", err)
+		}
+	}
+
+	s := &RemoteSink{
+		transport:    transport,
+		opts:         opts,
+		session:      *session,
+		sessionDirty: true,
+		health:       SinkHealth{Connected: true},
+		wake:         make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *RemoteSink) run() {
+	defer close(s.done)
+
+	b := backoff{min: s.opts.MinBackoff, max: s.opts.MaxBackoff}
+	for {
+		err := s.deliver(context.Background())
+
+		// While disconnected, new batches do not cut the backoff short
+		var wake <-chan struct{}
+		var retry <-chan time.Time
+		if err != nil {
+			delay := b.next()
+			s.setError(err, delay)
+			retry = time.After(delay)
+		} else {
+			b.reset()
+			s.setError(nil, 0)
+			wake = s.wake
+		}
+
+		select {
+		case <-s.stop:
+			return
+		case <-wake:
+		case <-retry:
+		}
+	}
+}
+
+// setError updates the health after a delivery attempt.
+func (s *RemoteSink) setError(err error, delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case err != nil && s.health.Connected:
+		log.Printf("Warning: remote sink failed, retrying with backoff: %v", err)
+	case err == nil && !s.health.Connected:
+		log.Printf("Remote sink recovered after %d failures", s.health.ConsecutiveFailures)
+		s.health.Reconnects++
+	}
+
+	s.health.Connected = err == nil
+	s.health.BackoffNs = delay.Nanoseconds()
+	if err != nil {
+		s.health.ConsecutiveFailures++
+		s.health.LastError = err.Error()
+	} else {
+		s.health.ConsecutiveFailures = 0
+	}
+}
+
+// deliver sends the session if it changed, then all waiting batches in
+// order.
+func (s *RemoteSink) deliver(ctx context.Context) error {
+	s.mu.Lock()
+	session, dirty := s.session, s.sessionDirty
+	s.sessionDirty = false
+	s.mu.Unlock()
+	if dirty {
+		if err := s.transport.SendSession(ctx, &session, false); err != nil {
+			s.mu.Lock()
+			s.sessionDirty = true
+			s.mu.Unlock()
+			return err
+		}
+	}
+
+	for {
+		batch, delivered, ok := s.head()
+		if !ok {
+			return nil
+		}
+
+		err := s.transport.Send(ctx, RemoteBatch{Seq: batch.seq, Body: batch.body, LostFrom: delivered})
+		if err != nil {
+			if errors.Is(err, ErrRemoteSessionLost) {
+				s.mu.Lock()
+				s.sessionDirty = true
+				s.mu.Unlock()
+			}
+			return fmt.Errorf("send batch %d: %w", batch.seq, err)
+		}
+
+		s.mu.Lock()
+		s.delivered = batch.seq + 1
+		// The batch may have been dropped while it was sent
+		if len(s.pending) > 0 && s.pending[0].seq == batch.seq {
+			s.pending = s.pending[1:]
+		}
+		s.mu.Unlock()
+	}
+}
+
+// head returns the oldest waiting batch and the sequence number following
+// the last delivered one, replaying spooled batches once the pending ones
+// are delivered.
+func (s *RemoteSink) head() (batch remoteBatch, delivered uint64, ok bool) {
+	for {
+		s.mu.Lock()
+		if len(s.pending) > 0 || len(s.spooled) == 0 {
+			ok = len(s.pending) > 0
+			if ok {
+				batch = s.pending[0]
+			}
+			delivered = s.delivered
+			s.mu.Unlock()
+			return batch, delivered, ok
+		}
+		s.mu.Unlock()
+
+		s.unspool()
+	}
+}
+
+// unspool moves the oldest spooled batch to the pending ones. Spooled
+// batches that cannot be read are dropped.
+func (s *RemoteSink) unspool() {
+	s.spoolMu.Lock()
+	defer s.spoolMu.Unlock()
+
+	// Spooled batches are only dropped while holding spoolMu, so the oldest
+	// one stays the oldest while it is read
+	s.mu.Lock()
+	if len(s.spooled) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	oldest := s.spooled[0]
+	s.mu.Unlock()
+
+	path := s.spoolPath(oldest.seq)
+	body, err := os.ReadFile(path)
+	os.Remove(path)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.spooled = s.spooled[1:]
+	s.spooledBytes -= oldest.size
+	if err != nil {
+		log.Printf("Warning: dropping spooled batch %d: %v", oldest.seq, err)
+		s.health.DroppedBatches++
+		return
+	}
+	s.pending = append(s.pending, remoteBatch{seq: oldest.seq, body: body})
+}
+
+func (s *RemoteSink) spoolPath(seq uint64) string {
+	return filepath.Join(s.opts.SpoolDir, fmt.Sprintf("%020d.batch", seq))
+}
+
+// queue keeps batch in memory if there is room and no batch is spooled, as
+// spooled batches are older. s.mu must be held.
+func (s *RemoteSink) queue(batch remoteBatch) bool {
+	if len(s.spooled) > 0 || len(s.pending) >= s.opts.MaxPending {
+		return false
+	}
+	s.pending = append(s.pending, batch)
+	return true
+}
+
+// spool spools batch once memory is full. While the spool is full, the
+// oldest spooled batches are dropped to make room. Without spool, the
+// oldest batch in memory is dropped instead. writeMu must be held.
+func (s *RemoteSink) spool(batch remoteBatch) (dropped int, err error) {
+	s.spoolMu.Lock()
+	defer s.spoolMu.Unlock()
+
+	size := int64(len(batch.body))
+	s.mu.Lock()
+	switch {
+	case s.queue(batch):
+		// The pending batches were delivered meanwhile
+		s.mu.Unlock()
+		return 0, nil
+	case s.opts.SpoolDir == "":
+		s.pending = append(s.pending[1:], batch)
+		s.health.DroppedBatches++
+		s.mu.Unlock()
+		return 1, nil
+	case size > s.opts.MaxSpoolBytes:
+		s.health.DroppedBatches++
+		s.mu.Unlock()
+		return 0, fmt.Errorf("dropped batch %d of %d bytes, larger than the spool", batch.seq, size)
+	}
+
+	var removed []uint64
+	for s.spooledBytes+size > s.opts.MaxSpoolBytes {
+		removed = append(removed, s.spooled[0].seq)
+		s.spooledBytes -= s.spooled[0].size
+		s.spooled = s.spooled[1:]
+	}
+	// Deliveries do not read the batch before it is written, as they hold
+	// spoolMu to unspool
+	s.spooled = append(s.spooled, spooledBatch{seq: batch.seq, size: size})
+	s.spooledBytes += size
+	s.health.DroppedBatches += uint64(len(removed))
+	s.mu.Unlock()
+
+	for _, seq := range removed {
+		os.Remove(s.spoolPath(seq))
+	}
+	path := s.spoolPath(batch.seq)
+	if err := os.WriteFile(path, batch.body, 0o600); err != nil {
+		os.Remove(path)
+
+		// As writes are serialized, the batch is still the newest spooled
+		s.mu.Lock()
+		s.spooled = s.spooled[:len(s.spooled)-1]
+		s.spooledBytes -= size
+		s.health.DroppedBatches++
+		s.mu.Unlock()
+		return len(removed) + 1, fmt.Errorf("spool batch %d: %w", batch.seq, err)
+	}
+	return len(removed), nil
+}
+
+func (s *RemoteSink) WriteEvent(event *Event) error {
+	return s.WriteBatch(context.Background(), []*Event{event})
+}
+
+// WriteBatch queues events for delivery. Only dropped batches are
+// reported, failed deliveries are retried in the background regardless of
+// ctx.
+func (s *RemoteSink) WriteBatch(ctx context.Context, events []*Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	body, err := s.transport.Encode(events)
+	if err != nil {
+		return fmt.Errorf("encode batch: %w", err)
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.mu.Lock()
+	batch := remoteBatch{seq: s.nextSeq, body: body}
+	s.nextSeq++
+	s.session.EventCount += int64(len(events))
+	queued := s.queue(batch)
+	s.mu.Unlock()
+
+	var dropped int
+	if !queued {
+		dropped, err = s.spool(batch)
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	if dropped > 0 {
+		err = errors.Join(err, fmt.Errorf("dropped %d batches not delivered to the remote sink, memory and spool are full", dropped))
+	}
+	return err
+}
+
+// Health returns the connection state of the sink.
+func (s *RemoteSink) Health() SinkHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	health := s.health
+	health.PendingBatches = len(s.pending)
+	health.SpooledBatches = len(s.spooled)
+	health.SpooledBytes = s.spooledBytes
+	return health
+}
+
+func (s *RemoteSink) ReadEvents(ctx context.Context, filter *EventFilter) ([]*Event, error) {
+	return nil, ErrRemoteRead
+}
+
+func (s *RemoteSink) ScanEvents(ctx context.Context, fromCursor int64, fn ScanFunc) error {
+	return ErrRemoteRead
+}
+
+func (s *RemoteSink) GetGoroutines(ctx context.Context) ([]uint32, error) {
+	return nil, ErrRemoteRead
+}
+
+func (s *RemoteSink) GetSession() *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session := s.session
+	return &session
+}
+
+// UpdateSession queues the session for delivery. The event count is kept,
+// as it counts the events written to the sink.
+func (s *RemoteSink) UpdateSession(session *Session) error {
+	s.mu.Lock()
+	eventCount := s.session.EventCount
+	s.session = *session
+	s.session.EventCount = eventCount
+	s.sessionDirty = true
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Close delivers the remaining batches for up to CloseTimeout, then the
+// final session. Undelivered spooled batches are left in the spool
+// directory.
+func (s *RemoteSink) Close() error {
+	close(s.stop)
+	<-s.done
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.CloseTimeout)
+	defer cancel()
+
+	b := backoff{min: s.opts.MinBackoff, max: s.opts.MaxBackoff}
+	for {
+		err := s.deliver(ctx)
+		if err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			health := s.Health()
+			return fmt.Errorf("%d batches not delivered, %d of them left in %s: %w",
+				health.PendingBatches+health.SpooledBatches, health.SpooledBatches, s.opts.SpoolDir, err)
+		case <-time.After(b.next()):
+		}
+	}
+
+	s.mu.Lock()
+	session := s.session
+	s.mu.Unlock()
+	if session.EndTime == nil {
+		endTime := time.Now()
+		session.EndTime = &endTime
+	}
+	if err := s.transport.SendSession(ctx, &session, true); err != nil {
+		return err
+	}
+
+	if s.opts.SpoolDir != "" {
+		// Only removes the spool directory if it is empty
+		os.Remove(s.opts.SpoolDir)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTransport records the deliveries of a RemoteSink. Batches fail while
+// down is set, and fail with ErrRemoteSessionLost while lost is set.
+type fakeTransport struct {
+	mu       sync.Mutex
+	down     bool
+	lost     bool
+	batches  []RemoteBatch
+	sessions int
+	final    bool
+}
+
+func (t *fakeTransport) Encode(events []*Event) ([]byte, error) {
+	return json.Marshal(events)
+}
+
+func (t *fakeTransport) Send(ctx context.Context, batch RemoteBatch) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case t.down:
+		return fmt.Errorf("unreachable")
+	case t.lost:
+		return fmt.Errorf("%w: unknown session", ErrRemoteSessionLost)
+	}
+	t.batches = append(t.batches, batch)
+	return nil
+}
+
+func (t *fakeTransport) SendSession(ctx context.Context, session *Session, final bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.down {
+		return fmt.Errorf("unreachable")
+	}
+	t.sessions++
+	t.lost = false
+	t.final = final
+	return nil
+}
+
+func (t *fakeTransport) set(f func(t *fakeTransport)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f(t)
+}
+
+// waitFor polls cond until it holds or a second passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestRemoteSinkSessionLost(t *testing.T) {
+	transport := &fakeTransport{}
+	sink, err := NewRemoteSink(transport, &Session{ID: "s1"}, RemoteOptions{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivered := func(n int) func() bool {
+		return func() bool {
+			transport.mu.Lock()
+			defer transport.mu.Unlock()
+			return len(transport.batches) == n
+		}
+	}
+	if err := sink.WriteEvent(&Event{Timestamp: 1}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "batch 0", delivered(1))
+
+	// The backend forgets the session, which is sent again before the
+	// batch is retried
+	transport.set(func(t *fakeTransport) { t.lost = true })
+	if err := sink.WriteEvent(&Event{Timestamp: 2}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "batch 1", delivered(2))
+
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if transport.sessions != 3 || !transport.final {
+		t.Errorf("sessions sent = %d (final %v), want 3 (final true)", transport.sessions, transport.final)
+	}
+	if seq := transport.batches[1].Seq; seq != 1 {
+		t.Errorf("batch seq = %d, want 1", seq)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := backoff{min: 10 * time.Millisecond, max: 80 * time.Millisecond}
+	for i, cur := range []time.Duration{10, 20, 40, 80, 80} {
+		cur *= time.Millisecond
+		if delay := b.next(); delay < cur/2 || delay > cur {
+			t.Errorf("retry %d: delay = %v, want within [%v, %v]", i, delay, cur/2, cur)
+		}
+	}
+
+	b.reset()
+	if delay := b.next(); delay < 5*time.Millisecond || delay > 10*time.Millisecond {
+		t.Errorf("delay after reset = %v, want within [5ms, 10ms]", delay)
+	}
+}
+
+func TestRemoteSinkOverflow(t *testing.T) {
+	body, _ := json.Marshal([]*Event{{Timestamp: 10}})
+	size := int64(len(body))
+
+	tests := []struct {
+		name  string
+		spool bool
+		// health while the backend is unreachable
+		pending, spooled int
+		dropped          uint64
+		// delivered are the sequence numbers of the delivered batches and
+		// lostFrom the ones they declared lost from
+		delivered []uint64
+		lostFrom  []uint64
+	}{
+		{
+			name:      "spool",
+			spool:     true,
+			pending:   2,
+			spooled:   3,
+			dropped:   2,
+			delivered: []uint64{0, 1, 4, 5, 6},
+			lostFrom:  []uint64{0, 1, 2, 5, 6},
+		},
+		{
+			name:      "no spool",
+			pending:   2,
+			dropped:   5,
+			delivered: []uint64{5, 6},
+			lostFrom:  []uint64{0, 6},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &fakeTransport{down: true}
+			opts := RemoteOptions{MaxPending: 2, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+			if tt.spool {
+				opts.SpoolDir = filepath.Join(t.TempDir(), "spool")
+				opts.MaxSpoolBytes = 3 * size
+			}
+			sink, err := NewRemoteSink(transport, &Session{ID: "s1"}, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := range 7 {
+				sink.WriteEvent(&Event{Timestamp: uint64(10 + i)})
+			}
+			waitFor(t, "a failed delivery", func() bool { return sink.Health().ConsecutiveFailures > 0 })
+
+			health := sink.Health()
+			if health.Connected || health.PendingBatches != tt.pending || health.SpooledBatches != tt.spooled ||
+				health.SpooledBytes != int64(tt.spooled)*size || health.DroppedBatches != tt.dropped {
+				t.Errorf("health = %+v, want %d pending, %d spooled and %d dropped batches", health, tt.pending, tt.spooled, tt.dropped)
+			}
+
+			// Once the backend recovers, the batches are delivered in order
+			transport.set(func(t *fakeTransport) { t.down = false })
+			waitFor(t, "the recovery", func() bool { return sink.Health().Connected })
+			if health := sink.Health(); health.Reconnects != 1 || health.PendingBatches+health.SpooledBatches != 0 {
+				t.Errorf("health after recovery = %+v, want all batches delivered after 1 reconnect", health)
+			}
+			if err := sink.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var delivered, lostFrom []uint64
+			for _, batch := range transport.batches {
+				delivered = append(delivered, batch.Seq)
+				lostFrom = append(lostFrom, batch.LostFrom)
+			}
+			if !reflect.DeepEqual(delivered, tt.delivered) || !reflect.DeepEqual(lostFrom, tt.lostFrom) {
+				t.Errorf("delivered %v lost from %v, want %v lost from %v", delivered, lostFrom, tt.delivered, tt.lostFrom)
+			}
+			if tt.spool {
+				if _, err := os.Stat(opts.SpoolDir); !os.IsNotExist(err) {
+					t.Errorf("spool directory left after delivery: %v", err)
+				}
+			}
+		})
+	}
+}
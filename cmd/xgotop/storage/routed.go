@@ -0,0 +1,280 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// RoutedStore is an EventStore that writes every event type to the store it
+// is routed to, e.g. noisy types to a MemoryStore and the rest to a
+// ProtobufStore. Reads merge the events of all stores.
+type RoutedStore struct {
+	fallback EventStore
+	routes   map[EventType]EventStore
+	// stores are all distinct stores, starting with fallback
+	stores []EventStore
+}
+
+// NewRoutedStore routes the event types in routes to their stores, and all
+// other event types to fallback.
+func NewRoutedStore(fallback EventStore, routes map[EventType]EventStore) *RoutedStore {
+	s := &RoutedStore{
+		fallback: fallback,
+		routes:   routes,
+		stores:   []EventStore{fallback},
+	}
+
+	// Routes are sorted so that reads visit the stores in a stable order
+	types := make([]EventType, 0, len(routes))
+	for eventType := range routes {
+		types = append(types, eventType)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	for _, eventType := range types {
+		store := routes[eventType]
+		known := false
+		for _, s := range s.stores {
+			if s == store {
+				known = true
+				break
+			}
+		}
+		if !known {
+			s.stores = append(s.stores, store)
+		}
+	}
+
+	return s
+}
+
+// newUnionStore merges the events of stores, e.g. the files of a session
+// whose event types were routed to different formats. Writes go to the
+// first store.
+func newUnionStore(stores []EventStore) *RoutedStore {
+	return &RoutedStore{
+		fallback: stores[0],
+		stores:   stores,
+	}
+}
+
+func (s *RoutedStore) storeFor(eventType EventType) EventStore {
+	if store, ok := s.routes[eventType]; ok {
+		return store
+	}
+	return s.fallback
+}
+
+func (s *RoutedStore) WriteEvent(event *Event) error {
+	return s.storeFor(event.EventType).WriteEvent(event)
+}
+
+// WriteBatch splits the batch by store. A failing store does not keep the
+// events of the other stores from being written, all errors are returned.
+func (s *RoutedStore) WriteBatch(ctx context.Context, events []*Event) error {
+	if len(s.routes) == 0 {
+		return s.fallback.WriteBatch(ctx, events)
+	}
+
+	batches := make(map[EventStore][]*Event, len(s.stores))
+	for _, event := range events {
+		store := s.storeFor(event.EventType)
+		batches[store] = append(batches[store], event)
+	}
+
+	var errs []error
+	for _, store := range s.stores {
+		if batch := batches[store]; len(batch) > 0 {
+			if err := store.WriteBatch(ctx, batch); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ReadEvents merges the matching events of all stores by timestamp before
+// applying the offset and limit of filter.
+func (s *RoutedStore) ReadEvents(ctx context.Context, filter *EventFilter) ([]*Event, error) {
+	if len(s.stores) == 1 {
+		return s.fallback.ReadEvents(ctx, filter)
+	}
+
+	var storeFilter *EventFilter
+	if filter != nil {
+		f := *filter
+		f.Offset, f.Limit = 0, 0
+		storeFilter = &f
+	}
+
+	var events []*Event
+	for _, store := range s.stores {
+		// Events of a routed type are only found in the store they are routed to
+		if filter != nil && filter.EventType != nil && s.routes != nil && store != s.storeFor(*filter.EventType) {
+			continue
+		}
+		storeEvents, err := store.ReadEvents(ctx, storeFilter)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, storeEvents...)
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp < events[j].Timestamp
+	})
+
+	if filter != nil && filter.Offset > 0 {
+		if filter.Offset >= len(events) {
+			return nil, nil
+		}
+		events = events[filter.Offset:]
+	}
+	if filter != nil && filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+
+	return events, nil
+}
+
+// routedScanBuffer is the number of events read ahead from every store
+// while merging their scans.
+const routedScanBuffer = 256
+
+// ScanEvents merges the scans of all stores by timestamp, events with equal
+// timestamps in the order of the stores. The cursor of an event is its
+// position in the merged order, which determines the position in every
+// store: scanning from a cursor merges the stores again up to it. Cursors
+// are only stable once the session has ended, as events written later can
+// sort before events already scanned.
+func (s *RoutedStore) ScanEvents(ctx context.Context, fromCursor int64, fn ScanFunc) error {
+	if len(s.stores) == 1 {
+		return s.fallback.ScanEvents(ctx, fromCursor, fn)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	// Scans left behind by an early return end once cancelled
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	streams := make([]chan *Event, len(s.stores))
+	errs := make([]error, len(s.stores))
+	for i, store := range s.stores {
+		stream := make(chan *Event, routedScanBuffer)
+		streams[i] = stream
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(stream)
+			errs[i] = store.ScanEvents(ctx, 0, func(_ int64, event *Event) error {
+				select {
+				case stream <- event:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+		}()
+	}
+
+	// heads are the next events of the stores, nil once a store is done
+	heads := make([]*Event, len(streams))
+	next := func(i int) error {
+		event, ok := <-streams[i]
+		if !ok {
+			// The error is set before the stream is closed
+			heads[i] = nil
+			return errs[i]
+		}
+		heads[i] = event
+		return nil
+	}
+	for i := range streams {
+		if err := next(i); err != nil {
+			return err
+		}
+	}
+
+	for cursor := int64(0); ; cursor++ {
+		oldest := -1
+		for i, head := range heads {
+			if head != nil && (oldest < 0 || head.Timestamp < heads[oldest].Timestamp) {
+				oldest = i
+			}
+		}
+		if oldest < 0 {
+			return nil
+		}
+
+		event := heads[oldest]
+		if err := next(oldest); err != nil {
+			return err
+		}
+		if cursor < fromCursor {
+			continue
+		}
+		if err := fn(cursor, event); err != nil {
+			if errors.Is(err, ErrStopScan) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (s *RoutedStore) GetGoroutines(ctx context.Context) ([]uint32, error) {
+	goroutineMap := make(map[uint32]bool)
+	for _, store := range s.stores {
+		goroutines, err := store.GetGoroutines(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, gid := range goroutines {
+			goroutineMap[gid] = true
+		}
+	}
+
+	goroutines := make([]uint32, 0, len(goroutineMap))
+	for gid := range goroutineMap {
+		goroutines = append(goroutines, gid)
+	}
+
+	return goroutines, nil
+}
+
+func (s *RoutedStore) Close() error {
+	var errs []error
+	for _, store := range s.stores {
+		if err := store.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// GetSession returns the session with the events of all stores. Every
+// store counts its own events, as the metadata they share holds the count of
+// the whole session.
+func (s *RoutedStore) GetSession() *Session {
+	session := *s.fallback.GetSession()
+	for _, store := range s.stores[1:] {
+		session.EventCount += store.GetSession().EventCount
+	}
+	return &session
+}
+
+func (s *RoutedStore) UpdateSession(session *Session) error {
+	var errs []error
+	for _, store := range s.stores {
+		if err := store.UpdateSession(session); err != nil {
+			errs = append(errs, fmt.Errorf("update session: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
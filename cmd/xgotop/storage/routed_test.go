@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestRoutedStoreStopScan(t *testing.T) {
+	ctx := context.Background()
+	session := &Session{ID: "routed"}
+	fallback, noisy := NewMemoryStore(session, 0), NewMemoryStore(session, 0)
+	store := NewRoutedStore(fallback, map[EventType]EventStore{EventTypeCasGStatus: noisy})
+
+	var events []*Event
+	for i := range 4 {
+		events = append(events,
+			&Event{Timestamp: uint64(2 * i), EventType: EventTypeNewObject},
+			&Event{Timestamp: uint64(2*i + 1), EventType: EventTypeCasGStatus})
+	}
+	if err := store.WriteBatch(ctx, events); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, limit := range []int{2, 4, 6} {
+		var scanned int
+		err := store.ScanEvents(ctx, 0, func(cursor int64, event *Event) error {
+			scanned++
+			if scanned == limit {
+				return ErrStopScan
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scanned != limit {
+			t.Errorf("scanned %d events after stopping at %d", scanned, limit)
+		}
+	}
+
+	read, err := store.ReadEvents(ctx, &EventFilter{Limit: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 5 {
+		t.Errorf("read %d events, want 5", len(read))
+	}
+}
+
+func TestRoutedStoreScanOrder(t *testing.T) {
+	ctx := context.Background()
+	session := &Session{ID: "routed"}
+	fallback, noisy := NewMemoryStore(session, 0), NewMemoryStore(session, 0)
+	store := NewRoutedStore(fallback, map[EventType]EventStore{EventTypeCasGStatus: noisy})
+
+	events := []*Event{
+		{Timestamp: 1, EventType: EventTypeCasGStatus},
+		{Timestamp: 2, EventType: EventTypeNewObject},
+		{Timestamp: 2, EventType: EventTypeCasGStatus},
+		{Timestamp: 3, EventType: EventTypeCasGStatus},
+		{Timestamp: 5, EventType: EventTypeNewObject},
+		{Timestamp: 4, EventType: EventTypeCasGStatus},
+	}
+	if err := store.WriteBatch(ctx, events); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		fromCursor int64
+		expected   []uint64
+	}{
+		{fromCursor: 0, expected: []uint64{1, 2, 2, 3, 4, 5}},
+		{fromCursor: 2, expected: []uint64{2, 3, 4, 5}},
+		{fromCursor: 6},
+	}
+
+	for _, tt := range tests {
+		var timestamps []uint64
+		var cursors []int64
+		err := store.ScanEvents(ctx, tt.fromCursor, func(cursor int64, event *Event) error {
+			timestamps = append(timestamps, event.Timestamp)
+			cursors = append(cursors, cursor)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(timestamps, tt.expected) {
+			t.Errorf("from cursor %d: timestamps = %v, want %v", tt.fromCursor, timestamps, tt.expected)
+		}
+		for i, cursor := range cursors {
+			if cursor != tt.fromCursor+int64(i) {
+				t.Errorf("from cursor %d: cursors = %v, want consecutive", tt.fromCursor, cursors)
+				break
+			}
+		}
+	}
+}
+
+func TestRoutedStoreReopen(t *testing.T) {
+	ctx := context.Background()
+	manager, err := NewManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := &Session{ID: "routed"}
+	fallback, err := manager.CreateSession(ctx, session, "protobuf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lifecycle, err := manager.CreateSession(ctx, session, "jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewRoutedStore(fallback, map[EventType]EventStore{EventTypeGoExit: lifecycle})
+
+	events := []*Event{
+		{Timestamp: 1, EventType: EventTypeNewObject},
+		{Timestamp: 2, EventType: EventTypeGoExit},
+		{Timestamp: 3, EventType: EventTypeNewObject},
+	}
+	if err := store.WriteBatch(ctx, events); err != nil {
+		t.Fatal(err)
+	}
+	// The metadata written through every store holds the count of the
+	// whole session
+	if err := store.UpdateSession(store.GetSession()); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := manager.OpenSession(ctx, "routed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if count := reopened.GetSession().EventCount; count != 3 {
+		t.Errorf("EventCount = %d, want 3", count)
+	}
+	var timestamps []uint64
+	err = reopened.ScanEvents(ctx, 0, func(_ int64, event *Event) error {
+		timestamps = append(timestamps, event.Timestamp)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []uint64{1, 2, 3}; !reflect.DeepEqual(timestamps, expected) {
+		t.Errorf("timestamps = %v, want %v", timestamps, expected)
+	}
+}
@@ -0,0 +1,78 @@
+package storage
+
+// SamplingPeriod is a sampling rate of an event type that was in effect
+// during a time range of a session.
+type SamplingPeriod struct {
+	// Percent is the percentage of the events that were captured
+	Percent uint32 `json:"percent"`
+	// FromTimestamp and ToTimestamp bound the period on the clock of the
+	// event timestamps. ToTimestamp is zero if the rate was in effect until
+	// the end of the session.
+	FromTimestamp uint64 `json:"from_timestamp"`
+	ToTimestamp   uint64 `json:"to_timestamp,omitempty"`
+}
+
+// FlagPeriod is a time range during which a goroutine was flagged, bounded
+// like the range of a SamplingPeriod.
+type FlagPeriod struct {
+	FromTimestamp uint64 `json:"from_timestamp"`
+	ToTimestamp   uint64 `json:"to_timestamp,omitempty"`
+}
+
+// SamplingManifest records the sampling rates the events of a session were
+// captured with, and the goroutines whose events bypassed them.
+type SamplingManifest struct {
+	// Rates maps the names of the sampled event types to the periods of
+	// their rates, in chronological order. Event types missing from it were
+	// captured unsampled.
+	Rates map[string][]SamplingPeriod `json:"rates"`
+	// Flagged maps the goroutines that were flagged to the periods they
+	// were flagged in, in chronological order.
+	Flagged map[uint32][]FlagPeriod `json:"flagged,omitempty"`
+}
+
+// Percent returns the sampling rate in effect for events of type t at
+// timestamp ts.
+func (m *SamplingManifest) Percent(t EventType, ts uint64) uint32 {
+	if m == nil {
+		return 100
+	}
+	for _, period := range m.Rates[t.String()] {
+		if ts >= period.FromTimestamp && (period.ToTimestamp == 0 || ts < period.ToTimestamp) {
+			return period.Percent
+		}
+	}
+	return 100
+}
+
+// IsFlagged reports whether goroutine gid was flagged at timestamp ts.
+func (m *SamplingManifest) IsFlagged(gid uint32, ts uint64) bool {
+	if m == nil {
+		return false
+	}
+	for _, period := range m.Flagged[gid] {
+		if ts >= period.FromTimestamp && (period.ToTimestamp == 0 || ts < period.ToTimestamp) {
+			return true
+		}
+	}
+	return false
+}
+
+// Weight returns the number of events that event stands for, see
+// SamplingWeight.
+func (m *SamplingManifest) Weight(event *Event) float64 {
+	return SamplingWeight(m.Percent(event.EventType, event.Timestamp), m.IsFlagged(event.Goroutine, event.Timestamp))
+}
+
+// SamplingWeight returns the number of events that an event captured at a
+// sampling rate of percent stands for, i.e. the inverse of the rate. The
+// events of flagged goroutines bypass sampling and stand for themselves.
+// So do events recorded at a rate of 0, which can only have been in flight
+// when the rate was set, as a rate of 0 disables an event type even for
+// flagged goroutines.
+func SamplingWeight(percent uint32, flagged bool) float64 {
+	if flagged || percent == 0 || percent >= 100 {
+		return 1
+	}
+	return 100 / float64(percent)
+}
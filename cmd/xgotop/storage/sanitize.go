@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+)
+
+// SanitizeMode is how the metadata of a session that may identify its
+// origin environment is treated when the session is shared: the path of the
+// traced binary, the file it was imported from, the hostname, the PID and
+// the label values.
+type SanitizeMode string
+
+const (
+	// SanitizeNone keeps the metadata.
+	SanitizeNone SanitizeMode = "none"
+	// SanitizeRedact removes the metadata.
+	SanitizeRedact SanitizeMode = "redact"
+	// SanitizeHash replaces the metadata with salted hashes, so sessions of
+	// the same origin can still be told apart and matched up. The PID is
+	// removed.
+	SanitizeHash SanitizeMode = "hash"
+)
+
+// ParseSanitizeMode parses s, which is SanitizeNone if empty.
+func ParseSanitizeMode(s string) (SanitizeMode, error) {
+	switch mode := SanitizeMode(s); mode {
+	case "":
+		return SanitizeNone, nil
+	case SanitizeNone, SanitizeRedact, SanitizeHash:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown sanitize mode %q (supported: none, redact, hash)", s)
+	}
+}
+
+// SanitizeSession returns a copy of session with its identifying metadata
+// sanitized according to mode. Hashes are salted with salt, so they cannot
+// be reversed by hashing guessed values without knowing it. The label keys
+// are kept, and the notes removed.
+func SanitizeSession(session *Session, mode SanitizeMode, salt string) *Session {
+	if session == nil || mode == SanitizeNone || mode == "" {
+		return session
+	}
+
+	sanitize := func(value string) string {
+		if mode == SanitizeRedact || value == "" {
+			return ""
+		}
+		sum := sha256.Sum256([]byte(salt + "\x00" + value))
+		return "sha256:" + hex.EncodeToString(sum[:8])
+	}
+
+	sanitized := *session
+	sanitized.Sanitized = mode
+	sanitized.PID = 0
+	// Free-form notes cannot be sanitized
+	sanitized.Notes, sanitized.Journal = "", nil
+	sanitized.BinaryPath = sanitize(session.BinaryPath)
+	sanitized.ImportedFrom = sanitize(session.ImportedFrom)
+	if session.Clock != nil {
+		clock := *session.Clock
+		clock.Hostname = sanitize(clock.Hostname)
+		sanitized.Clock = &clock
+	}
+	if mode == SanitizeRedact {
+		sanitized.Labels = nil
+	} else if session.Labels != nil {
+		sanitized.Labels = maps.Clone(session.Labels)
+		for key, value := range sanitized.Labels {
+			sanitized.Labels[key] = sanitize(value)
+		}
+	}
+	return &sanitized
+}
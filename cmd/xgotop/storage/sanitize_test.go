@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeSession(t *testing.T) {
+	session := &Session{
+		ID:         "s1",
+		PID:        42,
+		BinaryPath: "/srv/payments/bin/api",
+		Labels:     map[string]string{"service": "payments"},
+		Clock:      &ClockSync{Hostname: "db-7.internal"},
+	}
+
+	tests := []struct {
+		mode  SanitizeMode
+		check func(t *testing.T, sanitized *Session)
+	}{
+		{SanitizeNone, func(t *testing.T, sanitized *Session) {
+			if sanitized != session {
+				t.Error("session was copied")
+			}
+		}},
+		{SanitizeRedact, func(t *testing.T, sanitized *Session) {
+			if sanitized.PID != 0 || sanitized.BinaryPath != "" || sanitized.Labels != nil || sanitized.Clock.Hostname != "" {
+				t.Errorf("metadata not redacted: %+v", sanitized)
+			}
+		}},
+		{SanitizeHash, func(t *testing.T, sanitized *Session) {
+			if sanitized.PID != 0 || !strings.HasPrefix(sanitized.BinaryPath, "sha256:") || !strings.HasPrefix(sanitized.Clock.Hostname, "sha256:") {
+				t.Errorf("metadata not hashed: %+v", sanitized)
+			}
+			if value := sanitized.Labels["service"]; value == "payments" || !strings.HasPrefix(value, "sha256:") {
+				t.Errorf("label value = %q, want hash", value)
+			}
+			again := SanitizeSession(session, SanitizeHash, "salt")
+			other := SanitizeSession(session, SanitizeHash, "pepper")
+			if again.BinaryPath != sanitized.BinaryPath || other.BinaryPath == sanitized.BinaryPath {
+				t.Error("hashes do not depend on the salt only")
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			sanitized := SanitizeSession(session, tt.mode, "salt")
+			tt.check(t, sanitized)
+			if tt.mode != SanitizeNone && sanitized.Sanitized != tt.mode {
+				t.Errorf("Sanitized = %q, want %q", sanitized.Sanitized, tt.mode)
+			}
+		})
+	}
+
+	// The original session is left alone
+	if session.BinaryPath != "/srv/payments/bin/api" || session.Labels["service"] != "payments" || session.Clock.Hostname != "db-7.internal" {
+		t.Errorf("session modified: %+v", session)
+	}
+}
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	// ErrNoFlightRecorder is returned when snapshotting a session that is
+	// not recorded in the memory format.
+	ErrNoFlightRecorder = errors.New("session is not recorded in memory")
+
+	// ErrImmutable is returned when deleting a snapshot session.
+	ErrImmutable = errors.New("session is immutable")
+)
+
+// Window returns the events held by the ring whose timestamp is at most
+// window before the newest event. The events are copied under the lock, so
+// the result is consistent even while new events overwrite the oldest ones.
+func (s *MemoryStore) Window(window time.Duration) []*Event {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var newest uint64
+	for i := range s.count {
+		newest = max(newest, s.events[(s.start+i)%len(s.events)].Timestamp)
+	}
+	var cutoff uint64
+	if ns := uint64(window.Nanoseconds()); newest > ns {
+		cutoff = newest - ns
+	}
+
+	var events []*Event
+	for i := range s.count {
+		event := s.events[(s.start+i)%len(s.events)]
+		if event.Timestamp >= cutoff {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// windowOf returns the events of store whose timestamp is at most window
+// before the newest event.
+func windowOf(ctx context.Context, store EventStore, window time.Duration) ([]*Event, error) {
+	var newest uint64
+	err := store.ScanEvents(ctx, 0, func(_ int64, event *Event) error {
+		newest = max(newest, event.Timestamp)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var cutoff uint64
+	if ns := uint64(window.Nanoseconds()); newest > ns {
+		cutoff = newest - ns
+	}
+	return store.ReadEvents(ctx, &EventFilter{StartTime: &cutoff})
+}
+
+// Snapshot copies the last window of the flight recorder of session
+// sourceID into snapshot, a new session stored in format. If event types of
+// the session are routed to other stores than the flight recorder, their
+// events of the window are copied from these stores. The snapshot
+// session is immutable: its files are made read-only and it cannot be
+// deleted through the Manager, so it can serve as evidence of an incident
+// while the capture goes on and overwrites the ring. The snapshot starts
+// with its first event, or with the window if the source session has no
+// clock to place the events on the wall clock.
+func (m *Manager) Snapshot(ctx context.Context, sourceID string, snapshot *Session, window time.Duration, format string) (*Session, error) {
+	if m.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if format == "memory" {
+		return nil, fmt.Errorf("cannot snapshot into the memory format")
+	}
+
+	m.mu.RLock()
+	source, ok := m.memory[sourceID]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, ErrNoFlightRecorder
+	}
+
+	sourceSession := source.GetSession()
+	if !inScope(ctx, sourceSession) {
+		return nil, ErrNoSession
+	}
+
+	var events []*Event
+	if len(sourceSession.Routes) > 0 {
+		store, err := m.OpenSession(ctx, sourceID)
+		if err != nil {
+			return nil, err
+		}
+		events, err = windowOf(ctx, store, window)
+		store.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read session %s: %w", sourceID, err)
+		}
+	} else {
+		events = source.Window(window)
+	}
+
+	snapshot.StartTime = time.Now().Add(-window)
+	if len(events) > 0 && sourceSession.Clock != nil {
+		first := events[0].Timestamp
+		for _, event := range events {
+			first = min(first, event.Timestamp)
+		}
+		snapshot.StartTime = time.Unix(0, int64(first)+sourceSession.Clock.Start.OffsetNs)
+	}
+	snapshot.PID = sourceSession.PID
+	snapshot.BinaryPath = sourceSession.BinaryPath
+	snapshot.EventDetail = sourceSession.EventDetail
+	snapshot.USDTProbes = sourceSession.USDTProbes
+	snapshot.Functions = sourceSession.Functions
+	snapshot.SnapshotOf = sourceID
+	snapshot.Namespace = sourceSession.Namespace
+	snapshot.Immutable = true
+
+	store, err := m.CreateSession(ctx, snapshot, format)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.WriteBatch(ctx, events); err != nil {
+		store.Close()
+		// An incomplete snapshot is no evidence, and cannot be deleted once
+		// immutable
+		m.mu.Lock()
+		os.RemoveAll(filepath.Join(m.baseDir, snapshot.ID))
+		m.mu.Unlock()
+		return nil, fmt.Errorf("write snapshot: %w", err)
+	}
+	if err := store.Close(); err != nil {
+		return nil, fmt.Errorf("close snapshot: %w", err)
+	}
+
+	endTime := time.Now()
+	snapshot.EndTime = &endTime
+	snapshot.EventCount = int64(len(events))
+
+	sessionDir := filepath.Join(m.baseDir, snapshot.ID)
+	if err := saveSessionMetadata(sessionDir, snapshot, m.opts.Permissions); err != nil {
+		return nil, fmt.Errorf("save session metadata: %w", err)
+	}
+	if err := m.freeze(sessionDir); err != nil {
+		return nil, fmt.Errorf("make snapshot read-only: %w", err)
+	}
+
+	return snapshot, nil
+}
+
+// freeze removes the write permissions of the files in sessionDir.
+func (m *Manager) freeze(sessionDir string) error {
+	entries, err := os.ReadDir(sessionDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(sessionDir, entry.Name())
+		if err := os.Chmod(path, m.opts.Permissions.FileMode&^0222); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSnapshotStartTime(t *testing.T) {
+	ctx := context.Background()
+	const offset = int64(1_700_000_000_000_000_000)
+
+	for _, clock := range []*ClockSync{{Start: ClockSample{OffsetNs: offset}}, nil} {
+		manager, err := NewManager(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, err := manager.CreateSession(ctx, &Session{ID: "live", StartTime: time.Unix(0, offset), Clock: clock}, "memory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The first event is older than the window
+		for _, ts := range []uint64{10, 80, 40, 30} {
+			if err := store.WriteEvent(&Event{Timestamp: ts * uint64(time.Second)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		before := time.Now()
+		snapshot, err := manager.Snapshot(ctx, "live", &Session{ID: "snapshot"}, time.Minute, "jsonl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if snapshot.EventCount != 3 {
+			t.Errorf("EventCount = %d, want 3", snapshot.EventCount)
+		}
+		if clock != nil {
+			if expected := time.Unix(0, offset+30*int64(time.Second)); !snapshot.StartTime.Equal(expected) {
+				t.Errorf("StartTime = %v, want the first event at %v", snapshot.StartTime, expected)
+			}
+			continue
+		}
+		// Without a clock, the snapshot starts a window before it was taken
+		if snapshot.StartTime.Before(before.Add(-time.Minute)) || snapshot.StartTime.After(snapshot.EndTime.Add(-time.Minute)) {
+			t.Errorf("StartTime = %v, want a minute before %v", snapshot.StartTime, snapshot.EndTime)
+		}
+	}
+}
+
+func TestSnapshotRoutedSession(t *testing.T) {
+	ctx := context.Background()
+	manager, err := NewManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the scheduler events are held by the flight recorder
+	session := &Session{ID: "live", StartTime: time.Now(), Routes: map[string]string{EventTypeCasGStatus.String(): "memory"}}
+	fallback, err := manager.CreateSession(ctx, session, "jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder, err := manager.CreateSession(ctx, session, "memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewRoutedStore(fallback, map[EventType]EventStore{EventTypeCasGStatus: recorder})
+
+	// The first event is older than the window
+	var events []*Event
+	for i, ts := range []uint64{10, 20, 30, 40, 50, 80} {
+		eventType := EventTypeNewObject
+		if i%2 == 0 {
+			eventType = EventTypeCasGStatus
+		}
+		events = append(events, &Event{Timestamp: ts * uint64(time.Second), EventType: eventType})
+	}
+	if err := store.WriteBatch(ctx, events); err != nil {
+		t.Fatal(err)
+	}
+	if err := fallback.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := manager.Snapshot(ctx, "live", &Session{ID: "snapshot"}, time.Minute, "jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.EventCount != 5 {
+		t.Errorf("EventCount = %d, want 5", snapshot.EventCount)
+	}
+
+	stored, err := manager.OpenSession(ctx, "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stored.Close()
+	read, err := stored.ReadEvents(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []EventType
+	for _, event := range read {
+		types = append(types, event.EventType)
+	}
+	want := []EventType{EventTypeNewObject, EventTypeCasGStatus, EventTypeNewObject, EventTypeCasGStatus, EventTypeNewObject}
+	if !slices.Equal(types, want) {
+		t.Errorf("snapshot event types = %v, want %v", types, want)
+	}
+}
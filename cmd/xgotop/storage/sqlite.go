@@ -0,0 +1,422 @@
+//go:build cgo
+// +build cgo
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteSchema is the schema of events.db. Attributes are stored in their raw
+// positions in the events table, the views name them by event type, so the
+// database can be queried without knowing the attribute layout of xgotop.h.
+// SQLite integers are signed, so attributes of 2^63 and above, e.g. some
+// addresses, appear negative.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS events (
+	id               INTEGER PRIMARY KEY,
+	timestamp        INTEGER NOT NULL,
+	event_type       INTEGER NOT NULL,
+	goroutine        INTEGER NOT NULL,
+	parent_goroutine INTEGER NOT NULL,
+	attr0            INTEGER NOT NULL,
+	attr1            INTEGER NOT NULL,
+	attr2            INTEGER NOT NULL,
+	attr3            INTEGER NOT NULL,
+	attr4            INTEGER NOT NULL,
+	thread           INTEGER,
+	p                INTEGER
+);
+CREATE INDEX IF NOT EXISTS events_goroutine ON events (goroutine);
+CREATE INDEX IF NOT EXISTS events_event_type ON events (event_type);
+CREATE INDEX IF NOT EXISTS events_timestamp ON events (timestamp);
+
+CREATE TABLE IF NOT EXISTS event_types (id INTEGER PRIMARY KEY, name TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS kinds (id INTEGER PRIMARY KEY, name TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS goroutine_statuses (id INTEGER PRIMARY KEY, name TEXT NOT NULL);
+
+CREATE VIEW IF NOT EXISTS v_allocations AS
+SELECT e.id, e.timestamp, e.goroutine, 'slice' AS allocation,
+	e.attr1 AS kind, k.name AS kind_name, e.attr0 AS elem_size, e.attr2 AS len, e.attr3 AS cap,
+	NULL AS key_size, NULL AS key_kind_name, NULL AS hint, e.attr0 * e.attr3 AS bytes
+FROM events e LEFT JOIN kinds k ON k.id = e.attr1
+WHERE e.event_type = 1
+UNION ALL
+SELECT e.id, e.timestamp, e.goroutine, 'map',
+	e.attr3, k.name, e.attr2, NULL, NULL,
+	e.attr0, kk.name, e.attr4, NULL
+FROM events e LEFT JOIN kinds k ON k.id = e.attr3 LEFT JOIN kinds kk ON kk.id = e.attr1
+WHERE e.event_type = 2
+UNION ALL
+SELECT e.id, e.timestamp, e.goroutine, 'object',
+	e.attr1, k.name, e.attr0, NULL, NULL,
+	NULL, NULL, NULL, e.attr0
+FROM events e LEFT JOIN kinds k ON k.id = e.attr1
+WHERE e.event_type = 3
+UNION ALL
+SELECT e.id, e.timestamp, e.goroutine, 'string',
+	24 /* abi.String */, 'string', 1, e.attr0, e.attr0,
+	NULL, NULL, NULL, CASE WHEN e.attr3 != 0 THEN 0 ELSE e.attr0 END
+FROM events e
+WHERE e.event_type = 10;
+
+CREATE VIEW IF NOT EXISTS v_goroutine_lifecycle AS
+SELECT id, timestamp, 'create' AS event, attr1 AS goroutine, attr0 AS creator_goroutine,
+	attr2 AS start_pc, attr3 AS go_pc
+FROM events WHERE event_type = 4
+UNION ALL
+SELECT id, timestamp, 'exit', attr0, NULL, NULL, NULL
+FROM events WHERE event_type = 5;
+
+CREATE VIEW IF NOT EXISTS v_state_changes AS
+SELECT e.id, e.timestamp, e.attr2 AS goroutine, e.goroutine AS by_goroutine,
+	e.attr0 AS old_status, COALESCE(o.name, 'unknown') AS old_status_name,
+	e.attr1 AS new_status, COALESCE(n.name, 'unknown') AS new_status_name
+FROM events e
+LEFT JOIN goroutine_statuses o ON o.id = e.attr0
+LEFT JOIN goroutine_statuses n ON n.id = e.attr1
+WHERE e.event_type = 0;
+`
+
+const sqliteEventColumns = "id, timestamp, event_type, goroutine, parent_goroutine, attr0, attr1, attr2, attr3, attr4, thread, p"
+
+// SQLiteStore stores the events of a session in events.db, which can also be
+// opened directly with the sqlite3 shell or any SQLite client.
+type SQLiteStore struct {
+	db         *sql.DB
+	session    *Session
+	mu         sync.RWMutex
+	eventCount int64
+	// readOnly is set for opened stores, events cannot be appended to them
+	readOnly bool
+	baseDir  string
+	opts     Options
+}
+
+func NewSQLiteStore(baseDir string, session *Session, opts Options) (*SQLiteStore, error) {
+	sessionDir := filepath.Join(baseDir, session.ID)
+	if err := opts.Permissions.mkdirAll(sessionDir); err != nil {
+		return nil, fmt.Errorf("create session directory: %w", err)
+	}
+
+	// Create the file first, so it gets the configured mode and owner
+	filePath := filepath.Join(sessionDir, "events.db")
+	file, err := opts.Permissions.openFile(filePath, os.O_CREATE|os.O_WRONLY)
+	if err != nil {
+		return nil, fmt.Errorf("create sqlite file: %w", err)
+	}
+	file.Close()
+
+	db, err := sql.Open("sqlite3", "file:"+filePath+"?_synchronous=NORMAL")
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite database: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+
+	if err := createSQLiteSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteStore{
+		db:      db,
+		session: session,
+		baseDir: baseDir,
+		opts:    opts,
+	}, nil
+}
+
+// OpenSQLiteStore opens the events of an existing session for reading.
+func OpenSQLiteStore(baseDir string, sessionID string, opts Options) (*SQLiteStore, error) {
+	sessionDir := filepath.Join(baseDir, sessionID)
+	filePath := filepath.Join(sessionDir, "events.db")
+
+	if _, err := os.Stat(filePath); err != nil {
+		return nil, fmt.Errorf("open sqlite file: %w", err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+filePath+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite database: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+
+	session, err := loadSessionMetadata(sessionDir)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("load session metadata: %w", err)
+	}
+
+	// The count of the metadata is the one of the whole session, which can
+	// have events routed to other stores
+	var eventCount int64
+	if err := db.QueryRow("SELECT COUNT(*) FROM events").Scan(&eventCount); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("count events: %w", err)
+	}
+
+	return &SQLiteStore{
+		db:         db,
+		session:    session,
+		eventCount: eventCount,
+		readOnly:   true,
+		baseDir:    baseDir,
+		opts:       opts,
+	}, nil
+}
+
+// createSQLiteSchema creates the tables and views of events.db and fills the
+// lookup tables the views join.
+func createSQLiteSchema(db *sql.DB) error {
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		return fmt.Errorf("create sqlite schema: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	insert := func(table string, id uint64, name string) error {
+		_, err := tx.Exec("INSERT OR REPLACE INTO "+table+" (id, name) VALUES (?, ?)", int64(id), name)
+		return err
+	}
+
+	var errs []error
+	for eventType, name := range eventTypeNames {
+		errs = append(errs, insert("event_types", uint64(eventType), name))
+	}
+	for kind := KindInvalid; kind <= KindUnsafePointer; kind++ {
+		errs = append(errs, insert("kinds", uint64(kind), kind.String()))
+	}
+	for status, name := range goroutineStatuses {
+		errs = append(errs, insert("goroutine_statuses", uint64(status), name))
+		errs = append(errs, insert("goroutine_statuses", uint64(status|goroutineStatusScan), "scan"+name))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("fill lookup tables: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) WriteEvent(event *Event) error {
+	return s.WriteBatch(context.Background(), []*Event{event})
+}
+
+// WriteBatch writes events in a single transaction, which is rolled back if
+// ctx is done before it commits.
+func (s *SQLiteStore) WriteBatch(ctx context.Context, events []*Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO events (timestamp, event_type, goroutine, parent_goroutine,
+		attr0, attr1, attr2, attr3, attr4, thread, p) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("prepare insert: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, event := range events {
+		var thread, p any
+		if event.Thread != 0 {
+			thread = int64(event.Thread)
+		}
+		if event.P != nil {
+			p = int64(*event.P)
+		}
+
+		a := event.Attributes
+		_, err := stmt.ExecContext(ctx, int64(event.Timestamp), int64(event.EventType), int64(event.Goroutine), int64(event.ParentGoroutine),
+			int64(a[0]), int64(a[1]), int64(a[2]), int64(a[3]), int64(a[4]), thread, p)
+		if err != nil {
+			return fmt.Errorf("insert event: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	s.eventCount += int64(len(events))
+	return nil
+}
+
+// ReadEvents returns the events matching filter in the order they were
+// written. Offset skips matching events, like in JSONL stores.
+func (s *SQLiteStore) ReadEvents(ctx context.Context, filter *EventFilter) ([]*Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var where []string
+	var args []any
+	limit, offset := -1, 0
+	if filter != nil {
+		if filter.Goroutine != nil {
+			where, args = append(where, "goroutine = ?"), append(args, int64(*filter.Goroutine))
+		}
+		if filter.EventType != nil {
+			where, args = append(where, "event_type = ?"), append(args, int64(*filter.EventType))
+		}
+		if filter.StartTime != nil {
+			where, args = append(where, "timestamp >= ?"), append(args, int64(*filter.StartTime))
+		}
+		if filter.EndTime != nil {
+			where, args = append(where, "timestamp <= ?"), append(args, int64(*filter.EndTime))
+		}
+		if filter.Limit > 0 {
+			limit = filter.Limit
+		}
+		offset = filter.Offset
+	}
+
+	query := "SELECT " + sqliteEventColumns + " FROM events"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	var events []*Event
+	err := s.query(ctx, query, args, func(_ int64, event *Event) error {
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return events, err
+		}
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// ScanEvents streams the events after fromCursor. The cursor of an event is
+// its row ID minus one.
+func (s *SQLiteStore) ScanEvents(ctx context.Context, fromCursor int64, fn ScanFunc) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	query := "SELECT " + sqliteEventColumns + " FROM events WHERE id > ? ORDER BY id"
+	err := s.query(ctx, query, []any{fromCursor}, fn)
+	if errors.Is(err, ErrStopScan) {
+		return nil
+	}
+	return err
+}
+
+func (s *SQLiteStore) query(ctx context.Context, query string, args []any, fn ScanFunc) error {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("query events: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, timestamp, eventType, goroutine, parentGoroutine int64
+		var attrs [5]int64
+		var thread, p sql.NullInt64
+		err := rows.Scan(&id, &timestamp, &eventType, &goroutine, &parentGoroutine,
+			&attrs[0], &attrs[1], &attrs[2], &attrs[3], &attrs[4], &thread, &p)
+		if err != nil {
+			return fmt.Errorf("scan event: %w", err)
+		}
+
+		event := &Event{
+			Timestamp:       uint64(timestamp),
+			EventType:       EventType(eventType),
+			Goroutine:       uint32(goroutine),
+			ParentGoroutine: uint32(parentGoroutine),
+			Thread:          uint32(thread.Int64),
+		}
+		for i, attr := range attrs {
+			event.Attributes[i] = uint64(attr)
+		}
+		if p.Valid {
+			pid := uint32(p.Int64)
+			event.P = &pid
+		}
+
+		if err := fn(id-1, event); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("read events: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) GetGoroutines(ctx context.Context) ([]uint32, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT DISTINCT goroutine FROM events")
+	if err != nil {
+		return nil, fmt.Errorf("query goroutines: %w", err)
+	}
+	defer rows.Close()
+
+	var goroutines []uint32
+	for rows.Next() {
+		var gid int64
+		if err := rows.Scan(&gid); err != nil {
+			return nil, fmt.Errorf("scan goroutine: %w", err)
+		}
+		goroutines = append(goroutines, uint32(gid))
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read goroutines: %w", err)
+	}
+	return goroutines, nil
+}
+
+func (s *SQLiteStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) GetSession() *Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sessionCopy := *s.session
+	sessionCopy.EventCount = s.eventCount
+	return &sessionCopy
+}
+
+func (s *SQLiteStore) UpdateSession(session *Session) error {
+	if s.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.session = session
+	sessionDir := filepath.Join(s.baseDir, session.ID)
+	return saveSessionMetadata(sessionDir, session, s.opts.Permissions)
+}
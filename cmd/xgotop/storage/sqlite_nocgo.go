@@ -0,0 +1,23 @@
+//go:build !cgo
+// +build !cgo
+
+package storage
+
+import "errors"
+
+// errSQLiteUnavailable is returned for the sqlite format by builds without
+// cgo, which the SQLite driver requires.
+var errSQLiteUnavailable = errors.New("the sqlite format requires xgotop to be built with cgo")
+
+// SQLiteStore cannot be created without cgo.
+type SQLiteStore struct {
+	EventStore
+}
+
+func NewSQLiteStore(baseDir string, session *Session, opts Options) (*SQLiteStore, error) {
+	return nil, errSQLiteUnavailable
+}
+
+func OpenSQLiteStore(baseDir string, sessionID string, opts Options) (*SQLiteStore, error) {
+	return nil, errSQLiteUnavailable
+}
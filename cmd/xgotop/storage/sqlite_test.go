@@ -0,0 +1,102 @@
+//go:build cgo
+// +build cgo
+
+package storage
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestSQLiteViews(t *testing.T) {
+	store, err := NewSQLiteStore(t.TempDir(), &Session{ID: "s1"}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	events := []*Event{
+		{Timestamp: 1, EventType: EventTypeMakeSlice, Goroutine: 7, Attributes: [5]uint64{8, uint64(KindInt64), 10, 16}},
+		{Timestamp: 2, EventType: EventTypeMakeMap, Goroutine: 7, Attributes: [5]uint64{16, uint64(KindString), 32, uint64(KindStruct), 100}},
+		{Timestamp: 3, EventType: EventTypeNewObject, Goroutine: 8, Attributes: [5]uint64{48, uint64(KindStruct)}},
+		{Timestamp: 4, EventType: EventTypeStringAlloc, Goroutine: 8, Attributes: [5]uint64{12}},
+		// A string that is not allocated
+		{Timestamp: 5, EventType: EventTypeStringAlloc, Goroutine: 8, Attributes: [5]uint64{12, 0, 0, 1}},
+		{Timestamp: 6, EventType: EventTypeNewGoroutine, Goroutine: 7, Attributes: [5]uint64{7, 9, 0x1000, 0x2000}},
+		{Timestamp: 7, EventType: EventTypeGoExit, Goroutine: 9, Attributes: [5]uint64{9}},
+		{Timestamp: 8, EventType: EventTypeCasGStatus, Goroutine: 7, Attributes: [5]uint64{2, 4, 9}},
+		{Timestamp: 9, EventType: EventTypeCasGStatus, Goroutine: 7, Attributes: [5]uint64{4, 0x1001, 9}},
+	}
+	if err := store.WriteBatch(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		view, columns string
+		expected      [][]any
+	}{
+		{
+			view:    "v_allocations",
+			columns: "timestamp, goroutine, allocation, kind_name, elem_size, len, cap, key_size, key_kind_name, hint, bytes",
+			expected: [][]any{
+				{int64(1), int64(7), "slice", KindInt64.String(), int64(8), int64(10), int64(16), nil, nil, nil, int64(128)},
+				{int64(2), int64(7), "map", KindStruct.String(), int64(32), nil, nil, int64(16), KindString.String(), int64(100), nil},
+				{int64(3), int64(8), "object", KindStruct.String(), int64(48), nil, nil, nil, nil, nil, int64(48)},
+				{int64(4), int64(8), "string", "string", int64(1), int64(12), int64(12), nil, nil, nil, int64(12)},
+				{int64(5), int64(8), "string", "string", int64(1), int64(12), int64(12), nil, nil, nil, int64(0)},
+			},
+		},
+		{
+			view:    "v_goroutine_lifecycle",
+			columns: "timestamp, event, goroutine, creator_goroutine, start_pc, go_pc",
+			expected: [][]any{
+				{int64(6), "create", int64(9), int64(7), int64(0x1000), int64(0x2000)},
+				{int64(7), "exit", int64(9), nil, nil, nil},
+			},
+		},
+		{
+			view:    "v_state_changes",
+			columns: "timestamp, goroutine, by_goroutine, old_status_name, new_status_name",
+			expected: [][]any{
+				{int64(8), int64(9), int64(7), "running", "waiting"},
+				{int64(9), int64(9), int64(7), "waiting", "scanrunnable"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.view, func(t *testing.T) {
+			rows, err := store.db.Query("SELECT " + tt.columns + " FROM " + tt.view + " ORDER BY timestamp")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+
+			var result [][]any
+			for rows.Next() {
+				row := make([]any, len(tt.expected[0]))
+				ptrs := make([]any, len(row))
+				for i := range row {
+					ptrs[i] = &row[i]
+				}
+				if err := rows.Scan(ptrs...); err != nil {
+					t.Fatal(err)
+				}
+				for i, v := range row {
+					if b, ok := v.([]byte); ok {
+						row[i] = string(b)
+					}
+				}
+				result = append(result, row)
+			}
+			if err := rows.Err(); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("rows = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
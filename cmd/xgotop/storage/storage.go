@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -19,23 +20,287 @@ const (
 	EventTypeNewObject    EventType = 3
 	EventTypeNewGoroutine EventType = 4
 	EventTypeGoExit       EventType = 5
+	EventTypeSemaBlock    EventType = 6
+	EventTypeTimerCreate  EventType = 7
+	EventTypeTimerStop    EventType = 8
+	EventTypeIfaceConv    EventType = 9
+	EventTypeStringAlloc  EventType = 10
+	EventTypeSchedStats   EventType = 11
+	EventTypeNewM         EventType = 12
+	EventTypeMExit        EventType = 13
+	EventTypeGCAssist     EventType = 14
+	EventTypeGCMarkWorker EventType = 15
+	EventTypeMarker       EventType = 16
+	EventTypeUSDT         EventType = 17
+	// EventTypeAllocSummary events are synthesized by xgotop from the
+	// allocation events, they are never sent by the eBPF programs.
+	EventTypeAllocSummary EventType = 18
 )
 
+var eventTypeNames = map[EventType]string{
+	EventTypeCasGStatus:   "casgstatus",
+	EventTypeMakeSlice:    "makeslice",
+	EventTypeMakeMap:      "makemap",
+	EventTypeNewObject:    "newobject",
+	EventTypeNewGoroutine: "newgoroutine",
+	EventTypeGoExit:       "goexit",
+	EventTypeSemaBlock:    "semablock",
+	EventTypeTimerCreate:  "timercreate",
+	EventTypeTimerStop:    "timerstop",
+	EventTypeIfaceConv:    "ifaceconv",
+	EventTypeStringAlloc:  "stringalloc",
+	EventTypeSchedStats:   "schedstats",
+	EventTypeNewM:         "newm",
+	EventTypeMExit:        "mexit",
+	EventTypeGCAssist:     "gcassist",
+	EventTypeGCMarkWorker: "gcmarkworker",
+	EventTypeMarker:       "marker",
+	EventTypeUSDT:         "usdt",
+	EventTypeAllocSummary: "allocsummary",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", uint64(t))
+}
+
+// ParseEventType returns the event type named name, see EventType.String.
+func ParseEventType(name string) (EventType, bool) {
+	for t, n := range eventTypeNames {
+		if n == name {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
 type Event struct {
 	Timestamp       uint64    `json:"timestamp"`
 	EventType       EventType `json:"event_type"`
 	Goroutine       uint32    `json:"goroutine"`
 	ParentGoroutine uint32    `json:"parent_goroutine"`
 	Attributes      [5]uint64 `json:"attributes"`
+
+	// Thread is the ID of the OS thread the event happened on. It is only
+	// captured with the full event detail level.
+	Thread uint32 `json:"thread,omitempty"`
+
+	// P is the ID of the P the event happened on. It is only captured with
+	// the full event detail level, and nil if the thread held no P or the
+	// event was not emitted from Go code, like schedstats and usdt events.
+	P *uint32 `json:"p,omitempty"`
 }
 
+// EventDetail is the amount of data captured for every event of a session.
+type EventDetail string
+
+const (
+	// EventDetailMinimal events only carry a timestamp, event type and
+	// goroutine, except for the events of flagged goroutines, which are
+	// captured in full detail.
+	EventDetailMinimal EventDetail = "minimal"
+	// EventDetailStandard events carry all attributes of their event type.
+	EventDetailStandard EventDetail = "standard"
+	// EventDetailFull events additionally carry the IDs of the OS thread and
+	// the P the event happened on.
+	EventDetailFull EventDetail = "full"
+)
+
 type Session struct {
-	ID         string     `json:"id"`
-	StartTime  time.Time  `json:"start_time"`
-	EndTime    *time.Time `json:"end_time,omitempty"`
-	PID        int        `json:"pid,omitempty"`
-	BinaryPath string     `json:"binary_path"`
-	EventCount int64      `json:"event_count"`
+	ID         string       `json:"id"`
+	StartTime  time.Time    `json:"start_time"`
+	EndTime    *time.Time   `json:"end_time,omitempty"`
+	PID        int          `json:"pid,omitempty"`
+	BinaryPath string       `json:"binary_path"`
+	EventCount int64        `json:"event_count"`
+	Loss       []LossBucket `json:"loss,omitempty"`
+
+	// Annotations mark intervals of the timeline, such as the anomalies of
+	// the pipeline metrics detected during the capture.
+	Annotations []Annotation `json:"annotations,omitempty"`
+
+	// Baseline is the ID of the session the capture was compared with, see
+	// AnnotationBaselineDivergence.
+	Baseline string `json:"baseline,omitempty"`
+
+	// EventDetail is empty for sessions recorded before detail levels
+	// existed, which used the standard level.
+	EventDetail EventDetail `json:"event_detail,omitempty"`
+
+	// USDTProbes lists the USDT probes attached during the session. The
+	// first attribute of USDT events is the ID of the probe.
+	USDTProbes []USDTProbe `json:"usdt_probes,omitempty"`
+
+	// Probes reports how attaching the uprobe at every runtime function
+	// went, to tell why a session lacks the events of a probe.
+	Probes []ProbeStatus `json:"probes,omitempty"`
+
+	// Transforms are the -transform stages the events went through before
+	// being stored, see package transform.
+	Transforms []string `json:"transforms,omitempty"`
+
+	// Routes maps the names of the event types that were stored in other
+	// formats than the session's default format to their format. Events
+	// routed to the memory format are lost once xgotop exits.
+	Routes map[string]string `json:"routes,omitempty"`
+
+	// ImportedFrom is the path of the event file the session was imported
+	// from. It is empty for captured sessions.
+	ImportedFrom string `json:"imported_from,omitempty"`
+
+	// Sanitized is set on the copies of the session shared with their
+	// identifying metadata sanitized, see SanitizeSession.
+	Sanitized SanitizeMode `json:"sanitized,omitempty"`
+
+	// Functions maps the PCs recorded by newgoroutine events to the names of
+	// their functions in the traced program, so goroutines can be identified
+	// across sessions and builds.
+	Functions map[uint64]string `json:"functions,omitempty"`
+
+	// Clock relates the event timestamps to the wall clock of the capturing
+	// host. It is nil for imported sessions.
+	Clock *ClockSync `json:"clock,omitempty"`
+
+	// Labels are the key=value pairs given with -label, e.g. the service
+	// the session was captured from.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Notes and Journal are the investigation notes of the session, which
+	// are stored apart from its metadata, see SessionNotes. They are only
+	// set on the sessions served by the API.
+	Notes   string      `json:"notes,omitempty"`
+	Journal []NoteEntry `json:"journal,omitempty"`
+
+	// Namespace is the tenant the session belongs to, see WithNamespaces.
+	// Sessions without namespace are in DefaultNamespace.
+	Namespace string `json:"namespace,omitempty"`
+
+	// SnapshotOf is the ID of the session a snapshot was taken from. It is
+	// empty for captured sessions.
+	SnapshotOf string `json:"snapshot_of,omitempty"`
+	// Immutable sessions cannot be deleted.
+	Immutable bool `json:"immutable,omitempty"`
+
+	// TransferGaps lists the batches of the agent that the collector that
+	// stored the session never received, as the agent dropped them before
+	// pushing them or the collector lost them.
+	TransferGaps []BatchGap `json:"transfer_gaps,omitempty"`
+
+	// Sampling records the sampling rates the events were captured with,
+	// including the rates adjusted during the capture, and the flagged
+	// goroutines. It is nil for sessions captured unsampled.
+	Sampling *SamplingManifest `json:"sampling,omitempty"`
+
+	// LoadShedding lists the actions xgotop took during the capture to stay
+	// below its -memory-limit, in order.
+	LoadShedding []ShedAction `json:"load_shedding,omitempty"`
+
+	// LifecycleEvents counts the events of the lifecycle log, which holds
+	// all lifecycle events even if they were sampled. It is zero for sessions
+	// without lifecycle log.
+	LifecycleEvents int64 `json:"lifecycle_events,omitempty"`
+
+	// Termination is recorded when the capture ends. It is nil for sessions
+	// still being captured and for sessions that were not captured.
+	Termination *Termination `json:"termination,omitempty"`
+}
+
+// BatchGap is a range of pushed batches that never reached the collector.
+type BatchGap struct {
+	FromSeq uint64 `json:"from_seq"`
+	ToSeq   uint64 `json:"to_seq"`
+}
+
+// USDTProbe is a USDT probe compiled into the traced program.
+type USDTProbe struct {
+	ID       uint32 `json:"id"`
+	Provider string `json:"provider"`
+	Name     string `json:"name"`
+}
+
+// ProbeStatus is the outcome of attaching the uprobe at a runtime function.
+type ProbeStatus struct {
+	Symbol string `json:"symbol"`
+	// Optional probes may fail to attach without stopping the capture, e.g.
+	// because their function is inlined in the traced binary
+	Optional bool `json:"optional,omitempty"`
+	// Address of the symbol in the traced binary, zero if it was not found
+	Address  uint64 `json:"address,omitempty"`
+	Attached bool   `json:"attached"`
+	// AttachNanos is how long attaching took
+	AttachNanos int64  `json:"attach_ns"`
+	Error       string `json:"error,omitempty"`
+
+	// DelayNanos is how long attaching the probe waited after the previous
+	// one, see -attach-order and -attach-stagger
+	DelayNanos int64 `json:"delay_ns,omitempty"`
+	// Pending probes were still waiting for their delay when the probes were
+	// recorded, e.g. when the capture stopped
+	Pending bool `json:"pending,omitempty"`
+	// AttachedAt is the timestamp the probe was attached at, and
+	// FirstEventAt the timestamp of its first event, both on the clock of
+	// the event timestamps and zero if there was none
+	AttachedAt   uint64 `json:"attached_at,omitempty"`
+	FirstEventAt uint64 `json:"first_event_at,omitempty"`
+}
+
+// LossBucket counts the events lost during one stats interval of a capture,
+// split by where in the pipeline they were lost. Intervals without any loss
+// are not recorded.
+type LossBucket struct {
+	Time time.Time `json:"time"`
+	// Kernel counts events dropped by the eBPF programs because the ring
+	// buffer was full.
+	Kernel uint64 `json:"kernel"`
+	// Userspace counts events that were read but could not be decoded or
+	// written to storage.
+	Userspace uint64 `json:"userspace"`
+	// Shutdown counts events left unread in the ring buffer when the capture
+	// was stopped.
+	Shutdown uint64 `json:"shutdown"`
+	// Paused counts events discarded while the capture was paused because
+	// the disk was almost full.
+	Paused uint64 `json:"paused,omitempty"`
+	// Shed counts events discarded because xgotop exceeded its memory limit
+	// and shrank its event queue, see ShedShrinkBuffers.
+	Shed uint64 `json:"shed,omitempty"`
+}
+
+// Total returns the number of events lost in the bucket.
+func (b LossBucket) Total() uint64 {
+	return b.Kernel + b.Userspace + b.Shutdown + b.Paused + b.Shed
+}
+
+// ShedActionKind is a way of shedding the load of the capture.
+type ShedActionKind string
+
+const (
+	// ShedRaiseSampling halves the sampling rates of the frequent event
+	// types.
+	ShedRaiseSampling ShedActionKind = "raise-sampling"
+	// ShedShrinkBuffers halves the number of events queued for processing.
+	// Events read while the queue is full are discarded.
+	ShedShrinkBuffers ShedActionKind = "shrink-buffers"
+	// ShedDropCasGStatus stops capturing casgstatus events, usually the
+	// most frequent event type.
+	ShedDropCasGStatus ShedActionKind = "drop-casgstatus"
+)
+
+// ShedAction is an action xgotop took because its memory usage exceeded its
+// -memory-limit.
+type ShedAction struct {
+	Time time.Time `json:"time"`
+	// Timestamp is the time of the action on the clock of the event
+	// timestamps.
+	Timestamp uint64         `json:"timestamp"`
+	Kind      ShedActionKind `json:"kind"`
+	Detail    string         `json:"detail"`
+	// RSSBytes and HeapBytes are the memory usage of xgotop that triggered
+	// the action.
+	RSSBytes  uint64 `json:"rss_bytes"`
+	HeapBytes uint64 `json:"heap_bytes"`
 }
 
 type EventFilter struct {
@@ -47,10 +312,44 @@ type EventFilter struct {
 	Offset    int
 }
 
+// Matches reports whether event satisfies the goroutine, event type and time
+// range constraints of the filter. Limit and Offset are not considered.
+func (f *EventFilter) Matches(event *Event) bool {
+	if f == nil {
+		return true
+	}
+	if f.Goroutine != nil && event.Goroutine != *f.Goroutine {
+		return false
+	}
+	if f.EventType != nil && event.EventType != *f.EventType {
+		return false
+	}
+	if f.StartTime != nil && event.Timestamp < *f.StartTime {
+		return false
+	}
+	if f.EndTime != nil && event.Timestamp > *f.EndTime {
+		return false
+	}
+	return true
+}
+
+// ScanFunc is called for every stored event in storage order. The cursor is
+// the zero-based position of the event in the session, which can be used to
+// resume a scan later. Returning ErrStopScan ends the scan without error.
+type ScanFunc func(cursor int64, event *Event) error
+
+// ErrStopScan can be returned by a ScanFunc to stop scanning early.
+var ErrStopScan = errors.New("stop scan")
+
 type EventStore interface {
 	WriteEvent(event *Event) error
-	WriteBatch(events []*Event) error
+	// WriteBatch stops writing once ctx is done. The events written before
+	// are kept, so a cancelled batch may be partially stored.
+	WriteBatch(ctx context.Context, events []*Event) error
 	ReadEvents(ctx context.Context, filter *EventFilter) ([]*Event, error)
+	// ScanEvents streams all events starting at fromCursor to fn without
+	// loading the whole session into memory.
+	ScanEvents(ctx context.Context, fromCursor int64, fn ScanFunc) error
 	GetGoroutines(ctx context.Context) ([]uint32, error)
 	Close() error
 	GetSession() *Session
@@ -66,14 +365,14 @@ type SessionStore interface {
 	io.Closer
 }
 
-func saveSessionMetadata(sessionDir string, session *Session) error {
+func saveSessionMetadata(sessionDir string, session *Session, perms Permissions) error {
 	metadataPath := filepath.Join(sessionDir, "metadata.json")
 	data, err := json.MarshalIndent(session, "", "  ")
 	if err != nil {
 		return fmt.Errorf("marshal session metadata: %w", err)
 	}
 
-	if err := os.WriteFile(metadataPath, data, 0644); err != nil {
+	if err := perms.writeFile(metadataPath, data); err != nil {
 		return fmt.Errorf("write session metadata: %w", err)
 	}
 
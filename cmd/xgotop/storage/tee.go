@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultTeeQueueSize is the number of batches a TeeStore queues per
+// secondary sink unless told otherwise.
+const DefaultTeeQueueSize = 256
+
+const (
+	// teeEventBatchSize is the number of events written one by one that a
+	// TeeStore buffers into a single batch for the secondary sinks, and
+	// teeFlushInterval is how long it buffers them at most.
+	teeEventBatchSize = 256
+	teeFlushInterval  = time.Second
+)
+
+// TeeSink is a secondary store written by a TeeStore.
+type TeeSink struct {
+	// Name identifies the sink in its stats, e.g. its storage directory
+	Name  string
+	Store EventStore
+}
+
+// SinkStats are the write statistics of a secondary sink of a TeeStore.
+type SinkStats struct {
+	Name string `json:"name"`
+	// Queued is the number of events waiting to be written to the sink
+	Queued  int64  `json:"queued"`
+	Written uint64 `json:"written"`
+	// Failed counts the events the sink returned an error for
+	Failed uint64 `json:"failed"`
+	// Dropped counts the events discarded because the queue of the sink was
+	// full
+	Dropped uint64 `json:"dropped"`
+	// LagNs is the time the last written batch waited in the queue and took
+	// to be written
+	LagNs     int64  `json:"lag_ns"`
+	LastError string `json:"last_error,omitempty"`
+	// Health is the connection state of remote sinks
+	Health *SinkHealth `json:"health,omitempty"`
+}
+
+type teeBatch struct {
+	events   []*Event
+	enqueued time.Time
+}
+
+type teeSink struct {
+	name  string
+	store EventStore
+	queue chan teeBatch
+	done  chan struct{}
+
+	queued  atomic.Int64
+	written atomic.Uint64
+	failed  atomic.Uint64
+	dropped atomic.Uint64
+	lagNs   atomic.Int64
+
+	errMu   sync.Mutex
+	lastErr string
+}
+
+// TeeStore writes every event to a primary store and any number of
+// secondary sinks, e.g. a local store for durability and a remote one for
+// central analysis. The primary is written synchronously and serves all
+// reads. Every secondary sink has its own queue and writer goroutine, so a
+// slow or failing sink neither stalls nor fails the primary; its errors and
+// lag are reported by SinkStats instead.
+type TeeStore struct {
+	primary EventStore
+	sinks   []*teeSink
+
+	// pending are the events of WriteEvent not queued for the sinks yet,
+	// flushTimer queues them once they waited for teeFlushInterval
+	pendingMu  sync.Mutex
+	pending    []*Event
+	flushTimer *time.Timer
+	closed     bool
+}
+
+// NewTeeStore creates a TeeStore queueing at most queueSize batches per
+// secondary sink. Batches that do not fit into a full queue are dropped for
+// that sink.
+func NewTeeStore(primary EventStore, secondaries []TeeSink, queueSize int) *TeeStore {
+	if queueSize <= 0 {
+		queueSize = DefaultTeeQueueSize
+	}
+
+	s := &TeeStore{primary: primary}
+	for _, secondary := range secondaries {
+		sink := &teeSink{
+			name:  secondary.Name,
+			store: secondary.Store,
+			queue: make(chan teeBatch, queueSize),
+			done:  make(chan struct{}),
+		}
+		s.sinks = append(s.sinks, sink)
+		go sink.run()
+	}
+
+	return s
+}
+
+func (k *teeSink) run() {
+	defer close(k.done)
+
+	for batch := range k.queue {
+		// The batch was accepted by the primary, so it is written even if the
+		// caller gave up since
+		err := k.store.WriteBatch(context.Background(), batch.events)
+		k.queued.Add(-int64(len(batch.events)))
+		k.lagNs.Store(time.Since(batch.enqueued).Nanoseconds())
+		if err != nil {
+			k.failed.Add(uint64(len(batch.events)))
+			k.setError(err)
+			continue
+		}
+		k.written.Add(uint64(len(batch.events)))
+	}
+}
+
+func (k *teeSink) setError(err error) {
+	k.errMu.Lock()
+	k.lastErr = err.Error()
+	k.errMu.Unlock()
+}
+
+func (k *teeSink) enqueue(events []*Event) {
+	select {
+	case k.queue <- teeBatch{events: events, enqueued: time.Now()}:
+		k.queued.Add(int64(len(events)))
+	default:
+		k.dropped.Add(uint64(len(events)))
+	}
+}
+
+// WriteEvent writes event to the primary. Once the primary accepted it, it
+// is buffered with the events written after it, to queue them as a single
+// batch for the secondary sinks.
+func (s *TeeStore) WriteEvent(event *Event) error {
+	if err := s.primary.WriteEvent(event); err != nil {
+		return err
+	}
+	if len(s.sinks) == 0 {
+		return nil
+	}
+
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+
+	s.pending = append(s.pending, event)
+	if len(s.pending) >= teeEventBatchSize {
+		s.flushLocked()
+	} else if s.flushTimer == nil {
+		s.flushTimer = time.AfterFunc(teeFlushInterval, s.flush)
+	}
+	return nil
+}
+
+// WriteBatch writes events to the primary and, once the primary accepted
+// them, queues them for the secondary sinks. Only errors of the primary are
+// returned.
+func (s *TeeStore) WriteBatch(ctx context.Context, events []*Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := s.primary.WriteBatch(ctx, events); err != nil {
+		return err
+	}
+	if len(s.sinks) == 0 {
+		return nil
+	}
+
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+
+	// The buffered events were written before the batch
+	s.flushLocked()
+	// Callers reuse the batch slice once WriteBatch returns
+	queued := append([]*Event(nil), events...)
+	for _, sink := range s.sinks {
+		sink.enqueue(queued)
+	}
+	return nil
+}
+
+func (s *TeeStore) flush() {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+
+	if !s.closed {
+		s.flushLocked()
+	}
+}
+
+// flushLocked queues the buffered events for the secondary sinks.
+func (s *TeeStore) flushLocked() {
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+		s.flushTimer = nil
+	}
+	if len(s.pending) == 0 {
+		return
+	}
+	for _, sink := range s.sinks {
+		sink.enqueue(s.pending)
+	}
+	s.pending = nil
+}
+
+// SinkStats returns the statistics of every secondary sink.
+func (s *TeeStore) SinkStats() []SinkStats {
+	stats := make([]SinkStats, len(s.sinks))
+	for i, sink := range s.sinks {
+		sink.errMu.Lock()
+		lastErr := sink.lastErr
+		sink.errMu.Unlock()
+
+		stats[i] = SinkStats{
+			Name:      sink.name,
+			Queued:    sink.queued.Load(),
+			Written:   sink.written.Load(),
+			Failed:    sink.failed.Load(),
+			Dropped:   sink.dropped.Load(),
+			LagNs:     sink.lagNs.Load(),
+			LastError: lastErr,
+		}
+		if reporter, ok := sink.store.(HealthReporter); ok {
+			health := reporter.Health()
+			stats[i].Health = &health
+		}
+	}
+	return stats
+}
+
+func (s *TeeStore) ReadEvents(ctx context.Context, filter *EventFilter) ([]*Event, error) {
+	return s.primary.ReadEvents(ctx, filter)
+}
+
+func (s *TeeStore) ScanEvents(ctx context.Context, fromCursor int64, fn ScanFunc) error {
+	return s.primary.ScanEvents(ctx, fromCursor, fn)
+}
+
+func (s *TeeStore) GetGoroutines(ctx context.Context) ([]uint32, error) {
+	return s.primary.GetGoroutines(ctx)
+}
+
+// Close waits until the queued batches are written to the secondary sinks
+// and closes all stores. Errors of the secondary sinks are returned too.
+func (s *TeeStore) Close() error {
+	s.pendingMu.Lock()
+	s.flushLocked()
+	s.closed = true
+	s.pendingMu.Unlock()
+
+	errs := []error{s.primary.Close()}
+	for _, sink := range s.sinks {
+		close(sink.queue)
+		<-sink.done
+		if err := sink.store.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close sink %s: %w", sink.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *TeeStore) GetSession() *Session {
+	return s.primary.GetSession()
+}
+
+// UpdateSession updates the session of all stores. Errors of the secondary
+// sinks are only reported by SinkStats.
+func (s *TeeStore) UpdateSession(session *Session) error {
+	for _, sink := range s.sinks {
+		if err := sink.store.UpdateSession(session); err != nil {
+			sink.setError(err)
+		}
+	}
+	return s.primary.UpdateSession(session)
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// batchRecorder records the sizes of the batches written to a store.
+type batchRecorder struct {
+	EventStore
+	mu      sync.Mutex
+	batches []int
+}
+
+func (s *batchRecorder) WriteBatch(ctx context.Context, events []*Event) error {
+	s.mu.Lock()
+	s.batches = append(s.batches, len(events))
+	s.mu.Unlock()
+	return s.EventStore.WriteBatch(ctx, events)
+}
+
+// failingStore rejects every write.
+type failingStore struct {
+	EventStore
+}
+
+var errWriteRejected = errors.New("write rejected")
+
+func (s failingStore) WriteEvent(*Event) error {
+	return errWriteRejected
+}
+
+func (s failingStore) WriteBatch(context.Context, []*Event) error {
+	return errWriteRejected
+}
+
+func TestTeeStoreFailedPrimary(t *testing.T) {
+	session := &Session{ID: "tee"}
+	sink := &batchRecorder{EventStore: NewMemoryStore(session, 0)}
+	store := NewTeeStore(failingStore{NewMemoryStore(session, 0)}, []TeeSink{{Name: "sink", Store: sink}}, 0)
+
+	if err := store.WriteEvent(&Event{Timestamp: 1}); !errors.Is(err, errWriteRejected) {
+		t.Errorf("WriteEvent() error = %v, want %v", err, errWriteRejected)
+	}
+	if err := store.WriteBatch(context.Background(), []*Event{{Timestamp: 2}}); !errors.Is(err, errWriteRejected) {
+		t.Errorf("WriteBatch() error = %v, want %v", err, errWriteRejected)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.batches) != 0 {
+		t.Errorf("sink got batches %v of events the primary rejected", sink.batches)
+	}
+	if stats := store.SinkStats()[0]; stats.Written != 0 || stats.Dropped != 0 {
+		t.Errorf("sink stats = %+v, want nothing written or dropped", stats)
+	}
+}
+
+func TestTeeStoreBatchesEvents(t *testing.T) {
+	ctx := context.Background()
+	session := &Session{ID: "tee"}
+	primary := NewMemoryStore(session, 0)
+	sink := &batchRecorder{EventStore: NewMemoryStore(session, 0)}
+	store := NewTeeStore(primary, []TeeSink{{Name: "sink", Store: sink}}, 0)
+
+	var ts uint64
+	write := func(n int) {
+		for range n {
+			ts++
+			if err := store.WriteEvent(&Event{Timestamp: ts}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// A full buffer, buffered events flushed ahead of a batch, and buffered
+	// events flushed on close
+	write(teeEventBatchSize + 2)
+	ts++
+	if err := store.WriteBatch(ctx, []*Event{{Timestamp: ts}}); err != nil {
+		t.Fatal(err)
+	}
+	write(3)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []int{teeEventBatchSize, 2, 1, 3}
+	if len(sink.batches) != len(want) {
+		t.Fatalf("sink batches = %v, want %v", sink.batches, want)
+	}
+	for i := range want {
+		if sink.batches[i] != want[i] {
+			t.Fatalf("sink batches = %v, want %v", sink.batches, want)
+		}
+	}
+
+	var last uint64
+	err := sink.ScanEvents(ctx, 0, func(cursor int64, event *Event) error {
+		if event.Timestamp != last+1 {
+			t.Errorf("sink event %d has timestamp %d, want %d", cursor, event.Timestamp, last+1)
+		}
+		last = event.Timestamp
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != ts {
+		t.Errorf("sink has events up to %d, want %d", last, ts)
+	}
+}
@@ -0,0 +1,72 @@
+package storage
+
+import "time"
+
+// TerminationReason is why a capture ended.
+type TerminationReason string
+
+const (
+	// TerminationSignal is an interrupt or SIGTERM.
+	TerminationSignal TerminationReason = "signal"
+	// TerminationDuration is the end of -duration.
+	TerminationDuration TerminationReason = "duration"
+	// TerminationMaxEvents is reaching -max-events.
+	TerminationMaxEvents TerminationReason = "max-events"
+	// TerminationTargetExit is the exit of the process given with -pid.
+	TerminationTargetExit TerminationReason = "target-exit"
+	// TerminationError is an error that made continuing the capture
+	// impossible.
+	TerminationError TerminationReason = "error"
+)
+
+// Termination reports how and why a capture ended, so every session tells
+// whether it is complete.
+type Termination struct {
+	Reason TerminationReason `json:"reason"`
+	// Detail is e.g. the signal or the error that ended the capture
+	Detail string    `json:"detail,omitempty"`
+	Time   time.Time `json:"time"`
+
+	// Drops are the losses of the whole session
+	Drops LossTotals `json:"drops"`
+	// Queues are the depths of the pipeline queues when the capture was
+	// stopped, which were drained before the session ended
+	Queues QueueDepths `json:"queues"`
+	// StorageBytes is the size of the session files in the storage directory
+	StorageBytes int64 `json:"storage_bytes"`
+}
+
+// LossTotals sums the lost events of a session by cause, see LossBucket.
+type LossTotals struct {
+	Kernel    uint64 `json:"kernel"`
+	Userspace uint64 `json:"userspace"`
+	Shutdown  uint64 `json:"shutdown"`
+	Paused    uint64 `json:"paused"`
+	Shed      uint64 `json:"shed"`
+}
+
+// SumLosses sums buckets by cause.
+func SumLosses(buckets []LossBucket) LossTotals {
+	var totals LossTotals
+	for _, b := range buckets {
+		totals.Kernel += b.Kernel
+		totals.Userspace += b.Userspace
+		totals.Shutdown += b.Shutdown
+		totals.Paused += b.Paused
+		totals.Shed += b.Shed
+	}
+	return totals
+}
+
+// QueueDepths are the depths of the queues of the capture pipeline.
+type QueueDepths struct {
+	// RingbufUnread counts the events left unread in the ring buffer, which
+	// are lost
+	RingbufUnread int `json:"ringbuf_unread"`
+	// Events counts the events read and waiting to be processed
+	Events int64 `json:"events"`
+	// WriteBatches counts the batches waiting for the storage writer
+	WriteBatches int64 `json:"write_batches"`
+	// Sinks maps the -storage-tee and -push-url sinks to their queued events
+	Sinks map[string]int64 `json:"sinks,omitempty"`
+}
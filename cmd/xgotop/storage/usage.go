@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+// SessionUsage is the disk space taken by the files of a single session.
+type SessionUsage struct {
+	ID    string `json:"id"`
+	Bytes int64  `json:"bytes"`
+}
+
+// Usage is the disk space taken by all sessions of a Manager.
+type Usage struct {
+	// Sessions are ordered by size, largest first.
+	Sessions   []SessionUsage `json:"sessions"`
+	TotalBytes int64          `json:"total_bytes"`
+	// FreeBytes is the space left for unprivileged users on the file system
+	// of the storage directory.
+	FreeBytes uint64 `json:"free_bytes"`
+}
+
+// Usage reports the on-disk size of every session and the free space left.
+func (m *Manager) Usage(ctx context.Context) (*Usage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entries, err := os.ReadDir(m.baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("read directory: %w", err)
+	}
+
+	usage := &Usage{Sessions: []SessionUsage{}}
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !entry.IsDir() {
+			continue
+		}
+		if checkScope(ctx, filepath.Join(m.baseDir, entry.Name())) != nil {
+			continue
+		}
+
+		size, err := dirSize(ctx, filepath.Join(m.baseDir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("size of session %s: %w", entry.Name(), err)
+		}
+
+		usage.Sessions = append(usage.Sessions, SessionUsage{ID: entry.Name(), Bytes: size})
+		usage.TotalBytes += size
+	}
+
+	sort.Slice(usage.Sessions, func(i, j int) bool {
+		return usage.Sessions[i].Bytes > usage.Sessions[j].Bytes
+	})
+
+	usage.FreeBytes, err = FreeSpace(m.baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+// SessionBytes returns the on-disk size of the files of session id.
+func (m *Manager) SessionBytes(id string) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return dirSize(context.Background(), filepath.Join(m.baseDir, id))
+}
+
+// FreeSpace returns the number of bytes available to unprivileged users on
+// the file system holding path.
+func FreeSpace(path string) (uint64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, fmt.Errorf("statfs %s: %w", path, err)
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+func dirSize(ctx context.Context, dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// viewSettingsFile is the name of the file holding the view settings in a
+// session directory.
+const viewSettingsFile = "view.json"
+
+// LaneGrouping selects how the goroutine lanes of the timeline are grouped.
+type LaneGrouping string
+
+const (
+	// LaneGroupingNone shows every goroutine in its own lane.
+	LaneGroupingNone LaneGrouping = ""
+	// LaneGroupingCreator groups the goroutines by the function that
+	// created them.
+	LaneGroupingCreator LaneGrouping = "creator"
+)
+
+// ViewSettings is the state of an investigation of a session in the web UI.
+// It is stored in the session directory, so that every session keeps its own
+// settings. Colors override the ones of the global config.
+type ViewSettings struct {
+	LaneGrouping     LaneGrouping      `json:"lane_grouping"`
+	PinnedGoroutines []uint32          `json:"pinned_goroutines"`
+	StateColors      map[string]string `json:"state_colors,omitempty"`
+	TypeColors       map[string]string `json:"type_colors,omitempty"`
+	// GoroutineColors maps goroutine IDs to the color of their lane.
+	GoroutineColors map[string]string `json:"goroutine_colors,omitempty"`
+}
+
+// Validate checks that the settings can be applied by the web UI.
+func (v *ViewSettings) Validate() error {
+	switch v.LaneGrouping {
+	case LaneGroupingNone, LaneGroupingCreator:
+	default:
+		return fmt.Errorf("unknown lane grouping %q", v.LaneGrouping)
+	}
+	return nil
+}
+
+// GetViewSettings returns the view settings saved for the session, or empty
+// settings if none were saved yet.
+func (m *Manager) GetViewSettings(ctx context.Context, id string) (*ViewSettings, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sessionDir := filepath.Join(m.baseDir, id)
+	if session, err := loadSessionMetadata(sessionDir); err != nil {
+		return nil, err
+	} else if !inScope(ctx, session) {
+		return nil, ErrNoSession
+	}
+
+	settings := &ViewSettings{PinnedGoroutines: []uint32{}}
+
+	data, err := os.ReadFile(filepath.Join(sessionDir, viewSettingsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return settings, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read view settings: %w", err)
+	}
+
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, fmt.Errorf("unmarshal view settings: %w", err)
+	}
+
+	return settings, nil
+}
+
+// SaveViewSettings replaces the view settings of the session.
+func (m *Manager) SaveViewSettings(ctx context.Context, id string, settings *ViewSettings) error {
+	if m.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sessionDir := filepath.Join(m.baseDir, id)
+	if session, err := loadSessionMetadata(sessionDir); err != nil {
+		return err
+	} else if !inScope(ctx, session) {
+		return ErrNoSession
+	}
+
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal view settings: %w", err)
+	}
+
+	// Write to a temporary file first so that a crash cannot leave truncated
+	// settings behind
+	path := filepath.Join(sessionDir, viewSettingsFile)
+	if err := m.opts.Permissions.writeFile(path+".tmp", data); err != nil {
+		return fmt.Errorf("write view settings: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("write view settings: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"debug/elf"
+	"debug/gosym"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// symbolizer resolves the PCs recorded by newgoroutine events to function
+// names using the pclntab of the traced binary, and remembers every resolved
+// PC so that the names can be stored with the session.
+type symbolizer struct {
+	table *gosym.Table
+	// bias is the load address of position independent executables
+	bias uint64
+
+	mu        sync.Mutex
+	functions map[uint64]string
+}
+
+// newSymbolizer reads the function table of the Go binary at path. If pid is
+// set and the binary is position independent, PCs are translated using its
+// load address in that process.
+func newSymbolizer(path string, pid int) (*symbolizer, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pclntab := f.Section(".gopclntab")
+	text := f.Section(".text")
+	if pclntab == nil || text == nil {
+		return nil, fmt.Errorf("%s has no Go function table", path)
+	}
+	pclndata, err := pclntab.Data()
+	if err != nil {
+		return nil, fmt.Errorf("read .gopclntab: %w", err)
+	}
+	var symdata []byte
+	if symtab := f.Section(".gosymtab"); symtab != nil {
+		symdata, err = symtab.Data()
+		if err != nil {
+			return nil, fmt.Errorf("read .gosymtab: %w", err)
+		}
+	}
+
+	table, err := gosym.NewTable(symdata, gosym.NewLineTable(pclndata, text.Addr))
+	if err != nil {
+		return nil, fmt.Errorf("parse function table: %w", err)
+	}
+
+	s := &symbolizer{table: table, functions: make(map[uint64]string)}
+	if f.Type == elf.ET_DYN && pid != 0 {
+		s.bias, err = loadBias(path, pid)
+		if err != nil {
+			return nil, fmt.Errorf("find load address: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+// loadBias returns the address the position independent executable at path
+// is mapped at in process pid.
+func loadBias(path string, pid int) (uint64, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return 0, err
+	}
+
+	mapsFile, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer mapsFile.Close()
+
+	scanner := bufio.NewScanner(mapsFile)
+	for scanner.Scan() {
+		// address perms offset dev inode path
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[2] != "00000000" || fields[5] != resolved {
+			continue
+		}
+		start, _, _ := strings.Cut(fields[0], "-")
+		return strconv.ParseUint(start, 16, 64)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("%s is not mapped in process %d", resolved, pid)
+}
+
+// observe resolves the PCs of newgoroutine events.
+func (s *symbolizer) observe(event *runtimeEvent) {
+	if storage.EventType(event.EventType) != storage.EventTypeNewGoroutine {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, pc := range event.Attributes[2:4] {
+		if _, ok := s.functions[pc]; ok || pc == 0 {
+			continue
+		}
+		// Unknown PCs are remembered too, so they are only looked up once
+		var name string
+		if fn := s.table.PCToFunc(pc - s.bias); fn != nil {
+			name = fn.Name
+		}
+		s.functions[pc] = name
+	}
+}
+
+// resolved returns the names of all PCs resolved so far.
+func (s *symbolizer) resolved() map[uint64]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	functions := make(map[uint64]string, len(s.functions))
+	for pc, name := range s.functions {
+		if name != "" {
+			functions[pc] = name
+		}
+	}
+	return functions
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// teeTarget is a storage directory every session is mirrored to.
+type teeTarget struct {
+	dir    string
+	format string
+}
+
+// parseTeeTargets parses the -storage-tee flag, a comma separated list of
+// dir[:format] entries. Entries without a format use defaultFormat.
+func parseTeeTargets(spec, defaultFormat string) ([]teeTarget, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	var targets []teeTarget
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		target := teeTarget{dir: entry, format: defaultFormat}
+		if i := strings.LastIndex(entry, ":"); i >= 0 {
+			target.dir, target.format = entry[:i], strings.ToLower(entry[i+1:])
+			if !storageFormats[target.format] {
+				return nil, fmt.Errorf("unknown storage format %q in %q", target.format, entry)
+			}
+		}
+		if target.dir == "" {
+			return nil, fmt.Errorf("missing directory in %q", entry)
+		}
+		if seen[target.dir] {
+			return nil, fmt.Errorf("directory %s is given twice", target.dir)
+		}
+		seen[target.dir] = true
+
+		targets = append(targets, target)
+	}
+
+	return targets, nil
+}
+
+// createTeeStore mirrors the session written to primary into every target
+// and the already created extra sinks. Each sink is written by its own
+// writer, so a slow or failing sink does not affect primary.
+func createTeeStore(ctx context.Context, primary storage.EventStore, session *storage.Session, targets []teeTarget, extra []storage.TeeSink, opts storage.Options, queueSize int) (*storage.TeeStore, error) {
+	sinks := extra
+	closeSinks := func() {
+		for _, sink := range sinks {
+			sink.Store.Close()
+		}
+	}
+
+	for _, target := range targets {
+		manager, err := storage.NewManagerWithOptions(target.dir, opts)
+		if err != nil {
+			closeSinks()
+			return nil, fmt.Errorf("create storage manager for %s: %w", target.dir, err)
+		}
+
+		store, err := manager.CreateSession(ctx, session, target.format)
+		if err != nil {
+			closeSinks()
+			return nil, fmt.Errorf("create %s store in %s: %w", target.format, target.dir, err)
+		}
+
+		sinks = append(sinks, storage.TeeSink{Name: target.dir, Store: store})
+	}
+
+	return storage.NewTeeStore(primary, sinks, queueSize), nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"go.sazak.io/xgotop/cmd/xgotop/api"
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// tenancyConfig is the content of the -tenancy file, e.g.
+//
+//	{
+//	  "namespaces": {
+//	    "payments": {"quota": "20GB", "retention": "168h"},
+//	    "search": {}
+//	  },
+//	  "tokens": [
+//	    {"token": "...", "namespaces": ["payments"]},
+//	    {"token": "...", "namespaces": ["payments", "search"], "admin": true}
+//	  ]
+//	}
+type tenancyConfig struct {
+	Namespaces map[string]namespaceConfig `json:"namespaces"`
+	Tokens     []tokenConfig              `json:"tokens"`
+}
+
+type namespaceConfig struct {
+	// Quota limits the total size of the sessions of the namespace, e.g.
+	// "20GB", see -storage-quota
+	Quota string `json:"quota,omitempty"`
+	// Retention is how long the sessions of the namespace are kept after
+	// they ended, e.g. "168h"
+	Retention string `json:"retention,omitempty"`
+}
+
+type tokenConfig struct {
+	Token      string   `json:"token"`
+	Namespaces []string `json:"namespaces"`
+	// Admin grants access to the endpoints of the whole server, see
+	// api.TenantToken
+	Admin bool `json:"admin,omitempty"`
+}
+
+// tenancy is the parsed -tenancy file.
+type tenancy struct {
+	tokens     []api.TenantToken
+	quotas     []storage.Quota
+	retentions []storage.Retention
+}
+
+// loadTenancy reads the -tenancy file at path. It returns nil if path is
+// empty.
+func loadTenancy(path string) (*tenancy, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read tenancy file: %w", err)
+	}
+	return parseTenancy(data)
+}
+
+func parseTenancy(data []byte) (*tenancy, error) {
+	var config tenancyConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parse tenancy file: %w", err)
+	}
+	if len(config.Tokens) == 0 {
+		return nil, fmt.Errorf("tenancy file has no tokens")
+	}
+
+	t := &tenancy{}
+	for _, name := range slices.Sorted(maps.Keys(config.Namespaces)) {
+		if err := storage.ValidateNamespace(name); err != nil {
+			return nil, err
+		}
+
+		namespace := config.Namespaces[name]
+		if namespace.Quota != "" {
+			size, err := parseByteSize(namespace.Quota)
+			if err != nil {
+				return nil, fmt.Errorf("quota of namespace %s: %w", name, err)
+			}
+			t.quotas = append(t.quotas, storage.Quota{Namespace: name, MaxBytes: int64(size)})
+		}
+		if namespace.Retention != "" {
+			maxAge, err := time.ParseDuration(namespace.Retention)
+			if err != nil || maxAge <= 0 {
+				return nil, fmt.Errorf("invalid retention of namespace %s: %s", name, namespace.Retention)
+			}
+			t.retentions = append(t.retentions, storage.Retention{Namespace: name, MaxAge: maxAge})
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, token := range config.Tokens {
+		if strings.TrimSpace(token.Token) == "" {
+			return nil, fmt.Errorf("token %d is empty", i)
+		}
+		if seen[token.Token] {
+			return nil, fmt.Errorf("token %d is a duplicate", i)
+		}
+		seen[token.Token] = true
+
+		if len(token.Namespaces) == 0 {
+			return nil, fmt.Errorf("token %d has no namespaces", i)
+		}
+		for _, name := range token.Namespaces {
+			if _, ok := config.Namespaces[name]; !ok {
+				return nil, fmt.Errorf("token %d: undeclared namespace %q", i, name)
+			}
+		}
+		t.tokens = append(t.tokens, api.TenantToken{Token: token.Token, Namespaces: token.Namespaces, Admin: token.Admin})
+	}
+
+	return t, nil
+}
+
+// readPushToken returns the token in the -push-token-file at path, or an
+// empty token if path is empty.
+func readPushToken(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read push token: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("push token file %s is empty", path)
+	}
+	return token, nil
+}
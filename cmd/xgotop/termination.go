@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// targetCheckInterval is the interval of checking whether the -pid process
+// is still running.
+const targetCheckInterval = time.Second
+
+// captureStopper stops the capture for the first reason that comes up, and
+// records it for the termination report of the session.
+type captureStopper struct {
+	once sync.Once
+	// done is closed once the capture is to be stopped
+	done chan struct{}
+
+	mu     sync.Mutex
+	reason storage.TerminationReason
+	detail string
+	time   time.Time
+	queues storage.QueueDepths
+}
+
+func newCaptureStopper() *captureStopper {
+	return &captureStopper{done: make(chan struct{})}
+}
+
+// stop stops the capture for reason. Only the first call has an effect.
+func (s *captureStopper) stop(reason storage.TerminationReason, detail string) {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.reason, s.detail, s.time = reason, detail, time.Now()
+		s.mu.Unlock()
+
+		log.Printf("[Main] Stopping capture: %s (%s)", reason, detail)
+		close(s.done)
+	})
+}
+
+// setQueues records the queue depths at the time the capture was stopped.
+func (s *captureStopper) setQueues(queues storage.QueueDepths) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queues = queues
+}
+
+// report returns the termination report of a session with the given losses
+// and size.
+func (s *captureStopper) report(losses []storage.LossBucket, storageBytes int64) *storage.Termination {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return &storage.Termination{
+		Reason:       s.reason,
+		Detail:       s.detail,
+		Time:         s.time,
+		Drops:        storage.SumLosses(losses),
+		Queues:       s.queues,
+		StorageBytes: storageBytes,
+	}
+}
+
+// watchTarget stops the capture once process pid exits, or ctx is done.
+func watchTarget(ctx context.Context, pid int, stop *captureStopper) {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		log.Printf("Warning: the exit of PID %d will not stop the capture: %v", pid, err)
+		return
+	}
+
+	ticker := time.NewTicker(targetCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := proc.Signal(syscall.Signal(0)); errors.Is(err, os.ErrProcessDone) {
+				stop.stop(storage.TerminationTargetExit, fmt.Sprintf("PID %d exited", pid))
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Package transform runs the events of a capture through transformation
+// stages between decoding and storage, e.g. to hash sensitive attribute
+// values or to drop events.
+//
+// Stages are registered by name and configured with the -transform flag.
+// Besides the built-in stages, Go plugins loaded with -transform-plugin can
+// register stages from their init functions:
+//
+//	func init() {
+//		transform.Register("my-stage", func(config string) (transform.Stage, error) {
+//			return &myStage{}, nil
+//		})
+//	}
+package transform
+
+import (
+	"fmt"
+	"plugin"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// Stage transforms the events between decoding and storage.
+type Stage interface {
+	// Transform is called with every batch of events, concurrently by all
+	// processing workers. It may modify the events, and returns the events
+	// to keep, which may reuse the backing array of events.
+	Transform(events []*storage.Event) []*storage.Event
+}
+
+// Factory creates a stage from the configuration given after the name of
+// the stage, which is empty if none was given.
+type Factory func(config string) (Stage, error)
+
+var (
+	factoriesMu sync.Mutex
+	factories   = make(map[string]Factory)
+)
+
+// Register makes a stage available under name. It panics if the name is
+// already registered.
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("transform: stage %s registered twice", name))
+	}
+	factories[name] = factory
+}
+
+// Names lists the registered stages in alphabetical order.
+func Names() []string {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadPlugin opens the Go plugin at path, which registers its stages when
+// its init functions run. The plugin must be built with the same Go version
+// and dependencies as xgotop.
+func LoadPlugin(path string) error {
+	if _, err := plugin.Open(path); err != nil {
+		return fmt.Errorf("load transform plugin %s: %w", path, err)
+	}
+	return nil
+}
+
+// Pipeline runs the events through its stages in order. A nil pipeline
+// keeps all events unchanged.
+type Pipeline struct {
+	stages []Stage
+	specs  []string
+}
+
+// Parse creates the pipeline of specs like
+// "hash:newobject=1,drop:casgstatus", comma separated name[:config] stages.
+func Parse(specs string) (*Pipeline, error) {
+	p := &Pipeline{}
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		name, config, _ := strings.Cut(spec, ":")
+
+		factoriesMu.Lock()
+		factory, ok := factories[name]
+		factoriesMu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown transform stage %q, known stages are %s", name, strings.Join(Names(), ", "))
+		}
+
+		stage, err := factory(config)
+		if err != nil {
+			return nil, fmt.Errorf("transform stage %s: %w", spec, err)
+		}
+		p.stages = append(p.stages, stage)
+		p.specs = append(p.specs, spec)
+	}
+	return p, nil
+}
+
+// Specs returns the specs of the stages, as recorded in the session.
+func (p *Pipeline) Specs() []string {
+	if p == nil {
+		return nil
+	}
+	return p.specs
+}
+
+// Transform runs events through all stages.
+func (p *Pipeline) Transform(events []*storage.Event) []*storage.Event {
+	if p == nil {
+		return events
+	}
+	for _, stage := range p.stages {
+		if len(events) == 0 {
+			break
+		}
+		events = stage.Transform(events)
+	}
+	return events
+}
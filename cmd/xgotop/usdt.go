@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// usdtMaxArgs mirrors USDT_MAX_ARGS in xgotop.h
+const usdtMaxArgs = 4
+
+// Argument locations, as defined by enum usdt_arg_type in xgotop.h
+const (
+	usdtArgConst    = 0
+	usdtArgReg      = 1
+	usdtArgRegDeref = 2
+)
+
+// usdtArgSpec mirrors usdt_arg_spec_t in xgotop.h
+type usdtArgSpec struct {
+	ValOff      uint64
+	ArgType     uint32
+	RegOff      int16
+	ArgSigned   uint8
+	ArgBitshift int8
+}
+
+// usdtSpec mirrors usdt_spec_t in xgotop.h
+type usdtSpec struct {
+	ProbeID uint32
+	NArgs   uint32
+	Args    [usdtMaxArgs]usdtArgSpec
+}
+
+// usdtLocation is a single location of a USDT probe in an ELF file. A probe
+// can be compiled into several locations.
+type usdtLocation struct {
+	Path     string
+	Provider string
+	Name     string
+	// Offset is the file offset of the probe instruction
+	Offset uint64
+	// Semaphore is the file offset of the probe's semaphore, 0 if it has none
+	Semaphore uint64
+	Args      []usdtArgSpec
+}
+
+// Offsets of the registers in struct pt_regs, by the names used in USDT
+// argument specs
+var usdtRegisterOffsets = map[string]map[string]int16{
+	"amd64": {
+		"rip": 128,
+		"rax": 80, "eax": 80, "ax": 80, "al": 80,
+		"rbx": 40, "ebx": 40, "bx": 40, "bl": 40,
+		"rcx": 88, "ecx": 88, "cx": 88, "cl": 88,
+		"rdx": 96, "edx": 96, "dx": 96, "dl": 96,
+		"rsi": 104, "esi": 104, "si": 104, "sil": 104,
+		"rdi": 112, "edi": 112, "di": 112, "dil": 112,
+		"rbp": 32, "ebp": 32, "bp": 32, "bpl": 32,
+		"rsp": 152, "esp": 152, "sp": 152, "spl": 152,
+		"r8": 72, "r8d": 72, "r8w": 72, "r8b": 72,
+		"r9": 64, "r9d": 64, "r9w": 64, "r9b": 64,
+		"r10": 56, "r10d": 56, "r10w": 56, "r10b": 56,
+		"r11": 48, "r11d": 48, "r11w": 48, "r11b": 48,
+		"r12": 24, "r12d": 24, "r12w": 24, "r12b": 24,
+		"r13": 16, "r13d": 16, "r13w": 16, "r13b": 16,
+		"r14": 8, "r14d": 8, "r14w": 8, "r14b": 8,
+		"r15": 0, "r15d": 0, "r15w": 0, "r15b": 0,
+	},
+	"arm64": arm64RegisterOffsets(),
+}
+
+func arm64RegisterOffsets() map[string]int16 {
+	offsets := map[string]int16{"sp": 248}
+	for i := range 31 {
+		offsets["x"+strconv.Itoa(i)] = int16(i * 8)
+		offsets["w"+strconv.Itoa(i)] = int16(i * 8)
+	}
+	return offsets
+}
+
+var (
+	// 8@$5, 8@%rdi, -4@-8(%rbp)
+	usdtArgConstAmd64 = regexp.MustCompile(`^(-?\d+)@\$(-?\d+)$`)
+	usdtArgRegAmd64   = regexp.MustCompile(`^(-?\d+)@%(\w+)$`)
+	usdtArgDerefAmd64 = regexp.MustCompile(`^(-?\d+)@(-?\d*)\(%(\w+)\)$`)
+
+	// 8@5, 8@x0, -4@[sp, 12]
+	usdtArgConstArm64 = regexp.MustCompile(`^(-?\d+)@(-?\d+)$`)
+	usdtArgRegArm64   = regexp.MustCompile(`^(-?\d+)@(\w+)$`)
+	usdtArgDerefArm64 = regexp.MustCompile(`^(-?\d+)@\[\s*(\w+)\s*(?:,\s*(-?\d+)\s*)?\]$`)
+)
+
+// parseUSDTArg parses a single USDT argument spec of the given architecture,
+// as found in the .note.stapsdt section.
+func parseUSDTArg(arch, arg string) (usdtArgSpec, error) {
+	registers, ok := usdtRegisterOffsets[arch]
+	if !ok {
+		return usdtArgSpec{}, fmt.Errorf("unsupported architecture %s", arch)
+	}
+
+	var spec usdtArgSpec
+	var size, reg, off string
+
+	switch arch {
+	case "amd64":
+		if m := usdtArgConstAmd64.FindStringSubmatch(arg); m != nil {
+			spec.ArgType, size, off = usdtArgConst, m[1], m[2]
+		} else if m := usdtArgRegAmd64.FindStringSubmatch(arg); m != nil {
+			spec.ArgType, size, reg = usdtArgReg, m[1], m[2]
+		} else if m := usdtArgDerefAmd64.FindStringSubmatch(arg); m != nil {
+			spec.ArgType, size, off, reg = usdtArgRegDeref, m[1], m[2], m[3]
+		}
+	case "arm64":
+		if m := usdtArgDerefArm64.FindStringSubmatch(arg); m != nil {
+			spec.ArgType, size, reg, off = usdtArgRegDeref, m[1], m[2], m[3]
+		} else if m := usdtArgConstArm64.FindStringSubmatch(arg); m != nil {
+			spec.ArgType, size, off = usdtArgConst, m[1], m[2]
+		} else if m := usdtArgRegArm64.FindStringSubmatch(arg); m != nil {
+			spec.ArgType, size, reg = usdtArgReg, m[1], m[2]
+		}
+	}
+	if size == "" {
+		return usdtArgSpec{}, fmt.Errorf("unsupported argument %q", arg)
+	}
+
+	n, err := strconv.Atoi(size)
+	if err != nil {
+		return usdtArgSpec{}, fmt.Errorf("parse size of argument %q: %w", arg, err)
+	}
+	if n < 0 {
+		spec.ArgSigned = 1
+		n = -n
+	}
+	switch n {
+	case 1, 2, 4, 8:
+		spec.ArgBitshift = int8(64 - n*8)
+	default:
+		return usdtArgSpec{}, fmt.Errorf("invalid size of argument %q", arg)
+	}
+
+	if off != "" {
+		v, err := strconv.ParseInt(off, 10, 64)
+		if err != nil {
+			return usdtArgSpec{}, fmt.Errorf("parse offset of argument %q: %w", arg, err)
+		}
+		spec.ValOff = uint64(v)
+	}
+
+	if reg != "" {
+		regOff, ok := registers[reg]
+		if !ok {
+			return usdtArgSpec{}, fmt.Errorf("unknown register in argument %q", arg)
+		}
+		spec.RegOff = regOff
+	}
+
+	return spec, nil
+}
+
+// readUSDTLocations returns the USDT probe locations declared in the
+// .note.stapsdt section of the ELF file at path.
+func readUSDTLocations(path string) ([]usdtLocation, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open elf: %w", err)
+	}
+	defer f.Close()
+
+	notes := f.Section(".note.stapsdt")
+	if notes == nil {
+		return nil, nil
+	}
+	data, err := notes.Data()
+	if err != nil {
+		return nil, fmt.Errorf("read notes: %w", err)
+	}
+
+	// The addresses in the notes are relative to .stapsdt.base at link time,
+	// which moves if the file was prelinked
+	var baseAddr uint64
+	if base := f.Section(".stapsdt.base"); base != nil {
+		baseAddr = base.Addr
+	}
+
+	var locations []usdtLocation
+	for len(data) >= 12 {
+		nameSize := f.ByteOrder.Uint32(data[0:4])
+		descSize := f.ByteOrder.Uint32(data[4:8])
+		noteType := f.ByteOrder.Uint32(data[8:12])
+		data = data[12:]
+
+		nameEnd := align4(nameSize)
+		descEnd := nameEnd + align4(descSize)
+		if uint64(len(data)) < descEnd {
+			return nil, errors.New("truncated note")
+		}
+		name := data[:nameSize]
+		desc := data[nameEnd : nameEnd+uint64(descSize)]
+		data = data[descEnd:]
+
+		if noteType != 3 || string(bytes.TrimRight(name, "\x00")) != "stapsdt" || len(desc) < 24 {
+			continue
+		}
+
+		pc := f.ByteOrder.Uint64(desc[0:8])
+		noteBase := f.ByteOrder.Uint64(desc[8:16])
+		semaphore := f.ByteOrder.Uint64(desc[16:24])
+		strs := strings.Split(string(desc[24:]), "\x00")
+		if len(strs) < 3 {
+			continue
+		}
+
+		if baseAddr != 0 && noteBase != 0 {
+			pc += baseAddr - noteBase
+		}
+
+		location := usdtLocation{Path: path, Provider: strs[0], Name: strs[1]}
+
+		location.Offset, err = vaddrToFileOffset(f, pc)
+		if err != nil {
+			return nil, fmt.Errorf("probe %s:%s: %w", location.Provider, location.Name, err)
+		}
+
+		if semaphore != 0 {
+			location.Semaphore, err = semaphoreFileOffset(f, semaphore)
+			if err != nil {
+				return nil, fmt.Errorf("probe %s:%s: %w", location.Provider, location.Name, err)
+			}
+		}
+
+		for _, arg := range strings.Fields(strs[2]) {
+			spec, err := parseUSDTArg(runtime.GOARCH, arg)
+			if err != nil {
+				return nil, fmt.Errorf("probe %s:%s: %w", location.Provider, location.Name, err)
+			}
+			location.Args = append(location.Args, spec)
+		}
+
+		locations = append(locations, location)
+	}
+
+	return locations, nil
+}
+
+func align4(n uint32) uint64 {
+	return (uint64(n) + 3) &^ 3
+}
+
+// vaddrToFileOffset translates a virtual address in an executable segment
+// to the file offset expected by uprobes.
+func vaddrToFileOffset(f *elf.File, addr uint64) (uint64, error) {
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Flags&elf.PF_X == 0 {
+			continue
+		}
+		if addr >= prog.Vaddr && addr < prog.Vaddr+prog.Memsz {
+			return addr - prog.Vaddr + prog.Off, nil
+		}
+	}
+	return 0, fmt.Errorf("address 0x%x is not in an executable segment", addr)
+}
+
+// semaphoreFileOffset translates the virtual address of a USDT semaphore to
+// the file offset expected as the uprobe reference counter offset.
+func semaphoreFileOffset(f *elf.File, addr uint64) (uint64, error) {
+	for _, sec := range f.Sections {
+		if sec.Type == elf.SHT_NOBITS || addr < sec.Addr || addr >= sec.Addr+sec.Size {
+			continue
+		}
+		return addr - sec.Addr + sec.Offset, nil
+	}
+	return 0, fmt.Errorf("semaphore address 0x%x is not in any section", addr)
+}
+
+// discoverUSDTLocations returns the USDT probe locations in executablePath
+// and, if pid is set, in the shared objects the process has mapped, such as
+// the libraries generated at runtime by libstapsdt. Only probes matching one
+// of the provider:name patterns are returned.
+func discoverUSDTLocations(executablePath string, pid int, patterns []string) ([]usdtLocation, error) {
+	paths := []string{executablePath}
+	if pid != 0 {
+		libs, err := mappedFiles(pid)
+		if err != nil {
+			return nil, err
+		}
+		for _, lib := range libs {
+			if lib != executablePath {
+				paths = append(paths, lib)
+			}
+		}
+	}
+
+	var matched []usdtLocation
+	for _, p := range paths {
+		locations, err := readUSDTLocations(p)
+		if err != nil {
+			if p == executablePath {
+				return nil, err
+			}
+			// Mapped files are not necessarily ELF files
+			continue
+		}
+
+		for _, location := range locations {
+			if matchUSDTProbe(patterns, location.Provider, location.Name) {
+				matched = append(matched, location)
+			}
+		}
+	}
+
+	return matched, nil
+}
+
+func matchUSDTProbe(patterns []string, provider, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, provider+":"+name); ok {
+			return true
+		}
+		// A bare provider pattern matches all of its probes
+		if ok, _ := path.Match(pattern, provider); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// mappedFiles returns the files mapped into the memory of the process pid.
+func mappedFiles(pid int) ([]string, error) {
+	maps, err := os.ReadFile(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return nil, fmt.Errorf("read memory maps: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	var files []string
+	scanner := bufio.NewScanner(bytes.NewReader(maps))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || !strings.HasPrefix(fields[5], "/") || seen[fields[5]] {
+			continue
+		}
+		seen[fields[5]] = true
+		files = append(files, fields[5])
+	}
+
+	return files, scanner.Err()
+}
+
+// usdtProbeIDs assigns an ID to every distinct probe of locations, in order
+// of appearance, and returns the probe list recorded with the session.
+func usdtProbeIDs(locations []usdtLocation) (map[[2]string]uint32, []storage.USDTProbe) {
+	ids := make(map[[2]string]uint32)
+	var probes []storage.USDTProbe
+	for _, location := range locations {
+		key := [2]string{location.Provider, location.Name}
+		if _, ok := ids[key]; ok {
+			continue
+		}
+		id := uint32(len(probes))
+		ids[key] = id
+		probes = append(probes, storage.USDTProbe{ID: id, Provider: location.Provider, Name: location.Name})
+	}
+	return ids, probes
+}
+
+// newUSDTSpec builds the spec the BPF program uses to read the arguments at
+// location. Arguments beyond usdtMaxArgs are not captured.
+func newUSDTSpec(probeID uint32, location usdtLocation) usdtSpec {
+	spec := usdtSpec{ProbeID: probeID}
+	for i, arg := range location.Args {
+		if i == usdtMaxArgs {
+			break
+		}
+		spec.Args[i] = arg
+		spec.NArgs++
+	}
+	return spec
+}
+
+// attachUSDTProbes attaches the USDT program to every location of the probes
+// matching patterns and returns the attached links and the probe list.
+func attachUSDTProbes(objs *ebpfObjects, executablePath string, pid int, patterns []string, pinPath string) ([]link.Link, []storage.USDTProbe, error) {
+	locations, err := discoverUSDTLocations(executablePath, pid, patterns)
+	if err != nil {
+		return nil, nil, fmt.Errorf("discover probes: %w", err)
+	}
+
+	ids, probes := usdtProbeIDs(locations)
+	executables := make(map[string]*link.Executable)
+
+	var links []link.Link
+	closeAll := func() {
+		for _, l := range links {
+			l.Close()
+		}
+	}
+
+	for i, location := range locations {
+		cookie := uint64(i)
+		spec := newUSDTSpec(ids[[2]string{location.Provider, location.Name}], location)
+		if err := objs.UsdtSpecs.Update(&cookie, &spec, ebpf.UpdateAny); err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("update spec of %s:%s: %w", location.Provider, location.Name, err)
+		}
+
+		ex, ok := executables[location.Path]
+		if !ok {
+			ex, err = link.OpenExecutable(location.Path)
+			if err != nil {
+				closeAll()
+				return nil, nil, fmt.Errorf("open %s: %w", location.Path, err)
+			}
+			executables[location.Path] = ex
+		}
+
+		opts := &link.UprobeOptions{
+			Address:      location.Offset,
+			RefCtrOffset: location.Semaphore,
+			Cookie:       cookie,
+			PID:          pid,
+		}
+		symbol := fmt.Sprintf("usdt_%s_%s_%d", location.Provider, location.Name, i)
+		l, err := attachUprobe(ex, symbol, objs.UprobeUsdt, opts, pinPath)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("attach %s:%s: %w", location.Provider, location.Name, err)
+		}
+		links = append(links, l)
+	}
+
+	return links, probes, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// storageWriter writes the batches of the processing workers to storage on a
+// goroutine of its own, so slow fsyncs or a stalling storage backend do not
+// hold up event decoding. The queue is bounded: once it is full, enqueue
+// blocks, and the backpressure ends up in the ring buffer where dropped
+// events are counted as losses.
+type storageWriter struct {
+	store     storage.EventStore
+	losses    *lossTracker
+	broadcast func([]*storage.Event)
+
+	queue chan []*storage.Event
+	done  chan struct{}
+	depth atomic.Int64
+}
+
+// newStorageWriter starts a writer with room for queueSize batches. If
+// broadcast is set, it is called with every batch after it is written.
+func newStorageWriter(store storage.EventStore, queueSize int, losses *lossTracker, broadcast func([]*storage.Event)) *storageWriter {
+	w := &storageWriter{
+		store:     store,
+		losses:    losses,
+		broadcast: broadcast,
+		queue:     make(chan []*storage.Event, queueSize),
+		done:      make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *storageWriter) run() {
+	defer close(w.done)
+
+	for batch := range w.queue {
+		// Captured events are written even while the capture shuts down
+		if err := w.store.WriteBatch(context.Background(), batch); err != nil {
+			log.Printf("[Writer] Failed to write batch to storage: %v", err)
+			w.losses.addUserspace(uint64(len(batch)))
+		}
+		if w.broadcast != nil {
+			w.broadcast(batch)
+		}
+		w.depth.Add(-1)
+	}
+}
+
+// enqueue hands batch over to the writer. The caller must not modify batch
+// afterwards.
+func (w *storageWriter) enqueue(batch []*storage.Event) {
+	w.depth.Add(1)
+	w.queue <- batch
+}
+
+// queueDepth returns the number of batches waiting to be written.
+func (w *storageWriter) queueDepth() int64 {
+	return w.depth.Load()
+}
+
+// close waits until all queued batches are written.
+func (w *storageWriter) close() {
+	close(w.queue)
+	<-w.done
+}
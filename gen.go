@@ -1,3 +1,4 @@
 package main
 
-//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -type go_runtime_event_t -target ${GOARCH} -output-dir cmd/xgotop ebpf xgotop.bpf.c
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -type go_runtime_event_t -target amd64,arm64 -output-dir cmd/xgotop ebpf xgotop.bpf.c
+//go:generate sh -c "cd cmd/xgotop && sha256sum ebpf_x86_bpfel.o ebpf_arm64_bpfel.o > ebpf.sha256sums"
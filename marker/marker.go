@@ -0,0 +1,27 @@
+// Package marker lets a program traced by xgotop mark the beginning and end
+// of its own operations, such as handling a request. xgotop records the
+// calls as marker events of the calling goroutine and reports the latency
+// between matching Begin and End calls.
+//
+// The functions do nothing and cost a function call when xgotop is not
+// attached.
+package marker
+
+// Begin marks the start of an operation identified by id on the calling
+// goroutine.
+//
+//go:noinline
+func Begin(id uint64) {
+	sink = id
+}
+
+// End marks the end of the operation identified by id on the calling
+// goroutine.
+//
+//go:noinline
+func End(id uint64) {
+	sink = id
+}
+
+// sink keeps the compiler from treating the calls as dead code.
+var sink uint64
@@ -8,7 +8,7 @@ import { SettingsModal } from './components/SettingsModal';
 import { useEventStore } from './store/eventStore';
 import { WebSocketClient } from './services/websocket';
 
-const WS_URL = import.meta.env.VITE_WS_URL || 'ws://localhost:8080/ws';
+const WS_URL = import.meta.env.VITE_WS_URL || 'ws://localhost:8080/ws?backfill_seconds=30';
 
 function App() {
   const { addEvent, setConnected } = useEventStore();
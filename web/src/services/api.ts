@@ -1,4 +1,4 @@
-import type { Event, Session, TimelineConfig } from '../types/event';
+import type { Event, Session, SessionViewSettings, TimelineConfig } from '../types/event';
 
 const API_BASE_URL = import.meta.env.VITE_API_URL || 'http://localhost:8080/api';
 
@@ -82,6 +82,28 @@ export class APIClient {
     }
     return response.json();
   }
+
+  async getSessionConfig(sessionId: string): Promise<SessionViewSettings> {
+    const response = await fetch(`${this.baseUrl}/sessions/${sessionId}/config`);
+    if (!response.ok) {
+      throw new Error(`Failed to fetch session config: ${response.statusText}`);
+    }
+    return response.json();
+  }
+
+  async updateSessionConfig(sessionId: string, settings: SessionViewSettings): Promise<SessionViewSettings> {
+    const response = await fetch(`${this.baseUrl}/sessions/${sessionId}/config`, {
+      method: 'PUT',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify(settings),
+    });
+    if (!response.ok) {
+      throw new Error(`Failed to update session config: ${response.statusText}`);
+    }
+    return response.json();
+  }
 }
 
 export const apiClient = new APIClient();
@@ -4,6 +4,8 @@ export interface Event {
   goroutine: number;
   parent_goroutine: number;
   attributes: [number, number, number, number, number];
+  thread?: number;
+  p?: number;
 }
 
 export interface Session {
@@ -13,6 +15,19 @@ export interface Session {
   pid?: number;
   binary_path: string;
   event_count: number;
+  event_detail?: 'minimal' | 'standard' | 'full';
+  usdt_probes?: { id: number; provider: string; name: string }[];
+  imported_from?: string;
+  notes?: string;
+  journal?: SessionNoteEntry[];
+}
+
+// Timestamped entry of the investigation journal of a session
+export interface SessionNoteEntry {
+  id: number;
+  time: string;
+  timestamp?: number;
+  text: string;
 }
 
 export interface TimelineConfig {
@@ -21,6 +36,15 @@ export interface TimelineConfig {
   type_colors: Record<string, string>;
 }
 
+// Per-session view settings, colors override the global TimelineConfig
+export interface SessionViewSettings {
+  lane_grouping: '' | 'creator';
+  pinned_goroutines: number[];
+  state_colors?: Record<string, string>;
+  type_colors?: Record<string, string>;
+  goroutine_colors?: Record<string, string>;
+}
+
 export const EventType = {
   CasGStatus: 0,
   MakeSlice: 1,
@@ -28,6 +52,19 @@ export const EventType = {
   NewObject: 3,
   NewGoroutine: 4,
   GoExit: 5,
+  SemaBlock: 6,
+  TimerCreate: 7,
+  TimerStop: 8,
+  IfaceConv: 9,
+  StringAlloc: 10,
+  SchedStats: 11,
+  NewM: 12,
+  MExit: 13,
+  GCAssist: 14,
+  GCMarkWorker: 15,
+  Marker: 16,
+  USDT: 17,
+  AllocSummary: 18,
 } as const;
 
 export interface GoroutineState {
@@ -5,6 +5,7 @@ SEC("uprobe/runtime.casgstatus")
 int BPF_KPROBE(uprobe_casgstatus, const void *gp, const u32 oldval, const u32 newval) {
     u64 probe_start_ns = bpf_ktime_get_ns();
     u64 _ret, gp_id, g_id, g_parent_id;
+    u8 gp_waitreason;
     struct go_runtime_g g;
 
     _ret = bpf_probe_read(&g, sizeof(g), gp);
@@ -14,6 +15,7 @@ int BPF_KPROBE(uprobe_casgstatus, const void *gp, const u32 oldval, const u32 ne
     }
 
     gp_id = g.goid;
+    gp_waitreason = g.waitreason;
 
 #ifdef BPF_DEBUG
     bpf_printk("casgstatus: goid=%llu, oldval=%u, newval=%u", g.goid, oldval, newval);
@@ -49,12 +51,34 @@ int BPF_KPROBE(uprobe_casgstatus, const void *gp, const u32 oldval, const u32 ne
         }
     }
 
-    u64 *callerg_id = bpf_map_lookup_elem(&goroutines_in_creation, &g_id);
-    if (callerg_id != NULL) {
+    sema_wait_t *sema = bpf_map_lookup_elem(&sema_waits, &gp_id);
+    if (sema != NULL) {
+        if (oldval == G_STATUS_RUNNING && newval == G_STATUS_WAITING) {
+            // semacquire1 only parks if the semaphore is not available. Any other
+            // park means the semaphore was acquired without blocking.
+            if (gp_waitreason == sema->reason) {
+                sema->parked_ns = probe_start_ns;
+            } else {
+                bpf_map_delete_elem(&sema_waits, &gp_id);
+            }
+        } else if (oldval == G_STATUS_WAITING && newval == G_STATUS_RUNNABLE) {
+            if (sema->parked_ns != 0) {
+                // gp is the blocked goroutine, g is the one releasing the semaphore
+                SEND_EVENT_WITH_SAMPLING(GO_RUNTIME_EVENT_TYPE_SEMA_BLOCK, gp_id, 0,
+                                         probe_start_ns - sema->parked_ns, sema->addr,
+                                         sema->reason, g_id, 0, probe_start_ns);
+            }
+            bpf_map_delete_elem(&sema_waits, &gp_id);
+        }
+    }
+
+    goroutine_creation_t *creation = bpf_map_lookup_elem(&goroutines_in_creation, &g_id);
+    if (creation != NULL) {
         // This function is called inside the newproc1 function, so we need to send an event for the
         // caller. We cannot use a uretprobe on newproc1 so we're using this trick!
-        SEND_EVENT_WITH_SAMPLING(GO_RUNTIME_EVENT_TYPE_NEWGOROUTINE, g_id, g_parent_id, *callerg_id,
-                                 gp_id, 0, 0, 0, probe_start_ns);
+        SEND_EVENT_WITH_SAMPLING(GO_RUNTIME_EVENT_TYPE_NEWGOROUTINE, g_id, g_parent_id,
+                                 creation->callerg_id, gp_id, creation->start_pc,
+                                 creation->caller_pc, 0, probe_start_ns);
         _ret = bpf_map_delete_elem(&goroutines_in_creation, &g_id);
         if (_ret < 0) {
             bpf_printk("Failed to delete goroutines_in_creation, ret=%d", _ret);
@@ -185,9 +209,17 @@ int BPF_KPROBE(uprobe_makemap, const void *typ, const u64 hint, const void *m) {
 
 // func newproc1(fn *funcval, callergp *g, callerpc uintptr, parked bool, waitreason waitReason) *g
 SEC("uprobe/runtime.newproc1")
-int BPF_KPROBE(uprobe_newproc1, const void *__skip_fn, const void *callergp) {
-    u64 _ret, goid, callergoid;
+int BPF_KPROBE(uprobe_newproc1, const void *fn, const void *callergp, const u64 callerpc) {
+    u64 _ret, goid;
     struct go_runtime_g g;
+    goroutine_creation_t creation = {.caller_pc = callerpc};
+
+    // funcval starts with the entry PC of the function
+    _ret = bpf_probe_read(&creation.start_pc, sizeof(creation.start_pc), fn);
+    if (_ret < 0) {
+        bpf_printk("newproc1: failed to read fn, ret=%d, fn=%p", _ret, fn);
+        return 0;
+    }
 
     _ret = bpf_probe_read(&g, sizeof(g), callergp);
     if (_ret < 0) {
@@ -195,7 +227,7 @@ int BPF_KPROBE(uprobe_newproc1, const void *__skip_fn, const void *callergp) {
         return 0;
     }
 
-    callergoid = g.goid;
+    creation.callerg_id = g.goid;
 
     _ret = get_go_g_struct(ctx, &g);
     if (_ret < 0) {
@@ -206,11 +238,11 @@ int BPF_KPROBE(uprobe_newproc1, const void *__skip_fn, const void *callergp) {
     goid = g.goid;
 
 #ifdef BPF_DEBUG
-    bpf_printk("newproc1: callerg.id=%llu, callerg.parent.id=%llu", callergoid, g.parentGoid);
+    bpf_printk("newproc1: callerg.id=%llu, callerg.parent.id=%llu", creation.callerg_id, g.parentGoid);
     bpf_printk("newproc1: g.id=%llu, g.parent.id=%llu", goid, g.parentGoid);
 #endif
 
-    _ret = bpf_map_update_elem(&goroutines_in_creation, &goid, &callergoid, BPF_ANY);
+    _ret = bpf_map_update_elem(&goroutines_in_creation, &goid, &creation, BPF_ANY);
     if (_ret < 0) {
         bpf_printk("newproc1: failed to update goroutines_in_creation, ret=%d", _ret);
         return 0;
@@ -244,3 +276,610 @@ int BPF_KPROBE(uprobe_goexit1) {
 
     return 0;
 }
+
+// func semacquire1(addr *uint32, lifo bool, profile semaProfileFlags, skipframes int, reason
+// waitReason)
+SEC("uprobe/runtime.semacquire1")
+int BPF_KPROBE(uprobe_semacquire1, const void *addr, const u64 __skip_lifo,
+               const u64 __skip_profile, const u64 __skip_skipframes, const u64 reason) {
+    u64 _ret;
+
+    struct go_runtime_g g;
+    _ret = get_go_g_struct(ctx, &g);
+    if (_ret < 0) {
+        bpf_printk("semacquire1: failed to read g, ret=%d", _ret);
+        return 0;
+    }
+
+#ifdef BPF_DEBUG
+    bpf_printk("semacquire1: goid=%llu, addr=%p, reason=%llu", g.goid, addr, reason & 0xff);
+#endif
+
+    // The block duration is measured in casgstatus, once the goroutine parks and is
+    // readied again.
+    sema_wait_t sema = {
+        .addr = (u64)addr,
+        .reason = reason & 0xff,
+        .parked_ns = 0,
+    };
+    _ret = bpf_map_update_elem(&sema_waits, &g.goid, &sema, BPF_ANY);
+    if (_ret < 0) {
+        bpf_printk("semacquire1: failed to update sema_waits, ret=%d", _ret);
+        return 0;
+    }
+
+    return 0;
+}
+
+// func newTimer(when, period int64, f func(arg any, seq uintptr, delay int64), arg any, c *hchan)
+// *timeTimer
+// Linknamed as time.newTimer, called by time.NewTimer, time.NewTicker, time.AfterFunc, ...
+SEC("uprobe/time.newTimer")
+int BPF_KPROBE(uprobe_newtimer, const s64 when, const s64 period) {
+    u64 _ret;
+
+    struct go_runtime_g g;
+    _ret = get_go_g_struct(ctx, &g);
+    if (_ret < 0) {
+        bpf_printk("newTimer: failed to read g, ret=%d", _ret);
+        return 0;
+    }
+
+#ifdef BPF_DEBUG
+    bpf_printk("newTimer: goid=%llu, when=%lld, period=%lld", g.goid, when, period);
+#endif
+
+    // The address of the timer is only known once newTimer calls modify on it.
+    u64 p = (u64)period;
+    _ret = bpf_map_update_elem(&timers_in_creation, &g.goid, &p, BPF_ANY);
+    if (_ret < 0) {
+        bpf_printk("newTimer: failed to update timers_in_creation, ret=%d", _ret);
+        return 0;
+    }
+
+    return 0;
+}
+
+// func (t *timer) modify(when, period int64, f func(arg any, seq uintptr, delay int64), arg any,
+// seq uintptr) bool
+SEC("uprobe/runtime.(*timer).modify")
+int BPF_KPROBE(uprobe_timer_modify, const void *t, const s64 when, const s64 period) {
+    u64 probe_start_ns = bpf_ktime_get_ns();
+    u64 _ret;
+
+    struct go_runtime_g g;
+    _ret = get_go_g_struct(ctx, &g);
+    if (_ret < 0) {
+        bpf_printk("modify: failed to read g, ret=%d", _ret);
+        return 0;
+    }
+
+    // Only the first modify inside newTimer is interesting, resets are ignored.
+    u64 *creating = bpf_map_lookup_elem(&timers_in_creation, &g.goid);
+    if (creating == NULL) {
+        return 0;
+    }
+
+    u64 time_timer = (u64)t - TIME_TIMER_TIMER_OFFSET;
+    SEND_EVENT_WITH_SAMPLING(GO_RUNTIME_EVENT_TYPE_TIMER_CREATE, g.goid, g.parentGoid, time_timer,
+                             period, when, 0, 0, probe_start_ns);
+
+    _ret = bpf_map_delete_elem(&timers_in_creation, &g.goid);
+    if (_ret < 0) {
+        bpf_printk("modify: failed to delete timers_in_creation, ret=%d", _ret);
+        return 0;
+    }
+
+    return 0;
+}
+
+// func stopTimer(t *timeTimer) bool
+// Linknamed as time.stopTimer, called by (*time.Timer).Stop and (*time.Ticker).Stop
+SEC("uprobe/time.stopTimer")
+int BPF_KPROBE(uprobe_stoptimer, const void *t) {
+    u64 probe_start_ns = bpf_ktime_get_ns();
+    u64 _ret;
+
+    struct go_runtime_g g;
+    _ret = get_go_g_struct(ctx, &g);
+    if (_ret < 0) {
+        bpf_printk("stopTimer: failed to read g, ret=%d", _ret);
+        return 0;
+    }
+
+#ifdef BPF_DEBUG
+    bpf_printk("stopTimer: goid=%llu, t=%p", g.goid, t);
+#endif
+
+    SEND_EVENT_WITH_SAMPLING(GO_RUNTIME_EVENT_TYPE_TIMER_STOP, g.goid, g.parentGoid, (u64)t, 0, 0,
+                             0, 0, probe_start_ns);
+    return 0;
+}
+
+__always_inline static int send_iface_conv_event(struct pt_regs *ctx, u64 variant, u64 kind,
+                                                 u64 size, u64 probe_start_ns) {
+    u64 _ret;
+
+    struct go_runtime_g g;
+    _ret = get_go_g_struct(ctx, &g);
+    if (_ret < 0) {
+        bpf_printk("iface conv: failed to read g, ret=%d", _ret);
+        return 0;
+    }
+
+#ifdef BPF_DEBUG
+    bpf_printk("iface conv: goid=%llu, variant=%llu, kind=%llu", g.goid, variant, kind);
+#endif
+
+    SEND_EVENT_WITH_SAMPLING(GO_RUNTIME_EVENT_TYPE_IFACE_CONV, g.goid, g.parentGoid, kind, size,
+                             variant, 0, 0, probe_start_ns);
+    return 0;
+}
+
+__always_inline static int send_typed_iface_conv_event(struct pt_regs *ctx, u64 variant,
+                                                       const void *typ, u64 probe_start_ns) {
+    u64 _ret;
+
+    struct go_abi_type go_type;
+    _ret = bpf_probe_read(&go_type, sizeof(go_type), typ);
+    if (_ret < 0) {
+        bpf_printk("iface conv: failed to read go_type, ret=%d, typ=%p", _ret, typ);
+        return 0;
+    }
+
+    return send_iface_conv_event(ctx, variant, go_type.kind, go_type.size, probe_start_ns);
+}
+
+// func convT(t *_type, v unsafe.Pointer) unsafe.Pointer
+SEC("uprobe/runtime.convT")
+int BPF_KPROBE(uprobe_convt, const void *typ) {
+    u64 probe_start_ns = bpf_ktime_get_ns();
+    return send_typed_iface_conv_event(ctx, GO_IFACE_CONV_T, typ, probe_start_ns);
+}
+
+// func convTnoptr(t *_type, v unsafe.Pointer) unsafe.Pointer
+SEC("uprobe/runtime.convTnoptr")
+int BPF_KPROBE(uprobe_convtnoptr, const void *typ) {
+    u64 probe_start_ns = bpf_ktime_get_ns();
+    return send_typed_iface_conv_event(ctx, GO_IFACE_CONV_T_NOPTR, typ, probe_start_ns);
+}
+
+// func convT16(val uint16) (x unsafe.Pointer)
+SEC("uprobe/runtime.convT16")
+int BPF_KPROBE(uprobe_convt16) {
+    u64 probe_start_ns = bpf_ktime_get_ns();
+    return send_iface_conv_event(ctx, GO_IFACE_CONV_T16, GO_KIND_UINT16, 2, probe_start_ns);
+}
+
+// func convT32(val uint32) (x unsafe.Pointer)
+SEC("uprobe/runtime.convT32")
+int BPF_KPROBE(uprobe_convt32) {
+    u64 probe_start_ns = bpf_ktime_get_ns();
+    return send_iface_conv_event(ctx, GO_IFACE_CONV_T32, GO_KIND_UINT32, 4, probe_start_ns);
+}
+
+// func convT64(val uint64) (x unsafe.Pointer)
+SEC("uprobe/runtime.convT64")
+int BPF_KPROBE(uprobe_convt64) {
+    u64 probe_start_ns = bpf_ktime_get_ns();
+    return send_iface_conv_event(ctx, GO_IFACE_CONV_T64, GO_KIND_UINT64, 8, probe_start_ns);
+}
+
+// func convTstring(val string) (x unsafe.Pointer)
+SEC("uprobe/runtime.convTstring")
+int BPF_KPROBE(uprobe_convtstring, const void *__skip_ptr, const u64 len) {
+    u64 probe_start_ns = bpf_ktime_get_ns();
+    return send_iface_conv_event(ctx, GO_IFACE_CONV_T_STRING, GO_KIND_STRING, len, probe_start_ns);
+}
+
+// func convTslice(val []byte) (x unsafe.Pointer)
+SEC("uprobe/runtime.convTslice")
+int BPF_KPROBE(uprobe_convtslice, const void *__skip_ptr, const u64 len) {
+    u64 probe_start_ns = bpf_ktime_get_ns();
+    return send_iface_conv_event(ctx, GO_IFACE_CONV_T_SLICE, GO_KIND_SLICE, len, probe_start_ns);
+}
+
+// func assertE2I(inter *interfacetype, t *_type) *itab
+SEC("uprobe/runtime.assertE2I")
+int BPF_KPROBE(uprobe_asserte2i, const void *__skip_inter, const void *typ) {
+    u64 probe_start_ns = bpf_ktime_get_ns();
+    return send_typed_iface_conv_event(ctx, GO_IFACE_ASSERT_E2I, typ, probe_start_ns);
+}
+
+__always_inline static int send_string_alloc_event(struct pt_regs *ctx, u64 source, u64 len,
+                                                   u64 count, const void *buf,
+                                                   u64 probe_start_ns) {
+    u64 _ret;
+
+    struct go_runtime_g g;
+    _ret = get_go_g_struct(ctx, &g);
+    if (_ret < 0) {
+        bpf_printk("string alloc: failed to read g, ret=%d", _ret);
+        return 0;
+    }
+
+    // The result is written to the caller's stack buffer instead of the heap
+    // if one was passed and the string fits into it
+    u64 on_stack = buf != NULL && len <= GO_TMP_STRING_BUF_SIZE;
+
+#ifdef BPF_DEBUG
+    bpf_printk("string alloc: goid=%llu, source=%llu, len=%llu", g.goid, source, len);
+#endif
+
+    SEND_EVENT_WITH_SAMPLING(GO_RUNTIME_EVENT_TYPE_STRING_ALLOC, g.goid, g.parentGoid, len, source,
+                             count, on_stack, 0, probe_start_ns);
+    return 0;
+}
+
+// func concatstrings(buf *tmpBuf, a []string) string
+SEC("uprobe/runtime.concatstrings")
+int BPF_KPROBE(uprobe_concatstrings, const void *buf, const void *a_ptr, const u64 a_len) {
+    u64 probe_start_ns = bpf_ktime_get_ns();
+
+    u64 len = 0;
+    u64 count = 0;
+    for (int i = 0; i < GO_CONCAT_MAX_OPERANDS; i++) {
+        if (i >= a_len) {
+            break;
+        }
+
+        struct go_string str;
+        if (bpf_probe_read_user(&str, sizeof(str), a_ptr + i * sizeof(str)) < 0) {
+            break;
+        }
+        if (str.len > 0) {
+            len += str.len;
+            count++;
+        }
+    }
+
+    // A single non-empty operand is returned as is, without any allocation
+    if (count < 2) {
+        return 0;
+    }
+
+    return send_string_alloc_event(ctx, GO_STRING_ALLOC_CONCAT, len, count, buf, probe_start_ns);
+}
+
+// func slicebytetostring(buf *tmpBuf, ptr *byte, n int) string
+SEC("uprobe/runtime.slicebytetostring")
+int BPF_KPROBE(uprobe_slicebytetostring, const void *buf, const void *__skip_ptr, const u64 n) {
+    u64 probe_start_ns = bpf_ktime_get_ns();
+
+    // Empty and single byte strings are served from static memory
+    if (n <= 1) {
+        return 0;
+    }
+
+    return send_string_alloc_event(ctx, GO_STRING_ALLOC_BYTES, n, 1, buf, probe_start_ns);
+}
+
+// Runs on every CPU at the schedstats interval. Only the CPUs that happen to
+// run a thread of the traced program can read its memory, so the first of
+// them to fire within an interval samples the run queues of all Ps.
+SEC("perf_event")
+int perf_event_schedstats(struct bpf_perf_event_data *ctx) {
+    u64 probe_start_ns = bpf_ktime_get_ns();
+    u64 _ret;
+    u32 key = 0;
+
+    sched_config_t *cfg = bpf_map_lookup_elem(&sched_config, &key);
+    if (!cfg || cfg->allp_addr == 0) {
+        return 0;
+    }
+
+    if ((bpf_get_current_pid_tgid() >> 32) != cfg->tgid) {
+        return 0;
+    }
+
+    u64 *last_sample_ns = bpf_map_lookup_elem(&sched_last_sample, &key);
+    if (!last_sample_ns) {
+        return 0;
+    }
+    if (probe_start_ns - *last_sample_ns < cfg->interval_ns) {
+        return 0;
+    }
+    // Racing CPUs may both sample once, which is harmless
+    *last_sample_ns = probe_start_ns;
+
+    struct go_slice allp;
+    _ret = bpf_probe_read_user(&allp, sizeof(allp), (void *)cfg->allp_addr);
+    if (_ret < 0) {
+        bpf_printk("schedstats: failed to read allp, ret=%d", _ret);
+        return 0;
+    }
+
+    for (int i = 0; i < GO_SCHED_MAX_PS; i++) {
+        if (i >= allp.len) {
+            break;
+        }
+
+        u64 p_addr;
+        if (bpf_probe_read_user(&p_addr, sizeof(p_addr), (void *)(allp.ptr + i * sizeof(u64))) < 0 ||
+            p_addr == 0) {
+            continue;
+        }
+
+        u32 id_status[2];
+        u32 runq[2];
+        u64 runnext;
+        if (bpf_probe_read_user(&id_status, sizeof(id_status), (void *)(p_addr + P_ID_OFFSET)) < 0 ||
+            bpf_probe_read_user(&runq, sizeof(runq), (void *)(p_addr + P_RUNQHEAD_OFFSET)) < 0 ||
+            bpf_probe_read_user(&runnext, sizeof(runnext), (void *)(p_addr + P_RUNNEXT_OFFSET)) < 0) {
+            bpf_printk("schedstats: failed to read p, p=%llx", p_addr);
+            continue;
+        }
+
+        // runqtail - runqhead wraps around like in runtime.runqlen
+        u64 runq_len = (u32)(runq[1] - runq[0]) + (runnext != 0 ? 1 : 0);
+
+#ifdef BPF_DEBUG
+        bpf_printk("schedstats: p=%u, status=%u, runq=%llu", id_status[0], id_status[1], runq_len);
+#endif
+
+        // The sampled thread may not run Go code, and the P is in the
+        // event already
+        SEND_EVENT_WITH_SAMPLING_P(GO_RUNTIME_EVENT_TYPE_SCHED_STATS, 0, 0, id_status[0], runq_len,
+                                   id_status[1], allp.len, 0, probe_start_ns, GO_NO_P);
+    }
+
+    return 0;
+}
+
+// func newm(fn func(), pp *p, id int64)
+SEC("uprobe/runtime.newm")
+int BPF_KPROBE(uprobe_newm, const void *__skip_fn, const void *pp, const s64 id) {
+    u64 probe_start_ns = bpf_ktime_get_ns();
+    u64 _ret;
+
+    struct go_runtime_g g;
+    _ret = get_go_g_struct(ctx, &g);
+    if (_ret < 0) {
+        bpf_printk("newm: failed to read g, ret=%d", _ret);
+        return 0;
+    }
+
+    u64 has_p = 0;
+    u32 p_id = 0;
+    if (pp != NULL) {
+        _ret = bpf_probe_read_user(&p_id, sizeof(p_id), (void *)pp + P_ID_OFFSET);
+        if (_ret < 0) {
+            bpf_printk("newm: failed to read p.id, ret=%d, pp=%p", _ret, pp);
+        } else {
+            has_p = 1;
+        }
+    }
+
+#ifdef BPF_DEBUG
+    bpf_printk("newm: goid=%llu, m.id=%lld, p.id=%u", g.goid, id, p_id);
+#endif
+
+    SEND_EVENT_WITH_SAMPLING(GO_RUNTIME_EVENT_TYPE_NEWM, g.goid, g.parentGoid, id, has_p, p_id, 0,
+                             0, probe_start_ns);
+    return 0;
+}
+
+// func mexit(osStack bool)
+SEC("uprobe/runtime.mexit")
+int BPF_KPROBE(uprobe_mexit, const u8 os_stack) {
+    u64 probe_start_ns = bpf_ktime_get_ns();
+    u64 _ret;
+
+    // mexit runs on the g0 of the exiting M
+    u64 g_addr = __GO_G_ADDR(ctx);
+    u64 m_addr;
+    _ret = bpf_probe_read_user(&m_addr, sizeof(m_addr), (void *)(g_addr + G_M_OFFSET));
+    if (_ret < 0) {
+        bpf_printk("mexit: failed to read g.m, ret=%d", _ret);
+        return 0;
+    }
+
+    s64 m_id;
+    _ret = bpf_probe_read_user(&m_id, sizeof(m_id), (void *)(m_addr + M_ID_OFFSET));
+    if (_ret < 0) {
+        bpf_printk("mexit: failed to read m.id, ret=%d, m=%llx", _ret, m_addr);
+        return 0;
+    }
+
+#ifdef BPF_DEBUG
+    bpf_printk("mexit: m.id=%lld, osStack=%u", m_id, os_stack);
+#endif
+
+    SEND_EVENT_WITH_SAMPLING(GO_RUNTIME_EVENT_TYPE_MEXIT, 0, 0, m_id, os_stack, 0, 0, 0,
+                             probe_start_ns);
+    return 0;
+}
+
+// func gcAssistAlloc(gp *g)
+SEC("uprobe/runtime.gcAssistAlloc")
+int BPF_KPROBE(uprobe_gcassistalloc, const void *gp) {
+    u64 probe_start_ns = bpf_ktime_get_ns();
+    u64 _ret;
+
+    struct go_runtime_g g;
+    _ret = bpf_probe_read(&g, sizeof(g), gp);
+    if (_ret < 0) {
+        bpf_printk("gcAssistAlloc: failed to read g, ret=%d, gp=%p", _ret, gp);
+        return 0;
+    }
+
+    // gp.gcAssistBytes is negative while the goroutine is in debt to the GC
+    s64 assist_bytes = 0;
+    u64 debt = 0, readable = 0;
+    _ret = bpf_probe_read_user(&assist_bytes, sizeof(assist_bytes), (void *)gp + G_GC_ASSIST_BYTES_OFFSET);
+    if (_ret == 0) {
+        readable = 1;
+        if (assist_bytes < 0) {
+            debt = -assist_bytes;
+        }
+    }
+
+#ifdef BPF_DEBUG
+    bpf_printk("gcAssistAlloc: goid=%llu, debt=%llu", g.goid, debt);
+#endif
+
+    SEND_EVENT_WITH_SAMPLING(GO_RUNTIME_EVENT_TYPE_GC_ASSIST, g.goid, g.parentGoid, debt, readable, 0,
+                             0, 0, probe_start_ns);
+    return 0;
+}
+
+__always_inline static int send_gc_mark_worker_event(struct pt_regs *ctx, u64 phase, u64 mode,
+                                                     u64 duration_ns, u64 probe_start_ns) {
+    u64 _ret;
+
+    struct go_runtime_g g;
+    _ret = get_go_g_struct(ctx, &g);
+    if (_ret < 0) {
+        bpf_printk("mark worker: failed to read g, ret=%d", _ret);
+        return 0;
+    }
+
+#ifdef BPF_DEBUG
+    bpf_printk("mark worker: goid=%llu, phase=%llu, mode=%llu", g.goid, phase, mode);
+#endif
+
+    SEND_EVENT_WITH_SAMPLING(GO_RUNTIME_EVENT_TYPE_GC_MARK_WORKER, g.goid, g.parentGoid, phase, mode,
+                             duration_ns, 0, 0, probe_start_ns);
+    return 0;
+}
+
+// The mark worker drain functions run on the system stack, so their start
+// events are attributed to the g0 of the M running the worker.
+
+// func gcDrainMarkWorkerDedicated(gcw *gcWork, untilPreempt bool)
+SEC("uprobe/runtime.gcDrainMarkWorkerDedicated")
+int BPF_KPROBE(uprobe_gcdrainmarkworkerdedicated) {
+    u64 probe_start_ns = bpf_ktime_get_ns();
+    return send_gc_mark_worker_event(ctx, GO_GC_MARK_WORKER_START, GO_GC_MARK_WORKER_DEDICATED, 0,
+                                     probe_start_ns);
+}
+
+// func gcDrainMarkWorkerFractional(gcw *gcWork)
+SEC("uprobe/runtime.gcDrainMarkWorkerFractional")
+int BPF_KPROBE(uprobe_gcdrainmarkworkerfractional) {
+    u64 probe_start_ns = bpf_ktime_get_ns();
+    return send_gc_mark_worker_event(ctx, GO_GC_MARK_WORKER_START, GO_GC_MARK_WORKER_FRACTIONAL, 0,
+                                     probe_start_ns);
+}
+
+// func gcDrainMarkWorkerIdle(gcw *gcWork)
+SEC("uprobe/runtime.gcDrainMarkWorkerIdle")
+int BPF_KPROBE(uprobe_gcdrainmarkworkeridle) {
+    u64 probe_start_ns = bpf_ktime_get_ns();
+    return send_gc_mark_worker_event(ctx, GO_GC_MARK_WORKER_START, GO_GC_MARK_WORKER_IDLE, 0,
+                                     probe_start_ns);
+}
+
+// func (c *gcControllerState) markWorkerStop(mode gcMarkWorkerMode, duration int64)
+SEC("uprobe/runtime.(*gcControllerState).markWorkerStop")
+int BPF_KPROBE(uprobe_markworkerstop, const void *__skip_c, const u64 mode, const s64 duration) {
+    u64 probe_start_ns = bpf_ktime_get_ns();
+    return send_gc_mark_worker_event(ctx, GO_GC_MARK_WORKER_STOP, mode, duration, probe_start_ns);
+}
+
+__always_inline static int send_marker_event(struct pt_regs *ctx, u64 id, u64 phase,
+                                             u64 probe_start_ns) {
+    u64 _ret;
+
+    struct go_runtime_g g;
+    _ret = get_go_g_struct(ctx, &g);
+    if (_ret < 0) {
+        bpf_printk("marker: failed to read g, ret=%d", _ret);
+        return 0;
+    }
+
+#ifdef BPF_DEBUG
+    bpf_printk("marker: goid=%llu, id=%llu, phase=%llu", g.goid, id, phase);
+#endif
+
+    SEND_EVENT_WITH_SAMPLING(GO_RUNTIME_EVENT_TYPE_MARKER, g.goid, g.parentGoid, id, phase, 0, 0, 0,
+                             probe_start_ns);
+    return 0;
+}
+
+// func Begin(id uint64) in go.sazak.io/xgotop/marker
+SEC("uprobe/marker.Begin")
+int BPF_KPROBE(uprobe_marker_begin, const u64 id) {
+    u64 probe_start_ns = bpf_ktime_get_ns();
+    return send_marker_event(ctx, id, MARKER_BEGIN, probe_start_ns);
+}
+
+// func End(id uint64) in go.sazak.io/xgotop/marker
+SEC("uprobe/marker.End")
+int BPF_KPROBE(uprobe_marker_end, const u64 id) {
+    u64 probe_start_ns = bpf_ktime_get_ns();
+    return send_marker_event(ctx, id, MARKER_END, probe_start_ns);
+}
+
+__always_inline static long usdt_arg(struct pt_regs *ctx, usdt_arg_spec_t *spec, u64 *res) {
+    u64 val = 0;
+    long err;
+
+    switch (spec->arg_type) {
+    case USDT_ARG_CONST:
+        val = spec->val_off;
+        break;
+    case USDT_ARG_REG:
+        err = bpf_probe_read_kernel(&val, sizeof(val), (void *)ctx + spec->reg_off);
+        if (err) {
+            return err;
+        }
+        break;
+    case USDT_ARG_REG_DEREF:
+        err = bpf_probe_read_kernel(&val, sizeof(val), (void *)ctx + spec->reg_off);
+        if (err) {
+            return err;
+        }
+        err = bpf_probe_read_user(&val, sizeof(val), (void *)val + spec->val_off);
+        if (err) {
+            return err;
+        }
+        break;
+    default:
+        return -1;
+    }
+
+    // Cut the value down to the argument size, sign extending if needed
+    val <<= spec->arg_bitshift;
+    if (spec->arg_signed) {
+        val = ((s64)val) >> spec->arg_bitshift;
+    } else {
+        val >>= spec->arg_bitshift;
+    }
+
+    *res = val;
+    return 0;
+}
+
+// USDT probes usually fire in C code called through cgo, where the Go g
+// register does not hold a g, so the events are not attributed to a goroutine.
+SEC("uprobe/usdt")
+int BPF_KPROBE(uprobe_usdt) {
+    u64 probe_start_ns = bpf_ktime_get_ns();
+
+    u64 cookie = bpf_get_attach_cookie(ctx);
+    usdt_spec_t *spec = bpf_map_lookup_elem(&usdt_specs, &cookie);
+    if (!spec) {
+        bpf_printk("usdt: no spec for cookie %llu", cookie);
+        return 0;
+    }
+
+    u64 args[USDT_MAX_ARGS] = {};
+    for (int i = 0; i < USDT_MAX_ARGS; i++) {
+        if (i >= spec->nargs) {
+            break;
+        }
+        if (usdt_arg(ctx, &spec->args[i], &args[i]) < 0) {
+            bpf_printk("usdt: failed to read arg %d of probe %u", i, spec->probe_id);
+        }
+    }
+
+#ifdef BPF_DEBUG
+    bpf_printk("usdt: probe=%u, nargs=%u", spec->probe_id, spec->nargs);
+#endif
+
+    // USDT probes are not in Go code, so the g register holds no goroutine
+    SEND_EVENT_WITH_SAMPLING_P(GO_RUNTIME_EVENT_TYPE_USDT, 0, 0, spec->probe_id, args[0], args[1],
+                               args[2], args[3], probe_start_ns, GO_NO_P);
+    return 0;
+}
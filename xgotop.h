@@ -23,9 +23,31 @@
 
 #define G_ADDR_OFFSET -8
 #define G_GOID_OFFSET 152
+#define G_WAITREASON_OFFSET 176
 #define G_PARENT_GOID_OFFSET 272
+#define G_M_OFFSET 48
+#define G_GC_ASSIST_BYTES_OFFSET 424
+
+#define M_ID_OFFSET 232
+#define M_P_OFFSET 208
+
+// Offset of the embedded runtime.timer inside runtime.timeTimer (runtime/time.go)
+#define TIME_TIMER_TIMER_OFFSET 16
+
+// Offsets of the runtime.p fields sampled by the schedstats program. The
+// struct is far too large for the BPF stack, so the fields are read one by one.
+// p.status directly follows p.id, and p.runqtail directly follows p.runqhead.
+#define P_ID_OFFSET 0
+#define P_RUNQHEAD_OFFSET 400
+#define P_RUNNEXT_OFFSET 2456
+
+// Maximum number of Ps sampled by a single schedstats run
+#define GO_SCHED_MAX_PS 64
 
 // From runtime/runtime2.go of Go 1.25
+#define G_STATUS_RUNNABLE 1
+#define G_STATUS_RUNNING 2
+#define G_STATUS_WAITING 4
 #define G_STATUS_DEAD 6
 
 char LICENSE[] SEC("license") = "GPL";
@@ -47,7 +69,9 @@ struct trace_event_raw_bpf_trace_printk___x {};
 typedef struct go_runtime_g {
     uint8_t _pad1[G_GOID_OFFSET];
     uint64_t goid;  // offset=152 size=8
-    uint8_t _pad2[G_PARENT_GOID_OFFSET - G_GOID_OFFSET - sizeof(uint64_t)];
+    uint8_t _pad2[G_WAITREASON_OFFSET - G_GOID_OFFSET - sizeof(uint64_t)];
+    uint8_t waitreason;  // offset=176 size=1
+    uint8_t _pad3[G_PARENT_GOID_OFFSET - G_WAITREASON_OFFSET - sizeof(uint8_t)];
     uint64_t parentGoid;  // offset=272 size=8
 } __attribute__((packed)) go_runtime_g;
 
@@ -57,6 +81,65 @@ typedef struct go_abi_type {
     uint8_t kind;  // offset=23 size=1
 } __attribute__((packed)) go_abi_type;
 
+// From internal/abi/type.go of Go 1.25
+#define GO_KIND_UINT16 9
+#define GO_KIND_UINT32 10
+#define GO_KIND_UINT64 11
+#define GO_KIND_SLICE 23
+#define GO_KIND_STRING 24
+
+// Runtime function an interface conversion event was emitted from
+typedef enum go_iface_conv_variant {
+    GO_IFACE_CONV_T = 0,
+    GO_IFACE_CONV_T_NOPTR = 1,
+    GO_IFACE_CONV_T16 = 2,
+    GO_IFACE_CONV_T32 = 3,
+    GO_IFACE_CONV_T64 = 4,
+    GO_IFACE_CONV_T_STRING = 5,
+    GO_IFACE_CONV_T_SLICE = 6,
+    GO_IFACE_ASSERT_E2I = 7,
+} go_iface_conv_variant_t;
+
+// Runtime function a string allocation event was emitted from
+typedef enum go_string_alloc_source {
+    GO_STRING_ALLOC_CONCAT = 0,
+    GO_STRING_ALLOC_BYTES = 1,
+} go_string_alloc_source_t;
+
+// Size of runtime.tmpBuf, results up to this length may not be heap allocated
+#define GO_TMP_STRING_BUF_SIZE 32
+
+// Maximum number of operands summed up for a single concatstrings call
+#define GO_CONCAT_MAX_OPERANDS 32
+
+typedef struct go_string {
+    uint64_t ptr;  // offset=0 size=8
+    uint64_t len;  // offset=8 size=8
+} __attribute__((packed)) go_string;
+
+typedef struct go_slice {
+    uint64_t ptr;  // offset=0 size=8
+    uint64_t len;  // offset=8 size=8
+    uint64_t cap;  // offset=16 size=8
+} __attribute__((packed)) go_slice;
+
+// runtime.gcMarkWorkerMode
+typedef enum go_gc_mark_worker_mode {
+    GO_GC_MARK_WORKER_DEDICATED = 1,
+    GO_GC_MARK_WORKER_FRACTIONAL = 2,
+    GO_GC_MARK_WORKER_IDLE = 3,
+} go_gc_mark_worker_mode_t;
+
+typedef enum go_gc_mark_worker_phase {
+    GO_GC_MARK_WORKER_START = 0,
+    GO_GC_MARK_WORKER_STOP = 1,
+} go_gc_mark_worker_phase_t;
+
+typedef enum marker_phase {
+    MARKER_BEGIN = 0,
+    MARKER_END = 1,
+} marker_phase_t;
+
 typedef struct go_abi_map_type {
     uint8_t _pad1[48];
     uint64_t key_ptr;   // offset=48 size=8
@@ -70,6 +153,20 @@ typedef enum go_runtime_event_type {
     GO_RUNTIME_EVENT_TYPE_NEW_OBJECT = 3,
     GO_RUNTIME_EVENT_TYPE_NEWGOROUTINE = 4,
     GO_RUNTIME_EVENT_TYPE_GOEXIT = 5,
+    GO_RUNTIME_EVENT_TYPE_SEMA_BLOCK = 6,
+    GO_RUNTIME_EVENT_TYPE_TIMER_CREATE = 7,
+    GO_RUNTIME_EVENT_TYPE_TIMER_STOP = 8,
+    GO_RUNTIME_EVENT_TYPE_IFACE_CONV = 9,
+    GO_RUNTIME_EVENT_TYPE_STRING_ALLOC = 10,
+    GO_RUNTIME_EVENT_TYPE_SCHED_STATS = 11,
+    GO_RUNTIME_EVENT_TYPE_NEWM = 12,
+    GO_RUNTIME_EVENT_TYPE_MEXIT = 13,
+    GO_RUNTIME_EVENT_TYPE_GC_ASSIST = 14,
+    GO_RUNTIME_EVENT_TYPE_GC_MARK_WORKER = 15,
+    GO_RUNTIME_EVENT_TYPE_MARKER = 16,
+    GO_RUNTIME_EVENT_TYPE_USDT = 17,
+    // Synthesized by xgotop in userspace, never sent by the eBPF programs
+    GO_RUNTIME_EVENT_TYPE_ALLOC_SUMMARY = 18,
 } __attribute__((packed)) go_runtime_event_type_t;
 
 typedef struct go_runtime_event {
@@ -86,11 +183,47 @@ typedef struct go_runtime_event {
     // makeslice: size, kind, len, cap
     // makemap: key_size, key_kind, elem_size, elem_kind, hint
     // newobject: size, kind
-    // newproc1: callerg.id, newg.id
+    // newproc1: callerg.id, newg.id, start pc, go statement pc
     // goexit1: g.id, ts
+    // semacquire1: blocked_ns, addr, waitreason, waker g.id
+    // newTimer: timer addr, period, when
+    // stopTimer: timer addr
+    // convT*, assertE2I: kind, size, variant
+    // concatstrings, slicebytetostring: len, source, operand count, stack buffer
+    // schedstats: p.id, run queue length, p.status, len(allp)
+    // newm: m.id, has p, p.id
+    // mexit: m.id, osStack
+    // gcAssistAlloc: assist debt bytes, debt readable
+    // gcDrainMarkWorker*, markWorkerStop: phase, mode, duration_ns
+    // marker.Begin, marker.End: marker id, phase
+    // USDT probes: probe id, arg0, arg1, arg2, arg3
     u64 attributes[5];
 } __attribute__((packed)) go_runtime_event_t;
 
+// Event captured with -event-detail=minimal
+typedef struct go_runtime_event_minimal {
+    u64 timestamp;
+    u32 event_type;
+    u32 goroutine;
+} __attribute__((packed)) go_runtime_event_minimal_t;
+
+// Event captured with -event-detail=full
+typedef struct go_runtime_event_full {
+    go_runtime_event_t event;
+    u32 thread;  // ID of the OS thread the event happened on
+    u32 p;       // ID of the P the event happened on, GO_NO_P if the M held none
+} __attribute__((packed)) go_runtime_event_full_t;
+
+#define GO_NO_P 0xffffffff
+
+// Amount of data captured for every event, set by userspace. The zero value
+// is the default so that the programs work without any configuration.
+typedef enum event_detail {
+    EVENT_DETAIL_STANDARD = 0,
+    EVENT_DETAIL_MINIMAL = 1,
+    EVENT_DETAIL_FULL = 2,
+} event_detail_t;
+
 // Force emitting structs into the ELF for automatic creation of Go struct
 const go_runtime_event_t *unused_go_runtime_event_t __attribute__((unused));
 
@@ -131,16 +264,28 @@ const go_runtime_event_t *unused_go_runtime_event_t __attribute__((unused));
 // Maps
 struct {
     __uint(type, BPF_MAP_TYPE_RINGBUF);
-    // TODO: If this is too small and the read workers put more messages in the Go chan
+    // If this is too small and the read workers put more messages in the Go chan
     // than processors can handle, the ringbuffer is blocked and we start to get these
     // error messages in trace_pipe:
     // testserver-3455    [001] ...11   716.382798: bpf_trace_printk: Failed to reserve ringbuf
-    // We need to send another event to the Go prog with a new ringbuffer only for errors
-    // (and stats in the future) and the new ACC metric (accuracy) should use that ringbuffer's
-    // message count to calculate the accuracy as ACC = 100 * (total_events - errors) / total_events
+    // Every failed reservation is counted in dropped_events below.
     __uint(max_entries, 1 << 24);  // sizeof(go_runtime_event_t) = 64 = 2^6 => 2^(24 + 6) = 1 GB
 } events SEC(".maps");
 
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, u32);    // Always 0
+    __type(value, u64);  // Number of events dropped because the ringbuffer was full
+} dropped_events SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, u32);    // Always 0
+    __type(value, u32);  // event_detail_t
+} event_detail SEC(".maps");
+
 struct {
     __uint(type, BPF_MAP_TYPE_HASH);
     __uint(max_entries, 32);  // Support up to 32 different event types
@@ -148,11 +293,29 @@ struct {
     __type(value, u32);       // Sampling rate (0-100, representing percentage)
 } sampling_rates SEC(".maps");
 
+// Goroutines flagged by xgotop as interesting, e.g. top allocators. Their
+// events bypass sampling, unless the sampling rate of the event type is 0,
+// and are captured with EVENT_DETAIL_FULL whatever the detail level.
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 4096);
+    __type(key, u64);    // g.id
+    __type(value, u32);  // Unused
+} flagged_goroutines SEC(".maps");
+
+// Creation site of a goroutine, recorded by newproc1 until the goroutine is
+// made runnable
+typedef struct goroutine_creation {
+    u64 callerg_id;
+    u64 start_pc;   // fn.fn, the entry PC of the goroutine's function
+    u64 caller_pc;  // PC of the go statement
+} goroutine_creation_t;
+
 struct {
     __uint(type, BPF_MAP_TYPE_LRU_HASH);
     __uint(max_entries, 1 << 16);
-    __type(key, u64);    // Address of g.id
-    __type(value, u64);  // Address of callerg.id
+    __type(key, u64);                    // g.id
+    __type(value, goroutine_creation_t);  // Creator and creation site of g
 } goroutines_in_creation SEC(".maps");
 
 struct {
@@ -162,36 +325,191 @@ struct {
     __type(value, u64);  // Timestamp of exit (unused for now)
 } goroutines_in_exit SEC(".maps");
 
-#define SEND_EVENT_WITH_SAMPLING(EVENT_TYPE, G_ID, G_PARENT_ID, ATTR0, ATTR1, ATTR2, ATTR3, ATTR4, \
-                                 START_NS_U64)                                                     \
+// State of a goroutine between entering semacquire1 and being readied again
+typedef struct sema_wait {
+    u64 addr;       // Address of the semaphore
+    u64 reason;     // waitReason passed to semacquire1
+    u64 parked_ns;  // Timestamp of the park, 0 if not parked (yet)
+} sema_wait_t;
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, 1 << 16);
+    __type(key, u64);            // g.id
+    __type(value, sema_wait_t);  // Semaphore the goroutine may block on
+} sema_waits SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, 1 << 16);
+    __type(key, u64);    // g.id
+    __type(value, u64);  // Period of the timer being created, 0 for one-shot timers
+} timers_in_creation SEC(".maps");
+
+// Configuration of the schedstats program, written once by userspace
+typedef struct sched_config {
+    u32 tgid;         // Process ID of the traced program
+    u32 _pad;
+    u64 allp_addr;    // Address of the runtime.allp slice header
+    u64 interval_ns;  // Minimum time between two samples
+} sched_config_t;
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, u32);               // Always 0
+    __type(value, sched_config_t);  // Zero until schedstats sampling is enabled
+} sched_config SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, u32);    // Always 0
+    __type(value, u64);  // Timestamp of the last schedstats sample, shared by all CPUs
+} sched_last_sample SEC(".maps");
+
+#define COUNT_DROPPED_EVENT()                                          \
+    do {                                                               \
+        bpf_printk("Failed to reserve ringbuf");                       \
+        u32 drop_key = 0;                                              \
+        u64 *drops = bpf_map_lookup_elem(&dropped_events, &drop_key);  \
+        if (drops) {                                                   \
+            *drops += 1;                                               \
+        }                                                              \
+    } while (0)
+
+// get_go_p_id returns the ID of the P held by the M running the current
+// goroutine, or GO_NO_P if it holds none (e.g. in a syscall).
+__always_inline static u32 get_go_p_id(void *ctx) {
+    u64 g_addr = __GO_G_ADDR(ctx);
+    u64 m_addr, p_addr;
+    if (bpf_probe_read_user(&m_addr, sizeof(m_addr), (void *)(g_addr + G_M_OFFSET)) < 0 ||
+        m_addr == 0) {
+        return GO_NO_P;
+    }
+    if (bpf_probe_read_user(&p_addr, sizeof(p_addr), (void *)(m_addr + M_P_OFFSET)) < 0 ||
+        p_addr == 0) {
+        return GO_NO_P;
+    }
+    u32 p_id;
+    if (bpf_probe_read_user(&p_id, sizeof(p_id), (void *)(p_addr + P_ID_OFFSET)) < 0) {
+        return GO_NO_P;
+    }
+    return p_id;
+}
+
+#define FILL_EVENT(E, EVENT_TYPE, G_ID, G_PARENT_ID, ATTR0, ATTR1, ATTR2, ATTR3, ATTR4, START_NS_U64) \
+    do {                                                                                             \
+        (E)->timestamp = bpf_ktime_get_ns();                                                         \
+        (E)->event_type = (EVENT_TYPE);                                                              \
+        (E)->probe_duration_ns = (u32)((E)->timestamp - (START_NS_U64));                             \
+        (E)->goroutine = (G_ID);                                                                     \
+        (E)->parent_goroutine = (G_PARENT_ID);                                                       \
+        (E)->attributes[0] = (ATTR0);                                                                \
+        (E)->attributes[1] = (ATTR1);                                                                \
+        (E)->attributes[2] = (ATTR2);                                                                \
+        (E)->attributes[3] = (ATTR3);                                                                \
+        (E)->attributes[4] = (ATTR4);                                                                \
+    } while (0)
+
+// Maximum number of USDT probe arguments captured, the remaining attributes
+#define USDT_MAX_ARGS 4
+
+// Location of a USDT argument, following the layout of libbpf's usdt.bpf.h
+typedef enum usdt_arg_type {
+    USDT_ARG_CONST = 0,      // val_off is the value
+    USDT_ARG_REG = 1,        // Value of the register at reg_off in pt_regs
+    USDT_ARG_REG_DEREF = 2,  // Memory at val_off from the register at reg_off
+} usdt_arg_type_t;
+
+typedef struct usdt_arg_spec {
+    u64 val_off;
+    u32 arg_type;     // usdt_arg_type_t
+    s16 reg_off;      // Offset of the register in struct pt_regs
+    u8 arg_signed;    // Whether to sign extend the value
+    s8 arg_bitshift;  // 64 minus the argument size in bits
+} usdt_arg_spec_t;
+
+typedef struct usdt_spec {
+    u32 probe_id;  // Index of the probe in the session's probe list
+    u32 nargs;
+    usdt_arg_spec_t args[USDT_MAX_ARGS];
+} usdt_spec_t;
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 1 << 10);
+    __type(key, u64);            // Attach cookie, one per probe location
+    __type(value, usdt_spec_t);  // How to read the probe arguments at that location
+} usdt_specs SEC(".maps");
+
+// The ringbuf reservations are spelled out per detail level, as the verifier
+// requires a constant size for each of them. P_ID is only evaluated for full
+// events, which the events of flagged goroutines always are.
+#define SEND_EVENT_WITH_SAMPLING_P(EVENT_TYPE, G_ID, G_PARENT_ID, ATTR0, ATTR1, ATTR2, ATTR3,      \
+                                   ATTR4, START_NS_U64, P_ID)                                      \
     do {                                                                                           \
         u32 event_type = (EVENT_TYPE);                                                             \
+        u64 flag_key = (G_ID);                                                                     \
+        void *flagged = bpf_map_lookup_elem(&flagged_goroutines, &flag_key);                       \
         u32 *rate_ptr = bpf_map_lookup_elem(&sampling_rates, &event_type);                         \
         if (rate_ptr) {                                                                            \
             u32 rate = *rate_ptr;                                                                  \
-            u32 rand = bpf_get_prandom_u32() % 100;                                                \
-            if (rand >= rate) {                                                                    \
+            if (rate == 0 || !flagged) {                                                           \
+                u32 rand = bpf_get_prandom_u32() % 100;                                            \
+                if (rand >= rate) {                                                                \
+                    break;                                                                         \
+                }                                                                                  \
+            }                                                                                      \
+        }                                                                                          \
+        u32 detail_key = 0;                                                                        \
+        u32 *detail = bpf_map_lookup_elem(&event_detail, &detail_key);                             \
+        if (!flagged && detail && *detail == EVENT_DETAIL_MINIMAL) {                               \
+            go_runtime_event_minimal_t *m =                                                        \
+                bpf_ringbuf_reserve(&events, sizeof(go_runtime_event_minimal_t), 0);               \
+            if (!m) {                                                                              \
+                COUNT_DROPPED_EVENT();                                                             \
                 break;                                                                             \
             }                                                                                      \
+            m->timestamp = bpf_ktime_get_ns();                                                     \
+            m->event_type = (EVENT_TYPE);                                                          \
+            m->goroutine = (G_ID);                                                                 \
+            bpf_ringbuf_submit(m, 0);                                                              \
+            break;                                                                                 \
+        }                                                                                          \
+        if (flagged || (detail && *detail == EVENT_DETAIL_FULL)) {                                 \
+            go_runtime_event_full_t *f =                                                           \
+                bpf_ringbuf_reserve(&events, sizeof(go_runtime_event_full_t), 0);                  \
+            if (!f) {                                                                              \
+                COUNT_DROPPED_EVENT();                                                             \
+                break;                                                                             \
+            }                                                                                      \
+            FILL_EVENT(&f->event, EVENT_TYPE, G_ID, G_PARENT_ID, ATTR0, ATTR1, ATTR2, ATTR3,       \
+                       ATTR4, START_NS_U64);                                                       \
+            f->thread = (u32)bpf_get_current_pid_tgid();                                           \
+            f->p = (P_ID);                                                                         \
+            bpf_ringbuf_submit(f, 0);                                                              \
+            break;                                                                                 \
         }                                                                                          \
         go_runtime_event_t *e = bpf_ringbuf_reserve(&events, sizeof(go_runtime_event_t), 0);       \
         if (!e) {                                                                                  \
-            bpf_printk("Failed to reserve ringbuf");                                               \
+            COUNT_DROPPED_EVENT();                                                                 \
             break;                                                                                 \
         }                                                                                          \
-        e->timestamp = bpf_ktime_get_ns();                                                         \
-        e->event_type = (EVENT_TYPE);                                                              \
-        e->probe_duration_ns = (u32)(e->timestamp - (START_NS_U64));                               \
-        e->goroutine = (G_ID);                                                                     \
-        e->parent_goroutine = (G_PARENT_ID);                                                       \
-        e->attributes[0] = (ATTR0);                                                                \
-        e->attributes[1] = (ATTR1);                                                                \
-        e->attributes[2] = (ATTR2);                                                                \
-        e->attributes[3] = (ATTR3);                                                                \
-        e->attributes[4] = (ATTR4);                                                                \
+        FILL_EVENT(e, EVENT_TYPE, G_ID, G_PARENT_ID, ATTR0, ATTR1, ATTR2, ATTR3, ATTR4,            \
+                   START_NS_U64);                                                                  \
         bpf_ringbuf_submit(e, 0);                                                                  \
     } while (0)
 
+// SEND_EVENT_WITH_SAMPLING sends an event of a uprobe on Go code, where the
+// g register holds the current goroutine, so the P can be resolved from it.
+// Programs running outside of Go code, like the perf_event and USDT programs,
+// use SEND_EVENT_WITH_SAMPLING_P with GO_NO_P instead.
+#define SEND_EVENT_WITH_SAMPLING(EVENT_TYPE, G_ID, G_PARENT_ID, ATTR0, ATTR1, ATTR2, ATTR3, ATTR4, \
+                                 START_NS_U64)                                                     \
+    SEND_EVENT_WITH_SAMPLING_P(EVENT_TYPE, G_ID, G_PARENT_ID, ATTR0, ATTR1, ATTR2, ATTR3, ATTR4,   \
+                               START_NS_U64, get_go_p_id(ctx))
+
 __always_inline static int get_go_g_struct(struct pt_regs *ctx, struct go_runtime_g *g) {
     u64 g_addr = __GO_G_ADDR(ctx);
 #ifdef BPF_DEBUG
@@ -0,0 +1,374 @@
+// Package xgotopclient provides a small client for the live event feed of a
+// running xgotop instance started in web mode.
+package xgotopclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+const (
+	minReconnectDelay = 1 * time.Second
+	maxReconnectDelay = 30 * time.Second
+
+	// dedupeWindow is how long, in event time, live events are checked
+	// against the backfilled ones after a reconnect. Events broadcast while
+	// the backfill was fetched are delivered by both, slightly out of order.
+	dedupeWindow = uint64(5 * time.Second)
+)
+
+// Event is a single Go runtime event as served by the xgotop API.
+type Event = storage.Event
+
+// Filter selects which live events are delivered. Nil fields match everything.
+type Filter struct {
+	Goroutine *uint32
+	EventType *storage.EventType
+}
+
+func (f *Filter) match(event *Event) bool {
+	if f == nil {
+		return true
+	}
+	if f.Goroutine != nil && event.Goroutine != *f.Goroutine {
+		return false
+	}
+	if f.EventType != nil && event.EventType != *f.EventType {
+		return false
+	}
+	return true
+}
+
+// eventKey identifies an event, so that events delivered by both the
+// backfill and the live feed are only delivered once.
+type eventKey struct {
+	timestamp  uint64
+	eventType  storage.EventType
+	goroutine  uint32
+	attributes [5]uint64
+}
+
+func keyOf(event *Event) eventKey {
+	return eventKey{event.Timestamp, event.EventType, event.Goroutine, event.Attributes}
+}
+
+// liveMessage is a single message sent by the API server over the WebSocket.
+type liveMessage struct {
+	Type   string   `json:"type"`
+	Events []*Event `json:"events"`
+}
+
+type subscription struct {
+	baseURL *url.URL
+	filter  *Filter
+	out     chan []Event
+	http    *http.Client
+
+	// lastTimestamp is the timestamp of the newest event delivered so far,
+	// and lastEvents are the events delivered with it. After a reconnect,
+	// the events from lastTimestamp on are backfilled from storage, except
+	// lastEvents.
+	lastTimestamp uint64
+	lastEvents    map[eventKey]bool
+	// backfilled are the events delivered by the last backfill, dropped
+	// from the live feed until it passes backfillEnd by dedupeWindow
+	backfilled  map[eventKey]bool
+	backfillEnd uint64
+}
+
+// SubscribeLive connects to the xgotop API server at rawURL (e.g.
+// "http://localhost:8080") and returns a channel of live event batches
+// matching filter.
+//
+// The connection is re-established with exponential backoff when it drops.
+// On every reconnect the events written to storage while disconnected are
+// fetched from the live session and delivered before live events resume, so
+// the feed has no gaps as long as the session is still being recorded.
+// Events both backfilled and received live are delivered once.
+//
+// The returned channel is closed when ctx is cancelled.
+func SubscribeLive(ctx context.Context, rawURL string, filter *Filter) (<-chan []Event, error) {
+	baseURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse url: %w", err)
+	}
+
+	sub := &subscription{
+		baseURL: baseURL,
+		filter:  filter,
+		out:     make(chan []Event, 64),
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}
+
+	conn, err := sub.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	go sub.run(ctx, conn)
+
+	return sub.out, nil
+}
+
+func (s *subscription) run(ctx context.Context, conn *websocket.Conn) {
+	defer close(s.out)
+
+	delay := minReconnectDelay
+	for {
+		if conn != nil {
+			err := s.consume(ctx, conn)
+			conn.Close()
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("xgotopclient: live feed disconnected: %v", err)
+			delay = minReconnectDelay
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		var err error
+		conn, err = s.dial(ctx)
+		if err != nil {
+			log.Printf("xgotopclient: reconnect failed: %v", err)
+			delay = min(delay*2, maxReconnectDelay)
+			continue
+		}
+
+		if err := s.backfill(ctx); err != nil {
+			log.Printf("xgotopclient: backfill failed: %v", err)
+		}
+	}
+}
+
+func (s *subscription) dial(ctx context.Context) (*websocket.Conn, error) {
+	wsURL := *s.baseURL
+	switch wsURL.Scheme {
+	case "https":
+		wsURL.Scheme = "wss"
+	default:
+		wsURL.Scheme = "ws"
+	}
+	wsURL.Path = strings.TrimSuffix(wsURL.Path, "/") + "/ws"
+
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", wsURL.String(), err)
+	}
+
+	return conn, nil
+}
+
+// consume reads messages from conn until it fails or ctx is cancelled.
+func (s *subscription) consume(ctx context.Context, conn *websocket.Conn) error {
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		// The server may coalesce several queued messages into a single
+		// frame, separated by newlines.
+		for _, line := range bytes.Split(data, []byte{'\n'}) {
+			if len(line) == 0 {
+				continue
+			}
+			events, err := decodeMessage(line)
+			if err != nil {
+				log.Printf("xgotopclient: dropping malformed message: %v", err)
+				continue
+			}
+			if !s.deliver(ctx, s.dedupe(events)) {
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+func decodeMessage(data []byte) ([]*Event, error) {
+	var msg liveMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	if msg.Type == "batch" {
+		return msg.Events, nil
+	}
+
+	// Single events are broadcast without an envelope.
+	var event Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+	return []*Event{&event}, nil
+}
+
+// dedupe removes the live events that were already delivered by the last
+// backfill.
+func (s *subscription) dedupe(events []*Event) []*Event {
+	if s.backfilled == nil {
+		return events
+	}
+
+	live := events[:0]
+	for i, event := range events {
+		if event.Timestamp > s.backfillEnd+dedupeWindow {
+			s.backfilled = nil
+			return append(live, events[i:]...)
+		}
+		key := keyOf(event)
+		if s.backfilled[key] {
+			delete(s.backfilled, key)
+			continue
+		}
+		live = append(live, event)
+	}
+	return live
+}
+
+// deliver sends the events matching the filter to the output channel. It
+// returns false if ctx was cancelled before the batch could be delivered.
+func (s *subscription) deliver(ctx context.Context, events []*Event) bool {
+	batch := make([]Event, 0, len(events))
+	for _, event := range events {
+		if !s.filter.match(event) {
+			continue
+		}
+		batch = append(batch, *event)
+
+		switch {
+		case event.Timestamp > s.lastTimestamp || s.lastEvents == nil:
+			s.lastTimestamp = event.Timestamp
+			s.lastEvents = map[eventKey]bool{keyOf(event): true}
+		case event.Timestamp == s.lastTimestamp:
+			s.lastEvents[keyOf(event)] = true
+		}
+	}
+	if len(batch) == 0 {
+		return true
+	}
+
+	select {
+	case s.out <- batch:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// backfill fetches the events recorded in the live session since the last
+// delivered event and sends them to the output channel. Events sharing the
+// timestamp of the last delivered event are fetched too, except the ones
+// already delivered.
+func (s *subscription) backfill(ctx context.Context) error {
+	if s.lastTimestamp == 0 {
+		return nil
+	}
+
+	sessionID, err := s.liveSessionID(ctx)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("start_time", strconv.FormatUint(s.lastTimestamp, 10))
+	if s.filter != nil && s.filter.Goroutine != nil {
+		query.Set("goroutine", strconv.FormatUint(uint64(*s.filter.Goroutine), 10))
+	}
+	if s.filter != nil && s.filter.EventType != nil {
+		query.Set("event_type", strconv.FormatUint(uint64(*s.filter.EventType), 10))
+	}
+
+	var events []*Event
+	if err := s.getJSON(ctx, "/api/sessions/"+sessionID+"/events?"+query.Encode(), &events); err != nil {
+		return fmt.Errorf("get events: %w", err)
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Timestamp < events[j].Timestamp
+	})
+
+	// The live feed delivers the events broadcast since the reconnect
+	// again
+	s.backfilled = make(map[eventKey]bool, len(events))
+	s.backfillEnd = 0
+	fresh := events[:0]
+	for _, event := range events {
+		key := keyOf(event)
+		if event.Timestamp == s.lastTimestamp && s.lastEvents[key] {
+			continue
+		}
+		s.backfilled[key] = true
+		s.backfillEnd = max(s.backfillEnd, event.Timestamp)
+		fresh = append(fresh, event)
+	}
+
+	log.Printf("xgotopclient: backfilled %d events from session %s", len(fresh), sessionID)
+	s.deliver(ctx, fresh)
+	return nil
+}
+
+// liveSessionID returns the ID of the most recently started session that has
+// not ended yet.
+func (s *subscription) liveSessionID(ctx context.Context) (string, error) {
+	var sessions []*storage.Session
+	if err := s.getJSON(ctx, "/api/sessions", &sessions); err != nil {
+		return "", fmt.Errorf("list sessions: %w", err)
+	}
+
+	var live *storage.Session
+	for _, session := range sessions {
+		if session.EndTime != nil {
+			continue
+		}
+		if live == nil || session.StartTime.After(live.StartTime) {
+			live = session
+		}
+	}
+	if live == nil {
+		return "", fmt.Errorf("no live session found")
+	}
+
+	return live.ID, nil
+}
+
+func (s *subscription) getJSON(ctx context.Context, path string, v any) error {
+	reqURL := strings.TrimSuffix(s.baseURL.String(), "/") + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
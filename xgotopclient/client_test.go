@@ -0,0 +1,88 @@
+package xgotopclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+func TestSubscribeLiveBackfill(t *testing.T) {
+	event := func(ts uint64, attr uint64) *Event {
+		return &Event{Timestamp: ts, EventType: storage.EventTypeNewObject, Goroutine: 1, Attributes: [5]uint64{attr}}
+	}
+	// Two events share timestamp 2, and event 4 is both backfilled and
+	// received live after the reconnect
+	first := []*Event{event(1, 0), event(2, 1), event(2, 2)}
+	stored := []*Event{event(4, 0), event(3, 0), event(2, 2), event(2, 1)}
+	second := []*Event{event(4, 0), event(5, 0)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var conns atomic.Int32
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// The first connection drops after a batch
+		if conns.Add(1) == 1 {
+			conn.WriteJSON(liveMessage{Type: "batch", Events: first})
+			return
+		}
+		conn.WriteJSON(liveMessage{Type: "batch", Events: second})
+		<-ctx.Done()
+	})
+	mux.HandleFunc("/api/sessions", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]*storage.Session{{ID: "live", StartTime: time.Now()}})
+	})
+	mux.HandleFunc("/api/sessions/live/events", func(w http.ResponseWriter, r *http.Request) {
+		if start := r.URL.Query().Get("start_time"); start != "2" {
+			http.Error(w, "start_time = "+start+", want 2", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(stored)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	feed, err := SubscribeLive(ctx, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received []Event
+	timeout := time.After(5 * time.Second)
+	for len(received) < 6 {
+		select {
+		case batch := <-feed:
+			received = append(received, batch...)
+		case <-timeout:
+			t.Fatalf("received %d events, want 6", len(received))
+		}
+	}
+	// Duplicates would follow right away
+	select {
+	case batch := <-feed:
+		received = append(received, batch...)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	expected := []Event{*event(1, 0), *event(2, 1), *event(2, 2), *event(3, 0), *event(4, 0), *event(5, 0)}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("received %+v, want %+v", received, expected)
+	}
+}
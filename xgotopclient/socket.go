@@ -0,0 +1,98 @@
+package xgotopclient
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"go.sazak.io/xgotop/cmd/xgotop/storage"
+)
+
+// SubscribeSocket connects to the live socket of an xgotop instance on the
+// same host, started with -live-socket path, and returns a channel of live
+// event batches matching filter. The live socket streams the batches as
+// protobuf frames, which is cheaper for the traced host than the WebSocket
+// feed of SubscribeLive.
+//
+// The connection is re-established with exponential backoff when it drops.
+// Unlike SubscribeLive, the events streamed while disconnected are not
+// backfilled, and xgotop disconnects consumers that fall behind.
+//
+// The returned channel is closed when ctx is cancelled.
+func SubscribeSocket(ctx context.Context, path string, filter *Filter) (<-chan []Event, error) {
+	sub := &subscription{
+		filter: filter,
+		out:    make(chan []Event, 64),
+	}
+
+	conn, err := dialSocket(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		defer close(sub.out)
+
+		delay := minReconnectDelay
+		for {
+			if conn != nil {
+				err := sub.consumeSocket(ctx, conn)
+				conn.Close()
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("xgotopclient: live socket disconnected: %v", err)
+				delay = minReconnectDelay
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+
+			conn, err = dialSocket(ctx, path)
+			if err != nil {
+				log.Printf("xgotopclient: reconnect failed: %v", err)
+				delay = min(delay*2, maxReconnectDelay)
+			}
+		}
+	}()
+
+	return sub.out, nil
+}
+
+func dialSocket(ctx context.Context, path string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", path, err)
+	}
+	return conn, nil
+}
+
+// consumeSocket reads frames from conn until it fails or ctx is cancelled.
+func (s *subscription) consumeSocket(ctx context.Context, conn net.Conn) error {
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	reader := bufio.NewReader(conn)
+	for {
+		data, err := storage.ReadFrame(reader)
+		if err != nil {
+			return err
+		}
+		events, err := storage.UnmarshalBatch(data)
+		if err != nil {
+			return err
+		}
+		if !s.deliver(ctx, events) {
+			return ctx.Err()
+		}
+	}
+}